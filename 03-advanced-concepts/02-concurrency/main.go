@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/fajar/learn-go/concurrency/fanin"
 )
 
 func main() {
@@ -72,6 +74,10 @@ func main() {
 	fmt.Println("\n15. Timeout Pattern:")
 	timeoutExample()
 
+	// Ordered fan-in
+	fmt.Println("\n16. Ordered Fan-in:")
+	orderedFanInExample()
+
 	fmt.Println("\nAll concurrency examples completed!")
 }
 
@@ -319,7 +325,9 @@ func square(nums []int) <-chan int {
 	return out
 }
 
-// merge combines multiple channels into a single channel
+// merge combines multiple channels into a single channel. fanin.Merge in
+// concurrency/fanin is the reusable version: generic, and it stops when its
+// context is cancelled.
 func merge(cs ...<-chan int) <-chan int {
 	var wg sync.WaitGroup
 	out := make(chan int)
@@ -432,6 +440,33 @@ func timeoutExample() {
 	}
 }
 
+// 16. Ordered fan-in example
+func orderedFanInExample() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Submit work in order
+	input := make(chan int)
+	go func() {
+		defer close(input)
+		for i := 1; i <= 10; i++ {
+			input <- i
+		}
+	}()
+
+	// Workers finish in random order, but results come out in submission
+	// order. fanin.Ordered in concurrency/fanin keeps at most 4 values in
+	// flight or waiting, so one slow value can't make the buffer grow.
+	results := fanin.Ordered(ctx, input, 3, 4, func(n int) string {
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+		return fmt.Sprintf("%d squared is %d", n, n*n)
+	})
+
+	for result := range results {
+		fmt.Println(result)
+	}
+}
+
 // Additional examples (not called in main for brevity)
 
 // HTTP server with graceful shutdown
@@ -0,0 +1,209 @@
+package smtp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fajar/learn-go/emailtopology"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Sender sends an email. *EmailSender delivers over SMTP straight away and
+// *AsyncSender queues the message, so code written against Sender can
+// switch between them without changes.
+type Sender interface {
+	SendEmail(message EmailMessage) error
+}
+
+var (
+	_ Sender = (*EmailSender)(nil)
+	_ Sender = (*AsyncSender)(nil)
+)
+
+// Exchange and routing key consumed by 05-message-broker/email-queue
+const (
+	QueueExchange   = emailtopology.Exchange
+	QueueRoutingKey = emailtopology.SendKey
+)
+
+// AMQP priorities understood by the email-queue consumer; emails.primary is
+// declared with x-max-priority emailtopology.MaxPriority
+const (
+	QueuePriorityTransactional uint8 = 9
+	QueuePriorityNormal        uint8 = 5
+	QueuePriorityMarketing     uint8 = 1
+)
+
+// QueuedEmail is the JSON job AsyncSender publishes. It extends the
+// email-queue EmailJob (to, subject, body), so older consumers can still
+// send the plain text part.
+type QueuedEmail struct {
+	To              string             `json:"to"` // comma-separated, as EmailJob expects
+	Cc              []string           `json:"cc,omitempty"`
+	Bcc             []string           `json:"bcc,omitempty"`
+	Subject         string             `json:"subject"`
+	Body            string             `json:"body"`
+	HTMLBody        string             `json:"html_body,omitempty"`
+	PreviewText     string             `json:"preview_text,omitempty"`
+	ReplyTo         string             `json:"reply_to,omitempty"`
+	ReturnPath      string             `json:"return_path,omitempty"` // envelope sender for bounces; empty = the sender's address
+	MessageID       string             `json:"message_id,omitempty"`  // Message-ID header; the consumer generates one when empty
+	Priority        Priority           `json:"priority,omitempty"`
+	ListUnsubscribe []string           `json:"list_unsubscribe,omitempty"`
+	Headers         map[string]string  `json:"headers,omitempty"`
+	Attachments     []QueuedAttachment `json:"attachments,omitempty"`
+}
+
+// QueuedAttachment is an attachment inside a QueuedEmail; Data is base64 in JSON
+type QueuedAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// NewQueuedEmail converts a message into a queue job. S/MIME and calendar
+// invites are rejected: the keys and event state stay with the sender.
+func NewQueuedEmail(message EmailMessage) (QueuedEmail, error) {
+	if message.Sign != nil || len(message.EncryptTo) > 0 {
+		return QueuedEmail{}, errors.New("S/MIME messages cannot be queued; send them with EmailSender")
+	}
+	if message.Calendar != nil {
+		return QueuedEmail{}, errors.New("calendar invites cannot be queued; send them with EmailSender")
+	}
+
+	job := QueuedEmail{
+		To:              strings.Join(message.To, ", "),
+		Cc:              message.Cc,
+		Bcc:             message.Bcc,
+		Subject:         message.Subject,
+		Body:            message.PlainBody,
+		HTMLBody:        message.HTMLBody,
+		PreviewText:     message.PreviewText,
+		ReplyTo:         message.ReplyTo,
+		ReturnPath:      message.ReturnPath,
+		MessageID:       message.MessageID,
+		Priority:        message.Priority,
+		ListUnsubscribe: message.ListUnsubscribe,
+		Headers:         message.Headers,
+	}
+	for _, attachment := range message.Attachments {
+		job.Attachments = append(job.Attachments, QueuedAttachment(attachment))
+	}
+	return job, nil
+}
+
+// Message converts a queue job back into an EmailMessage for EmailSender
+func (q QueuedEmail) Message() EmailMessage {
+	message := EmailMessage{
+		Cc:              q.Cc,
+		Bcc:             q.Bcc,
+		Subject:         q.Subject,
+		PlainBody:       q.Body,
+		HTMLBody:        q.HTMLBody,
+		PreviewText:     q.PreviewText,
+		ReplyTo:         q.ReplyTo,
+		ReturnPath:      q.ReturnPath,
+		MessageID:       q.MessageID,
+		Priority:        q.Priority,
+		ListUnsubscribe: q.ListUnsubscribe,
+		Headers:         q.Headers,
+	}
+	for _, to := range strings.Split(q.To, ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			message.To = append(message.To, to)
+		}
+	}
+	for _, attachment := range q.Attachments {
+		message.Attachments = append(message.Attachments, Attachment(attachment))
+	}
+	return message
+}
+
+// AsyncSender publishes messages to the email-queue RabbitMQ topology
+// instead of talking to an SMTP server. SendEmail returns once the broker
+// has confirmed the job; delivery happens later in the consumer.
+type AsyncSender struct {
+	Channel    *amqp.Channel
+	Exchange   string        // defaults to QueueExchange
+	RoutingKey string        // defaults to QueueRoutingKey
+	Timeout    time.Duration // publish and confirm timeout (0 = 5s)
+
+	// QueuePriority orders jobs in a backed-up queue, e.g.
+	// QueuePriorityTransactional for password resets (0 = QueuePriorityNormal)
+	QueuePriority uint8
+}
+
+// NewAsyncSender declares the email-queue topology on ch and puts the
+// channel into confirm mode. ch should not be shared with publishers that
+// don't expect confirms.
+func NewAsyncSender(ch *amqp.Channel) (*AsyncSender, error) {
+	if err := emailtopology.Declare(ch, emailtopology.RetryTiers); err != nil {
+		return nil, fmt.Errorf("declare email queue topology: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("enable publisher confirms: %w", err)
+	}
+	return &AsyncSender{Channel: ch}, nil
+}
+
+// SendEmail validates the message and queues it
+func (a *AsyncSender) SendEmail(message EmailMessage) error {
+	if err := validateMessage(message); err != nil {
+		return err
+	}
+
+	job, err := NewQueuedEmail(message)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("encode email job: %w", err)
+	}
+
+	exchange := a.Exchange
+	if exchange == "" {
+		exchange = QueueExchange
+	}
+	routingKey := a.RoutingKey
+	if routingKey == "" {
+		routingKey = QueueRoutingKey
+	}
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	priority := a.QueuePriority
+	if priority == 0 {
+		priority = QueuePriorityNormal
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// x-enqueued-at lets the consumer measure end-to-end latency across retries
+	confirm, err := a.Channel.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, false, false, amqp.Publishing{
+		Priority:     priority,
+		ContentType:  "application/json",
+		Body:         body,
+		DeliveryMode: amqp.Persistent,
+		Headers:      amqp.Table{"x-attempts": int32(0), "x-enqueued-at": time.Now().UnixMilli()},
+		Timestamp:    time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("publish email job: %w", err)
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("wait for publish confirm: %w", err)
+	}
+	if !acked {
+		return errors.New("broker rejected email job")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+// Run with: go test -run '^$' -bench BuildEmail -benchmem ./04-smtp
+
+func benchSender() *EmailSender {
+	return &EmailSender{Config: EmailConfig{SenderEmail: "reports@example.com", SenderName: "Reports"}}
+}
+
+func BenchmarkBuildEmailPlain(b *testing.B) {
+	s := benchSender()
+	message := EmailMessage{
+		To:        []string{"a@example.com", "b@example.com"},
+		Subject:   "Weekly report",
+		PlainBody: strings.Repeat("The quick brown fox jumps over the lazy dog.\r\n", 100),
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := s.buildEmail(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuildEmailAttachment(b *testing.B) {
+	s := benchSender()
+	message := EmailMessage{
+		To:        []string{"a@example.com"},
+		Subject:   "Weekly report",
+		PlainBody: "Report attached.",
+		HTMLBody:  "<p>Report attached.</p>",
+		Attachments: []Attachment{{
+			Filename:    "report.pdf",
+			ContentType: "application/pdf",
+			Data:        []byte(strings.Repeat("%PDF-1.7 binary-ish data ", 20000)), // ~500 KB
+		}},
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := s.buildEmail(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Calendar methods supported by CalendarEvent (RFC 5546)
+const (
+	CalendarMethodRequest = "REQUEST"
+	CalendarMethodCancel  = "CANCEL"
+)
+
+// Attendee is a participant invited to a CalendarEvent
+type Attendee struct {
+	Name     string
+	Email    string
+	Optional bool // Marks the attendee as OPT-PARTICIPANT instead of REQ-PARTICIPANT
+}
+
+// CalendarEvent describes a meeting invite rendered as an RFC 5545 VEVENT
+type CalendarEvent struct {
+	UID         string // Stable identifier; reuse it when sending updates or cancellations
+	Sequence    int    // Revision number; must increase with every update
+	Method      string // CalendarMethodRequest (default) or CalendarMethodCancel
+	Summary     string
+	Description string
+	Location    string
+	Start       time.Time
+	End         time.Time
+	Organizer   Attendee // Defaults to the configured sender
+	Attendees   []Attendee
+}
+
+// NewCalendarEvent creates a meeting request with a freshly generated UID
+func NewCalendarEvent(summary string, start, end time.Time, attendees ...Attendee) CalendarEvent {
+	uid := strings.Trim(generateMessageID(""), "<>")
+	return CalendarEvent{
+		UID:       uid,
+		Method:    CalendarMethodRequest,
+		Summary:   summary,
+		Start:     start,
+		End:       end,
+		Attendees: attendees,
+	}
+}
+
+// Update returns a copy of the event with its sequence bumped, ready to be sent as a change
+func (e CalendarEvent) Update() CalendarEvent {
+	e.Method = CalendarMethodRequest
+	e.Sequence++
+	return e
+}
+
+// Cancel returns a copy of the event that cancels the meeting for all attendees
+func (e CalendarEvent) Cancel() CalendarEvent {
+	e.Method = CalendarMethodCancel
+	e.Sequence++
+	return e
+}
+
+// validate checks the fields calendar clients require
+func (e CalendarEvent) validate() error {
+	if e.Summary == "" {
+		return fmt.Errorf("calendar event summary is required")
+	}
+	if e.Start.IsZero() || e.End.IsZero() {
+		return fmt.Errorf("calendar event start and end times are required")
+	}
+	if !e.End.After(e.Start) {
+		return fmt.Errorf("calendar event must end after it starts")
+	}
+	if len(e.Attendees) == 0 {
+		return fmt.Errorf("calendar event needs at least one attendee")
+	}
+	return nil
+}
+
+// method returns the iTIP method, defaulting to REQUEST
+func (e CalendarEvent) method() string {
+	if e.Method == "" {
+		return CalendarMethodRequest
+	}
+	return e.Method
+}
+
+// renderICS renders the event as a VCALENDAR document with CRLF line endings
+func (e CalendarEvent) renderICS(organizer Attendee) string {
+	if e.Organizer.Email != "" {
+		organizer = e.Organizer
+	}
+
+	status := "CONFIRMED"
+	if e.method() == CalendarMethodCancel {
+		status = "CANCELLED"
+	}
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"PRODID:-//learn-go//smtp//EN",
+		"VERSION:2.0",
+		"CALSCALE:GREGORIAN",
+		"METHOD:" + e.method(),
+		"BEGIN:VEVENT",
+		"UID:" + e.UID,
+		"DTSTAMP:" + formatICSTime(time.Now()),
+		"DTSTART:" + formatICSTime(e.Start),
+		"DTEND:" + formatICSTime(e.End),
+		fmt.Sprintf("SEQUENCE:%d", e.Sequence),
+		"STATUS:" + status,
+		"SUMMARY:" + escapeICSText(e.Summary),
+	}
+	if e.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+escapeICSText(e.Description))
+	}
+	if e.Location != "" {
+		lines = append(lines, "LOCATION:"+escapeICSText(e.Location))
+	}
+	lines = append(lines, fmt.Sprintf("ORGANIZER;CN=%s:mailto:%s", quoteICSParam(organizer.Name), organizer.Email))
+
+	for _, attendee := range e.Attendees {
+		role := "REQ-PARTICIPANT"
+		if attendee.Optional {
+			role = "OPT-PARTICIPANT"
+		}
+		lines = append(lines, fmt.Sprintf("ATTENDEE;CN=%s;ROLE=%s;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:%s",
+			quoteICSParam(attendee.Name), role, attendee.Email))
+	}
+
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	var ics strings.Builder
+	for _, line := range lines {
+		ics.WriteString(foldICSLine(line))
+		ics.WriteString("\r\n")
+	}
+	return ics.String()
+}
+
+// formatICSTime formats a time in UTC as required for DTSTART/DTEND/DTSTAMP
+func formatICSTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// escapeICSText escapes TEXT values per RFC 5545 section 3.3.11
+func escapeICSText(s string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	)
+	return replacer.Replace(s)
+}
+
+// quoteICSParam quotes a parameter value such as CN, which may contain separators
+func quoteICSParam(s string) string {
+	if s == "" {
+		return `""`
+	}
+	return `"` + strings.ReplaceAll(s, `"`, "'") + `"`
+}
+
+// foldICSLine splits content lines longer than 75 octets, as RFC 5545 requires
+func foldICSLine(line string) string {
+	const limit = 75
+	if len(line) <= limit {
+		return line
+	}
+
+	var folded strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > limit {
+			folded.WriteString("\r\n ")
+			width = 1
+		}
+		folded.WriteRune(r)
+		width += size
+	}
+	return folded.String()
+}
@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RenderEML returns the complete RFC 822 message exactly as SendEmail would transmit it.
+// The result can be saved with a .eml extension and opened in any mail client.
+func (s *EmailSender) RenderEML(message EmailMessage) ([]byte, error) {
+	if err := s.validate(message); err != nil {
+		return nil, err
+	}
+	email, err := s.buildEmail(message)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(email), nil
+}
+
+// dryRun renders the message and, if DryRunDir is set, saves it instead of sending it
+func (s *EmailSender) dryRun(message EmailMessage) error {
+	eml, err := s.RenderEML(message)
+	if err != nil {
+		return err
+	}
+
+	s.logger().Debug("dry run, not sending", "bytes", len(eml), "to", message.To)
+
+	if s.Config.DryRunDir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.Config.DryRunDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create dry-run directory: %w", err)
+	}
+
+	filename := filepath.Join(s.Config.DryRunDir, time.Now().Format("20060102-150405.000000000")+".eml")
+	if err := os.WriteFile(filename, eml, 0o644); err != nil {
+		return fmt.Errorf("failed to write dry-run message: %w", err)
+	}
+
+	return nil
+}
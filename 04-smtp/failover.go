@@ -0,0 +1,73 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+)
+
+// SMTPEndpoint is a fallback server, tried in order when the primary (and
+// any fallback before it) cannot be reached or refuses to authenticate
+type SMTPEndpoint struct {
+	Server     string
+	Port       int
+	Username   string // Empty reuses SMTPUsername and SMTPPassword
+	Password   string
+	AuthMethod string // Empty reuses AuthMethod
+}
+
+// addr returns the host:port the sender connects to
+func (s *EmailSender) addr() string {
+	return fmt.Sprintf("%s:%d", s.Config.SMTPServer, s.Config.SMTPPort)
+}
+
+// endpoints returns one sender per server: the primary first, then each
+// fallback with its own server, port and (optionally) credentials
+func (s *EmailSender) endpoints() []*EmailSender {
+	senders := []*EmailSender{s}
+	for _, endpoint := range s.Config.Fallbacks {
+		fallback := *s
+		fallback.Config.SMTPServer = endpoint.Server
+		fallback.Config.SMTPPort = endpoint.Port
+		if endpoint.Username != "" {
+			fallback.Config.SMTPUsername = endpoint.Username
+			fallback.Config.SMTPPassword = endpoint.Password
+		}
+		if endpoint.AuthMethod != "" {
+			fallback.Config.AuthMethod = endpoint.AuthMethod
+		}
+		senders = append(senders, &fallback)
+	}
+	return senders
+}
+
+// open connects and authenticates to the first server that accepts, and
+// returns the client along with that server's address. Once a session is
+// authenticated there is no further failover, so a message is never sent twice.
+func (s *EmailSender) open() (*smtp.Client, string, error) {
+	senders := s.endpoints()
+
+	var errs []error
+	for i, sender := range senders {
+		addr := sender.addr()
+		c, err := sender.connect(addr)
+		if err == nil {
+			if err = sender.authenticate(c); err == nil {
+				return c, addr, nil
+			}
+			c.Close()
+		}
+		errs = append(errs, err)
+
+		if i < len(senders)-1 {
+			s.logger().Info("failing over to next SMTP server", "failed", addr, "next", senders[i+1].addr(), "error", err)
+			s.hookFailover(addr, err)
+		}
+	}
+
+	// Without fallbacks, keep the original error so callers see it unchanged
+	if len(errs) == 1 {
+		return nil, "", errs[0]
+	}
+	return nil, "", fmt.Errorf("all %d SMTP servers failed: %w", len(senders), errors.Join(errs...))
+}
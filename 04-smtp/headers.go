@@ -0,0 +1,156 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// Errors returned when a message fails the header hardening checks
+var (
+	ErrHeaderInjection   = errors.New("address contains CR or LF")
+	ErrTooManyRecipients = errors.New("too many recipients")
+	ErrInvalidHeaderName = errors.New("invalid header field name")
+	ErrInvalidMessageID  = errors.New("invalid Message-ID")
+)
+
+// RecipientLimits caps the recipients of a single message, e.g. to stop a
+// compromised form from turning the sender into a bulk mailer (0 = no limit)
+type RecipientLimits struct {
+	MaxTo    int
+	MaxCc    int
+	MaxBcc   int
+	MaxTotal int // To, Cc and Bcc combined
+}
+
+// blindHeaders must never be written: their whole point is that other
+// recipients can't see them. Bcc recipients only appear in RCPT commands.
+var blindHeaders = map[string]bool{
+	"Bcc":        true,
+	"Resent-Bcc": true,
+}
+
+// headerSanitizer turns any line break in a header value into a space, so
+// user input such as a subject can't start a new header or the body
+var headerSanitizer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// sanitizeHeaderValue strips CR and LF from a header value
+func sanitizeHeaderValue(value string) string {
+	return headerSanitizer.Replace(value)
+}
+
+// validHeaderField reports whether name is a legal header field name:
+// printable ASCII other than space and colon (RFC 5322 section 3.6.8)
+func validHeaderField(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateHeaders rejects addresses that would inject headers when written
+// out. Free-text values are cleaned in buildEmail instead.
+func validateHeaders(message EmailMessage) error {
+	addresses := append(append(append([]string{message.ReplyTo}, message.To...), message.Cc...), message.Bcc...)
+	for _, address := range addresses {
+		if strings.ContainsAny(address, "\r\n") {
+			return fmt.Errorf("%w: %q", ErrHeaderInjection, address)
+		}
+	}
+	for name := range message.Headers {
+		if !validHeaderField(name) {
+			return fmt.Errorf("%w: %q", ErrInvalidHeaderName, name)
+		}
+	}
+	if message.MessageID != "" {
+		if _, err := normalizeMessageID(message.MessageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateConfigHeaders checks the header values that come from Config
+func (s *EmailSender) validateConfigHeaders() error {
+	for _, address := range []string{s.Config.Sender, s.Config.ReplyTo} {
+		if strings.ContainsAny(address, "\r\n") {
+			return fmt.Errorf("%w: %q", ErrHeaderInjection, address)
+		}
+	}
+	if domain := s.Config.MessageIDDomain; domain != "" && !validMessageIDPart(domain) {
+		return fmt.Errorf("%w: domain %q", ErrInvalidMessageID, domain)
+	}
+	return nil
+}
+
+// normalizeMessageID checks that id looks like <left@right> (RFC 5322
+// section 3.6.4) and returns it with the angle brackets, adding them when
+// they are missing
+func normalizeMessageID(id string) (string, error) {
+	inner := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+	left, right, ok := strings.Cut(inner, "@")
+	if !ok || !validMessageIDPart(left) || !validMessageIDPart(right) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidMessageID, id)
+	}
+	return "<" + inner + ">", nil
+}
+
+// validMessageIDPart reports whether s can be one side of a Message-ID:
+// printable ASCII without spaces, angle brackets or a second @
+func validMessageIDPart(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 33 || s[i] > 126 || strings.IndexByte("<>@", s[i]) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRecipientLimits enforces Config.RecipientLimits
+func (s *EmailSender) checkRecipientLimits(message EmailMessage) error {
+	limits := s.Config.RecipientLimits
+	checks := []struct {
+		field string
+		count int
+		limit int
+	}{
+		{"To", len(message.To), limits.MaxTo},
+		{"Cc", len(message.Cc), limits.MaxCc},
+		{"Bcc", len(message.Bcc), limits.MaxBcc},
+		{"total", len(message.To) + len(message.Cc) + len(message.Bcc), limits.MaxTotal},
+	}
+	for _, check := range checks {
+		if check.limit > 0 && check.count > check.limit {
+			return fmt.Errorf("%w: %d %s recipients, limit is %d", ErrTooManyRecipients, check.count, check.field, check.limit)
+		}
+	}
+	return nil
+}
+
+// customHeaders returns message.Headers minus blind headers and any header
+// the sender builds itself. Names are compared case-insensitively.
+func customHeaders(message EmailMessage, built map[string]string) map[string]string {
+	reserved := make(map[string]bool, len(built))
+	for key := range built {
+		reserved[textproto.CanonicalMIMEHeaderKey(key)] = true
+	}
+
+	headers := make(map[string]string, len(message.Headers))
+	for key, value := range message.Headers {
+		canonical := textproto.CanonicalMIMEHeaderKey(key)
+		if blindHeaders[canonical] || reserved[canonical] {
+			continue
+		}
+		headers[key] = value
+	}
+	return headers
+}
@@ -0,0 +1,212 @@
+package smtp
+
+import (
+	"errors"
+	"mime"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestValidateHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		message EmailMessage
+		want    error // nil = accepted
+	}{
+		{"plain", EmailMessage{To: []string{"a@example.com"}, Headers: map[string]string{"X-Campaign": "spring"}}, nil},
+		{"LF in To", EmailMessage{To: []string{"a@example.com\nBcc: victim@example.com"}}, ErrHeaderInjection},
+		{"CR in Cc", EmailMessage{Cc: []string{"a@example.com\rX-Spam: no"}}, ErrHeaderInjection},
+		{"folded Bcc", EmailMessage{Bcc: []string{"a@example.com\r\n\tb@example.com"}}, ErrHeaderInjection},
+		{"CRLF in Reply-To", EmailMessage{ReplyTo: "a@example.com\r\nSubject: hijacked"}, ErrHeaderInjection},
+		{"space in header name", EmailMessage{Headers: map[string]string{"X Campaign": "spring"}}, ErrInvalidHeaderName},
+		{"colon in header name", EmailMessage{Headers: map[string]string{"X-Campaign:": "spring"}}, ErrInvalidHeaderName},
+		{"CRLF in header name", EmailMessage{Headers: map[string]string{"X-A\r\nBcc": "victim@example.com"}}, ErrInvalidHeaderName},
+		{"empty header name", EmailMessage{Headers: map[string]string{"": "spring"}}, ErrInvalidHeaderName},
+		{"Message-ID", EmailMessage{MessageID: "<1@example.com>"}, nil},
+		{"malformed Message-ID", EmailMessage{MessageID: "no-at-sign"}, ErrInvalidMessageID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateHeaders(tt.message)
+			if tt.want == nil && err != nil {
+				t.Fatalf("validateHeaders() = %v, want nil", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("validateHeaders() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeHeaderValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain", "Weekly report", "Weekly report"},
+		{"CRLF", "hi\r\nBcc: victim@example.com", "hi Bcc: victim@example.com"},
+		{"bare LF", "hi\nX-Spam: no", "hi X-Spam: no"},
+		{"bare CR", "hi\rX-Spam: no", "hi X-Spam: no"},
+		{"folded", "a long\r\n subject", "a long  subject"},
+		{"ends the headers", "hi\r\n\r\n<script>", "hi  <script>"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeHeaderValue(tt.value); got != tt.want {
+			t.Errorf("%s: sanitizeHeaderValue(%q) = %q, want %q", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	message := EmailMessage{Headers: map[string]string{
+		"X-Campaign": "spring",
+		"Bcc":        "hidden@example.com",
+		"resent-bcc": "hidden@example.com",
+		"from":       "spoofed@example.com",
+		"SUBJECT":    "overridden",
+	}}
+	built := map[string]string{"From": "sender@example.com", "Subject": "Weekly report"}
+
+	got := customHeaders(message, built)
+	if len(got) != 1 || got["X-Campaign"] != "spring" {
+		t.Errorf("customHeaders() = %v, want only X-Campaign", got)
+	}
+}
+
+func TestBuildEmailDropsBcc(t *testing.T) {
+	s := &EmailSender{Config: EmailConfig{SenderEmail: "sender@example.com"}}
+	raw, err := s.buildEmail(EmailMessage{
+		To:        []string{"a@example.com"},
+		Bcc:       []string{"hidden@example.com"},
+		Subject:   "hi\r\nX-Injected: yes",
+		PlainBody: "body",
+		Headers:   map[string]string{"Bcc": "hidden@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, _, _ := strings.Cut(raw, "\r\n\r\n")
+	for _, line := range strings.Split(head, "\r\n") {
+		name, _, _ := strings.Cut(line, ":")
+		switch textproto.CanonicalMIMEHeaderKey(name) {
+		case "Bcc", "X-Injected":
+			t.Errorf("header %q written", line)
+		}
+	}
+	if strings.Contains(raw, "hidden@example.com") {
+		t.Error("message contains the Bcc address")
+	}
+}
+
+func TestNormalizeMessageID(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    string
+		wantErr bool
+	}{
+		{id: "<1@example.com>", want: "<1@example.com>"},
+		{id: "1@example.com", want: "<1@example.com>"},
+		{id: "  <1@example.com>  ", want: "<1@example.com>"},
+		{id: "", wantErr: true},
+		{id: "no-at-sign", wantErr: true},
+		{id: "<@example.com>", wantErr: true},
+		{id: "<1@>", wantErr: true},
+		{id: "<1@a@example.com>", wantErr: true},
+		{id: "<1 2@example.com>", wantErr: true},
+		{id: "<1@example.com>\r\nBcc: victim@example.com", wantErr: true},
+		{id: "<<1@example.com>>", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeMessageID(tt.id)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidMessageID) {
+				t.Errorf("normalizeMessageID(%q) = %q, %v, want ErrInvalidMessageID", tt.id, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeMessageID(%q) = %q, %v, want %q", tt.id, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckRecipientLimits(t *testing.T) {
+	addresses := func(n int) []string {
+		list := make([]string, n)
+		for i := range list {
+			list[i] = "a@example.com"
+		}
+		return list
+	}
+	limits := RecipientLimits{MaxTo: 3, MaxCc: 2, MaxBcc: 1, MaxTotal: 5}
+	tests := []struct {
+		name    string
+		limits  RecipientLimits
+		message EmailMessage
+		wantErr bool
+	}{
+		{"within every limit", limits, EmailMessage{To: addresses(3), Cc: addresses(1), Bcc: addresses(1)}, false},
+		{"too many To", limits, EmailMessage{To: addresses(4)}, true},
+		{"too many Cc", limits, EmailMessage{Cc: addresses(3)}, true},
+		{"too many Bcc", limits, EmailMessage{Bcc: addresses(2)}, true},
+		{"too many in total", limits, EmailMessage{To: addresses(3), Cc: addresses(2), Bcc: addresses(1)}, true},
+		{"no limits", RecipientLimits{}, EmailMessage{To: addresses(1000), Bcc: addresses(1000)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &EmailSender{Config: EmailConfig{RecipientLimits: tt.limits}}
+			err := s.checkRecipientLimits(tt.message)
+			if tt.wantErr != errors.Is(err, ErrTooManyRecipients) {
+				t.Fatalf("checkRecipientLimits() = %v, want ErrTooManyRecipients: %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("checkRecipientLimits() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestAttachmentHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		attachment Attachment
+		wantType   string
+		wantName   string
+	}{
+		{"plain", Attachment{Filename: "report.pdf", ContentType: "application/pdf"}, "application/pdf", "report.pdf"},
+		{"space", Attachment{Filename: "Q1 report.pdf", ContentType: "application/pdf"}, "application/pdf", "Q1 report.pdf"},
+		{"quote", Attachment{Filename: `a".pdf"; x="y`, ContentType: "application/pdf"}, "application/pdf", `a".pdf"; x="y`},
+		{"backslash", Attachment{Filename: `a\b.txt`, ContentType: "text/plain"}, "text/plain", `a\b.txt`},
+		{"non-ASCII", Attachment{Filename: "laporan-käuf 日本.pdf", ContentType: "application/pdf"}, "application/pdf", "laporan-käuf 日本.pdf"},
+		{"CRLF", Attachment{Filename: "a.txt\r\nBcc: victim@example.com", ContentType: "text/plain"}, "text/plain", "a.txt\r\nBcc: victim@example.com"},
+		{"invalid content type", Attachment{Filename: "a.bin", ContentType: "not a type\r\nX-Injected: yes"}, "application/octet-stream", "a.bin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, disposition := attachmentHeaders(tt.attachment)
+			for _, header := range []string{contentType, disposition} {
+				if strings.ContainsAny(header, "\r\n") {
+					t.Fatalf("header value %q spans lines", header)
+				}
+			}
+
+			mediaType, params, err := mime.ParseMediaType(contentType)
+			if err != nil {
+				t.Fatalf("Content-Type %q: %v", contentType, err)
+			}
+			if mediaType != tt.wantType || params["name"] != tt.wantName || len(params) != 1 {
+				t.Errorf("Content-Type %q = %s %v, want %s with name %q", contentType, mediaType, params, tt.wantType, tt.wantName)
+			}
+			mediaType, params, err = mime.ParseMediaType(disposition)
+			if err != nil {
+				t.Fatalf("Content-Disposition %q: %v", disposition, err)
+			}
+			if mediaType != "attachment" || params["filename"] != tt.wantName || len(params) != 1 {
+				t.Errorf("Content-Disposition %q = %s %v, want attachment with filename %q", disposition, mediaType, params, tt.wantName)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package smtp
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Logger receives structured log records from the sender.
+// *slog.Logger satisfies it, so applications can pass their own logger directly.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Hooks lets applications observe each step of a send. All hooks are optional.
+type Hooks struct {
+	OnConnect  func(addr string)                               // Called after the TCP/TLS connection is established
+	OnAuth     func(username, method string, err error)        // Called after authentication, with err set on failure
+	OnSend     func(message EmailMessage, recipients []string) // Called after the server accepted the message; message.MessageID is the ID sent
+	OnError    func(stage string, err error)                   // Called when a stage fails (preflight, connect, starttls, auth, mail, rcpt, data, quit)
+	OnFailover func(addr string, err error)                    // Called when a server is abandoned for the next one in Config.Fallbacks
+}
+
+// nopLogger discards everything; used when DebugMode is off and no Logger is set
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// defaultLogger returns a debug-level text logger when DebugMode is on, otherwise a no-op logger
+func defaultLogger(config EmailConfig) Logger {
+	if !config.DebugMode {
+		return nopLogger{}
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// logger returns the configured logger, falling back to the default
+func (s *EmailSender) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return defaultLogger(s.Config)
+}
+
+func (s *EmailSender) hookConnect(addr string) {
+	if s.Hooks.OnConnect != nil {
+		s.Hooks.OnConnect(addr)
+	}
+}
+
+func (s *EmailSender) hookAuth(err error) {
+	if s.Hooks.OnAuth != nil {
+		s.Hooks.OnAuth(s.Config.SMTPUsername, s.authMethod(), err)
+	}
+}
+
+func (s *EmailSender) hookSend(message EmailMessage, recipients []string) {
+	if s.Hooks.OnSend != nil {
+		s.Hooks.OnSend(message, recipients)
+	}
+}
+
+func (s *EmailSender) hookFailover(addr string, err error) {
+	if s.Hooks.OnFailover != nil {
+		s.Hooks.OnFailover(addr, err)
+	}
+}
+
+// fail logs a failed stage, notifies OnError, and returns err unchanged
+func (s *EmailSender) fail(stage string, err error) error {
+	s.logger().Error("smtp stage failed", "stage", stage, "error", err)
+	if s.Hooks.OnError != nil {
+		s.Hooks.OnError(stage, err)
+	}
+	return err
+}
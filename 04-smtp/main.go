@@ -2,15 +2,25 @@
 package smtp
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/smtp"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/fajar/learn-go/pool"
 )
 
 // EmailConfig holds the configuration for SMTP email sending
@@ -22,8 +32,21 @@ type EmailConfig struct {
 	SenderEmail        string
 	SenderName         string
 	InsecureSkipVerify bool // Skip TLS certificate verification (for testing only)
-	DebugMode          bool // Enable debug logging
+	DebugMode          bool // Enable debug logging to stdout when no Logger is set
 	AuthMethod         string // Authentication method: "plain", "login", or "cram-md5"
+	RateLimit          RateLimitConfig // Sending quota enforced by the default token bucket limiter
+	MinTLSVersion      uint16 // Minimum TLS version, e.g. tls.VersionTLS12 (0 = Go's default)
+	RequireTLS         bool // Refuse to log in or send unless the session is encrypted; errors wrap ErrTLSRequired
+	RootCAs            *x509.CertPool // CA pool for servers with private certificates (nil = system roots)
+	DryRun             bool // Build messages without connecting to the SMTP server
+	DryRunDir          string // Optional directory where dry-run messages are saved as .eml files
+	ProxyURL           string // Optional outbound proxy: socks5://[user:pass@]host:port or http://[user:pass@]host:port
+	PreflightMX        bool // Validate recipients and look up their mail servers before connecting
+	RecipientLimits    RecipientLimits // Maximum To, Cc and Bcc recipients per message (zero values = no limit)
+	Fallbacks          []SMTPEndpoint // Servers tried in order when SMTPServer can't be reached or refuses to authenticate
+	MessageIDDomain    string // Domain of generated Message-IDs (default: the domain of SenderEmail)
+	Sender             string // Sender header, the mailbox actually sending when SenderEmail is someone else's, e.g. a shared inbox
+	ReplyTo            string // Reply-To for messages that don't set their own
 }
 
 // EmailMessage represents an email message to be sent
@@ -35,6 +58,31 @@ type EmailMessage struct {
 	PlainBody   string
 	HTMLBody    string
 	Attachments []Attachment
+
+	// PreviewText is the preheader snippet shown next to the subject in inbox lists (HTML only)
+	PreviewText string
+
+	// ReplyTo sets the Reply-To header when replies should go somewhere other than the sender
+	ReplyTo string
+	// ReturnPath is the envelope sender (MAIL FROM) that bounces are returned to, e.g. a
+	// VERP address unique to the message (empty = SenderEmail)
+	ReturnPath string
+	// MessageID is the Message-ID header, with or without angle brackets (empty = generated).
+	// Set it from NewMessageID to know the ID before the message is sent.
+	MessageID string
+	// Priority adds X-Priority, Importance and X-MSMail-Priority headers (empty = no headers)
+	Priority Priority
+	// ListUnsubscribe holds mailto: or https: URIs advertised in the List-Unsubscribe header
+	ListUnsubscribe []string
+	// Headers holds additional headers; standard headers built by the sender cannot be overridden
+	Headers map[string]string
+	// Calendar attaches a meeting invite, update, or cancellation
+	Calendar *CalendarEvent
+
+	// Sign adds an S/MIME signature made with the sender's certificate
+	Sign *SMIMESigner
+	// EncryptTo encrypts the message with S/MIME for each of these recipient certificates
+	EncryptTo []*x509.Certificate
 }
 
 // Attachment represents a file attachment for an email
@@ -46,7 +94,25 @@ type Attachment struct {
 
 // EmailSender handles sending emails via SMTP
 type EmailSender struct {
-	Config EmailConfig
+	Config  EmailConfig
+	Limiter Limiter // Optional; nil means no rate limiting
+	Logger  Logger  // Optional; defaults to a debug logger on stdout when DebugMode is set
+	Hooks   Hooks   // Optional lifecycle callbacks
+	// Sanitizer cleans HTMLBody before sending; set it when bodies contain user-generated content
+	Sanitizer *HTMLSanitizer
+	// DialContext replaces the TCP dialer (and Config.ProxyURL), e.g. to send through an SSH tunnel
+	DialContext DialContextFunc
+	// Resolver is used for PreflightMX lookups; nil means net.DefaultResolver
+	Resolver *net.Resolver
+	// Metrics receives send outcomes and auth failures; nil disables metrics
+	Metrics MetricsCollector
+}
+
+// SendResult describes a message the server accepted
+type SendResult struct {
+	MessageID  string   // Message-ID header of the message, for matching replies and bounces to the send
+	Endpoint   string   // Address (host:port) of the server that accepted it; empty in dry-run mode
+	Recipients []string // Recipients the server accepted
 }
 
 // loginAuth is a custom implementation of smtp.Auth for LOGIN authentication
@@ -85,12 +151,14 @@ func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 
 // NewEmailSender creates a new email sender with the given configuration
 func NewEmailSender(config EmailConfig) *EmailSender {
-	return &EmailSender{Config: config}
+	return &EmailSender{
+		Config:  config,
+		Limiter: NewLimiter(config.RateLimit),
+	}
 }
 
-// SendEmail sends an email using the configured SMTP server
-func (s *EmailSender) SendEmail(message EmailMessage) error {
-	// Validate required fields
+// validateMessage checks the fields every message needs before it can be built
+func validateMessage(message EmailMessage) error {
 	if len(message.To) == 0 {
 		return fmt.Errorf("recipient email address is required")
 	}
@@ -99,309 +167,413 @@ func (s *EmailSender) SendEmail(message EmailMessage) error {
 		return fmt.Errorf("email subject is required")
 	}
 
-	if message.PlainBody == "" && message.HTMLBody == "" {
+	if message.PlainBody == "" && message.HTMLBody == "" && message.Calendar == nil {
 		return fmt.Errorf("email body (plain or HTML) is required")
 	}
 
-	// Debug logging
-	if s.Config.DebugMode {
-		fmt.Println("[DEBUG] Starting email send process")
-		fmt.Printf("[DEBUG] SMTP Server: %s:%d\n", s.Config.SMTPServer, s.Config.SMTPPort)
-		fmt.Printf("[DEBUG] Username: %s\n", s.Config.SMTPUsername)
-		fmt.Printf("[DEBUG] From: %s <%s>\n", s.Config.SenderName, s.Config.SenderEmail)
-		fmt.Printf("[DEBUG] To: %v\n", message.To)
-		fmt.Printf("[DEBUG] Subject: %s\n", message.Subject)
-		fmt.Printf("[DEBUG] InsecureSkipVerify: %v\n", s.Config.InsecureSkipVerify)
+	if err := message.Priority.validate(); err != nil {
+		return err
 	}
 
-	// Create email content
-	email := s.buildEmail(message)
+	if message.ReturnPath != "" {
+		if err := Validate(message.ReturnPath); err != nil {
+			return fmt.Errorf("return path: %w", err)
+		}
+	}
+
+	if message.Calendar != nil {
+		if err := message.Calendar.validate(); err != nil {
+			return err
+		}
+	}
+
+	return validateHeaders(message)
+}
+
+// validate checks the message itself and the sender's recipient limits
+func (s *EmailSender) validate(message EmailMessage) error {
+	if err := validateMessage(message); err != nil {
+		return err
+	}
+	if err := s.validateConfigHeaders(); err != nil {
+		return err
+	}
+	return s.checkRecipientLimits(message)
+}
+
+// SendEmail sends an email using the configured SMTP server, falling back
+// to Config.Fallbacks in order when a server can't be reached or refuses to authenticate
+func (s *EmailSender) SendEmail(message EmailMessage) error {
+	_, err := s.SendEmailWithResult(message)
+	return err
+}
+
+// SendEmailWithEndpoint works like SendEmail and also returns the address
+// (host:port) of the server that accepted the message
+func (s *EmailSender) SendEmailWithEndpoint(message EmailMessage) (endpoint string, err error) {
+	result, err := s.SendEmailWithResult(message)
+	return result.Endpoint, err
+}
+
+// SendEmailWithResult works like SendEmail and also returns the message's
+// Message-ID and where it was delivered. The Message-ID is set even when
+// sending fails, so a failed attempt can be logged under the same ID.
+func (s *EmailSender) SendEmailWithResult(message EmailMessage) (result SendResult, err error) {
+	// Validate required fields, header safety and recipient limits
+	if err := s.validate(message); err != nil {
+		return result, err
+	}
+
+	// Fix the Message-ID now, so the result, the log and OnSend all see the one sent
+	message.MessageID = s.messageID(message)
+	result.MessageID = message.MessageID
+
+	log := s.logger()
+	log.Debug("starting email send",
+		"server", s.Config.SMTPServer,
+		"port", s.Config.SMTPPort,
+		"username", s.Config.SMTPUsername,
+		"from", s.Config.SenderEmail,
+		"to", message.To,
+		"subject", message.Subject,
+		"message_id", message.MessageID,
+		"insecure_skip_verify", s.Config.InsecureSkipVerify,
+	)
+
+	// In dry-run mode, build the message but never touch the network
+	if s.Config.DryRun {
+		return result, s.dryRun(message)
+	}
+
+	// Everything past this point counts towards the send metrics
+	start := time.Now()
+	defer func() { s.observeSend(start, err) }()
 
 	// Prepare recipient list
-	recipients := append(append(message.To, message.Cc...), message.Bcc...)
-	
-	// Format SMTP server address
-	smtpAddr := fmt.Sprintf("%s:%d", s.Config.SMTPServer, s.Config.SMTPPort)
-	
-	// Set up authentication based on the specified method
-	var auth smtp.Auth
-	
-	switch s.Config.AuthMethod {
-	case "cram-md5":
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] Using CRAM-MD5 authentication")
+	recipients := append(append(append([]string{}, message.To...), message.Cc...), message.Bcc...)
+
+	// Catch bad addresses and dead domains before spending a connection on them
+	if s.Config.PreflightMX {
+		if err := s.preflight(recipients); err != nil {
+			return result, s.fail("preflight", err)
 		}
-		auth = smtp.CRAMMD5Auth(s.Config.SMTPUsername, s.Config.SMTPPassword)
-		
-	case "login":
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] Using LOGIN authentication")
+	}
+
+	// Respect the provider's sending quota
+	if s.Limiter != nil {
+		if err := s.Limiter.Wait(context.Background()); err != nil {
+			return result, fmt.Errorf("rate limiter: %w", err)
 		}
+	}
+
+	// Create email content
+	email, err := s.buildEmail(message)
+	if err != nil {
+		return result, err
+	}
+
+	// Connect and log in to the first server that accepts
+	c, endpoint, err := s.open()
+	if err != nil {
+		return result, err
+	}
+	defer c.Close()
+	result.Endpoint = endpoint
+
+	// A MultiRecipientError with accepted recipients still means the message went out
+	err = s.deliver(c, s.returnPath(message), recipients, email)
+	accepted := recipients
+	var rcptErr *MultiRecipientError
+	if errors.As(err, &rcptErr) && rcptErr.Delivered() {
+		accepted = rcptErr.Accepted
+	} else if err != nil {
+		return result, err
+	}
+	result.Recipients = accepted
+
+	log.Info("email sent", "to", message.To, "recipients", len(accepted), "endpoint", endpoint, "message_id", message.MessageID)
+	s.hookSend(message, accepted)
+	return result, err
+}
+
+// authMethod returns the configured authentication method, defaulting to "plain"
+func (s *EmailSender) authMethod() string {
+	if s.Config.AuthMethod == "" {
+		return "plain"
+	}
+	return s.Config.AuthMethod
+}
+
+// auth builds the smtp.Auth for the configured method
+func (s *EmailSender) auth() smtp.Auth {
+	switch s.authMethod() {
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(s.Config.SMTPUsername, s.Config.SMTPPassword)
+	case "login":
 		// Use our custom LOGIN authentication implementation
-		auth = &loginAuth{
+		return &loginAuth{
 			username: s.Config.SMTPUsername,
 			password: s.Config.SMTPPassword,
 		}
-		
-	default: // "plain" or empty
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] Using PLAIN authentication")
-		}
-		auth = smtp.PlainAuth("", s.Config.SMTPUsername, s.Config.SMTPPassword, s.Config.SMTPServer)
+	default: // "plain"
+		return smtp.PlainAuth("", s.Config.SMTPUsername, s.Config.SMTPPassword, s.Config.SMTPServer)
 	}
-	
-	// Check if we're using a secure port (465 is typically SMTPS)
+}
+
+// connect dials the server and negotiates encryption based on the port:
+// 465 uses implicit TLS (SMTPS), 587 requires STARTTLS, and any other port
+// upgrades with STARTTLS when the server offers it.
+func (s *EmailSender) connect(addr string) (*smtp.Client, error) {
+	log := s.logger()
+
 	if s.Config.SMTPPort == 465 {
-		// For SMTPS (SMTP over SSL/TLS), we need to use a different approach
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] Using SMTPS (SMTP over SSL/TLS) for port 465")
-		}
-		
-		// Create TLS config
-		tlsConfig := &tls.Config{
-			ServerName:         s.Config.SMTPServer,
-			InsecureSkipVerify: s.Config.InsecureSkipVerify,
-		}
-		
-		if s.Config.DebugMode {
-			fmt.Printf("[DEBUG] TLS Config: ServerName=%s, InsecureSkipVerify=%v\n", 
-				tlsConfig.ServerName, tlsConfig.InsecureSkipVerify)
-		}
-		
-		// Connect to the server
-		if s.Config.DebugMode {
-			fmt.Printf("[DEBUG] Connecting to %s...\n", smtpAddr)
-		}
-		
-		conn, err := tls.Dial("tcp", smtpAddr, tlsConfig)
+		log.Debug("connecting with implicit TLS (SMTPS)", "addr", addr)
+		rawConn, err := s.dial(addr)
 		if err != nil {
-			if s.Config.DebugMode {
-				fmt.Printf("[DEBUG] Connection failed: %v\n", err)
-			}
-			return fmt.Errorf("failed to connect to SMTP server: %w", err)
+			return nil, s.fail("connect", fmt.Errorf("failed to connect to SMTP server: %w", err))
 		}
-		
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] Connection established successfully")
-		}
-		
-		defer conn.Close()
-		
-		// Create a new SMTP client
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] Creating SMTP client...")
+
+		conn := tls.Client(rawConn, s.tlsConfig())
+		if err := conn.Handshake(); err != nil {
+			rawConn.Close()
+			return nil, s.fail("connect", fmt.Errorf("TLS handshake with SMTP server failed: %w", err))
 		}
-		
+
 		c, err := smtp.NewClient(conn, s.Config.SMTPServer)
 		if err != nil {
-			if s.Config.DebugMode {
-				fmt.Printf("[DEBUG] Failed to create SMTP client: %v\n", err)
-			}
-			return fmt.Errorf("failed to create SMTP client: %w", err)
-		}
-		
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] SMTP client created successfully")
-		}
-		
-		defer c.Close()
-		
-		// Authenticate
-		if s.Config.DebugMode {
-			fmt.Printf("[DEBUG] Authenticating with username: %s\n", s.Config.SMTPUsername)
-			fmt.Printf("[DEBUG] Password length: %d characters\n", len(s.Config.SMTPPassword))
-			// Safely display part of the password for debugging
-			passLen := len(s.Config.SMTPPassword)
-			if passLen > 0 {
-				firstChar := string(s.Config.SMTPPassword[0])
-				fmt.Printf("[DEBUG] Password first char: %s\n", firstChar)
-				if passLen > 1 {
-					lastChar := string(s.Config.SMTPPassword[passLen-1])
-					fmt.Printf("[DEBUG] Password last char: %s\n", lastChar)
-				}
-			}
-		}
-		
-		// Use standard Auth method for all authentication types
-		if s.Config.DebugMode {
-			fmt.Printf("[DEBUG] Authenticating with method: %s\n", s.Config.AuthMethod)
-		}
-		
-		if err = c.Auth(auth); err != nil {
-			if s.Config.DebugMode {
-				fmt.Printf("[DEBUG] Authentication failed: %v\n", err)
-			}
-			return fmt.Errorf("SMTP authentication failed for user %s on server %s:%d: %w", 
-				s.Config.SMTPUsername, s.Config.SMTPServer, s.Config.SMTPPort, err)
-		}
-		
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] Authentication successful")
-		}
-		
-		if s.Config.DebugMode {
-			fmt.Println("[DEBUG] Authentication successful")
-		}
-		
-		// Set the sender and recipients
-		if s.Config.DebugMode {
-			fmt.Printf("[DEBUG] Setting sender: %s\n", s.Config.SenderEmail)
-		}
-		
-		if err = c.Mail(s.Config.SenderEmail); err != nil {
-			if s.Config.DebugMode {
-				fmt.Printf("[DEBUG] Failed to set sender: %v\n", err)
-			}
-			return fmt.Errorf("failed to set sender: %w", err)
-		}
-		
-		for _, recipient := range recipients {
-			if s.Config.DebugMode {
-				fmt.Printf("[DEBUG] Setting recipient: %s\n", recipient)
-			}
-			
-			if err = c.Rcpt(recipient); err != nil {
-				if s.Config.DebugMode {
-					fmt.Printf("[DEBUG] Failed to set recipient: %v\n", err)
-				}
-				return fmt.Errorf("failed to set recipient %s: %w", recipient, err)
-			}
-		}
-		
-		// Send the email body
-		w, err := c.Data()
-		if err != nil {
-			return fmt.Errorf("failed to open data writer: %w", err)
-		}
-		
-		_, err = w.Write([]byte(email))
-		if err != nil {
-			return fmt.Errorf("failed to write email data: %w", err)
-		}
-		
-		err = w.Close()
-		if err != nil {
-			return fmt.Errorf("failed to close data writer: %w", err)
+			conn.Close()
+			return nil, s.fail("connect", fmt.Errorf("failed to create SMTP client: %w", err))
 		}
-		
-		// Send the QUIT command and close the connection
-		err = c.Quit()
-		if err != nil {
-			return fmt.Errorf("failed to close connection: %w", err)
-		}
-	} else if s.Config.SMTPPort == 587 {
-		// For SMTP with STARTTLS (port 587)
-		// Connect to the server
-		c, err := smtp.Dial(smtpAddr)
-		if err != nil {
-			return fmt.Errorf("failed to connect to SMTP server: %w", err)
-		}
-		defer c.Close()
-		
-		// Start TLS
-		tlsConfig := &tls.Config{
-			ServerName:         s.Config.SMTPServer,
-			InsecureSkipVerify: s.Config.InsecureSkipVerify,
-		}
-		if err = c.StartTLS(tlsConfig); err != nil {
-			return fmt.Errorf("failed to start TLS: %w", err)
+		log.Debug("connected", "addr", addr, "tls", true)
+		s.hookConnect(addr)
+		return c, nil
+	}
+
+	log.Debug("connecting", "addr", addr)
+	conn, err := s.dial(addr)
+	if err != nil {
+		return nil, s.fail("connect", fmt.Errorf("failed to connect to SMTP server: %w", err))
+	}
+
+	c, err := smtp.NewClient(conn, s.Config.SMTPServer)
+	if err != nil {
+		conn.Close()
+		return nil, s.fail("connect", fmt.Errorf("failed to create SMTP client: %w", err))
+	}
+	log.Debug("connected", "addr", addr, "tls", false)
+	s.hookConnect(addr)
+
+	hasStartTLS, _ := c.Extension("STARTTLS")
+	if !hasStartTLS && s.Config.RequireTLS {
+		c.Close()
+		return nil, s.fail("starttls", fmt.Errorf("%w: server %s does not advertise STARTTLS, refusing to send in clear text", ErrTLSRequired, addr))
+	}
+	if s.Config.SMTPPort == 587 || hasStartTLS {
+		log.Debug("starting TLS")
+		if err := c.StartTLS(s.tlsConfig()); err != nil {
+			c.Close()
+			return nil, s.fail("starttls", fmt.Errorf("failed to start TLS: %w", err))
 		}
-		
-		// Authenticate
-		if err = c.Auth(auth); err != nil {
-			return fmt.Errorf("SMTP authentication failed for user %s on server %s:%d: %w", 
-				s.Config.SMTPUsername, s.Config.SMTPServer, s.Config.SMTPPort, err)
+	}
+
+	return c, nil
+}
+
+// authenticate logs in to the server. On ports other than 465 and 587,
+// authentication is skipped when the server does not advertise AUTH.
+func (s *EmailSender) authenticate(c *smtp.Client) error {
+	if s.Config.SMTPPort != 465 && s.Config.SMTPPort != 587 {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return nil
 		}
-		
-		// Set the sender and recipients
-		if err = c.Mail(s.Config.SenderEmail); err != nil {
-			return fmt.Errorf("failed to set sender: %w", err)
+	}
+
+	// Never log the password or any part of it
+	s.logger().Debug("authenticating", "username", s.Config.SMTPUsername, "method", s.authMethod())
+
+	if err := c.Auth(s.auth()); err != nil {
+		err = fmt.Errorf("SMTP authentication failed for user %s on server %s:%d: %w",
+			s.Config.SMTPUsername, s.Config.SMTPServer, s.Config.SMTPPort, err)
+		s.hookAuth(err)
+		if s.Metrics != nil {
+			s.Metrics.ObserveAuthFailure(s.Config.SMTPServer, s.authMethod())
 		}
-		
-		for _, recipient := range recipients {
-			if err = c.Rcpt(recipient); err != nil {
-				return fmt.Errorf("failed to set recipient %s: %w", recipient, err)
+		return s.fail("auth", err)
+	}
+
+	s.logger().Debug("authentication successful")
+	s.hookAuth(nil)
+	return nil
+}
+
+// returnPath is the envelope sender of message: its ReturnPath, or else
+// the sender's address
+func (s *EmailSender) returnPath(message EmailMessage) string {
+	if message.ReturnPath != "" {
+		return message.ReturnPath
+	}
+	return s.Config.SenderEmail
+}
+
+// deliver runs the MAIL, RCPT, DATA and QUIT commands, with from as the
+// envelope sender. Recipients the server refuses are collected into a
+// *MultiRecipientError instead of aborting the send.
+func (s *EmailSender) deliver(c *smtp.Client, from string, recipients []string, email string) error {
+	log := s.logger()
+
+	log.Debug("setting sender", "from", from)
+	if err := c.Mail(from); err != nil {
+		return s.fail("mail", fmt.Errorf("failed to set sender: %w", err))
+	}
+
+	// Keep going past rejected recipients so the accepted ones still get the message
+	var rcptErr MultiRecipientError
+	for _, recipient := range recipients {
+		log.Debug("setting recipient", "rcpt", recipient)
+		if err := c.Rcpt(recipient); err != nil {
+			failed := newRecipientError(recipient, err)
+			if failed == nil {
+				return s.fail("rcpt", fmt.Errorf("failed to set recipient %s: %w", recipient, err))
 			}
+			s.fail("rcpt", failed)
+			rcptErr.Failed = append(rcptErr.Failed, failed)
+			continue
 		}
-		
-		// Send the email body
-		w, err := c.Data()
-		if err != nil {
-			return fmt.Errorf("failed to open data writer: %w", err)
-		}
-		
-		_, err = w.Write([]byte(email))
-		if err != nil {
-			return fmt.Errorf("failed to write email data: %w", err)
-		}
-		
-		err = w.Close()
-		if err != nil {
-			return fmt.Errorf("failed to close data writer: %w", err)
-		}
-		
-		// Send the QUIT command and close the connection
-		err = c.Quit()
-		if err != nil {
-			return fmt.Errorf("failed to close connection: %w", err)
-		}
-	} else {
-		// For standard SMTP without encryption
-		err := smtp.SendMail(smtpAddr, auth, s.Config.SenderEmail, recipients, []byte(email))
-		if err != nil {
-			return fmt.Errorf("failed to send email: %w", err)
-		}
+		rcptErr.Accepted = append(rcptErr.Accepted, recipient)
+	}
+
+	if len(rcptErr.Accepted) == 0 {
+		// Nothing to deliver; end the session politely before giving up
+		_ = c.Quit()
+		return &rcptErr
 	}
 
+	// Send the email body
+	w, err := c.Data()
+	if err != nil {
+		return s.fail("data", fmt.Errorf("failed to open data writer: %w", err))
+	}
+
+	if _, err := w.Write([]byte(email)); err != nil {
+		return s.fail("data", fmt.Errorf("failed to write email data: %w", err))
+	}
+
+	if err := w.Close(); err != nil {
+		return s.fail("data", fmt.Errorf("failed to close data writer: %w", err))
+	}
+
+	// Send the QUIT command and close the connection
+	if err := c.Quit(); err != nil {
+		return s.fail("quit", fmt.Errorf("failed to close connection: %w", err))
+	}
+
+	if len(rcptErr.Failed) > 0 {
+		return &rcptErr
+	}
 	return nil
 }
 
 // buildEmail constructs the full email content including headers and body
-func (s *EmailSender) buildEmail(message EmailMessage) string {
-	// Generate a boundary for multipart messages
-	boundary := "==_GoEmailBoundary_" + time.Now().Format("20060102150405") + "_=="
-
+func (s *EmailSender) buildEmail(message EmailMessage) (string, error) {
 	// Build email headers
 	headers := make(map[string]string)
-	headers["From"] = fmt.Sprintf("%s <%s>", s.Config.SenderName, s.Config.SenderEmail)
+	headers["From"] = s.Config.SenderEmail
+	if s.Config.SenderName != "" {
+		headers["From"] = fmt.Sprintf("%s <%s>", s.Config.SenderName, s.Config.SenderEmail)
+	}
 	headers["To"] = strings.Join(message.To, ", ")
 	if len(message.Cc) > 0 {
 		headers["Cc"] = strings.Join(message.Cc, ", ")
 	}
+	if s.Config.Sender != "" && !strings.EqualFold(s.Config.Sender, s.Config.SenderEmail) {
+		headers["Sender"] = s.Config.Sender
+	}
 	headers["Subject"] = message.Subject
+	headers["Date"] = time.Now().Format(time.RFC1123Z)
+	headers["Message-ID"] = s.messageID(message)
 	headers["MIME-Version"] = "1.0"
+	replyTo := message.ReplyTo
+	if replyTo == "" {
+		replyTo = s.Config.ReplyTo
+	}
+	if replyTo != "" {
+		headers["Reply-To"] = replyTo
+	}
+	for key, value := range message.Priority.headers() {
+		headers[key] = value
+	}
+	if len(message.ListUnsubscribe) > 0 {
+		uris := make([]string, len(message.ListUnsubscribe))
+		for i, uri := range message.ListUnsubscribe {
+			uris[i] = "<" + uri + ">"
+		}
+		headers["List-Unsubscribe"] = strings.Join(uris, ", ")
+	}
 
-	// Determine content type based on message content
-	hasAttachments := len(message.Attachments) > 0
-	hasHTML := message.HTMLBody != ""
+	contentType, body := s.buildBody(message)
+	entityHeaders := map[string]string{"Content-Type": contentType}
 
-	if hasAttachments || hasHTML {
-		// Multipart email
-		headers["Content-Type"] = fmt.Sprintf("multipart/mixed; boundary=\"%s\"", boundary)
-	} else {
-		// Simple plain text email
-		headers["Content-Type"] = "text/plain; charset=UTF-8"
+	// Sign and/or encrypt the body; the outer headers stay readable
+	if message.Sign != nil || len(message.EncryptTo) > 0 {
+		var err error
+		entityHeaders, body, err = secureBody(message, entityHeaders, body)
+		if err != nil {
+			return "", err
+		}
+	}
+	for key, value := range entityHeaders {
+		headers[key] = value
+	}
+
+	// Add custom headers without clobbering the ones built above; Bcc is never written
+	for key, value := range customHeaders(message, headers) {
+		headers[key] = value
 	}
 
-	// Build the email content
-	var emailContent strings.Builder
+	// Build the email content in a pooled buffer; only the returned string is kept
+	buf := pool.Get(len(body) + 1024)
+	defer pool.Put(buf)
 
-	// Add headers
+	// Add headers, with line breaks stripped so no value can inject another header
 	for key, value := range headers {
-		emailContent.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+		buf.WriteString(key)
+		buf.WriteString(": ")
+		buf.WriteString(sanitizeHeaderValue(value))
+		buf.WriteString("\r\n")
 	}
-	emailContent.WriteString("\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(body)
+
+	return buf.String(), nil
+}
+
+// buildBody returns the Content-Type and body of the message, without the outer headers
+func (s *EmailSender) buildBody(message EmailMessage) (string, string) {
+	// Generate a boundary for multipart messages
+	boundary := "==_GoEmailBoundary_" + time.Now().Format("20060102150405") + "_=="
+
+	// Determine content type based on message content
+	hasAttachments := len(message.Attachments) > 0
+	hasHTML := message.HTMLBody != ""
+	hasCalendar := message.Calendar != nil
 
 	// For simple plain text emails without attachments
-	if !hasAttachments && !hasHTML {
-		emailContent.WriteString(message.PlainBody)
-		return emailContent.String()
+	if !hasAttachments && !hasHTML && !hasCalendar {
+		return "text/plain; charset=UTF-8", message.PlainBody
 	}
 
+	// Size the buffer up front so large attachments don't make it grow (and copy) repeatedly
+	size := len(message.PlainBody) + len(message.HTMLBody) + 1024
+	for _, attachment := range message.Attachments {
+		size += base64LinesLen(len(attachment.Data)) + 256
+	}
+	emailContent := pool.Get(size)
+	defer pool.Put(emailContent)
+
 	// For multipart emails
 	// Add plain text part if available
 	if message.PlainBody != "" {
-		emailContent.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		writeBoundary(emailContent, boundary)
 		emailContent.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
 		emailContent.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
 		emailContent.WriteString(message.PlainBody)
@@ -410,39 +582,143 @@ func (s *EmailSender) buildEmail(message EmailMessage) string {
 
 	// Add HTML part if available
 	if hasHTML {
-		emailContent.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		writeBoundary(emailContent, boundary)
 		emailContent.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
 		emailContent.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
-		emailContent.WriteString(message.HTMLBody)
+		emailContent.WriteString(s.renderHTML(message))
+		emailContent.WriteString("\r\n")
+	}
+
+	// Add the calendar invite inline (so clients show Accept/Decline) and as an .ics file
+	attachments := message.Attachments
+	if hasCalendar {
+		organizer := Attendee{Name: s.Config.SenderName, Email: s.Config.SenderEmail}
+		ics := message.Calendar.renderICS(organizer)
+
+		writeBoundary(emailContent, boundary)
+		emailContent.WriteString("Content-Type: text/calendar; charset=UTF-8; method=")
+		emailContent.WriteString(message.Calendar.method())
 		emailContent.WriteString("\r\n")
+		emailContent.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+		emailContent.WriteString(ics)
+
+		attachments = append(attachments[:len(attachments):len(attachments)], Attachment{
+			Filename:    "invite.ics",
+			ContentType: "application/ics",
+			Data:        []byte(ics),
+		})
 	}
 
 	// Add attachments
-	for _, attachment := range message.Attachments {
-		emailContent.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-		emailContent.WriteString(fmt.Sprintf("Content-Type: %s; name=\"%s\"\r\n", 
-			attachment.ContentType, attachment.Filename))
+	for _, attachment := range attachments {
+		writeBoundary(emailContent, boundary)
+		contentType, disposition := attachmentHeaders(attachment)
+		emailContent.WriteString("Content-Type: " + contentType + "\r\n")
 		emailContent.WriteString("Content-Transfer-Encoding: base64\r\n")
-		emailContent.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", 
-			attachment.Filename))
-
-		// Encode attachment data as base64
-		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
-		
-		// Split the base64 data into lines of 76 characters
-		for i := 0; i < len(encoded); i += 76 {
-			end := i + 76
-			if end > len(encoded) {
-				end = len(encoded)
-			}
-			emailContent.WriteString(encoded[i:end] + "\r\n")
-		}
+		emailContent.WriteString("Content-Disposition: " + disposition + "\r\n\r\n")
+		writeBase64Lines(emailContent, attachment.Data)
 	}
 
 	// Close the multipart message
-	emailContent.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+	emailContent.WriteString("--" + boundary + "--\r\n")
+
+	return "multipart/mixed; boundary=\"" + boundary + "\"", emailContent.String()
+}
+
+// attachmentHeaders returns an attachment's Content-Type and
+// Content-Disposition values. mime.FormatMediaType quotes the filename,
+// escaping quotes and backslashes, and writes names with non-ASCII or
+// control characters as RFC 2231 encoded parameters. An invalid content type
+// falls back to application/octet-stream.
+func attachmentHeaders(attachment Attachment) (contentType, disposition string) {
+	contentType = mime.FormatMediaType(attachment.ContentType, map[string]string{"name": attachment.Filename})
+	if contentType == "" {
+		contentType = mime.FormatMediaType("application/octet-stream", map[string]string{"name": attachment.Filename})
+	}
+	disposition = mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+	return contentType, disposition
+}
+
+// writeBoundary starts the next part of a multipart body
+func writeBoundary(buf *bytes.Buffer, boundary string) {
+	buf.WriteString("--")
+	buf.WriteString(boundary)
+	buf.WriteString("\r\n")
+}
+
+// base64LineBytes is how much data fills one 76-character base64 line
+const base64LineBytes = 57
+
+// writeBase64Lines writes data as base64 split into lines of 76 characters,
+// encoding a line at a time instead of building the whole encoded string
+func writeBase64Lines(buf *bytes.Buffer, data []byte) {
+	var line [76]byte
+	for len(data) > 0 {
+		n := min(len(data), base64LineBytes)
+		base64.StdEncoding.Encode(line[:], data[:n])
+		buf.Write(line[:base64.StdEncoding.EncodedLen(n)])
+		buf.WriteString("\r\n")
+		data = data[n:]
+	}
+}
+
+// base64LinesLen is the size writeBase64Lines writes for n bytes of data
+func base64LinesLen(n int) int {
+	lines := (n + base64LineBytes - 1) / base64LineBytes
+	return base64.StdEncoding.EncodedLen(n) + 2*lines
+}
+
+// renderHTML sanitizes the HTML body (when a sanitizer is set) and adds the preview text
+func (s *EmailSender) renderHTML(message EmailMessage) string {
+	htmlBody := message.HTMLBody
+	if s.Sanitizer != nil {
+		htmlBody = s.Sanitizer.Sanitize(htmlBody)
+	}
+	return insertPreviewText(htmlBody, message.PreviewText)
+}
+
+// NewMessageID returns a fresh Message-ID in the sender's domain. Callers
+// that store the ID before sending set it as EmailMessage.MessageID.
+func (s *EmailSender) NewMessageID() string {
+	return generateMessageID(s.messageIDDomain())
+}
+
+// messageID returns the Message-ID of message: its own, in angle brackets,
+// or a new one
+func (s *EmailSender) messageID(message EmailMessage) string {
+	if message.MessageID != "" {
+		if id, err := normalizeMessageID(message.MessageID); err == nil {
+			return id
+		}
+	}
+	return s.NewMessageID()
+}
+
+// messageIDDomain returns Config.MessageIDDomain, or else the domain of the sender
+func (s *EmailSender) messageIDDomain() string {
+	if s.Config.MessageIDDomain != "" {
+		return s.Config.MessageIDDomain
+	}
+	sender := s.Config.SenderEmail
+	if at := strings.LastIndex(sender, "@"); at != -1 && at < len(sender)-1 {
+		return sender[at+1:]
+	}
+	return ""
+}
+
+// generateMessageID creates an RFC 5322 Message-ID in domain ("localhost" when empty)
+func generateMessageID(domain string) string {
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		// Fall back to the timestamp alone if the random source fails
+		return fmt.Sprintf("<%d@%s>", time.Now().UnixNano(), domain)
+	}
 
-	return emailContent.String()
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain)
 }
 
 // CreateAttachmentFromFile creates an attachment from a file on disk
@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Send outcomes reported to MetricsCollector.ObserveSend
+const (
+	SendStatusSent    = "sent"    // every recipient accepted the message
+	SendStatusPartial = "partial" // delivered, but some recipients were rejected
+	SendStatusFailed  = "failed"  // nothing was delivered
+)
+
+// MetricsCollector receives send outcomes for monitoring. Implementations
+// must be safe for concurrent use. PrometheusMetrics is a ready-made one.
+type MetricsCollector interface {
+	ObserveSend(status string, duration time.Duration)
+	ObserveAuthFailure(server, method string)
+}
+
+// PrometheusMetrics exports send outcomes as Prometheus metrics:
+// emails_sent_total{status}, send_duration_seconds{status} and
+// auth_failures_total{server,method}
+type PrometheusMetrics struct {
+	sent         *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	authFailures *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics creates the metrics and registers them with reg
+// (prometheus.DefaultRegisterer if nil)
+func NewPrometheusMetrics(reg prometheus.Registerer) (*PrometheusMetrics, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &PrometheusMetrics{
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "emails_sent_total",
+			Help: "Emails submitted to the SMTP server, by outcome.",
+		}, []string{"status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "send_duration_seconds",
+			Help:    "Time spent in SendEmail, including rate-limit waits and MX preflight, by outcome.",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60},
+		}, []string{"status"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_failures_total",
+			Help: "SMTP authentication failures, by server and method.",
+		}, []string{"server", "method"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.sent, m.duration, m.authFailures} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ObserveSend implements MetricsCollector
+func (m *PrometheusMetrics) ObserveSend(status string, duration time.Duration) {
+	m.sent.WithLabelValues(status).Inc()
+	m.duration.WithLabelValues(status).Observe(duration.Seconds())
+}
+
+// ObserveAuthFailure implements MetricsCollector
+func (m *PrometheusMetrics) ObserveAuthFailure(server, method string) {
+	m.authFailures.WithLabelValues(server, method).Inc()
+}
+
+// observeSend reports the outcome of a SendEmail call to the configured collector
+func (s *EmailSender) observeSend(start time.Time, err error) {
+	if s.Metrics == nil {
+		return
+	}
+
+	status := SendStatusSent
+	var rcptErr *MultiRecipientError
+	switch {
+	case errors.As(err, &rcptErr) && rcptErr.Delivered():
+		status = SendStatusPartial
+	case err != nil:
+		status = SendStatusFailed
+	}
+	s.Metrics.ObserveSend(status, time.Since(start))
+}
@@ -0,0 +1,36 @@
+package smtp
+
+import "fmt"
+
+// Priority marks how urgent a message is; mail clients flag high-priority messages
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// validate rejects values other than the Priority constants (empty means unset)
+func (p Priority) validate() error {
+	switch p {
+	case "", PriorityHigh, PriorityNormal, PriorityLow:
+		return nil
+	}
+	return fmt.Errorf("unknown priority %q (use high, normal or low)", p)
+}
+
+// headers returns the priority headers understood by the major clients:
+// X-Priority (most clients), Importance (Outlook/Exchange, RFC 2156) and
+// X-MSMail-Priority (older Outlook versions)
+func (p Priority) headers() map[string]string {
+	switch p {
+	case PriorityHigh:
+		return map[string]string{"X-Priority": "1 (Highest)", "Importance": "High", "X-MSMail-Priority": "High"}
+	case PriorityLow:
+		return map[string]string{"X-Priority": "5 (Lowest)", "Importance": "Low", "X-MSMail-Priority": "Low"}
+	case PriorityNormal:
+		return map[string]string{"X-Priority": "3 (Normal)", "Importance": "Normal", "X-MSMail-Priority": "Normal"}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeTimeout bounds a whole Probe: connecting, both EHLOs and the TLS handshake
+const probeTimeout = 30 * time.Second
+
+// Capabilities is what a server advertised in its EHLO response
+type Capabilities struct {
+	Server   string
+	Port     int
+	Greeting string // The 220 banner, e.g. "smtp.example.com ESMTP ready"
+
+	ImplicitTLS bool   // Port 465: the session was encrypted from the start
+	STARTTLS    bool   // The server offered STARTTLS before encryption
+	TLSVersion  string // Negotiated version, e.g. "TLS 1.3"; empty if the session stayed in clear text
+
+	// AUTH mechanisms, e.g. ["PLAIN", "LOGIN"]. Many servers only offer AUTH
+	// after STARTTLS, so this is read from the encrypted session when there is one.
+	AuthMechanisms []string
+	MaxSize        int64 // SIZE limit in bytes; 0 if not advertised or unlimited
+	Pipelining     bool
+
+	// Extensions holds every advertised extension with its parameters,
+	// keyed by upper-case name, from the last EHLO
+	Extensions map[string]string
+}
+
+// Encrypted reports whether a sender could reach this server over TLS
+func (c *Capabilities) Encrypted() bool {
+	return c.ImplicitTLS || c.STARTTLS
+}
+
+// SupportsAuth reports whether the server offers the given mechanism
+// ("PLAIN", "LOGIN", "CRAM-MD5"); the comparison ignores case
+func (c *Capabilities) SupportsAuth(mechanism string) bool {
+	for _, m := range c.AuthMechanisms {
+		if strings.EqualFold(m, mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
+// Probe connects to server:port, sends EHLO and reports the extensions the
+// server advertises, without logging in or sending anything. Port 465 uses
+// implicit TLS. On other ports, when STARTTLS is offered, Probe upgrades and
+// sends EHLO again, since servers often advertise AUTH only after that.
+//
+// Certificates are verified against the system roots, so an invalid
+// certificate is reported as an error rather than ignored.
+func Probe(server string, port int) (*Capabilities, error) {
+	addr := net.JoinHostPort(server, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: server}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: probeTimeout}
+	if port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("probe %s: connect: %w", addr, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(probeTimeout))
+
+	text := textproto.NewConn(conn)
+	_, greeting, err := text.ReadResponse(220)
+	if err != nil {
+		return nil, fmt.Errorf("probe %s: greeting: %w", addr, err)
+	}
+
+	caps := &Capabilities{Server: server, Port: port, Greeting: greeting, ImplicitTLS: port == 465}
+	if caps.Extensions, err = ehlo(text); err != nil {
+		return nil, fmt.Errorf("probe %s: %w", addr, err)
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		caps.TLSVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+	} else if _, ok := caps.Extensions["STARTTLS"]; ok {
+		caps.STARTTLS = true
+		if _, _, err := probeCmd(text, 220, "STARTTLS"); err != nil {
+			return nil, fmt.Errorf("probe %s: STARTTLS: %w", addr, err)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("probe %s: TLS handshake: %w", addr, err)
+		}
+		caps.TLSVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+
+		text = textproto.NewConn(tlsConn)
+		if caps.Extensions, err = ehlo(text); err != nil {
+			return nil, fmt.Errorf("probe %s: EHLO after STARTTLS: %w", addr, err)
+		}
+	}
+
+	if mechs, ok := caps.Extensions["AUTH"]; ok {
+		caps.AuthMechanisms = strings.Fields(mechs)
+	}
+	if size, ok := caps.Extensions["SIZE"]; ok {
+		caps.MaxSize, _ = strconv.ParseInt(size, 10, 64)
+	}
+	_, caps.Pipelining = caps.Extensions["PIPELINING"]
+
+	_, _, _ = probeCmd(text, 221, "QUIT")
+	return caps, nil
+}
+
+// ehlo sends EHLO and parses the extension lines of the reply
+func ehlo(text *textproto.Conn) (map[string]string, error) {
+	_, msg, err := probeCmd(text, 250, "EHLO localhost")
+	if err != nil {
+		return nil, fmt.Errorf("EHLO: %w", err)
+	}
+
+	// The first line is the server's hostname; each further line is one extension
+	ext := make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		name, params, _ := strings.Cut(line, " ")
+		ext[strings.ToUpper(name)] = params
+	}
+	return ext, nil
+}
+
+func probeCmd(text *textproto.Conn, expectCode int, line string) (int, string, error) {
+	id, err := text.Cmd("%s", line)
+	if err != nil {
+		return 0, "", err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	return text.ReadResponse(expectCode)
+}
@@ -0,0 +1,119 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// DialContextFunc opens the raw TCP connection to the SMTP server. Set
+// EmailSender.DialContext to route mail through an SSH tunnel or any other
+// custom transport.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialTimeout bounds connection setup, including any proxy handshake
+const dialTimeout = 30 * time.Second
+
+// dial connects to addr directly, through the configured proxy, or with the
+// custom DialContext, in that order of precedence (DialContext wins)
+func (s *EmailSender) dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	if s.DialContext != nil {
+		return s.DialContext(ctx, "tcp", addr)
+	}
+
+	direct := &net.Dialer{Timeout: dialTimeout}
+	if s.Config.ProxyURL == "" {
+		return direct.DialContext(ctx, "tcp", addr)
+	}
+
+	proxyURL, err := url.Parse(s.Config.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	s.logger().Debug("dialing through proxy", "scheme", proxyURL.Scheme, "proxy", proxyURL.Host, "addr", addr)
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(proxyURL, direct)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http":
+		return dialHTTPConnect(ctx, direct, proxyURL, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use socks5, socks5h or http)", proxyURL.Scheme)
+	}
+}
+
+// dialHTTPConnect opens a tunnel to addr through an HTTP proxy using CONNECT
+func dialHTTPConnect(ctx context.Context, direct *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := direct.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy: %w", err)
+	}
+
+	// Bound the handshake by the same deadline as the dial
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// The SMTP greeting may already be sitting in the reader's buffer
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn drains bytes read ahead during the CONNECT handshake before
+// reading from the connection again
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,100 @@
+package smtp
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/sleep"
+)
+
+// Limiter decides when the next message may be sent
+type Limiter interface {
+	// Wait blocks until a message may be sent or the context is done
+	Wait(ctx context.Context) error
+}
+
+// RateLimitConfig describes a provider's sending quota
+type RateLimitConfig struct {
+	PerSecond float64 // Messages allowed per second (0 = no per-second limit)
+	PerMinute int     // Messages allowed per minute (0 = no per-minute limit)
+	Burst     int     // Messages that may be sent back to back before limiting kicks in
+}
+
+// Common provider quotas, useful as starting points
+var (
+	GmailRateLimit = RateLimitConfig{PerMinute: 20, Burst: 5}
+	SESRateLimit   = RateLimitConfig{PerSecond: 14, Burst: 14}
+)
+
+// TokenBucketLimiter is the default Limiter, refilling tokens at a steady rate
+type TokenBucketLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // tokens per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// NewTokenBucketLimiter creates a limiter that allows rate messages per second
+// with bursts of up to burst messages
+func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucketLimiter{
+		rate:     rate,
+		capacity: float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// NewLimiter builds a token bucket from a RateLimitConfig, returning nil when no limit is set.
+// When both PerSecond and PerMinute are given, the stricter of the two wins.
+func NewLimiter(config RateLimitConfig) Limiter {
+	rate := config.PerSecond
+	if config.PerMinute > 0 {
+		perMinute := float64(config.PerMinute) / 60
+		if rate == 0 || perMinute < rate {
+			rate = perMinute
+		}
+	}
+	if rate <= 0 {
+		return nil
+	}
+	return NewTokenBucketLimiter(rate, config.Burst)
+}
+
+// Wait implements Limiter
+func (l *TokenBucketLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay == 0 {
+			return nil
+		}
+
+		if err := sleep.Until(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// reserve takes a token if one is available, otherwise reports how long until one will be
+func (l *TokenBucketLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = math.Min(l.capacity, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	missing := 1 - l.tokens
+	return time.Duration(missing / l.rate * float64(time.Second))
+}
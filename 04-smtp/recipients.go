@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// RecipientError records a single address the server refused at RCPT time
+type RecipientError struct {
+	Recipient string
+	Code      int // SMTP reply code, e.g. 550 for an unknown mailbox (0 if unknown)
+	Err       error
+}
+
+// Error implements the error interface
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("recipient %s rejected: %v", e.Recipient, e.Err)
+}
+
+// Unwrap returns the underlying server error
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the server used a 4xx code, meaning a later retry may succeed
+func (e *RecipientError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// MultiRecipientError is returned by SendEmail when the server rejects one or
+// more recipients. If Accepted is non-empty the message was still delivered
+// to those addresses; otherwise nothing was sent.
+type MultiRecipientError struct {
+	Failed   []*RecipientError
+	Accepted []string
+}
+
+// Error implements the error interface
+func (e *MultiRecipientError) Error() string {
+	parts := make([]string, len(e.Failed))
+	for i, failed := range e.Failed {
+		parts[i] = failed.Error()
+	}
+	return fmt.Sprintf("%d of %d recipients rejected: %s",
+		len(e.Failed), len(e.Failed)+len(e.Accepted), strings.Join(parts, "; "))
+}
+
+// Unwrap returns the per-recipient errors so errors.As can reach them
+func (e *MultiRecipientError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, failed := range e.Failed {
+		errs[i] = failed
+	}
+	return errs
+}
+
+// Delivered reports whether at least one recipient accepted the message
+func (e *MultiRecipientError) Delivered() bool {
+	return len(e.Accepted) > 0
+}
+
+// newRecipientError wraps a RCPT failure. It returns nil when err is not an
+// SMTP reply (e.g. a broken connection), since continuing makes no sense then.
+func newRecipientError(recipient string, err error) *RecipientError {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return nil
+	}
+	return &RecipientError{Recipient: recipient, Code: protoErr.Code, Err: err}
+}
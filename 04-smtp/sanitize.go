@@ -0,0 +1,170 @@
+package smtp
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// HTMLSanitizer strips disallowed tags and attributes from HTML bodies.
+// Disallowed tags are removed but their text is kept; DropElements are removed
+// together with everything inside them.
+type HTMLSanitizer struct {
+	AllowedTags       []string            // Tags that are kept
+	AllowedAttributes map[string][]string // Attributes kept per tag; "*" applies to every tag
+	DropElements      []string            // Tags removed along with their content (script, style, ...)
+	AllowedSchemes    []string            // URL schemes allowed in href/src; relative URLs are always allowed
+}
+
+// DefaultHTMLSanitizer returns a policy suited to email: common formatting and
+// table layout tags with inline styles, no scripts, stylesheets, frames, or forms
+func DefaultHTMLSanitizer() *HTMLSanitizer {
+	return &HTMLSanitizer{
+		AllowedTags: []string{
+			"html", "head", "body", "meta", "title",
+			"a", "b", "blockquote", "br", "caption", "center", "code", "div", "em", "font",
+			"h1", "h2", "h3", "h4", "h5", "h6", "hr", "i", "img", "li", "ol", "p", "pre",
+			"s", "small", "span", "strong", "sub", "sup", "u", "ul",
+			"table", "thead", "tbody", "tfoot", "tr", "td", "th",
+		},
+		AllowedAttributes: map[string][]string{
+			"*":     {"style", "class", "align", "dir", "title"},
+			"a":     {"href", "target", "name"},
+			"img":   {"src", "alt", "width", "height", "border"},
+			"table": {"width", "border", "cellpadding", "cellspacing", "bgcolor"},
+			"td":    {"width", "height", "colspan", "rowspan", "valign", "bgcolor"},
+			"th":    {"width", "height", "colspan", "rowspan", "valign", "bgcolor"},
+			"font":  {"color", "face", "size"},
+			"meta":  {"charset"},
+		},
+		DropElements:   []string{"script", "style", "iframe", "object", "embed", "form", "noscript"},
+		AllowedSchemes: []string{"http", "https", "mailto", "tel", "cid"},
+	}
+}
+
+// unsafeStyle matches CSS that can run script or load remote content in some clients
+var unsafeStyle = regexp.MustCompile(`(?i)expression\s*\(|javascript:|behaviou?r\s*:|@import`)
+
+// Sanitize returns input with disallowed markup removed
+func (p *HTMLSanitizer) Sanitize(input string) string {
+	allowedTags := toSet(p.AllowedTags)
+	dropElements := toSet(p.DropElements)
+
+	var out strings.Builder
+	z := nethtml.NewTokenizer(strings.NewReader(input))
+	dropDepth := 0 // > 0 while inside a dropped element
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case nethtml.ErrorToken:
+			// io.EOF or malformed input; either way we are done
+			return out.String()
+
+		case nethtml.TextToken:
+			if dropDepth == 0 {
+				out.WriteString(html.EscapeString(string(z.Text())))
+			}
+
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			tok := z.Token()
+			if dropElements[tok.Data] {
+				if tt == nethtml.StartTagToken {
+					dropDepth++
+				}
+				continue
+			}
+			if dropDepth > 0 || !allowedTags[tok.Data] {
+				continue
+			}
+			tok.Attr = p.filterAttributes(tok.Data, tok.Attr)
+			out.WriteString(tok.String())
+
+		case nethtml.EndTagToken:
+			tok := z.Token()
+			if dropElements[tok.Data] {
+				if dropDepth > 0 {
+					dropDepth--
+				}
+				continue
+			}
+			if dropDepth > 0 || !allowedTags[tok.Data] {
+				continue
+			}
+			out.WriteString(tok.String())
+
+		case nethtml.DoctypeToken:
+			out.WriteString(z.Token().String())
+
+		case nethtml.CommentToken:
+			// Comments are dropped; conditional comments can hide arbitrary markup
+		}
+	}
+}
+
+// filterAttributes keeps only allowed attributes with safe values
+func (p *HTMLSanitizer) filterAttributes(tag string, attrs []nethtml.Attribute) []nethtml.Attribute {
+	allowed := toSet(append(append([]string{}, p.AllowedAttributes["*"]...), p.AllowedAttributes[tag]...))
+
+	kept := attrs[:0]
+	for _, attr := range attrs {
+		key := strings.ToLower(attr.Key)
+		if !allowed[key] || strings.HasPrefix(key, "on") {
+			continue
+		}
+		if (key == "href" || key == "src") && !p.safeURL(attr.Val) {
+			continue
+		}
+		if key == "style" && unsafeStyle.MatchString(attr.Val) {
+			continue
+		}
+		kept = append(kept, attr)
+	}
+	return kept
+}
+
+// safeURL reports whether a URL is relative or uses an allowed scheme
+func (p *HTMLSanitizer) safeURL(raw string) bool {
+	value := strings.TrimSpace(raw)
+	colon := strings.Index(value, ":")
+	if colon == -1 || strings.ContainsAny(value[:colon], "/?#") {
+		return true // relative URL
+	}
+
+	scheme := strings.ToLower(value[:colon])
+	for _, allowed := range p.AllowedSchemes {
+		if scheme == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyTag matches the opening <body> tag so the preheader can go right after it
+var bodyTag = regexp.MustCompile(`(?i)<body[^>]*>`)
+
+// insertPreviewText adds a hidden preheader that inbox lists show next to the subject
+func insertPreviewText(htmlBody, previewText string) string {
+	if previewText == "" {
+		return htmlBody
+	}
+
+	// Pad with zero-width non-joiners so clients don't pull body text into the preview
+	preheader := `<div style="display:none;font-size:1px;line-height:1px;max-height:0;max-width:0;opacity:0;overflow:hidden;mso-hide:all;">` +
+		html.EscapeString(previewText) + strings.Repeat("&zwnj;&nbsp;", 40) + `</div>`
+
+	if loc := bodyTag.FindStringIndex(htmlBody); loc != nil {
+		return htmlBody[:loc[1]] + preheader + htmlBody[loc[1]:]
+	}
+	return preheader + htmlBody
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[strings.ToLower(v)] = true
+	}
+	return set
+}
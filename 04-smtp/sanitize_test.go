@@ -0,0 +1,63 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"allowed markup kept", `<p class="x">Hi <b>there</b></p>`, `<p class="x">Hi <b>there</b></p>`},
+		{"script dropped with its content", `<p>a</p><script>alert(1)</script><p>b</p>`, `<p>a</p><p>b</p>`},
+		{"style dropped with its content", `<style>body{background:url(x)}</style><p>a</p>`, `<p>a</p>`},
+		{"nested dropped elements", `<div><form><script>alert(1)</script><input name="q">x</form>y</div>`, `<div>y</div>`},
+		{"unclosed script", `<p>a</p><script>alert(1)`, `<p>a</p>`},
+		{"unclosed allowed tag", `<p><b>bold`, `<p><b>bold`},
+		{"stray end tag", `</script><p>a</p>`, `<p>a</p>`},
+		{"disallowed tag keeps its text", `<blink>hi</blink>`, `hi`},
+		{"onclick", `<a href="https://example.com" onclick="steal()">x</a>`, `<a href="https://example.com">x</a>`},
+		{"onerror", `<img src="cid:logo" onerror="steal()">`, `<img src="cid:logo">`},
+		{"uppercase ONLOAD", `<body ONLOAD="steal()">x</body>`, `<body>x</body>`},
+		{"javascript: href", `<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"mixed case javascript:", `<a href="  JaVaScRiPt:alert(1)">x</a>`, `<a>x</a>`},
+		{"entity-encoded javascript:", `<a href="java&#x09;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"data: src", `<img src="data:text/html;base64,PHNjcmlwdD4=">`, `<img>`},
+		{"relative URL", `<a href="/unsubscribe?id=1">x</a>`, `<a href="/unsubscribe?id=1">x</a>`},
+		{"mailto", `<a href="mailto:a@example.com">x</a>`, `<a href="mailto:a@example.com">x</a>`},
+		{"style expression", `<p style="width: expression(alert(1))">x</p>`, `<p>x</p>`},
+		{"comment", `<p>a<!--[if mso]><script>alert(1)</script><![endif]-->b</p>`, `<p>ab</p>`},
+		{"text escaped", `<p>1 &lt; 2 &amp;&amp; 3 &gt; 2</p>`, `<p>1 &lt; 2 &amp;&amp; 3 &gt; 2</p>`},
+	}
+	p := DefaultHTMLSanitizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Sanitize(tt.input); got != tt.want {
+				t.Errorf("Sanitize(%q)\n got %q\nwant %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeNothingExecutable(t *testing.T) {
+	inputs := []string{
+		`<scr<script>ipt>alert(1)</script>`,
+		`<svg><script>alert(1)</script></svg>`,
+		`<iframe src="https://example.com"><p>inside</p>`,
+		`<a href="javascript&colon;alert(1)">x</a>`,
+		`<img src=x onerror=alert(1)//`,
+		`<p style="background:url(javascript:alert(1))">x</p>`,
+	}
+	p := DefaultHTMLSanitizer()
+	for _, input := range inputs {
+		got := strings.ToLower(p.Sanitize(input))
+		for _, bad := range []string{"<script", "<iframe", "<svg", "onerror", "javascript:"} {
+			if strings.Contains(got, bad) {
+				t.Errorf("Sanitize(%q) = %q, contains %s", input, got, bad)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package smtp
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// SMIMESigner holds the sender's certificate and key used to sign messages
+type SMIMESigner struct {
+	Certificate *x509.Certificate
+	PrivateKey  crypto.PrivateKey
+	Chain       []*x509.Certificate // Intermediate certificates included in the signature
+}
+
+// LoadSMIMESigner reads a PEM certificate (optionally followed by intermediates) and its private key
+func LoadSMIMESigner(certFile, keyFile string) (*SMIMESigner, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load S/MIME key pair: %w", err)
+	}
+
+	certs := make([]*x509.Certificate, len(pair.Certificate))
+	for i, der := range pair.Certificate {
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, fmt.Errorf("failed to parse S/MIME certificate: %w", err)
+		}
+	}
+
+	return &SMIMESigner{Certificate: certs[0], PrivateKey: pair.PrivateKey, Chain: certs[1:]}, nil
+}
+
+// LoadCertificate reads a single PEM-encoded certificate, e.g. a recipient's for EncryptTo
+func LoadCertificate(pemFile string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(pemFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found in %s", pemFile)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// encryptMu guards pkcs7.ContentEncryptionAlgorithm, which the library keeps as a global
+var encryptMu sync.Mutex
+
+// secureBody signs and/or encrypts the MIME entity described by headers and body (RFC 8551).
+// The message is signed first so the signature is hidden inside the encrypted envelope.
+func secureBody(message EmailMessage, headers map[string]string, body string) (map[string]string, string, error) {
+	entity := renderEntity(headers, body)
+
+	if message.Sign != nil {
+		signature, err := signEntity(message.Sign, entity)
+		if err != nil {
+			return nil, "", fmt.Errorf("S/MIME signing failed: %w", err)
+		}
+
+		boundary := "==_GoSignedBoundary_" + time.Now().Format("20060102150405") + "_=="
+		headers = map[string]string{
+			"Content-Type": fmt.Sprintf(`multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary="%s"`, boundary),
+		}
+
+		// The first part must be byte-for-byte the entity that was signed
+		var signed strings.Builder
+		signed.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+		signed.WriteString(entity)
+		signed.WriteString(fmt.Sprintf("\r\n--%s\r\n", boundary))
+		signed.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+		signed.WriteString("Content-Transfer-Encoding: base64\r\n")
+		signed.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+		signed.WriteString(wrapBase64(signature))
+		signed.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+
+		body = signed.String()
+		entity = renderEntity(headers, body)
+	}
+
+	if len(message.EncryptTo) > 0 {
+		encryptMu.Lock()
+		pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+		envelope, err := pkcs7.Encrypt([]byte(entity), message.EncryptTo)
+		encryptMu.Unlock()
+		if err != nil {
+			return nil, "", fmt.Errorf("S/MIME encryption failed: %w", err)
+		}
+
+		headers = map[string]string{
+			"Content-Type":              `application/pkcs7-mime; smime-type=enveloped-data; name="smime.p7m"`,
+			"Content-Transfer-Encoding": "base64",
+			"Content-Disposition":       `attachment; filename="smime.p7m"`,
+		}
+		body = wrapBase64(envelope)
+	}
+
+	return headers, body, nil
+}
+
+// signEntity returns a detached SHA-256 PKCS#7 signature over entity
+func signEntity(signer *SMIMESigner, entity string) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData([]byte(entity))
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSignerChain(signer.Certificate, signer.PrivateKey, signer.Chain, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	sd.Detach()
+	return sd.Finish()
+}
+
+// renderEntity writes a MIME entity in canonical form: sorted headers and CRLF line endings
+func renderEntity(headers map[string]string, body string) string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var entity strings.Builder
+	for _, key := range keys {
+		entity.WriteString(fmt.Sprintf("%s: %s\r\n", key, headers[key]))
+	}
+	entity.WriteString("\r\n")
+
+	// Signatures break if a relay rewrites bare LFs, so canonicalize before signing
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	entity.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return entity.String()
+}
+
+// wrapBase64 encodes data as base64 in CRLF-terminated lines of 76 characters
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var out strings.Builder
+	for i := 0; i < len(encoded); i += 76 {
+		end := min(i+76, len(encoded))
+		out.WriteString(encoded[i:end] + "\r\n")
+	}
+	return out.String()
+}
@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// testSigner returns a signer with a freshly generated self-signed
+// certificate for sender@example.com
+func testSigner(t *testing.T) *SMIMESigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "sender@example.com"},
+		EmailAddresses: []string{"sender@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SMIMESigner{Certificate: cert, PrivateKey: key}
+}
+
+func TestBuildEmailSigned(t *testing.T) {
+	signer := testSigner(t)
+	s := &EmailSender{Config: EmailConfig{SenderEmail: "sender@example.com"}}
+	raw, err := s.buildEmail(EmailMessage{
+		To:        []string{"a@example.com"},
+		Subject:   "Signed",
+		PlainBody: "line one\nline two",
+		HTMLBody:  "<p>line one</p>",
+		Sign:      signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Subject") != "Signed" {
+		t.Errorf("Subject = %q, want the outer headers left readable", msg.Header.Get("Subject"))
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+		t.Fatalf("Content-Type = %s %v, want multipart/signed with the PKCS#7 protocol and sha-256", mediaType, params)
+	}
+	boundary := params["boundary"]
+
+	// The first part, byte for byte, is what the signature covers
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rest, ok := strings.Cut(string(body), "--"+boundary+"\r\n")
+	signed, _, ok2 := strings.Cut(rest, "\r\n--"+boundary+"\r\n")
+	if !ok || !ok2 {
+		t.Fatalf("body doesn't hold two parts between %q boundaries:\n%s", boundary, body)
+	}
+	if !strings.Contains(signed, "line one\r\nline two") {
+		t.Errorf("signed part isn't in canonical CRLF form:\n%q", signed)
+	}
+
+	parts := multipart.NewReader(strings.NewReader(string(body)), boundary)
+	var types []string
+	var signature []byte
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		types = append(types, contentType)
+		if contentType == "application/pkcs7-signature" {
+			encoded, _ := io.ReadAll(part)
+			if signature, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", "")); err != nil {
+				t.Fatalf("signature isn't base64: %v", err)
+			}
+		}
+	}
+	if len(types) != 2 || types[0] != "multipart/mixed" || types[1] != "application/pkcs7-signature" {
+		t.Fatalf("parts = %v, want the signed entity and then the signature", types)
+	}
+
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		t.Fatalf("parse signature: %v", err)
+	}
+	p7.Content = []byte(signed)
+	if err := p7.Verify(); err != nil {
+		t.Errorf("signature doesn't verify over the first part: %v", err)
+	}
+	if len(p7.Certificates) != 1 || !p7.Certificates[0].Equal(signer.Certificate) {
+		t.Errorf("signature carries %d certificates, want the signer's", len(p7.Certificates))
+	}
+
+	p7.Content = []byte(strings.Replace(signed, "line two", "line 2", 1))
+	if err := p7.Verify(); err == nil {
+		t.Error("signature verifies over a tampered part")
+	}
+}
@@ -0,0 +1,37 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrTLSRequired is returned when RequireTLS is set and the server offers no
+// way to encrypt the session
+var ErrTLSRequired = errors.New("TLS required")
+
+// tlsConfig builds the TLS configuration used for SMTPS and STARTTLS
+func (s *EmailSender) tlsConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         s.Config.SMTPServer,
+		InsecureSkipVerify: s.Config.InsecureSkipVerify,
+		MinVersion:         s.Config.MinTLSVersion,
+		RootCAs:            s.Config.RootCAs,
+	}
+}
+
+// LoadCertPool reads PEM-encoded CA certificates from a file, for use as EmailConfig.RootCAs
+func LoadCertPool(pemFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(pemFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid certificates found in %s", pemFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,185 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Reasons an address can fail validation; match them with errors.Is
+var (
+	ErrInvalidSyntax    = errors.New("invalid address syntax")
+	ErrLocalPartTooLong = errors.New("local part exceeds 64 octets")
+	ErrDomainTooLong    = errors.New("domain exceeds 255 octets")
+	ErrPathTooLong      = errors.New("address exceeds 254 octets")
+	ErrInvalidDomain    = errors.New("invalid domain")
+	ErrNoMailServer     = errors.New("domain has no mail server")
+	ErrNullMX           = errors.New("domain does not accept mail (null MX)")
+)
+
+// mxLookupTimeout bounds the DNS lookups done for each domain during preflight
+const mxLookupTimeout = 10 * time.Second
+
+// ValidationError describes why a single address was rejected before delivery
+type ValidationError struct {
+	Address string
+	Err     error // one of the Err* values above, or the DNS error from the MX lookup
+}
+
+// Error implements the error interface
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid address %q: %v", e.Address, e.Err)
+}
+
+// Unwrap returns the underlying reason
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is returned by SendEmail when PreflightMX rejects one or more recipients
+type ValidationErrors []*ValidationError
+
+// Error implements the error interface
+func (e ValidationErrors) Error() string {
+	parts := make([]string, len(e))
+	for i, err := range e {
+		parts[i] = err.Error()
+	}
+	return fmt.Sprintf("%d recipient(s) failed preflight: %s", len(e), strings.Join(parts, "; "))
+}
+
+// Unwrap returns the individual errors so errors.As can reach them
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Validate checks that email is a single, syntactically valid address within
+// the RFC 5321 length limits. It does not touch the network.
+func Validate(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return &ValidationError{Address: email, Err: fmt.Errorf("%w: %v", ErrInvalidSyntax, err)}
+	}
+
+	at := strings.LastIndex(addr.Address, "@")
+	if at < 1 {
+		return &ValidationError{Address: email, Err: ErrInvalidSyntax}
+	}
+	local, domain := addr.Address[:at], addr.Address[at+1:]
+
+	switch {
+	case len(local) > 64:
+		return &ValidationError{Address: email, Err: ErrLocalPartTooLong}
+	case len(domain) > 255:
+		return &ValidationError{Address: email, Err: ErrDomainTooLong}
+	case len(addr.Address) > 254:
+		return &ValidationError{Address: email, Err: ErrPathTooLong}
+	}
+
+	if err := validateDomain(domain); err != nil {
+		return &ValidationError{Address: email, Err: err}
+	}
+	return nil
+}
+
+// validateDomain checks a domain against the RFC 5321 grammar: either an
+// address literal such as [192.0.2.1] or dot-separated LDH labels
+func validateDomain(domain string) error {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		literal := strings.TrimPrefix(domain[1:len(domain)-1], "IPv6:")
+		if net.ParseIP(literal) == nil {
+			return fmt.Errorf("%w: bad address literal %s", ErrInvalidDomain, domain)
+		}
+		return nil
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("%w: bad label length in %s", ErrInvalidDomain, domain)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("%w: label %q starts or ends with a hyphen", ErrInvalidDomain, label)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("%w: label %q contains %q", ErrInvalidDomain, label, r)
+			}
+		}
+	}
+	return nil
+}
+
+// LookupMail confirms that a domain can receive mail. It follows RFC 5321:
+// MX records are preferred, a domain without MX falls back to its A/AAAA
+// records, and a null MX (RFC 7505) means the domain accepts no mail.
+func LookupMail(ctx context.Context, resolver *net.Resolver, domain string) error {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	// Address literals name the server directly
+	if strings.HasPrefix(domain, "[") {
+		return nil
+	}
+
+	records, err := resolver.LookupMX(ctx, domain)
+	if err == nil && len(records) > 0 {
+		if len(records) == 1 && (records[0].Host == "." || records[0].Host == "") {
+			return ErrNullMX
+		}
+		return nil
+	}
+
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return fmt.Errorf("MX lookup for %s failed: %w", domain, err)
+	}
+
+	// Implicit MX: the domain's own address records
+	if hosts, err := resolver.LookupHost(ctx, domain); err == nil && len(hosts) > 0 {
+		return nil
+	}
+	return ErrNoMailServer
+}
+
+// preflight validates every recipient and checks that each domain can
+// receive mail. Each domain is looked up once per message.
+func (s *EmailSender) preflight(recipients []string) error {
+	var errs ValidationErrors
+	domains := make(map[string]error)
+
+	for _, recipient := range recipients {
+		if err := Validate(recipient); err != nil {
+			errs = append(errs, err.(*ValidationError))
+			continue
+		}
+
+		addr, _ := mail.ParseAddress(recipient)
+		domain := strings.ToLower(addr.Address[strings.LastIndex(addr.Address, "@")+1:])
+
+		lookupErr, seen := domains[domain]
+		if !seen {
+			ctx, cancel := context.WithTimeout(context.Background(), mxLookupTimeout)
+			lookupErr = LookupMail(ctx, s.Resolver, domain)
+			cancel()
+			domains[domain] = lookupErr
+			s.logger().Debug("mx preflight", "domain", domain, "error", lookupErr)
+		}
+		if lookupErr != nil {
+			errs = append(errs, &ValidationError{Address: recipient, Err: lookupErr})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
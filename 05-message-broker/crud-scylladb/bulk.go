@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+)
+
+// maxBulkUsers is the most users one POST /users/bulk may create. main sets
+// it from Config.MaxBulkUsers.
+var maxBulkUsers = 500
+
+// bulkConcurrency is how many partition batches of a bulk create are in
+// flight at once
+const bulkConcurrency = 16
+
+// BulkCreateUsersRequest is the body of POST /users/bulk
+type BulkCreateUsersRequest struct {
+	Users []CreateUserRequest `json:"users"`
+}
+
+// BulkCreateResult reports every item of a bulk create, in request order
+type BulkCreateResult struct {
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Items   []BulkItemResult `json:"items"`
+}
+
+// BulkItemResult is the outcome of one user of a bulk create
+type BulkItemResult struct {
+	Index   int    `json:"index"`
+	Success bool   `json:"success"`
+	User    *User  `json:"user,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// validate checks the fields every new user needs
+func (req CreateUserRequest) validate() error {
+	if req.Name == "" || req.Email == "" {
+		return errors.New("name and email are required")
+	}
+	return nil
+}
+
+// partitionBatch is the statements of a bulk create that share a partition,
+// and the users they belong to
+type partitionBatch struct {
+	stmt  string
+	names []string
+	users []int // indexes into the users being created
+}
+
+// CreateMany writes new users and their email lookup rows with unlogged
+// batches, one per partition: a batch that stays on one partition is
+// applied by a single replica set, while one spread over many partitions
+// makes its coordinator wait on all of them. Each users row is its own
+// partition, and users sharing an email share a lookup batch.
+//
+// Unlike Create there is no IF NOT EXISTS. The IDs are fresh random
+// UUIDs, and a lightweight transaction per user would undo the point of
+// batching. The returned errors are per user, nil for those created.
+func (r ScyllaUserRepository) CreateMany(ctx context.Context, users []User) (errs []error) {
+	var err error
+	defer observeOperation("bulk_create_users", time.Now(), &err)
+
+	errs = make([]error, len(users))
+	byEmail := make(map[string][]int)
+	var emails []string // in request order, so batches go out deterministically
+	for i, user := range users {
+		if _, ok := byEmail[user.Email]; !ok {
+			emails = append(emails, user.Email)
+		}
+		byEmail[user.Email] = append(byEmail[user.Email], i)
+	}
+
+	// users rows first: a lookup row is only written for a user that exists
+	stmt, names := userTable.Insert()
+	userBatches := make([]partitionBatch, len(users))
+	for i := range users {
+		userBatches[i] = partitionBatch{stmt: stmt, names: names, users: []int{i}}
+	}
+	runPartitionBatches(ctx, r.session, users, userBatches, func(i int, err error) {
+		errs[i] = fmt.Errorf("failed to create user: %w", err)
+	})
+
+	stmt, names = usersByEmailTable.Insert()
+	var lookupBatches []partitionBatch
+	for _, email := range emails {
+		var written []int
+		for _, i := range byEmail[email] {
+			if errs[i] == nil {
+				written = append(written, i)
+			}
+		}
+		if len(written) > 0 {
+			lookupBatches = append(lookupBatches, partitionBatch{stmt: stmt, names: names, users: written})
+		}
+	}
+	runPartitionBatches(ctx, r.session, users, lookupBatches, func(i int, err error) {
+		errs[i] = fmt.Errorf("user created but its email lookup row was not written: %w", err)
+	})
+
+	err = errors.Join(errs...)
+	return errs
+}
+
+// runPartitionBatches executes each batch as an unlogged batch of one
+// statement per user, bulkConcurrency at a time, and calls failed for every
+// user of a batch that failed
+func runPartitionBatches(ctx context.Context, session *instrumentedSession, users []User, batches []partitionBatch, failed func(i int, err error)) {
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex // guards failed
+		sem = make(chan struct{}, bulkConcurrency)
+	)
+	for _, pb := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(pb partitionBatch) {
+			defer func() { <-sem; wg.Done() }()
+
+			batch := requestBatch(ctx, session.NewBatch(gocql.UnloggedBatch))
+			var err error
+			for _, i := range pb.users {
+				if err = addToBatch(batch, pb.stmt, pb.names, users[i]); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = session.ExecuteBatch(batch)
+			}
+			if err != nil {
+				mu.Lock()
+				for _, i := range pb.users {
+					failed(i, err)
+				}
+				mu.Unlock()
+			}
+		}(pb)
+	}
+	wg.Wait()
+}
+
+// bulkCreateUsersHandler handles POST /users/bulk. Every valid user is
+// written, whatever happens to the others: 201 Created when all were,
+// 207 Multi-Status when some were, and an error status when none were.
+// Each item reports its own outcome either way.
+func (s *server) bulkCreateUsersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req BulkCreateUsersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+	if len(req.Users) == 0 || len(req.Users) > maxBulkUsers {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Send between 1 and %d users", maxBulkUsers),
+		})
+		return
+	}
+
+	result := BulkCreateResult{Items: make([]BulkItemResult, len(req.Users))}
+	var users []User
+	var positions []int // request index of each entry in users
+	now := time.Now()
+	for i, item := range req.Users {
+		result.Items[i].Index = i
+		if err := item.validate(); err != nil {
+			result.Items[i].Error = err.Error()
+			continue
+		}
+		users = append(users, User{
+			ID:        uuid.New().String(),
+			Name:      item.Name,
+			Email:     item.Email,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Version:   1,
+		})
+		positions = append(positions, i)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+	defer cancel()
+
+	var dbErr error
+	if len(users) > 0 {
+		for j, err := range s.users.CreateMany(ctx, users) {
+			item := &result.Items[positions[j]]
+			if err != nil {
+				item.Error = err.Error()
+				dbErr = err
+				continue
+			}
+			item.Success, item.User = true, &users[j]
+		}
+	}
+
+	// Every created user gets its created event, like a single create
+	var events []UserEvent
+	var created []*BulkItemResult
+	for i := range result.Items {
+		if item := &result.Items[i]; item.Success {
+			events = append(events, newUserEvent(r, eventCreated, nil, item.User))
+			created = append(created, item)
+		}
+	}
+	if len(events) > 0 {
+		for k, err := range s.users.RecordEvents(ctx, events) {
+			if err != nil {
+				created[k].Success = false
+				created[k].Error = "user created but the change was not recorded in its history: " + err.Error()
+				dbErr = err
+			}
+		}
+	}
+	for _, item := range result.Items {
+		if item.Success {
+			result.Created++
+		} else {
+			result.Failed++
+		}
+	}
+
+	response := APIResponse{
+		Success: result.Failed == 0,
+		Message: fmt.Sprintf("Created %d of %d users", result.Created, len(req.Users)),
+		Data:    result,
+	}
+	switch {
+	case result.Failed == 0:
+		w.WriteHeader(http.StatusCreated)
+	case result.Created > 0:
+		w.WriteHeader(http.StatusMultiStatus)
+	case dbErr != nil:
+		w.WriteHeader(dbErrorStatus(dbErr))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Config is everything that differs between environments. Each setting has
+// an environment variable and a flag; the flag wins when both are set.
+type Config struct {
+	Hosts        []string          // contact points, host or host:port
+	Keyspace     string            // created on startup if missing
+	Consistency  gocql.Consistency // of every query
+	Port         int               // of the REST API
+	MaxBulkUsers int               // per POST /users/bulk
+
+	// MultiTenant gives every tenant, named by the X-Tenant header, its own
+	// keyspace next to Keyspace; see tenantRegistry
+	MultiTenant bool
+	MaxTenants  int // provisioned by one process
+
+	// Replication of the keyspace when it is created: SimpleStrategy with
+	// ReplicationFactor, or NetworkTopologyStrategy when Datacenters is set.
+	// An existing keyspace is left as it is.
+	ReplicationFactor int
+	Datacenters       map[string]int // replicas per datacenter
+
+	ConnectTimeout time.Duration // to open a connection
+	Timeout        time.Duration // per query attempt, cluster.Timeout
+	ReadTimeout    time.Duration // per request, see readTimeout
+	WriteTimeout   time.Duration // per request, see writeTimeout
+	SlowQuery      time.Duration // log query attempts slower than this, 0 for none
+
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGINT or SIGTERM before their connections are closed
+	ShutdownTimeout time.Duration
+}
+
+// defaultConfig is a single local node, the setup of docker-compose.yml
+func defaultConfig() Config {
+	return Config{
+		Hosts:             []string{"localhost:9042"},
+		Keyspace:          KeyspaceName,
+		Consistency:       gocql.LocalQuorum,
+		Port:              8080,
+		MaxBulkUsers:      500,
+		MaxTenants:        100,
+		ReplicationFactor: 1,
+		ConnectTimeout:    10 * time.Second,
+		Timeout:           10 * time.Second,
+		ReadTimeout:       2 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		SlowQuery:         100 * time.Millisecond,
+		ShutdownTimeout:   15 * time.Second,
+	}
+}
+
+// loadConfig reads the configuration from the environment and then from
+// the flags in args, and validates it. It returns the arguments left after
+// the flags, the subcommand.
+func loadConfig(args []string) (Config, []string, error) {
+	cfg := defaultConfig()
+	env := func(name string) string { return strings.TrimSpace(os.Getenv(name)) }
+
+	// Flags default to the environment, so a flag overrides its variable
+	// and -h shows what is in effect
+	hosts := strings.Join(cfg.Hosts, ",")
+	if v := env("SCYLLA_HOSTS"); v != "" {
+		hosts = v
+	}
+	datacenters := env("SCYLLA_DATACENTERS")
+	settings := []struct {
+		env   string
+		apply func(string) error
+	}{
+		{"SCYLLA_KEYSPACE", func(v string) error { cfg.Keyspace = v; return nil }},
+		{"SCYLLA_CONSISTENCY", func(v string) (err error) {
+			cfg.Consistency, err = gocql.ParseConsistencyWrapper(v)
+			return err
+		}},
+		{"PORT", intSetting(&cfg.Port)},
+		{"BULK_MAX_USERS", intSetting(&cfg.MaxBulkUsers)},
+		{"SCYLLA_MULTI_TENANT", boolSetting(&cfg.MultiTenant)},
+		{"SCYLLA_MAX_TENANTS", intSetting(&cfg.MaxTenants)},
+		{"SCYLLA_REPLICATION_FACTOR", intSetting(&cfg.ReplicationFactor)},
+		{"SCYLLA_CONNECT_TIMEOUT", durationSetting(&cfg.ConnectTimeout)},
+		{"SCYLLA_TIMEOUT", durationSetting(&cfg.Timeout)},
+		{"SCYLLA_READ_TIMEOUT", durationSetting(&cfg.ReadTimeout)},
+		{"SCYLLA_WRITE_TIMEOUT", durationSetting(&cfg.WriteTimeout)},
+		{"SCYLLA_SLOW_QUERY", durationSetting(&cfg.SlowQuery)},
+		{"SHUTDOWN_TIMEOUT", durationSetting(&cfg.ShutdownTimeout)},
+	}
+	for _, setting := range settings {
+		if v := env(setting.env); v != "" {
+			if err := setting.apply(v); err != nil {
+				return Config{}, nil, fmt.Errorf("%s: %w", setting.env, err)
+			}
+		}
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&hosts, "hosts", hosts, "comma-separated contact points, host[:port] ($SCYLLA_HOSTS)")
+	fs.StringVar(&cfg.Keyspace, "keyspace", cfg.Keyspace, "keyspace to use, created if missing ($SCYLLA_KEYSPACE)")
+	fs.TextVar(&cfg.Consistency, "consistency", cfg.Consistency, "consistency level, e.g. ONE, QUORUM, LOCAL_QUORUM ($SCYLLA_CONSISTENCY)")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "port of the REST API ($PORT)")
+	fs.IntVar(&cfg.MaxBulkUsers, "bulk-max-users", cfg.MaxBulkUsers, "most users one POST /users/bulk may create ($BULK_MAX_USERS)")
+	fs.BoolVar(&cfg.MultiTenant, "multi-tenant", cfg.MultiTenant, "route each request to the keyspace of its X-Tenant header ($SCYLLA_MULTI_TENANT)")
+	fs.IntVar(&cfg.MaxTenants, "max-tenants", cfg.MaxTenants, "most tenants one process provisions ($SCYLLA_MAX_TENANTS)")
+	fs.IntVar(&cfg.ReplicationFactor, "replication-factor", cfg.ReplicationFactor, "SimpleStrategy replication factor of a new keyspace ($SCYLLA_REPLICATION_FACTOR)")
+	fs.StringVar(&datacenters, "datacenters", datacenters, "NetworkTopologyStrategy replicas of a new keyspace, e.g. dc1:3,dc2:3 ($SCYLLA_DATACENTERS)")
+	fs.DurationVar(&cfg.ConnectTimeout, "connect-timeout", cfg.ConnectTimeout, "timeout to open a connection ($SCYLLA_CONNECT_TIMEOUT)")
+	fs.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "timeout of one query attempt ($SCYLLA_TIMEOUT)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "deadline of a request's reads ($SCYLLA_READ_TIMEOUT)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "deadline of a request's writes ($SCYLLA_WRITE_TIMEOUT)")
+	fs.DurationVar(&cfg.SlowQuery, "slow-query", cfg.SlowQuery, "log query attempts slower than this, 0 to log none ($SCYLLA_SLOW_QUERY)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "time in-flight requests get to finish on SIGTERM ($SHUTDOWN_TIMEOUT)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	cfg.Hosts = splitList(hosts)
+	if datacenters != "" {
+		dcs, err := parseDatacenters(datacenters)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("datacenters: %w", err)
+		}
+		cfg.Datacenters = dcs
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+func intSetting(dst *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("must be a number, got %q", v)
+		}
+		*dst = n
+		return nil
+	}
+}
+
+func boolSetting(dst *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("must be true or false, got %q", v)
+		}
+		*dst = b
+		return nil
+	}
+}
+
+func durationSetting(dst *time.Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 2s, got %q", v)
+		}
+		*dst = d
+		return nil
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseDatacenters parses "dc1:3,dc2:3" into replicas per datacenter
+func parseDatacenters(s string) (map[string]int, error) {
+	dcs := make(map[string]int)
+	for _, item := range splitList(s) {
+		name, replicas, ok := strings.Cut(item, ":")
+		n, err := strconv.Atoi(strings.TrimSpace(replicas))
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%q must look like dc1:3", item)
+		}
+		name = strings.TrimSpace(name)
+		if _, dup := dcs[name]; dup {
+			return nil, fmt.Errorf("%s is listed twice", name)
+		}
+		dcs[name] = n
+	}
+	return dcs, nil
+}
+
+var (
+	// CQL identifiers, unquoted; keyspace names are limited to 48 characters
+	keyspaceName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`)
+	// Datacenter names end up in a CQL string literal
+	datacenterName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// validate checks the configuration once at startup, so a typo fails
+// there instead of on the first query
+func (cfg Config) validate() error {
+	var errs []error
+	if len(cfg.Hosts) == 0 {
+		errs = append(errs, errors.New("hosts: at least one host is required"))
+	}
+	for _, host := range cfg.Hosts {
+		if err := validateHost(host); err != nil {
+			errs = append(errs, fmt.Errorf("hosts: %s: %w", host, err))
+		}
+	}
+	if !keyspaceName.MatchString(cfg.Keyspace) {
+		errs = append(errs, fmt.Errorf("keyspace: %q must be a letter followed by up to 47 letters, digits or underscores", cfg.Keyspace))
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d is not between 1 and 65535", cfg.Port))
+	}
+	if cfg.MaxBulkUsers < 1 {
+		errs = append(errs, fmt.Errorf("bulk max users: must be at least 1, got %d", cfg.MaxBulkUsers))
+	}
+	if cfg.MaxTenants < 1 {
+		errs = append(errs, fmt.Errorf("max tenants: must be at least 1, got %d", cfg.MaxTenants))
+	}
+	if cfg.ReplicationFactor < 1 {
+		errs = append(errs, fmt.Errorf("replication factor: must be at least 1, got %d", cfg.ReplicationFactor))
+	}
+	for name, replicas := range cfg.Datacenters {
+		if !datacenterName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("datacenters: %q is not a valid datacenter name", name))
+		}
+		if replicas < 1 {
+			errs = append(errs, fmt.Errorf("datacenters: %s must have at least 1 replica, got %d", name, replicas))
+		}
+	}
+	timeouts := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"connect timeout", cfg.ConnectTimeout},
+		{"timeout", cfg.Timeout},
+		{"read timeout", cfg.ReadTimeout},
+		{"write timeout", cfg.WriteTimeout},
+		{"shutdown timeout", cfg.ShutdownTimeout},
+	}
+	for _, t := range timeouts {
+		if t.timeout <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive, got %s", t.name, t.timeout))
+		}
+	}
+	if cfg.SlowQuery < 0 {
+		errs = append(errs, fmt.Errorf("slow query: must be 0 or positive, got %s", cfg.SlowQuery))
+	}
+	return errors.Join(errs...)
+}
+
+// validateHost checks a contact point, host or host:port
+func validateHost(host string) error {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return errors.New("must be host or host:port")
+		}
+		return nil // no port, gocql uses 9042
+	}
+	if h == "" {
+		return errors.New("host is empty")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("port %q is not between 1 and 65535", port)
+	}
+	return nil
+}
+
+// newCluster configures the driver for cfg
+func (cfg Config) newCluster() *gocql.ClusterConfig {
+	cluster := gocql.NewCluster(cfg.Hosts...)
+	cluster.Consistency = cfg.Consistency
+	cluster.ConnectTimeout = cfg.ConnectTimeout
+	cluster.Timeout = cfg.Timeout
+	cluster.QueryObserver = metrics // per-attempt latency, retries and timeouts
+	return cluster
+}
+
+// replication is the replication map of a new keyspace, as CQL
+func (cfg Config) replication() string {
+	if len(cfg.Datacenters) == 0 {
+		return fmt.Sprintf("{'class': 'SimpleStrategy', 'replication_factor': %d}", cfg.ReplicationFactor)
+	}
+	names := make([]string, 0, len(cfg.Datacenters))
+	for name := range cfg.Datacenters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{"'class': 'NetworkTopologyStrategy'"}
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("'%s': %d", name, cfg.Datacenters[name]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/scylladb/gocqlx/v2"
+)
+
+// consistencyHeader lets a request pick the consistency of its queries,
+// trading latency for durability; without it they run at the configured
+// SCYLLA_CONSISTENCY. The response names the level used in the same header.
+const consistencyHeader = "X-Consistency"
+
+// defaultConsistency is the level of queries whose request asks for none,
+// cluster.Consistency. main sets it from the configuration.
+var defaultConsistency = gocql.LocalQuorum
+
+// requestConsistencies are the levels a request may ask for. ANY only
+// applies to writes, and SERIAL and LOCAL_SERIAL only to the conditions of
+// lightweight transactions, which keep their own serial consistency.
+var requestConsistencies = []gocql.Consistency{
+	gocql.One, gocql.Two, gocql.Three, gocql.Quorum, gocql.All,
+	gocql.LocalQuorum, gocql.EachQuorum, gocql.LocalOne,
+}
+
+// parseRequestConsistency parses an X-Consistency value, e.g. local_quorum
+func parseRequestConsistency(v string) (gocql.Consistency, error) {
+	c, err := gocql.ParseConsistencyWrapper(strings.ToUpper(strings.TrimSpace(v)))
+	if err == nil {
+		for _, allowed := range requestConsistencies {
+			if c == allowed {
+				return c, nil
+			}
+		}
+	}
+	names := make([]string, len(requestConsistencies))
+	for i, allowed := range requestConsistencies {
+		names[i] = allowed.String()
+	}
+	return 0, fmt.Errorf("%q is not one of %s", v, strings.Join(names, ", "))
+}
+
+// consistencyKey is the context key of a request's consistency
+type consistencyKey struct{}
+
+// consistencyFrom returns the consistency a request asked for, if it did
+func consistencyFrom(ctx context.Context) (gocql.Consistency, bool) {
+	c, ok := ctx.Value(consistencyKey{}).(gocql.Consistency)
+	return c, ok
+}
+
+// consistencyMiddleware reads X-Consistency into the request's context,
+// refusing a level it can't run at with 400 Bad Request
+func consistencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(consistencyHeader)
+		if v == "" {
+			w.Header().Set(consistencyHeader, defaultConsistency.String())
+			next.ServeHTTP(w, r)
+			return
+		}
+		c, err := parseRequestConsistency(v)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "Invalid " + consistencyHeader + " header",
+				Error:   err.Error(),
+			})
+			return
+		}
+		w.Header().Set(consistencyHeader, c.String())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), consistencyKey{}, c)))
+	})
+}
+
+// inRequest runs q under ctx: its deadline, and the consistency the request
+// asked for, if any
+func inRequest(ctx context.Context, q *gocqlx.Queryx) *gocqlx.Queryx {
+	q = q.WithContext(ctx)
+	if c, ok := consistencyFrom(ctx); ok {
+		q.Consistency(c)
+	}
+	return q
+}
+
+// requestBatch is inRequest for a batch
+func requestBatch(ctx context.Context, batch *gocql.Batch) *gocql.Batch {
+	batch = batch.WithContext(ctx)
+	if c, ok := consistencyFrom(ctx); ok {
+		batch.SetConsistency(c)
+	}
+	return batch
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	"github.com/scylladb/gocqlx/v2/qb"
+	"github.com/scylladb/gocqlx/v2/table"
+)
+
+// What happened to a user, the action of a UserEvent
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+)
+
+// actorHeader names who makes a change. The API has no authentication, so
+// this is whatever the client says; requests without it are anonymous.
+const actorHeader = "X-Actor"
+
+// UserEvent is one change to a user, a row of user_events. Diff holds the
+// fields that changed as JSON, e.g. {"name":{"old":"Ann","new":"Anna"}}:
+// only "new" for a create and only "old" for a delete.
+type UserEvent struct {
+	UserID     string          `db:"user_id" json:"user_id"`
+	EventID    gocql.UUID      `db:"event_id" json:"event_id"` // a timeuuid
+	Action     string          `db:"action" json:"action"`
+	Actor      string          `db:"actor" json:"actor"`
+	Diff       json.RawMessage `db:"diff" json:"diff"`
+	OccurredAt time.Time       `db:"occurred_at" json:"occurred_at"`
+}
+
+// userEventsMetadata describes the audit history of users. Each user's
+// events are one partition, clustered by their timeuuid, so the history of
+// a user reads oldest first.
+var userEventsMetadata = table.Metadata{
+	Name:    "user_events",
+	Columns: []string{"user_id", "event_id", "action", "actor", "diff", "occurred_at"},
+	PartKey: []string{"user_id"},
+	SortKey: []string{"event_id"},
+}
+
+var userEventsTable = table.New(userEventsMetadata)
+
+// fieldChange is one field of an event's diff
+type fieldChange struct {
+	Old *string `json:"old,omitempty"`
+	New *string `json:"new,omitempty"`
+}
+
+// userDiff returns the fields that differ between before and after, either
+// of which is nil for a create or a delete. Only name and email are
+// compared: the others are bookkeeping the event records anyway.
+func userDiff(before, after *User) json.RawMessage {
+	diff := make(map[string]fieldChange)
+	field := func(name string, get func(User) string) {
+		var change fieldChange
+		if before != nil {
+			value := get(*before)
+			change.Old = &value
+		}
+		if after != nil {
+			value := get(*after)
+			change.New = &value
+		}
+		if change.Old != nil && change.New != nil && *change.Old == *change.New {
+			return
+		}
+		diff[name] = change
+	}
+	field("name", func(u User) string { return u.Name })
+	field("email", func(u User) string { return u.Email })
+
+	raw, _ := json.Marshal(diff) // a map of strings always encodes
+	return raw
+}
+
+// newUserEvent records what the request r did to a user, before and after
+func newUserEvent(r *http.Request, action string, before, after *User) UserEvent {
+	user := after
+	if user == nil {
+		user = before
+	}
+	actor := strings.TrimSpace(r.Header.Get(actorHeader))
+	if actor == "" {
+		actor = "anonymous"
+	}
+	id := gocql.TimeUUID()
+	return UserEvent{
+		UserID:     user.ID,
+		EventID:    id,
+		Action:     action,
+		Actor:      actor,
+		Diff:       userDiff(before, after),
+		OccurredAt: id.Time().UTC().Truncate(time.Millisecond), // CQL timestamps have millisecond precision
+	}
+}
+
+// RecordEvents writes events, bulkConcurrency at a time since each user's
+// events are their own partition. The returned errors are per event, nil
+// for those written.
+func (r ScyllaUserRepository) RecordEvents(ctx context.Context, events []UserEvent) (errs []error) {
+	var err error
+	defer observeOperation("record_user_events", time.Now(), &err)
+
+	errs = make([]error, len(events))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, bulkConcurrency)
+	for i := range events {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			q := inRequest(ctx, r.session.Query(userEventsTable.Insert())).BindStruct(events[i])
+			if err := q.ExecRelease(); err != nil {
+				errs[i] = fmt.Errorf("failed to record user event: %w", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	err = errors.Join(errs...)
+	return errs
+}
+
+// Events retrieves the history of a user, oldest first. It is kept after
+// the user is deleted.
+func (r ScyllaUserRepository) Events(ctx context.Context, userID string) (_ []UserEvent, err error) {
+	defer observeOperation("get_user_events", time.Now(), &err)
+	var events []UserEvent
+	q := inRequest(ctx, r.session.Query(userEventsTable.Select())).BindMap(qb.M{"user_id": userID})
+	if err := q.SelectRelease(&events); err != nil {
+		return nil, fmt.Errorf("failed to get user events: %w", err)
+	}
+	return events, nil
+}
+
+// recordEvent writes the event of a change the handler has just made
+func (s *server) recordEvent(ctx context.Context, event UserEvent) error {
+	return s.users.RecordEvents(ctx, []UserEvent{event})[0]
+}
+
+// writeEventError answers a change that was applied but whose event could
+// not be written, with the user as the change left it, if it still exists
+func writeEventError(w http.ResponseWriter, action string, err error, user *User) {
+	response := APIResponse{
+		Success: false,
+		Message: fmt.Sprintf("User %s but the change was not recorded in its history", action),
+		Error:   err.Error(),
+	}
+	if user != nil {
+		response.Data = user
+	}
+	w.WriteHeader(dbErrorStatus(err))
+	json.NewEncoder(w).Encode(response)
+}
+
+// getUserEventsHandler handles GET /users/{id}/events. The history of a
+// deleted user is still there; 404 means the user has neither events nor
+// a row, e.g. an ID that never existed.
+func (s *server) getUserEventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := mux.Vars(r)["id"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), readTimeout)
+	defer cancel()
+
+	events, err := s.users.Events(ctx, userID)
+	if err == nil && len(events) == 0 {
+		// Users created before the history existed have no events yet
+		var user *User
+		if user, err = s.users.Get(ctx, userID); err == nil && user == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "User not found",
+			})
+			return
+		}
+	}
+	if err != nil {
+		w.WriteHeader(dbErrorStatus(err))
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Failed to get user events",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if events == nil {
+		events = []UserEvent{}
+	}
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Retrieved %d events", len(events)),
+		Data:    events,
+	})
+}
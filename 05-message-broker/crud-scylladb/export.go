@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/fanin"
+	"github.com/fajar/learn-go/report"
+)
+
+// exportPageSize is how many users one token range query of an export reads
+var exportPageSize = 1000
+
+// An export splits the token ring into exportRanges ranges and runs
+// exportWorkers page queries at once. The ranges are handed on in token
+// order, so the file comes out as a sequential scan would, and at most
+// exportWindow of them are read or waiting at a time. A range that is
+// ahead of the export stops after one page waiting to be sent, which
+// bounds an export's memory to about 2*exportWindow pages.
+var (
+	exportRanges  = 64
+	exportWorkers = 4
+	exportWindow  = 8
+)
+
+// Export formats of GET /users/export
+const (
+	exportCSV    = "csv"
+	exportNDJSON = "ndjson"
+)
+
+// exportStmt reads the next page of users of a token range in token order.
+// Paging by token rather than with the driver's paging state means each
+// page is its own query, with its own timeout, so an export isn't bounded
+// by one deadline.
+const exportStmt = "SELECT id, name, email, created_at, updated_at, version, token(id) FROM users WHERE token(id) > ? AND token(id) <= ? LIMIT ?"
+
+// tokenRange is the tokens after After, up to and including UpTo
+type tokenRange struct {
+	After, UpTo int64
+}
+
+// tokenRanges splits the Murmur3 token ring into n contiguous ranges, in
+// order. Tokens are greater than math.MinInt64, so the first range starts
+// at the lowest token there is.
+func tokenRanges(n int) []tokenRange {
+	n = max(n, 1)
+	step := math.MaxUint64 / uint64(n)
+	ranges := make([]tokenRange, n)
+	after := int64(math.MinInt64)
+	for i := range ranges {
+		upTo := int64(math.MaxInt64)
+		if i < n-1 {
+			upTo = after + int64(step)
+		}
+		ranges[i] = tokenRange{After: after, UpTo: upTo}
+		after = upTo
+	}
+	return ranges
+}
+
+// userPage is one page of an export, or the error that ended its token range
+type userPage struct {
+	users []User
+	err   error
+}
+
+// Export reads every user with fanin.Ordered, a token range at a time and
+// each range a page at a time, and hands the pages to page in token order.
+// Each page query gets readTimeout. An error from page stops the export
+// and is returned as is.
+func (r ScyllaUserRepository) Export(ctx context.Context, page func([]User) error) (err error) {
+	defer observeOperation("export_users", time.Now(), &err)
+
+	// Stops the readers when the export ends early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ranges := make(chan tokenRange)
+	go func() {
+		defer close(ranges)
+		for _, tr := range tokenRanges(exportRanges) {
+			select {
+			case ranges <- tr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	queries := make(chan struct{}, exportWorkers)
+	read := func(tr tokenRange) <-chan userPage {
+		return r.exportRange(ctx, tr, queries)
+	}
+	for pages := range fanin.Ordered(ctx, ranges, exportWorkers, exportWindow, read) {
+		for p := range pages {
+			if p.err != nil {
+				return p.err
+			}
+			if err := page(p.users); err != nil {
+				return err
+			}
+		}
+	}
+	// Ordered closes its channel early when ctx is done, and so do the ranges
+	return ctx.Err()
+}
+
+// exportRange streams the users of tr a page at a time. The channel holds
+// one page, so the range's reader stops once it is a page ahead of the
+// export; it is closed after the last page, an error, or once ctx is done.
+// Each page query holds a slot in queries while it runs.
+func (r ScyllaUserRepository) exportRange(ctx context.Context, tr tokenRange, queries chan struct{}) <-chan userPage {
+	pages := make(chan userPage, 1)
+	go func() {
+		defer close(pages)
+		after := tr.After
+		for {
+			select {
+			case queries <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			users, last, err := r.exportPage(ctx, after, tr.UpTo)
+			<-queries
+
+			if len(users) > 0 || err != nil {
+				select {
+				case pages <- userPage{users: users, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil || len(users) < exportPageSize {
+				return
+			}
+			after = last
+		}
+	}()
+	return pages
+}
+
+// exportPage reads the users whose token follows after, up to upTo, and
+// returns the token of the last one
+func (r ScyllaUserRepository) exportPage(ctx context.Context, after, upTo int64) ([]User, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+
+	iter := inRequest(ctx, r.session.Query(exportStmt, nil)).Bind(after, upTo, exportPageSize).Iter()
+	users := make([]User, 0, exportPageSize)
+	var (
+		user  User
+		token int64
+	)
+	for iter.Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Version, &token) {
+		users = append(users, user)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, 0, fmt.Errorf("failed to export users: %w", err)
+	}
+	return users, token, nil
+}
+
+// exportColumns is the header row of a CSV export
+var exportColumns = []string{"id", "name", "email", "created_at", "updated_at", "version"}
+
+// exportSheet is a CSV export of users. Its rows come straight from
+// Export's pages, and an error that stops the export ends the sheet.
+func exportSheet(ctx context.Context, users UserRepository) report.Sheet {
+	columns := make([]report.Column, len(exportColumns))
+	for i, header := range exportColumns {
+		columns[i] = report.Column{Header: header}
+	}
+	return report.Sheet{
+		Columns: columns,
+		Rows: func(yield func(report.Row, error) bool) {
+			stopped := errors.New("export stopped")
+			err := users.Export(ctx, func(page []User) error {
+				for _, u := range page {
+					row := report.Row{
+						u.ID,
+						u.Name,
+						u.Email,
+						u.CreatedAt.UTC().Format(time.RFC3339Nano),
+						u.UpdatedAt.UTC().Format(time.RFC3339Nano),
+						u.Version,
+					}
+					if !yield(row, nil) {
+						return stopped
+					}
+				}
+				return nil
+			})
+			if err != nil && err != stopped {
+				yield(nil, err)
+			}
+		},
+	}
+}
+
+// userExporter writes an export in one format. Nothing is written until
+// the first page arrives, or the export finishes empty, so an export that
+// fails on its first query still gets a JSON error.
+type userExporter struct {
+	w       http.ResponseWriter
+	format  string
+	started bool
+	json    *json.Encoder
+}
+
+// start sends the headers
+func (e *userExporter) start() {
+	e.started = true
+	contentType := "application/x-ndjson"
+	if e.format == exportCSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	filename := fmt.Sprintf("users-%s.%s", time.Now().UTC().Format("20060102T150405Z"), e.format)
+	e.w.Header().Set("Content-Type", contentType)
+	e.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	e.w.WriteHeader(http.StatusOK)
+}
+
+// Write is where the report package's CSV writer sends the file. It buffers
+// rows, so they reach the client a few kilobytes at a time, each flushed.
+func (e *userExporter) Write(p []byte) (int, error) {
+	if !e.started {
+		e.start()
+	}
+	n, err := e.w.Write(p)
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// page writes users as NDJSON and flushes them to the client
+func (e *userExporter) page(users []User) error {
+	if !e.started {
+		e.start()
+		e.json = json.NewEncoder(e.w)
+	}
+	for _, u := range users {
+		if err := e.json.Encode(u); err != nil {
+			return err
+		}
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// exportUsersHandler handles GET /users/export?format=csv|ndjson, csv when
+// format is absent. The users are streamed a page at a time, and CSV cells
+// a spreadsheet would run as a formula are quoted by the report package.
+// Once the first page is sent the status can't change, so a later failure
+// aborts the response instead, and the client sees a truncated download
+// rather than one that looks complete.
+func (s *server) exportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportCSV
+	}
+	if format != exportCSV && format != exportNDJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("format must be %s or %s", exportCSV, exportNDJSON),
+		})
+		return
+	}
+
+	e := &userExporter{w: w, format: format}
+	var err error
+	if format == exportCSV {
+		// The header row waits in the writer's buffer with the first rows.
+		// The writer isn't closed after a failure, since closing flushes it.
+		var csvWriter report.Writer
+		if csvWriter, err = report.NewWriter(report.CSV, e); err == nil {
+			if err = csvWriter.WriteSheet(exportSheet(r.Context(), s.users)); err == nil {
+				err = csvWriter.Close()
+			}
+		}
+	} else {
+		err = s.users.Export(r.Context(), e.page)
+	}
+	switch {
+	case err != nil && !e.started:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(dbErrorStatus(err))
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Failed to export users",
+			Error:   err.Error(),
+		})
+	case err != nil:
+		log.Printf("Export of users aborted: %v", err)
+		panic(http.ErrAbortHandler)
+	case !e.started:
+		// No users: just the headers
+		e.start()
+	}
+}
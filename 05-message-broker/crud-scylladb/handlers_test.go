@@ -0,0 +1,759 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/scylladb/gocqlx/v2"
+)
+
+// Handler tests: the API served by setupRoutes over the in-memory fake, so
+// they run without a database. The integration tests cover the same
+// routes against ScyllaDB.
+
+// newFakeServer serves a fresh fake repository whose health probe reports
+// a single node
+func newFakeServer(t *testing.T) (*httptest.Server, *memoryUserRepository) {
+	t.Helper()
+	repo := newMemoryUserRepository()
+	s := &server{
+		users: repo,
+		probe: func(context.Context) (clusterHealth, error) {
+			return clusterHealth{Latency: time.Millisecond, ClusterName: "fake", DataCenter: "dc1"}, nil
+		},
+	}
+	srv := httptest.NewServer(setupRoutes(s))
+	t.Cleanup(srv.Close)
+	return srv, repo
+}
+
+// apiCall sends a JSON request and decodes the APIResponse envelope
+func apiCall(t *testing.T, srv *httptest.Server, method, path string, body any) (int, APIResponse) {
+	t.Helper()
+	return apiCallAs(t, srv, "", method, path, body)
+}
+
+// apiCallAs is apiCall on behalf of actor, sent as X-Actor when not empty
+func apiCallAs(t *testing.T, srv *httptest.Server, actor, method, path string, body any) (int, APIResponse) {
+	t.Helper()
+
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("encode request: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, &payload)
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if actor != "" {
+		req.Header.Set(actorHeader, actor)
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var out APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode %s %s response: %v", method, path, err)
+	}
+	return resp.StatusCode, out
+}
+
+// dataUser re-decodes the envelope's Data field as a User
+func dataUser(t *testing.T, resp APIResponse) User {
+	t.Helper()
+	raw, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatalf("encode data: %v", err)
+	}
+	var user User
+	if err := json.Unmarshal(raw, &user); err != nil {
+		t.Fatalf("decode user: %v", err)
+	}
+	return user
+}
+
+func TestCreateUserHandler(t *testing.T) {
+	srv, repo := newFakeServer(t)
+
+	status, resp := apiCall(t, srv, http.MethodPost, "/api/v1/users", CreateUserRequest{Name: "Ada", Email: "ada@example.com"})
+	if status != http.StatusCreated || !resp.Success {
+		t.Fatalf("create: status=%d resp=%+v", status, resp)
+	}
+	created := dataUser(t, resp)
+	if created.ID == "" || created.Version != 1 {
+		t.Fatalf("expected a new ID at version 1, got %+v", created)
+	}
+	if stored, _ := repo.Get(context.Background(), created.ID); stored == nil || stored.Email != "ada@example.com" {
+		t.Fatalf("user not stored: %+v", stored)
+	}
+
+	status, _ = apiCall(t, srv, http.MethodPost, "/api/v1/users", CreateUserRequest{Name: "No Email"})
+	if status != http.StatusBadRequest {
+		t.Fatalf("create without email: status=%d", status)
+	}
+	if users, _ := repo.List(context.Background()); len(users) != 1 {
+		t.Fatalf("an invalid create stored a user: %+v", users)
+	}
+}
+
+func TestGetUserHandlers(t *testing.T) {
+	srv, repo := newFakeServer(t)
+	user := newTestUser("grace")
+	if err := repo.Create(context.Background(), user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users/"+user.ID, nil)
+	if status != http.StatusOK || dataUser(t, resp).Name != "grace" {
+		t.Fatalf("get: status=%d resp=%+v", status, resp)
+	}
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users/missing", nil); status != http.StatusNotFound {
+		t.Fatalf("get missing: status=%d resp=%+v", status, resp)
+	}
+
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users/by-email/"+user.Email, nil); status != http.StatusOK {
+		t.Fatalf("get by email: status=%d resp=%+v", status, resp)
+	}
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users/by-email/nobody@example.com", nil); status != http.StatusNotFound {
+		t.Fatalf("get by unknown email: status=%d resp=%+v", status, resp)
+	}
+
+	status, resp = apiCall(t, srv, http.MethodGet, "/api/v1/users", nil)
+	if list, ok := resp.Data.([]any); status != http.StatusOK || !ok || len(list) != 1 {
+		t.Fatalf("list: status=%d resp=%+v", status, resp)
+	}
+}
+
+func TestUpdateUserHandler(t *testing.T) {
+	srv, repo := newFakeServer(t)
+	user := newTestUser("kim")
+	if err := repo.Create(context.Background(), user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	path := "/api/v1/users/" + user.ID
+
+	t.Run("a partial update keeps the other fields", func(t *testing.T) {
+		status, resp := apiCall(t, srv, http.MethodPut, path, UpdateUserRequest{Name: "Kim Lee", Version: 1})
+		if status != http.StatusOK {
+			t.Fatalf("update: status=%d resp=%+v", status, resp)
+		}
+		if got := dataUser(t, resp); got.Name != "Kim Lee" || got.Email != user.Email || got.Version != 2 {
+			t.Fatalf("got %+v", got)
+		}
+	})
+
+	t.Run("a stale version answers 409 with the current user", func(t *testing.T) {
+		status, resp := apiCall(t, srv, http.MethodPut, path, UpdateUserRequest{Name: "Kim Stale", Version: 1})
+		if status != http.StatusConflict {
+			t.Fatalf("update: status=%d resp=%+v", status, resp)
+		}
+		if current := dataUser(t, resp); current.Name != "Kim Lee" || current.Version != 2 {
+			t.Fatalf("409 should carry the current user, got %+v", current)
+		}
+	})
+
+	t.Run("a missing user is 404", func(t *testing.T) {
+		if status, resp := apiCall(t, srv, http.MethodPut, "/api/v1/users/missing", UpdateUserRequest{Name: "X"}); status != http.StatusNotFound {
+			t.Fatalf("update: status=%d resp=%+v", status, resp)
+		}
+	})
+}
+
+// racingRepository runs race before its next Patch, as a request landing
+// between the handler's read and its write would
+type racingRepository struct {
+	*memoryUserRepository
+	race func()
+}
+
+func (r *racingRepository) Patch(ctx context.Context, previous User, patch UserPatch) (User, error) {
+	if race := r.race; race != nil {
+		r.race = nil
+		race()
+	}
+	return r.memoryUserRepository.Patch(ctx, previous, patch)
+}
+
+func TestPatchUserHandler(t *testing.T) {
+	repo := &racingRepository{memoryUserRepository: newMemoryUserRepository()}
+	srv := httptest.NewServer(setupRoutes(&server{users: repo}))
+	t.Cleanup(srv.Close)
+	user := newTestUser("noor")
+	if err := repo.Create(context.Background(), user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	path := "/api/v1/users/" + user.ID
+
+	t.Run("only the fields sent change", func(t *testing.T) {
+		status, resp := apiCall(t, srv, http.MethodPatch, path, map[string]any{"name": "Noor Ali"})
+		if status != http.StatusOK {
+			t.Fatalf("patch: status=%d resp=%+v", status, resp)
+		}
+		if got := dataUser(t, resp); got.Name != "Noor Ali" || got.Email != user.Email || got.Version != 2 {
+			t.Fatalf("got %+v", got)
+		}
+	})
+
+	t.Run("a change to another field in between is kept", func(t *testing.T) {
+		repo.race = func() {
+			stored, _ := repo.Get(context.Background(), user.ID)
+			moved := *stored
+			moved.Email = "noor.ali@example.com"
+			if err := repo.Update(context.Background(), *stored, &moved); err != nil {
+				t.Errorf("racing Update: %v", err)
+			}
+		}
+		status, resp := apiCall(t, srv, http.MethodPatch, path, map[string]any{"name": "Noor A."})
+		if status != http.StatusOK {
+			t.Fatalf("patch: status=%d resp=%+v", status, resp)
+		}
+		if got := dataUser(t, resp); got.Name != "Noor A." || got.Email != "noor.ali@example.com" || got.Version != 4 {
+			t.Fatalf("the patch should apply on top of the racing update, got %+v", got)
+		}
+	})
+
+	t.Run("a stale version answers 409 with the current user", func(t *testing.T) {
+		status, resp := apiCall(t, srv, http.MethodPatch, path, map[string]any{"name": "Noor Stale", "version": 2})
+		if status != http.StatusConflict {
+			t.Fatalf("patch: status=%d resp=%+v", status, resp)
+		}
+		if current := dataUser(t, resp); current.Name != "Noor A." || current.Version != 4 {
+			t.Fatalf("409 should carry the current user, got %+v", current)
+		}
+	})
+
+	t.Run("bad masks are refused", func(t *testing.T) {
+		for _, body := range []map[string]any{
+			{},
+			{"version": 4},
+			{"name": ""},
+			{"nmae": "typo"},
+			{"created_at": "2020-01-01T00:00:00Z"},
+		} {
+			if status, resp := apiCall(t, srv, http.MethodPatch, path, body); status != http.StatusBadRequest || resp.Success {
+				t.Errorf("patch %v: status=%d resp=%+v", body, status, resp)
+			}
+		}
+		if got, _ := repo.Get(context.Background(), user.ID); got.Version != 4 {
+			t.Fatalf("a refused patch was written: %+v", got)
+		}
+	})
+
+	t.Run("a missing user is 404", func(t *testing.T) {
+		if status, resp := apiCall(t, srv, http.MethodPatch, "/api/v1/users/missing", map[string]any{"name": "X"}); status != http.StatusNotFound {
+			t.Fatalf("patch: status=%d resp=%+v", status, resp)
+		}
+	})
+
+	events, err := repo.Events(context.Background(), user.ID)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("want an updated event per applied patch, got %d events, err %v", len(events), err)
+	}
+}
+
+func TestDeleteUserHandler(t *testing.T) {
+	srv, repo := newFakeServer(t)
+	user := newTestUser("mia")
+	if err := repo.Create(context.Background(), user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if status, resp := apiCall(t, srv, http.MethodDelete, "/api/v1/users/"+user.ID, nil); status != http.StatusOK {
+		t.Fatalf("delete: status=%d resp=%+v", status, resp)
+	}
+	if got, _ := repo.Get(context.Background(), user.ID); got != nil {
+		t.Fatalf("user still stored: %+v", got)
+	}
+	if status, resp := apiCall(t, srv, http.MethodDelete, "/api/v1/users/"+user.ID, nil); status != http.StatusNotFound {
+		t.Fatalf("second delete: status=%d resp=%+v", status, resp)
+	}
+}
+
+func TestBulkCreateUsersHandler(t *testing.T) {
+	srv, repo := newFakeServer(t)
+
+	bulk := func(users ...CreateUserRequest) (int, BulkCreateResult) {
+		t.Helper()
+		status, resp := apiCall(t, srv, http.MethodPost, "/api/v1/users/bulk", BulkCreateUsersRequest{Users: users})
+		var result BulkCreateResult
+		raw, _ := json.Marshal(resp.Data)
+		json.Unmarshal(raw, &result)
+		return status, result
+	}
+
+	if status, result := bulk(CreateUserRequest{Name: "A", Email: "a@example.com"}, CreateUserRequest{Name: "B", Email: "b@example.com"}); status != http.StatusCreated || result.Created != 2 {
+		t.Fatalf("all valid: status=%d result=%+v", status, result)
+	}
+	status, result := bulk(CreateUserRequest{Name: "C", Email: "c@example.com"}, CreateUserRequest{Name: "No Email"})
+	if status != http.StatusMultiStatus || result.Created != 1 || result.Failed != 1 || result.Items[1].Error == "" {
+		t.Fatalf("one invalid: status=%d result=%+v", status, result)
+	}
+	if status, _ := bulk(); status != http.StatusBadRequest {
+		t.Fatalf("empty: status=%d", status)
+	}
+	if users, _ := repo.List(context.Background()); len(users) != 3 {
+		t.Fatalf("expected 3 stored users, got %d", len(users))
+	}
+}
+
+func TestUserEventsHandler(t *testing.T) {
+	srv, repo := newFakeServer(t)
+
+	status, resp := apiCallAs(t, srv, "alice", http.MethodPost, "/api/v1/users", CreateUserRequest{Name: "Ann", Email: "ann@example.com"})
+	if status != http.StatusCreated {
+		t.Fatalf("create: status=%d resp=%+v", status, resp)
+	}
+	path := "/api/v1/users/" + dataUser(t, resp).ID
+	if status, resp := apiCallAs(t, srv, "bob", http.MethodPut, path, UpdateUserRequest{Name: "Anna"}); status != http.StatusOK {
+		t.Fatalf("update: status=%d resp=%+v", status, resp)
+	}
+	if status, resp := apiCall(t, srv, http.MethodDelete, path, nil); status != http.StatusOK {
+		t.Fatalf("delete: status=%d resp=%+v", status, resp)
+	}
+
+	// The history outlives the user
+	status, resp = apiCall(t, srv, http.MethodGet, path+"/events", nil)
+	var events []struct {
+		Action string                 `json:"action"`
+		Actor  string                 `json:"actor"`
+		Diff   map[string]fieldChange `json:"diff"`
+	}
+	raw, _ := json.Marshal(resp.Data)
+	if err := json.Unmarshal(raw, &events); status != http.StatusOK || err != nil || len(events) != 3 {
+		t.Fatalf("events: status=%d resp=%+v err=%v", status, resp, err)
+	}
+	for i, want := range []struct{ action, actor string }{{eventCreated, "alice"}, {eventUpdated, "bob"}, {eventDeleted, "anonymous"}} {
+		if events[i].Action != want.action || events[i].Actor != want.actor {
+			t.Fatalf("event %d: got %+v, want %s by %s", i, events[i], want.action, want.actor)
+		}
+	}
+	if created := events[0].Diff["email"]; created.Old != nil || created.New == nil || *created.New != "ann@example.com" {
+		t.Fatalf("created event should hold the new email only: %+v", events[0].Diff)
+	}
+	if name, ok := events[1].Diff["name"]; len(events[1].Diff) != 1 || !ok || *name.Old != "Ann" || *name.New != "Anna" {
+		t.Fatalf("updated event should hold the name change only: %+v", events[1].Diff)
+	}
+	if deleted := events[2].Diff["name"]; deleted.New != nil || deleted.Old == nil || *deleted.Old != "Anna" {
+		t.Fatalf("deleted event should hold the old name only: %+v", events[2].Diff)
+	}
+
+	// A user from before the history has none, an unknown ID is 404
+	legacy := newTestUser("legacy")
+	if err := repo.Create(context.Background(), legacy); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	status, resp = apiCall(t, srv, http.MethodGet, "/api/v1/users/"+legacy.ID+"/events", nil)
+	if list, ok := resp.Data.([]any); status != http.StatusOK || !ok || len(list) != 0 {
+		t.Fatalf("legacy user events: status=%d resp=%+v", status, resp)
+	}
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users/missing/events", nil); status != http.StatusNotFound {
+		t.Fatalf("unknown user events: status=%d resp=%+v", status, resp)
+	}
+}
+
+// download GETs path and returns the status, headers and body as is
+func download(t *testing.T, srv *httptest.Server, path string) (int, http.Header, string) {
+	t.Helper()
+	resp, err := srv.Client().Get(srv.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return resp.StatusCode, resp.Header, string(body)
+}
+
+func TestExportUsersHandler(t *testing.T) {
+	srv, repo := newFakeServer(t)
+	previous := exportPageSize
+	exportPageSize = 2
+	t.Cleanup(func() { exportPageSize = previous })
+
+	status, header, body := download(t, srv, "/api/v1/users/export")
+	if status != http.StatusOK || body != strings.Join(exportColumns, ",")+"\n" {
+		t.Fatalf("empty export: status=%d body=%q", status, body)
+	}
+
+	users := []User{newTestUser("ada"), newTestUser("grace"), newTestUser("linus"), newTestUser("mallory")}
+	users[1].Name = "Hopper, Grace"                 // needs quoting in CSV
+	users[3].Name = `=HYPERLINK("http://evil","x")` // a spreadsheet would run it
+	for _, u := range users {
+		if err := repo.Create(context.Background(), u); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		status, header, body = download(t, srv, "/api/v1/users/export?format=csv")
+		if status != http.StatusOK || header.Get("Content-Type") != "text/csv; charset=utf-8" {
+			t.Fatalf("status=%d Content-Type=%q", status, header.Get("Content-Type"))
+		}
+		if cd := header.Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment; filename=") || !strings.HasSuffix(cd, `.csv"`) {
+			t.Fatalf("Content-Disposition %q", cd)
+		}
+		rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+		if err != nil {
+			t.Fatalf("parse CSV: %v", err)
+		}
+		if len(rows) != len(users)+1 || !slices.Equal(rows[0], exportColumns) {
+			t.Fatalf("rows %q", rows)
+		}
+		names := make(map[string]bool)
+		for _, row := range rows[1:] {
+			names[row[1]] = true
+		}
+		if !names["Hopper, Grace"] {
+			t.Fatalf("quoted name lost: %q", rows)
+		}
+		if !names["'"+users[3].Name] {
+			t.Fatalf("formula not escaped: %q", rows)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		status, header, body = download(t, srv, "/api/v1/users/export?format=ndjson")
+		if status != http.StatusOK || header.Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("status=%d Content-Type=%q", status, header.Get("Content-Type"))
+		}
+		if cd := header.Get("Content-Disposition"); !strings.HasSuffix(cd, `.ndjson"`) {
+			t.Fatalf("Content-Disposition %q", cd)
+		}
+		dec := json.NewDecoder(strings.NewReader(body))
+		var got []User
+		for dec.More() {
+			var u User
+			if err := dec.Decode(&u); err != nil {
+				t.Fatalf("decode line: %v", err)
+			}
+			got = append(got, u)
+		}
+		if len(got) != len(users) {
+			t.Fatalf("exported %d users, want %d", len(got), len(users))
+		}
+	})
+
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users/export?format=xml", nil); status != http.StatusBadRequest {
+		t.Fatalf("unknown format: status=%d resp=%+v", status, resp)
+	}
+	repo.fail = context.DeadlineExceeded
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users/export", nil); status != http.StatusGatewayTimeout {
+		t.Fatalf("export failing on the first page: status=%d resp=%+v", status, resp)
+	}
+}
+
+func TestHandlerDatabaseErrors(t *testing.T) {
+	srv, repo := newFakeServer(t)
+
+	repo.fail = context.DeadlineExceeded
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users", nil); status != http.StatusGatewayTimeout {
+		t.Fatalf("timed out list: status=%d resp=%+v", status, resp)
+	}
+	repo.fail = errors.New("connection refused")
+	if status, resp := apiCall(t, srv, http.MethodPost, "/api/v1/users", CreateUserRequest{Name: "Ada", Email: "ada@example.com"}); status != http.StatusInternalServerError {
+		t.Fatalf("failed create: status=%d resp=%+v", status, resp)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	repo := newMemoryUserRepository()
+	probeErr := error(nil)
+	s := &server{
+		users: repo,
+		probe: func(context.Context) (clusterHealth, error) {
+			return clusterHealth{Latency: 2 * time.Millisecond, Peers: 2, ClusterName: "fake"}, probeErr
+		},
+	}
+	srv := httptest.NewServer(setupRoutes(s))
+	t.Cleanup(srv.Close)
+
+	status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/health", nil)
+	health, _ := resp.Data.(map[string]any)
+	if status != http.StatusOK || health["peers"] != float64(2) || health["latency_ms"] != float64(2) {
+		t.Fatalf("healthy: status=%d resp=%+v", status, resp)
+	}
+
+	probeErr = errors.New("no hosts available")
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/health", nil); status != http.StatusServiceUnavailable || resp.Success {
+		t.Fatalf("unhealthy: status=%d resp=%+v", status, resp)
+	}
+}
+
+func TestQueriesAreTaggedWithTheirHandler(t *testing.T) {
+	var tagged string
+	s := &server{
+		users: newMemoryUserRepository(),
+		probe: func(ctx context.Context) (clusterHealth, error) {
+			tagged = handlerName(ctx)
+			return clusterHealth{}, nil
+		},
+	}
+	router := setupRoutes(s)
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/health", nil); status != http.StatusOK || tagged != "health" {
+		t.Fatalf("health: status=%d resp=%+v, probe tagged %q", status, resp, tagged)
+	}
+	if got := handlerName(context.Background()); got != "none" {
+		t.Fatalf("untagged context: got %q, want none", got)
+	}
+
+	// An unnamed route's queries would be counted under none
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if path, _ := route.GetPathTemplate(); strings.HasPrefix(path, "/api/v1/") && route.GetName() == "" {
+			t.Errorf("route %s has no name", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk routes: %v", err)
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	previous := slowQueryThreshold
+	slowQueryThreshold = 50 * time.Millisecond
+	t.Cleanup(func() { slowQueryThreshold = previous })
+	slowCount := func(handler string) uint64 {
+		return counterValue(metrics.slow.WithLabelValues(handler))
+	}
+
+	s := newInstrumentedSession(gocqlx.Session{})
+	ctx := withHandler(context.Background(), "get_user")
+	start := time.Now()
+	before := slowCount("get_user")
+	s.ObserveQuery(ctx, gocql.ObservedQuery{Statement: "SELECT * FROM users WHERE id=?", Start: start, End: start.Add(10 * time.Millisecond)})
+	if logged.Len() != 0 || slowCount("get_user") != before {
+		t.Fatalf("a fast query was reported as slow: %q", logged.String())
+	}
+
+	s.ObserveQuery(ctx, gocql.ObservedQuery{Statement: "SELECT * FROM users WHERE id=?", Start: start, End: start.Add(120 * time.Millisecond), Attempt: 1})
+	line := logged.String()
+	for _, want := range []string{"Slow query: 120ms", "handler get_user", "attempt 1", "SELECT * FROM users WHERE id=?"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("slow query log %q is missing %q", line, want)
+		}
+	}
+	if got := slowCount("get_user"); got != before+1 {
+		t.Fatalf("get_user slow queries went from %d to %d, want +1", before, got)
+	}
+
+	logged.Reset()
+	s.ObserveBatch(context.Background(), gocql.ObservedBatch{
+		Statements: []string{"INSERT INTO users_by_email", "INSERT INTO users_by_email"},
+		Start:      start,
+		End:        start.Add(time.Second),
+		Err:        errors.New("write timeout"),
+	})
+	if line := logged.String(); !strings.Contains(line, "handler none") || !strings.Contains(line, "(write timeout): BATCH of 2: INSERT INTO users_by_email") {
+		t.Fatalf("slow batch log: %q", line)
+	}
+}
+
+func TestTenantRouting(t *testing.T) {
+	repos := make(map[string]*memoryUserRepository) // by keyspace
+	var provisioned []string
+	failNext := false
+	tenants := &tenantRegistry{
+		keyspace: "example",
+		max:      2,
+		tenants:  make(map[string]*tenant),
+		provision: func(keyspace string) (UserRepository, func(), error) {
+			provisioned = append(provisioned, keyspace)
+			if failNext {
+				failNext = false
+				return nil, nil, errors.New("keyspace creation timed out")
+			}
+			repos[keyspace] = newMemoryUserRepository()
+			return repos[keyspace], func() {}, nil
+		},
+	}
+	srv := httptest.NewServer(setupRoutes(&server{
+		users:   tenantUsers{},
+		tenants: tenants,
+		probe:   func(context.Context) (clusterHealth, error) { return clusterHealth{}, nil },
+	}))
+	t.Cleanup(srv.Close)
+	call := func(tenant, method, path string, body any) (int, APIResponse) {
+		t.Helper()
+		var payload bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&payload).Encode(body)
+		}
+		req, _ := http.NewRequest(method, srv.URL+path, &payload)
+		if tenant != "" {
+			req.Header.Set(tenantHeader, tenant)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var out APIResponse
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	// Each tenant sees only its own users
+	status, resp := call("acme", http.MethodPost, "/api/v1/users", CreateUserRequest{Name: "Ann", Email: "ann@acme.test"})
+	if status != http.StatusCreated {
+		t.Fatalf("create for acme: status=%d resp=%+v", status, resp)
+	}
+	path := "/api/v1/users/" + dataUser(t, resp).ID
+	if status, _ := call("acme", http.MethodGet, path, nil); status != http.StatusOK {
+		t.Fatalf("get for acme: status=%d", status)
+	}
+	if status, _ := call("globex", http.MethodGet, path, nil); status != http.StatusNotFound {
+		t.Fatalf("get acme's user as globex: status=%d, want 404", status)
+	}
+	if users, _ := repos["example_acme"].List(context.Background()); len(users) != 1 {
+		t.Fatalf("example_acme holds %d users, want 1", len(users))
+	}
+	if !slices.Equal(provisioned, []string{"example_acme", "example_globex"}) {
+		t.Fatalf("provisioned %v, want each tenant once", provisioned)
+	}
+
+	// The health check needs no tenant, the users API does
+	if status, _ := call("", http.MethodGet, "/api/v1/health", nil); status != http.StatusOK {
+		t.Fatalf("health without a tenant: status=%d", status)
+	}
+	for _, tenant := range []string{"", "Acme", "acme-corp", "../system", strings.Repeat("a", 41)} {
+		if status, resp := call(tenant, http.MethodGet, "/api/v1/users", nil); status != http.StatusBadRequest {
+			t.Errorf("tenant %q: status=%d resp=%+v, want 400", tenant, status, resp)
+		}
+	}
+
+	// Beyond the limit new tenants are refused, existing ones still served
+	if status, _ := call("initech", http.MethodGet, "/api/v1/users", nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("third tenant: status=%d, want 503", status)
+	}
+	if status, _ := call("acme", http.MethodGet, "/api/v1/users", nil); status != http.StatusOK {
+		t.Fatalf("acme after the limit: status=%d", status)
+	}
+
+	// A failed provisioning is retried by the next request
+	tenants.max = 3
+	failNext = true
+	if status, _ := call("initech", http.MethodGet, "/api/v1/users", nil); status != http.StatusInternalServerError {
+		t.Fatalf("failed provisioning: status=%d, want 500", status)
+	}
+	if status, _ := call("initech", http.MethodGet, "/api/v1/users", nil); status != http.StatusOK {
+		t.Fatalf("retried provisioning: status=%d", status)
+	}
+}
+
+func TestRequestConsistency(t *testing.T) {
+	var asked gocql.Consistency
+	var set bool
+	repo := newMemoryUserRepository()
+	srv := httptest.NewServer(setupRoutes(&server{
+		users: repo,
+		probe: func(ctx context.Context) (clusterHealth, error) {
+			asked, set = consistencyFrom(ctx)
+			return clusterHealth{}, nil
+		},
+	}))
+	t.Cleanup(srv.Close)
+	call := func(level string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/health", nil)
+		if level != "" {
+			req.Header.Set(consistencyHeader, level)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("health at %q: %v", level, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Without the header queries keep the configured level, which is echoed
+	resp := call("")
+	if resp.StatusCode != http.StatusOK || set || resp.Header.Get(consistencyHeader) != defaultConsistency.String() {
+		t.Fatalf("no header: status=%d %s=%q, context set=%v",
+			resp.StatusCode, consistencyHeader, resp.Header.Get(consistencyHeader), set)
+	}
+
+	resp = call(" local_one")
+	if resp.StatusCode != http.StatusOK || !set || asked != gocql.LocalOne || resp.Header.Get(consistencyHeader) != "LOCAL_ONE" {
+		t.Fatalf("local_one: status=%d %s=%q, context %v %v",
+			resp.StatusCode, consistencyHeader, resp.Header.Get(consistencyHeader), asked, set)
+	}
+
+	// Levels that don't apply to every query, and nonsense, are refused
+	for _, level := range []string{"ANY", "SERIAL", "LOCAL_SERIAL", "MOST", "1"} {
+		if resp := call(level); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status=%d, want 400", level, resp.StatusCode)
+		}
+	}
+
+	// Too few replicas up for the level asked is the cluster's fault, not ours
+	repo.fail = &gocql.RequestErrUnavailable{Consistency: gocql.All, Required: 3, Alive: 2}
+	if status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users", nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("unavailable list: status=%d resp=%+v", status, resp)
+	}
+}
+
+// counterValue reads a counter's current value
+func counterValue(c prometheus.Counter) uint64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		panic(err)
+	}
+	return uint64(m.GetCounter().GetValue())
+}
+
+func TestMetricsHandler(t *testing.T) {
+	start := time.Now()
+	timedOut := error(context.DeadlineExceeded)
+	observeOperation("metrics_test", start.Add(-30*time.Millisecond), &timedOut)
+	metrics.ObserveQuery(context.Background(), gocql.ObservedQuery{
+		Start: start, End: start.Add(3 * time.Millisecond), Attempt: 1, Err: &gocql.RequestErrReadTimeout{},
+	})
+
+	rec := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`scylla_operations_total{operation="metrics_test",outcome="timeout"} 1`,
+		`scylla_operation_duration_seconds_bucket{operation="metrics_test",outcome="timeout",le="0.025"} 0`,
+		`scylla_operation_duration_seconds_bucket{operation="metrics_test",outcome="timeout",le="0.05"} 1`,
+		`scylla_query_duration_seconds_count{outcome="error"}`,
+		`scylla_query_errors_total{type="read_timeout"}`,
+		"# TYPE scylla_query_retries_total counter",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics is missing %s:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// clusterHealth is what the health probe learned about the node that
+// answered it
+type clusterHealth struct {
+	Latency        time.Duration
+	Peers          int
+	ClusterName    string `db:"cluster_name"`
+	DataCenter     string `db:"data_center"`
+	ReleaseVersion string `db:"release_version"`
+}
+
+// probeDatabase reads system.local and system.peers, the cheapest queries
+// that still need a live node: both are node-local tables, so they don't
+// depend on the replicas of the users keyspace. Latency is the time both
+// took, as the client sees it.
+func probeDatabase(ctx context.Context, session *instrumentedSession) (_ clusterHealth, err error) {
+	defer observeOperation("health_probe", time.Now(), &err)
+	start := time.Now()
+
+	var health clusterHealth
+	q := session.Query("SELECT cluster_name, data_center, release_version FROM system.local WHERE key = 'local'", nil).WithContext(ctx)
+	if err := q.GetRelease(&health); err != nil {
+		return clusterHealth{}, fmt.Errorf("failed to read system.local: %w", err)
+	}
+
+	var peers []struct {
+		Peer net.IP `db:"peer"`
+	}
+	q = session.Query("SELECT peer FROM system.peers", nil).WithContext(ctx)
+	if err := q.SelectRelease(&peers); err != nil {
+		return clusterHealth{}, fmt.Errorf("failed to read system.peers: %w", err)
+	}
+	health.Peers = len(peers)
+	health.Latency = time.Since(start)
+	return health, nil
+}
+
+// healthHandler handles GET /health. It probes the database, so a 200 means
+// Scylla answered within the read timeout; otherwise it returns 503 Service
+// Unavailable, which load balancers take as a reason to stop routing here.
+func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), readTimeout)
+	defer cancel()
+
+	health, err := s.probe(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Database is unreachable",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	response := APIResponse{
+		Success: true,
+		Message: "API is healthy",
+		Data: map[string]interface{}{
+			"timestamp":       time.Now(),
+			"version":         "1.0.0",
+			"database":        "ScyllaDB",
+			"latency_ms":      float64(health.Latency.Microseconds()) / 1000,
+			"peers":           health.Peers,
+			"cluster_name":    health.ClusterName,
+			"data_center":     health.DataCenter,
+			"release_version": health.ReleaseVersion,
+		},
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,731 @@
+//go:build integration
+
+// Integration tests against a real ScyllaDB started with testcontainers.
+// Run them with:
+//
+//	go test -tags integration -v ./...
+//
+// Docker must be running. The container is started once in TestMain and
+// always terminated, even when a test fails. TestMain also compares the
+// migrated schema with the table metadata the queries are built from, and
+// runs no test at all when they differ.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+	"github.com/scylladb/gocqlx/v2"
+	"github.com/scylladb/gocqlx/v2/table"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// scyllaImage is pinned so test runs are reproducible
+const scyllaImage = "scylladb/scylla:5.4"
+
+// The session to the test keyspace, and the repository on it
+var (
+	testSession gocqlx.Session
+	testUsers   ScyllaUserRepository
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegration(m))
+}
+
+// runIntegration starts ScyllaDB, runs the tests and tears everything down.
+// It is split from TestMain so the deferred cleanup runs before os.Exit.
+func runIntegration(m *testing.M) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        scyllaImage,
+			ExposedPorts: []string{"9042/tcp"},
+			Cmd:          []string{"--smp", "1", "--memory", "512M", "--overprovisioned", "1", "--developer-mode", "1"},
+			WaitingFor: wait.ForAll(
+				wait.ForListeningPort("9042/tcp"),
+				wait.ForLog("Starting listening for CQL clients"),
+			).WithDeadline(3 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		log.Printf("failed to start ScyllaDB container: %v", err)
+		return 1
+	}
+	defer func() {
+		if err := container.Terminate(context.Background()); err != nil {
+			log.Printf("failed to terminate ScyllaDB container: %v", err)
+		}
+	}()
+
+	session, err := connectTestCluster(ctx, container)
+	if err != nil {
+		log.Printf("failed to connect to ScyllaDB: %v", err)
+		return 1
+	}
+	defer session.Close()
+
+	// Drift between the migrations and the code would fail most tests in
+	// confusing ways, so report it alone
+	if err := checkSchema(session, KeyspaceName); err != nil {
+		log.Printf("the migrated schema does not match the code:\n%v", err)
+		return 1
+	}
+
+	testSession, testUsers = session, NewScyllaUserRepository(session)
+	return m.Run()
+}
+
+// connectTestCluster creates the keyspace, applies the migrations and
+// returns a session bound to the keyspace.
+// Scylla advertises its container IP, so every peer address is translated
+// back to the port mapped on the host.
+func connectTestCluster(ctx context.Context, container testcontainers.Container) (gocqlx.Session, error) {
+	host, err := container.Host(ctx)
+	if err != nil {
+		return gocqlx.Session{}, err
+	}
+	port, err := container.MappedPort(ctx, "9042/tcp")
+	if err != nil {
+		return gocqlx.Session{}, err
+	}
+	hostIPs, err := net.LookupIP(host)
+	if err != nil || len(hostIPs) == 0 {
+		return gocqlx.Session{}, fmt.Errorf("resolve container host %s: %v", host, err)
+	}
+
+	cluster := gocql.NewCluster(net.JoinHostPort(host, port.Port()))
+	cluster.Consistency = gocql.LocalQuorum
+	cluster.ConnectTimeout = 10 * time.Second
+	cluster.Timeout = 10 * time.Second
+	cluster.AddressTranslator = gocql.AddressTranslatorFunc(func(net.IP, int) (net.IP, int) {
+		return hostIPs[0], int(port.Num())
+	})
+	cluster.QueryObserver = metrics
+
+	session, err := gocqlx.WrapSession(cluster.CreateSession())
+	if err != nil {
+		return gocqlx.Session{}, err
+	}
+	if err := createKeyspace(session, defaultConfig()); err != nil {
+		session.Close()
+		return gocqlx.Session{}, err
+	}
+	session.Close()
+
+	cluster.Keyspace = KeyspaceName
+	session, err = gocqlx.WrapSession(cluster.CreateSession())
+	if err != nil {
+		return gocqlx.Session{}, err
+	}
+	if _, err := migrateUp(session, 0); err != nil {
+		session.Close()
+		return gocqlx.Session{}, err
+	}
+	return session, nil
+}
+
+// checkSchema compares every table the code queries with the columns the
+// migrations created in keyspace: each column of the table's metadata must
+// exist with the same role, partition key, clustering or regular, and the
+// table may have no column the metadata lacks.
+func checkSchema(session gocqlx.Session, keyspace string) error {
+	var errs []error
+	for _, t := range []*table.Table{userTable, usersByEmailTable, userEventsTable, schemaMigrationsTable} {
+		meta := t.Metadata()
+		kinds := make(map[string]string) // column name to kind
+		iter := session.Query(`SELECT column_name, kind FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ?`, nil).
+			Bind(keyspace, meta.Name).Iter()
+		var name, kind string
+		for iter.Scan(&name, &kind) {
+			kinds[name] = kind
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("read the columns of %s: %w", meta.Name, err)
+		}
+		if len(kinds) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no such table", meta.Name))
+			continue
+		}
+
+		for _, column := range meta.Columns {
+			want := "regular"
+			if slices.Contains(meta.PartKey, column) {
+				want = "partition_key"
+			} else if slices.Contains(meta.SortKey, column) {
+				want = "clustering"
+			}
+			got, ok := kinds[column]
+			switch {
+			case !ok:
+				errs = append(errs, fmt.Errorf("%s.%s: no such column", meta.Name, column))
+			case got != want:
+				errs = append(errs, fmt.Errorf("%s.%s: is %s, the code expects %s", meta.Name, column, got, want))
+			}
+		}
+		for _, column := range slices.Sorted(maps.Keys(kinds)) {
+			if !slices.Contains(meta.Columns, column) {
+				errs = append(errs, fmt.Errorf("%s.%s: not in the code's metadata", meta.Name, column))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resetUsers empties the users, users_by_email and user_events tables
+// before and after a test, so tests don't see each other's rows regardless
+// of order
+func resetUsers(t *testing.T) {
+	t.Helper()
+	truncate := func() {
+		for _, name := range []string{TableName, EmailTableName, EventTableName} {
+			if err := testSession.ExecStmt("TRUNCATE " + name); err != nil {
+				t.Fatalf("truncate %s: %v", name, err)
+			}
+		}
+	}
+	truncate()
+	t.Cleanup(truncate)
+}
+
+// Repository contract: ScyllaUserRepository behaves as UserRepository
+// promises, like the fake the handler tests use
+
+func TestUserRepositoryContract(t *testing.T) {
+	resetUsers(t)
+	testUserRepositoryContract(t, testUsers, resetUsers)
+}
+
+// Email lookups: users_by_email follows every write to users
+
+// emailLookup returns the IDs stored under an email in users_by_email
+func emailLookup(t *testing.T, email string) []string {
+	t.Helper()
+	users, err := testUsers.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatalf("GetByEmail(%q): %v", email, err)
+	}
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	return ids
+}
+
+func TestEmailLookup(t *testing.T) {
+	resetUsers(t)
+
+	t.Run("create indexes the email", func(t *testing.T) {
+		user := newTestUser("frank")
+		if err := testUsers.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		users, err := testUsers.GetByEmail(context.Background(), user.Email)
+		if err != nil || len(users) != 1 {
+			t.Fatalf("GetByEmail: users=%v err=%v", users, err)
+		}
+		if got := users[0]; got.ID != user.ID || got.Name != user.Name || !got.CreatedAt.Equal(user.CreatedAt) {
+			t.Fatalf("got %+v, want %+v", got, user)
+		}
+	})
+
+	t.Run("update moves the lookup row to the new email", func(t *testing.T) {
+		user := newTestUser("grace")
+		if err := testUsers.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		updated := user
+		updated.Name = "Grace Hopper"
+		updated.Email = "hopper@example.com"
+		if err := testUsers.Update(context.Background(), user, &updated); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if ids := emailLookup(t, user.Email); len(ids) != 0 {
+			t.Fatalf("old email still finds %v", ids)
+		}
+		users, err := testUsers.GetByEmail(context.Background(), updated.Email)
+		if err != nil || len(users) != 1 || users[0].Name != "Grace Hopper" {
+			t.Fatalf("new email: users=%v err=%v", users, err)
+		}
+	})
+
+	t.Run("a shared email finds every user, and delete removes only one", func(t *testing.T) {
+		first, second := newTestUser("heidi"), newTestUser("heidi")
+		for _, u := range []User{first, second} {
+			if err := testUsers.Create(context.Background(), u); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		if ids := emailLookup(t, first.Email); len(ids) != 2 {
+			t.Fatalf("expected both users, got %v", ids)
+		}
+		if err := testUsers.Delete(context.Background(), first); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if ids := emailLookup(t, first.Email); len(ids) != 1 || ids[0] != second.ID {
+			t.Fatalf("expected only %s left, got %v", second.ID, ids)
+		}
+	})
+
+	t.Run("reindex backfills users written without a lookup row", func(t *testing.T) {
+		user := newTestUser("ivan")
+		if err := testSession.Query(userTable.Insert()).BindStruct(user).ExecRelease(); err != nil {
+			t.Fatalf("insert user: %v", err)
+		}
+		if ids := emailLookup(t, user.Email); len(ids) != 0 {
+			t.Fatalf("expected no lookup row yet, got %v", ids)
+		}
+		if _, err := testUsers.reindexEmails(context.Background()); err != nil {
+			t.Fatalf("reindexEmails: %v", err)
+		}
+		if ids := emailLookup(t, user.Email); len(ids) != 1 || ids[0] != user.ID {
+			t.Fatalf("after reindex got %v", ids)
+		}
+	})
+}
+
+// Optimistic concurrency: writes to users are lightweight transactions
+
+func TestOptimisticConcurrency(t *testing.T) {
+	resetUsers(t)
+
+	t.Run("an update based on a stale read is refused", func(t *testing.T) {
+		user := newTestUser("kim")
+		if err := testUsers.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		first, second := user, user
+		first.Name = "Kim First"
+		second.Name = "Kim Second"
+		if err := testUsers.Update(context.Background(), user, &first); err != nil {
+			t.Fatalf("first update: %v", err)
+		}
+		if err := testUsers.Update(context.Background(), user, &second); !errors.Is(err, errVersionConflict) {
+			t.Fatalf("second update from the same read: got %v, want errVersionConflict", err)
+		}
+		got, err := testUsers.Get(context.Background(), user.ID)
+		if err != nil || got == nil || got.Name != "Kim First" || got.Version != 2 {
+			t.Fatalf("expected the first update to stand: user=%v err=%v", got, err)
+		}
+	})
+
+	t.Run("creating an existing ID is refused", func(t *testing.T) {
+		user := newTestUser("lee")
+		if err := testUsers.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		clash := user
+		clash.Name = "Someone Else"
+		if err := testUsers.Create(context.Background(), clash); !errors.Is(err, errUserExists) {
+			t.Fatalf("got %v, want errUserExists", err)
+		}
+		if got, err := testUsers.Get(context.Background(), user.ID); err != nil || got == nil || got.Name != user.Name {
+			t.Fatalf("original user overwritten: user=%v err=%v", got, err)
+		}
+	})
+
+	t.Run("updating a deleted user is a conflict", func(t *testing.T) {
+		user := newTestUser("mia")
+		if err := testUsers.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := testUsers.Delete(context.Background(), user); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		updated := user
+		if err := testUsers.Update(context.Background(), user, &updated); !errors.Is(err, errVersionConflict) {
+			t.Fatalf("got %v, want errVersionConflict", err)
+		}
+		if got, err := testUsers.Get(context.Background(), user.ID); err != nil || got != nil {
+			t.Fatalf("update resurrected the user: user=%v err=%v", got, err)
+		}
+	})
+
+	t.Run("users written before versioning can be updated", func(t *testing.T) {
+		user := newTestUser("ned")
+		stmt := "INSERT INTO users (id, name, email, created_at) VALUES (?, ?, ?, ?)"
+		if err := testSession.Session.Query(stmt, user.ID, user.Name, user.Email, user.CreatedAt).Exec(); err != nil {
+			t.Fatalf("insert unversioned user: %v", err)
+		}
+		legacy, err := testUsers.Get(context.Background(), user.ID)
+		if err != nil || legacy == nil || legacy.Version != 0 {
+			t.Fatalf("expected version 0: user=%v err=%v", legacy, err)
+		}
+		updated := *legacy
+		updated.Name = "Ned Stark"
+		if err := testUsers.Update(context.Background(), *legacy, &updated); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if got, err := testUsers.Get(context.Background(), user.ID); err != nil || got == nil || got.Version != 1 {
+			t.Fatalf("expected version 1: user=%v err=%v", got, err)
+		}
+	})
+
+	t.Run("PUT with a stale version answers 409 with the current user", func(t *testing.T) {
+		srv := httptest.NewServer(setupRoutes(newServer(testSession)))
+		t.Cleanup(srv.Close)
+
+		status, resp := apiCall(t, srv, http.MethodPost, "/api/v1/users", CreateUserRequest{Name: "Olga", Email: "olga@example.com"})
+		if status != http.StatusCreated {
+			t.Fatalf("create: status=%d resp=%+v", status, resp)
+		}
+		created := dataUser(t, resp)
+		path := "/api/v1/users/" + created.ID
+
+		status, resp = apiCall(t, srv, http.MethodPut, path, UpdateUserRequest{Name: "Olga B", Version: created.Version})
+		if status != http.StatusOK || dataUser(t, resp).Version != created.Version+1 {
+			t.Fatalf("update at the current version: status=%d resp=%+v", status, resp)
+		}
+
+		status, resp = apiCall(t, srv, http.MethodPut, path, UpdateUserRequest{Name: "Olga C", Version: created.Version})
+		if status != http.StatusConflict {
+			t.Fatalf("update at a stale version: status=%d resp=%+v", status, resp)
+		}
+		if current := dataUser(t, resp); current.Name != "Olga B" || current.Version != created.Version+1 {
+			t.Fatalf("409 should carry the current user, got %+v", current)
+		}
+	})
+
+	if got := operationCount("update_user", outcomeConflict); got == 0 {
+		t.Errorf("expected update_user conflicts at /metrics")
+	}
+}
+
+// Migrations: the embedded schema can be reverted and reapplied
+
+func TestMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	latest := migrations[len(migrations)-1]
+
+	t.Run("every migration is applied once", func(t *testing.T) {
+		done, err := migrateUp(testSession, 0)
+		if err != nil || len(done) != 0 {
+			t.Fatalf("second migrateUp applied %v, err=%v", done, err)
+		}
+		applied, err := appliedMigrations(testSession)
+		if err != nil {
+			t.Fatalf("appliedMigrations: %v", err)
+		}
+		for _, m := range migrations {
+			if row, ok := applied[m.Version]; !ok || row.Checksum != m.checksum() {
+				t.Fatalf("migration %04d not recorded correctly: %+v", m.Version, row)
+			}
+		}
+	})
+
+	t.Run("down reverts the latest migration and up reapplies it", func(t *testing.T) {
+		done, err := migrateDown(testSession, 1)
+		if err != nil || len(done) != 1 || done[0].Version != latest.Version {
+			t.Fatalf("migrateDown: done=%v err=%v", done, err)
+		}
+		if applied, err := appliedMigrations(testSession); err != nil || applied[latest.Version].Version != 0 {
+			t.Fatalf("migration %04d still recorded after down, err=%v", latest.Version, err)
+		}
+
+		done, err = migrateUp(testSession, 0)
+		if err != nil || len(done) != 1 || done[0].Version != latest.Version {
+			t.Fatalf("migrateUp: done=%v err=%v", done, err)
+		}
+		// The reapplied tables are usable again
+		resetUsers(t)
+		if err := testUsers.Create(context.Background(), newTestUser("judy")); err != nil {
+			t.Fatalf("Create after up: %v", err)
+		}
+	})
+
+	t.Run("a held lock stops other runners", func(t *testing.T) {
+		err := withMigrationLock(testSession, func() error {
+			_, err := migrateUp(testSession, 0)
+			return err
+		})
+		if err == nil || !strings.Contains(err.Error(), "locked by") {
+			t.Fatalf("expected a lock error, got %v", err)
+		}
+		// The lock is released afterwards
+		if _, err := migrateUp(testSession, 0); err != nil {
+			t.Fatalf("migrateUp after the lock was released: %v", err)
+		}
+	})
+}
+
+// HTTP flows: the full API served by setupRoutes
+
+func TestHTTPCRUDFlow(t *testing.T) {
+	resetUsers(t)
+	srv := httptest.NewServer(setupRoutes(newServer(testSession)))
+	t.Cleanup(srv.Close)
+
+	status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/health", nil)
+	if status != http.StatusOK || !resp.Success {
+		t.Fatalf("health: status=%d resp=%+v", status, resp)
+	}
+	health, _ := resp.Data.(map[string]any)
+	if _, ok := health["latency_ms"].(float64); !ok || health["peers"] == nil || health["cluster_name"] == nil {
+		t.Fatalf("health: want latency_ms, peers and cluster_name from the probe, got %+v", resp.Data)
+	}
+
+	status, resp = apiCall(t, srv, http.MethodPost, "/api/v1/users", CreateUserRequest{Name: "Dana", Email: "dana@example.com"})
+	if status != http.StatusCreated || !resp.Success {
+		t.Fatalf("create: status=%d resp=%+v", status, resp)
+	}
+	created := dataUser(t, resp)
+	if created.ID == "" || created.Name != "Dana" {
+		t.Fatalf("create returned %+v", created)
+	}
+
+	status, resp = apiCall(t, srv, http.MethodGet, "/api/v1/users/"+created.ID, nil)
+	if status != http.StatusOK || dataUser(t, resp).Email != "dana@example.com" {
+		t.Fatalf("get: status=%d resp=%+v", status, resp)
+	}
+
+	status, resp = apiCall(t, srv, http.MethodPut, "/api/v1/users/"+created.ID, UpdateUserRequest{Name: "Dana Scully"})
+	if status != http.StatusOK {
+		t.Fatalf("update: status=%d resp=%+v", status, resp)
+	}
+	if updated := dataUser(t, resp); updated.Name != "Dana Scully" || updated.Email != "dana@example.com" {
+		t.Fatalf("partial update should keep the email: %+v", updated)
+	}
+
+	status, resp = apiCall(t, srv, http.MethodGet, "/api/v1/users/by-email/dana@example.com", nil)
+	if status != http.StatusOK {
+		t.Fatalf("get by email: status=%d resp=%+v", status, resp)
+	}
+	if users, ok := resp.Data.([]any); !ok || len(users) != 1 {
+		t.Fatalf("get by email: expected one user, got %+v", resp.Data)
+	}
+
+	status, resp = apiCall(t, srv, http.MethodGet, "/api/v1/users", nil)
+	if status != http.StatusOK {
+		t.Fatalf("list: status=%d resp=%+v", status, resp)
+	}
+	if users, ok := resp.Data.([]any); !ok || len(users) != 1 {
+		t.Fatalf("list: expected one user, got %+v", resp.Data)
+	}
+
+	status, header, body := download(t, srv, "/api/v1/users/export?format=ndjson")
+	if status != http.StatusOK || header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export: status=%d header=%v body=%q", status, header, body)
+	}
+	var exported User
+	if err := json.Unmarshal([]byte(body), &exported); err != nil || exported.ID != created.ID || exported.Name != "Dana Scully" || exported.Version != 2 {
+		t.Fatalf("export: want the updated user on one line, got %q (%v)", body, err)
+	}
+
+	status, resp = apiCall(t, srv, http.MethodDelete, "/api/v1/users/"+created.ID, nil)
+	if status != http.StatusOK || !resp.Success {
+		t.Fatalf("delete: status=%d resp=%+v", status, resp)
+	}
+
+	// The history outlives the user
+	status, resp = apiCall(t, srv, http.MethodGet, "/api/v1/users/"+created.ID+"/events", nil)
+	if status != http.StatusOK {
+		t.Fatalf("events: status=%d resp=%+v", status, resp)
+	}
+	events, _ := resp.Data.([]any)
+	var actions []string
+	for _, e := range events {
+		event, _ := e.(map[string]any)
+		action, _ := event["action"].(string)
+		actions = append(actions, action)
+	}
+	if want := []string{eventCreated, eventUpdated, eventDeleted}; !slices.Equal(actions, want) {
+		t.Fatalf("events: got actions %v, want %v", actions, want)
+	}
+	if user, err := testUsers.Get(context.Background(), created.ID); err != nil || user != nil {
+		t.Fatalf("user still stored after delete: user=%v err=%v", user, err)
+	}
+
+	status, _ = apiCall(t, srv, http.MethodGet, "/api/v1/users/by-email/dana@example.com", nil)
+	if status != http.StatusNotFound {
+		t.Fatalf("get by email after delete: status=%d", status)
+	}
+	status, _ = apiCall(t, srv, http.MethodDelete, "/api/v1/users/"+created.ID, nil)
+	if status != http.StatusNotFound {
+		t.Fatalf("delete missing user: status=%d", status)
+	}
+}
+
+func TestHTTPValidation(t *testing.T) {
+	resetUsers(t)
+	srv := httptest.NewServer(setupRoutes(newServer(testSession)))
+	t.Cleanup(srv.Close)
+
+	status, resp := apiCall(t, srv, http.MethodPost, "/api/v1/users", CreateUserRequest{Name: "no email"})
+	if status != http.StatusBadRequest || resp.Success {
+		t.Fatalf("missing email: status=%d resp=%+v", status, resp)
+	}
+
+	status, _ = apiCall(t, srv, http.MethodPost, "/api/v1/users", "not an object")
+	if status != http.StatusBadRequest {
+		t.Fatalf("bad body: status=%d", status)
+	}
+
+	users, err := testUsers.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("rejected requests stored %d users", len(users))
+	}
+}
+
+// Timeouts: queries give up with the request's context
+
+func TestQueryTimeouts(t *testing.T) {
+	resetUsers(t)
+	user := newTestUser("trent")
+	if err := testUsers.Create(context.Background(), user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// A query whose deadline has passed never reaches Scylla
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	timeouts := operationCount("get_user_by_id", outcomeTimeout)
+	if _, err := testUsers.Get(expired, user.ID); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get with an expired context: got %v, want context.DeadlineExceeded", err)
+	}
+	if got := operationCount("get_user_by_id", outcomeTimeout); got != timeouts+1 {
+		t.Fatalf("get_user_by_id timeouts went from %d to %d, want +1", timeouts, got)
+	}
+
+	// Over HTTP a request that runs out of time answers 504
+	previous := readTimeout
+	readTimeout = time.Nanosecond
+	t.Cleanup(func() { readTimeout = previous })
+	srv := httptest.NewServer(setupRoutes(newServer(testSession)))
+	t.Cleanup(srv.Close)
+
+	status, resp := apiCall(t, srv, http.MethodGet, "/api/v1/users/"+user.ID, nil)
+	if status != http.StatusGatewayTimeout || resp.Success {
+		t.Fatalf("get with a 1ns timeout: status=%d resp=%+v", status, resp)
+	}
+}
+
+// Bulk create: one request, per-item outcomes
+
+func TestBulkCreateUsers(t *testing.T) {
+	resetUsers(t)
+	srv := httptest.NewServer(setupRoutes(newServer(testSession)))
+	t.Cleanup(srv.Close)
+
+	body := BulkCreateUsersRequest{Users: []CreateUserRequest{
+		{Name: "uma", Email: "shared@example.com"},
+		{Name: "", Email: "nameless@example.com"},
+		{Name: "victor", Email: "shared@example.com"},
+		{Name: "wendy", Email: "wendy@example.com"},
+	}}
+	status, resp := apiCall(t, srv, http.MethodPost, "/api/v1/users/bulk", body)
+	if status != http.StatusMultiStatus || resp.Success {
+		t.Fatalf("bulk create with one invalid user: status=%d resp=%+v", status, resp)
+	}
+	raw, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatalf("encode data: %v", err)
+	}
+	var result BulkCreateResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		t.Fatalf("decode bulk result: %v", err)
+	}
+	if result.Created != 3 || result.Failed != 1 || len(result.Items) != 4 {
+		t.Fatalf("bulk result: %+v", result)
+	}
+	if item := result.Items[1]; item.Success || item.Error == "" || item.User != nil {
+		t.Fatalf("invalid item: %+v", item)
+	}
+
+	// Created users are readable and indexed by email, like single creates
+	for _, i := range []int{0, 2, 3} {
+		item := result.Items[i]
+		if !item.Success || item.User == nil || item.User.Version != 1 {
+			t.Fatalf("item %d: %+v", i, item)
+		}
+		got, err := testUsers.Get(context.Background(), item.User.ID)
+		if err != nil || got == nil || got.Name != body.Users[i].Name {
+			t.Fatalf("Get(item %d) = %+v, %v", i, got, err)
+		}
+	}
+	if ids := emailLookup(t, "shared@example.com"); len(ids) != 2 {
+		t.Fatalf("shared@example.com lookup: got %v, want both users", ids)
+	}
+
+	// Over the limit the whole request is refused
+	previous := maxBulkUsers
+	maxBulkUsers = 2
+	t.Cleanup(func() { maxBulkUsers = previous })
+	status, resp = apiCall(t, srv, http.MethodPost, "/api/v1/users/bulk", body)
+	if status != http.StatusBadRequest || resp.Success {
+		t.Fatalf("bulk create over the limit: status=%d resp=%+v", status, resp)
+	}
+}
+
+// Metrics: the data functions and gocql's queries are counted at /metrics
+
+// operationCount reads one scylla_operations_total series
+func operationCount(operation, outcome string) uint64 {
+	return counterValue(metrics.operations.WithLabelValues(operation, outcome))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	resetUsers(t)
+	srv := httptest.NewServer(setupRoutes(newServer(testSession)))
+	t.Cleanup(srv.Close)
+
+	created := operationCount("create_user", outcomeSuccess)
+	lookups := operationCount("get_user_by_id", outcomeSuccess)
+	if err := testUsers.Create(context.Background(), newTestUser("erin")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Not finding a user is not an error
+	if _, err := testUsers.Get(context.Background(), uuid.New().String()); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := operationCount("create_user", outcomeSuccess); got != created+1 {
+		t.Fatalf("create_user successes went from %d to %d, want +1", created, got)
+	}
+	if got := operationCount("get_user_by_id", outcomeSuccess); got != lookups+1 {
+		t.Fatalf("get_user_by_id successes went from %d to %d, want +1", lookups, got)
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read /metrics: %v", err)
+	}
+	for _, want := range []string{
+		`scylla_operations_total{operation="create_user",outcome="success"}`,
+		`scylla_operation_duration_seconds_bucket{operation="get_user_by_id",outcome="success",le="+Inf"}`,
+		`scylla_query_duration_seconds_count{outcome="success"}`,
+		"scylla_query_retries_total ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics is missing %s", want)
+		}
+	}
+}
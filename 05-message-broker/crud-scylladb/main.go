@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -16,32 +23,95 @@ import (
 	"github.com/scylladb/gocqlx/v2/table"
 )
 
-// User represents the user data structure
+// User represents the user data structure. Version starts at 1 and is
+// bumped by every update; it is 0 for users created before versioning.
 type User struct {
 	ID        string    `db:"id"`
 	Name      string    `db:"name"`
 	Email     string    `db:"email"`
 	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+	Version   int64     `db:"version"`
 }
 
 // UserTable metadata for ScyllaDB operations
 var userMetadata = table.Metadata{
 	Name:    "users",
-	Columns: []string{"id", "name", "email", "created_at"},
+	Columns: []string{"id", "name", "email", "created_at", "updated_at", "version"},
 	PartKey: []string{"id"},
 }
 
 var userTable = table.New(userMetadata)
 
+// Lightweight transactions on users. An insert only applies when the ID is
+// free, and an update only when the version is still the one that was read.
+var (
+	insertUserIfNotExists = userTable.InsertBuilder().Unique()
+	updateUserIfVersion   = userTable.UpdateBuilder("name", "email", "updated_at", "version").
+				If(qb.EqNamed("version", "expected_version"))
+	// Users created before versioning have a null version
+	updateUserIfUnversioned = userTable.UpdateBuilder("name", "email", "updated_at", "version").
+				If(qb.EqLit("version", "null"))
+)
+
+// Conflicts detected by the lightweight transactions; the handlers answer
+// both with 409 Conflict
+var (
+	errUserExists      = errors.New("a user with this ID already exists")
+	errVersionConflict = errors.New("user was changed by another request")
+)
+
+// usersByEmailMetadata describes the lookup table for users by email. Create
+// writes the lookup row after its conditional insert into users, since a
+// lightweight transaction can't share a batch with another table. If that
+// second write fails, the request fails but the user exists without a lookup
+// row: GET /users/by-email misses it until the user is updated or reindex
+// runs. id is a clustering column, so users sharing an email each keep their
+// own row.
+var usersByEmailMetadata = table.Metadata{
+	Name:    "users_by_email",
+	Columns: []string{"email", "id", "name", "created_at"},
+	PartKey: []string{"email"},
+	SortKey: []string{"id"},
+}
+
+var usersByEmailTable = table.New(usersByEmailMetadata)
+
 // Database configuration
 const (
-	KeyspaceName = "example"
-	TableName    = "users"
-	ServerPort   = ":8080"
+	KeyspaceName   = "example" // default, see Config.Keyspace
+	TableName      = "users"
+	EmailTableName = "users_by_email"
+	EventTableName = "user_events"
+)
+
+// Deadlines for the queries of one request, counted from when the handler
+// starts. Writes are lightweight transactions, several round trips each, so
+// they get longer. main sets them from Config.ReadTimeout and Config.WriteTimeout.
+var (
+	readTimeout  = 2 * time.Second
+	writeTimeout = 5 * time.Second
 )
 
-// Global session variable for HTTP handlers
-var globalSession gocqlx.Session
+// server is what the HTTP handlers depend on, passed in so that tests can
+// replace the database with a fake
+type server struct {
+	users UserRepository
+	probe func(ctx context.Context) (clusterHealth, error) // see probeDatabase
+
+	// tenants routes each request to its tenant's keyspace, with users a
+	// tenantUsers; nil serves the one keyspace
+	tenants *tenantRegistry
+}
+
+// newServer serves the users stored through session
+func newServer(session gocqlx.Session) *server {
+	users := NewScyllaUserRepository(session)
+	return &server{
+		users: users,
+		probe: func(ctx context.Context) (clusterHealth, error) { return probeDatabase(ctx, users.session) },
+	}
+}
 
 // API Response structures
 type APIResponse struct {
@@ -59,94 +129,37 @@ type CreateUserRequest struct {
 type UpdateUserRequest struct {
 	Name  string `json:"name,omitempty"`
 	Email string `json:"email,omitempty"`
-}
 
-// initializeDatabase creates keyspace and table if they don't exist
-func initializeDatabase(session gocqlx.Session) error {
-	// Create keyspace
-	keyspaceQuery := fmt.Sprintf(`
-		CREATE KEYSPACE IF NOT EXISTS %s 
-		WITH replication = {
-			'class': 'SimpleStrategy',
-			'replication_factor': 1
-		}
-	`, KeyspaceName)
-	
-	if err := session.ExecStmt(keyspaceQuery); err != nil {
-		return fmt.Errorf("failed to create keyspace: %w", err)
-	}
-	
-	// Create table in the keyspace (fully qualified name)
-	tableQuery := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s.%s (
-			id text PRIMARY KEY,
-			name text,
-			email text,
-			created_at timestamp
-		)
-	`, KeyspaceName, TableName)
-	
-	if err := session.ExecStmt(tableQuery); err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
-	}
-	
-	return nil
+	// The version the client last read. When set, the update is refused with
+	// 409 Conflict if the user has changed since.
+	Version int64 `json:"version,omitempty"`
 }
 
-// createUser inserts a new user into the database
-func createUser(session gocqlx.Session, user User) error {
-	q := session.Query(userTable.Insert()).BindStruct(user)
-	if err := q.ExecRelease(); err != nil {
-		return fmt.Errorf("failed to create user: %w", err)
-	}
-	return nil
+// isTimeout reports whether a query gave up waiting: the request's deadline
+// passed, or no answer came within cluster.Timeout
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, gocql.ErrTimeoutNoResponse)
 }
 
-// getUserByID retrieves a user by ID
-func getUserByID(session gocqlx.Session, id string) (*User, error) {
-	var user User
-	q := session.Query(userTable.Get()).BindMap(qb.M{"id": id})
-	if err := q.GetRelease(&user); err != nil {
-		if err == gocql.ErrNotFound {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("failed to get user: %w", err)
-	}
-	return &user, nil
-}
-
-// updateUser updates an existing user
-func updateUser(session gocqlx.Session, user User) error {
-	q := session.Query(userTable.Update("name", "email")).BindStruct(user)
-	if err := q.ExecRelease(); err != nil {
-		return fmt.Errorf("failed to update user: %w", err)
-	}
-	return nil
-}
-
-// deleteUser removes a user by ID
-func deleteUser(session gocqlx.Session, id string) error {
-	q := session.Query(userTable.Delete()).BindMap(qb.M{"id": id})
-	if err := q.ExecRelease(); err != nil {
-		return fmt.Errorf("failed to delete user: %w", err)
-	}
-	return nil
-}
-
-// getAllUsers retrieves all users from the database
-func getAllUsers(session gocqlx.Session) ([]User, error) {
-	var users []User
-	q := session.Query(userTable.SelectAll())
-	if err := q.SelectRelease(&users); err != nil {
-		return nil, fmt.Errorf("failed to get all users: %w", err)
-	}
-	return users, nil
+// dbErrorStatus is the status of a request whose query failed: 504 Gateway
+// Timeout when it timed out, 503 Service Unavailable when too few replicas
+// were up for its consistency, 500 otherwise
+func dbErrorStatus(err error) int {
+	var unavailable *gocql.RequestErrUnavailable
+	switch {
+	case isTimeout(err):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &unavailable):
+		// Too few replicas alive for the consistency, e.g. ALL with a node down
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
 }
 
 // HTTP Handlers
 
 // createUserHandler handles POST /users
-func createUserHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) createUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	var req CreateUserRequest
@@ -162,7 +175,7 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Validate required fields
-	if req.Name == "" || req.Email == "" {
+	if err := req.validate(); err != nil {
 		response := APIResponse{
 			Success: false,
 			Message: "Name and email are required",
@@ -172,25 +185,41 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+	defer cancel()
+	
 	// Create user
+	now := time.Now()
 	user := User{
 		ID:        uuid.New().String(),
 		Name:      req.Name,
 		Email:     req.Email,
-		CreatedAt: time.Now(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
 	}
 	
-	if err := createUser(globalSession, user); err != nil {
+	if err := s.users.Create(ctx, user); err != nil {
+		statusCode := dbErrorStatus(err)
+		if errors.Is(err, errUserExists) {
+			statusCode = http.StatusConflict
+		}
+		
 		response := APIResponse{
 			Success: false,
 			Message: "Failed to create user",
 			Error:   err.Error(),
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(statusCode)
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 	
+	if err := s.recordEvent(ctx, newUserEvent(r, eventCreated, nil, &user)); err != nil {
+		writeEventError(w, eventCreated, err, &user)
+		return
+	}
+	
 	response := APIResponse{
 		Success: true,
 		Message: "User created successfully",
@@ -201,15 +230,18 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // getUserHandler handles GET /users/{id}
-func getUserHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) getUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	vars := mux.Vars(r)
 	userID := vars["id"]
 	
-	user, err := getUserByID(globalSession, userID)
+	ctx, cancel := context.WithTimeout(r.Context(), readTimeout)
+	defer cancel()
+	
+	user, err := s.users.Get(ctx, userID)
 	if err != nil {
-		statusCode := http.StatusInternalServerError
+		statusCode := dbErrorStatus(err)
 		if err.Error() == "user not found" {
 			statusCode = http.StatusNotFound
 		}
@@ -224,6 +256,16 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	if user == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "User not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	
 	response := APIResponse{
 		Success: true,
 		Message: "User retrieved successfully",
@@ -232,18 +274,61 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// getUsersByEmailHandler handles GET /users/by-email/{email}
+func (s *server) getUsersByEmailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	
+	vars := mux.Vars(r)
+	email := vars["email"]
+	
+	ctx, cancel := context.WithTimeout(r.Context(), readTimeout)
+	defer cancel()
+	
+	users, err := s.users.GetByEmail(ctx, email)
+	if err != nil {
+		response := APIResponse{
+			Success: false,
+			Message: "Failed to get users",
+			Error:   err.Error(),
+		}
+		w.WriteHeader(dbErrorStatus(err))
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	
+	if len(users) == 0 {
+		response := APIResponse{
+			Success: false,
+			Message: "No user with that email",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	
+	response := APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Retrieved %d users", len(users)),
+		Data:    users,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
 // getAllUsersHandler handles GET /users
-func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
-	users, err := getAllUsers(globalSession)
+	ctx, cancel := context.WithTimeout(r.Context(), readTimeout)
+	defer cancel()
+	
+	users, err := s.users.List(ctx)
 	if err != nil {
 		response := APIResponse{
 			Success: false,
 			Message: "Failed to get users",
 			Error:   err.Error(),
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(dbErrorStatus(err))
 		json.NewEncoder(w).Encode(response)
 		return
 	}
@@ -257,16 +342,20 @@ func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // updateUserHandler handles PUT /users/{id}
-func updateUserHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	vars := mux.Vars(r)
 	userID := vars["id"]
 	
+	// The read, the conditional write and any re-read share one deadline
+	ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+	defer cancel()
+	
 	// Get existing user
-	existingUser, err := getUserByID(globalSession, userID)
+	existingUser, err := s.users.Get(ctx, userID)
 	if err != nil {
-		statusCode := http.StatusInternalServerError
+		statusCode := dbErrorStatus(err)
 		if err.Error() == "user not found" {
 			statusCode = http.StatusNotFound
 		}
@@ -281,6 +370,16 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	if existingUser == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "User not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	
 	var req UpdateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		response := APIResponse{
@@ -293,7 +392,14 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	// The client edited an older version than the stored one
+	if req.Version != 0 && req.Version != existingUser.Version {
+		writeVersionConflict(w, existingUser)
+		return
+	}
+	
 	// Update fields if provided
+	previousUser := *existingUser
 	if req.Name != "" {
 		existingUser.Name = req.Name
 	}
@@ -301,17 +407,38 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 		existingUser.Email = req.Email
 	}
 	
-	if err := updateUser(globalSession, *existingUser); err != nil {
+	if err := s.users.Update(ctx, previousUser, existingUser); err != nil {
+		// Another request changed the user between our read and our write
+		if errors.Is(err, errVersionConflict) {
+			current, getErr := s.users.Get(ctx, userID)
+			if getErr == nil && current == nil {
+				response := APIResponse{
+					Success: false,
+					Message: "User not found",
+				}
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+			writeVersionConflict(w, current)
+			return
+		}
+		
 		response := APIResponse{
 			Success: false,
 			Message: "Failed to update user",
 			Error:   err.Error(),
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(dbErrorStatus(err))
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 	
+	if err := s.recordEvent(ctx, newUserEvent(r, eventUpdated, &previousUser, existingUser)); err != nil {
+		writeEventError(w, eventUpdated, err, existingUser)
+		return
+	}
+	
 	response := APIResponse{
 		Success: true,
 		Message: "User updated successfully",
@@ -320,17 +447,35 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// writeVersionConflict answers 409 Conflict with the user as it is now, if
+// known, so the client can reapply its change to the current version
+func writeVersionConflict(w http.ResponseWriter, current *User) {
+	response := APIResponse{
+		Success: false,
+		Message: "User was changed by another request; fetch it and retry",
+		Error:   errVersionConflict.Error(),
+	}
+	if current != nil {
+		response.Data = current
+	}
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(response)
+}
+
 // deleteUserHandler handles DELETE /users/{id}
-func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	
 	vars := mux.Vars(r)
 	userID := vars["id"]
 	
-	// Check if user exists
-	_, err := getUserByID(globalSession, userID)
+	ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+	defer cancel()
+	
+	// Check if user exists; its email is needed to remove the lookup row
+	existingUser, err := s.users.Get(ctx, userID)
 	if err != nil {
-		statusCode := http.StatusInternalServerError
+		statusCode := dbErrorStatus(err)
 		if err.Error() == "user not found" {
 			statusCode = http.StatusNotFound
 		}
@@ -345,58 +490,72 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	if err := deleteUser(globalSession, userID); err != nil {
+	if existingUser == nil {
+		response := APIResponse{
+			Success: false,
+			Message: "User not found",
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	
+	if err := s.users.Delete(ctx, *existingUser); err != nil {
 		response := APIResponse{
 			Success: false,
 			Message: "Failed to delete user",
 			Error:   err.Error(),
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(dbErrorStatus(err))
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 	
-	response := APIResponse{
-		Success: true,
-		Message: "User deleted successfully",
+	if err := s.recordEvent(ctx, newUserEvent(r, eventDeleted, existingUser, nil)); err != nil {
+		writeEventError(w, eventDeleted, err, nil)
+		return
 	}
-	json.NewEncoder(w).Encode(response)
-}
-
-// healthHandler handles GET /health
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
 	
 	response := APIResponse{
 		Success: true,
-		Message: "API is healthy",
-		Data: map[string]interface{}{
-			"timestamp": time.Now(),
-			"version":   "1.0.0",
-			"database":  "ScyllaDB",
-		},
+		Message: "User deleted successfully",
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
-// setupRoutes configures all API routes
-func setupRoutes() *mux.Router {
+// setupRoutes configures all API routes, served by s
+func setupRoutes(s *server) *mux.Router {
 	r := mux.NewRouter()
 	
 	// API routes
+	// Each route is named, and its queries are tagged with the name
 	api := r.PathPrefix("/api/v1").Subrouter()
-	api.HandleFunc("/health", healthHandler).Methods("GET")
-	api.HandleFunc("/users", createUserHandler).Methods("POST")
-	api.HandleFunc("/users", getAllUsersHandler).Methods("GET")
-	api.HandleFunc("/users/{id}", getUserHandler).Methods("GET")
-	api.HandleFunc("/users/{id}", updateUserHandler).Methods("PUT")
-	api.HandleFunc("/users/{id}", deleteUserHandler).Methods("DELETE")
+	api.Use(tagHandler, consistencyMiddleware)
+	if s.tenants != nil {
+		api.Use(s.tenants.middleware)
+	}
+	api.HandleFunc("/health", s.healthHandler).Methods("GET").Name("health")
+	api.HandleFunc("/users", s.createUserHandler).Methods("POST").Name("create_user")
+	api.HandleFunc("/users/bulk", s.bulkCreateUsersHandler).Methods("POST").Name("bulk_create_users")
+	api.HandleFunc("/users", s.getAllUsersHandler).Methods("GET").Name("get_all_users")
+	api.HandleFunc("/users/export", s.exportUsersHandler).Methods("GET").Name("export_users")
+	api.HandleFunc("/users/by-email/{email}", s.getUsersByEmailHandler).Methods("GET").Name("get_users_by_email")
+	api.HandleFunc("/users/{id}", s.getUserHandler).Methods("GET").Name("get_user")
+	api.HandleFunc("/users/{id}", s.updateUserHandler).Methods("PUT").Name("update_user")
+	api.HandleFunc("/users/{id}", s.patchUserHandler).Methods("PATCH").Name("patch_user")
+	api.HandleFunc("/users/{id}", s.deleteUserHandler).Methods("DELETE").Name("delete_user")
+	api.HandleFunc("/users/{id}/events", s.getUserEventsHandler).Methods("GET").Name("get_user_events")
+	
+	// Prometheus scrapes the usual path, outside the API prefix
+	r.Handle("/metrics", metricsHandler).Methods("GET")
 	
 	return r
 }
 
 // runDemo runs the original CRUD demo
-func runDemo(session gocqlx.Session) {
+func runDemo(users UserRepository) {
+	ctx := context.Background()
+	
 	// Generate a unique ID for the user
 	userID := uuid.New().String()
 	
@@ -413,14 +572,14 @@ func runDemo(session gocqlx.Session) {
 	
 	// CREATE
 	fmt.Println("\n1. Creating user...")
-	if err := createUser(session, user); err != nil {
+	if err := users.Create(ctx, user); err != nil {
 		log.Fatalf("Create operation failed: %v", err)
 	}
 	fmt.Printf("✓ User created successfully with ID: %s\n", userID)
 	
 	// READ
 	fmt.Println("\n2. Reading user...")
-	fetchedUser, err := getUserByID(session, userID)
+	fetchedUser, err := users.Get(ctx, userID)
 	if err != nil {
 		log.Fatalf("Read operation failed: %v", err)
 	}
@@ -428,23 +587,40 @@ func runDemo(session gocqlx.Session) {
 	
 	// UPDATE
 	fmt.Println("\n3. Updating user...")
+	previousUser := *fetchedUser
 	fetchedUser.Name = "John Smith"
 	fetchedUser.Email = "johnsmith@example.com"
-	if err := updateUser(session, *fetchedUser); err != nil {
+	if err := users.Update(ctx, previousUser, fetchedUser); err != nil {
 		log.Fatalf("Update operation failed: %v", err)
 	}
-	fmt.Println("✓ User updated successfully")
+	fmt.Printf("✓ User updated successfully to version %d\n", fetchedUser.Version)
+	
+	// A second update based on the stale read loses the race
+	stale := previousUser
+	stale.Name = "Johnny"
+	if err := users.Update(ctx, previousUser, &stale); errors.Is(err, errVersionConflict) {
+		fmt.Println("✓ Stale update rejected with a version conflict")
+	} else {
+		fmt.Printf("⚠ Warning: stale update was not rejected: %v\n", err)
+	}
 	
 	// READ again to verify update
-	updatedUser, err := getUserByID(session, userID)
+	updatedUser, err := users.Get(ctx, userID)
 	if err != nil {
 		log.Fatalf("Read after update failed: %v", err)
 	}
 	fmt.Printf("✓ Updated user: %+v\n", *updatedUser)
 	
+	// READ by email, through the lookup table
+	byEmail, err := users.GetByEmail(ctx, updatedUser.Email)
+	if err != nil {
+		log.Fatalf("Read by email failed: %v", err)
+	}
+	fmt.Printf("✓ Found %d user(s) with email %s\n", len(byEmail), updatedUser.Email)
+	
 	// LIST ALL
 	fmt.Println("\n4. Listing all users...")
-	allUsers, err := getAllUsers(session)
+	allUsers, err := users.List(ctx)
 	if err != nil {
 		log.Fatalf("List operation failed: %v", err)
 	}
@@ -455,13 +631,13 @@ func runDemo(session gocqlx.Session) {
 	
 	// DELETE
 	fmt.Println("\n5. Deleting user...")
-	if err := deleteUser(session, userID); err != nil {
+	if err := users.Delete(ctx, *updatedUser); err != nil {
 		log.Fatalf("Delete operation failed: %v", err)
 	}
 	fmt.Println("✓ User deleted successfully")
 	
 	// Verify deletion
-	_, err = getUserByID(session, userID)
+	_, err = users.Get(ctx, userID)
 	if err != nil {
 		fmt.Println("✓ Confirmed: User no longer exists")
 	} else {
@@ -472,11 +648,25 @@ func runDemo(session gocqlx.Session) {
 }
 
 func main() {
+	// Flags come before the subcommand: go run . -hosts node1,node2 migrate status
+	cfg, args, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	readTimeout, writeTimeout = cfg.ReadTimeout, cfg.WriteTimeout
+	slowQueryThreshold = cfg.SlowQuery
+	defaultConsistency = cfg.Consistency
+	maxBulkUsers = cfg.MaxBulkUsers
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	
 	// Initialize ScyllaDB cluster
-	cluster := gocql.NewCluster("localhost:9042")
-	cluster.Consistency = gocql.LocalQuorum
-	cluster.ConnectTimeout = time.Second * 10
-	cluster.Timeout = time.Second * 10
+	cluster := cfg.newCluster()
 	
 	// Create session for initialization
 	session, err := gocqlx.WrapSession(cluster.CreateSession())
@@ -484,48 +674,131 @@ func main() {
 		log.Fatalf("Failed to connect to ScyllaDB: %v", err)
 	}
 	
-	fmt.Println("Connected to ScyllaDB successfully!")
+	fmt.Printf("Connected to ScyllaDB at %s (consistency %s)\n", strings.Join(cfg.Hosts, ", "), cfg.Consistency)
 	
-	// Initialize database (create keyspace and table)
-	if err := initializeDatabase(session); err != nil {
+	// The keyspace has to exist before anything can connect to it
+	if err := createKeyspace(session, cfg); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	
-	fmt.Println("Database initialized successfully!")
-	
 	// Close the initial session
 	session.Close()
 	
 	// Create a new session connected to the keyspace
-	cluster.Keyspace = KeyspaceName
+	cluster.Keyspace = cfg.Keyspace
 	keyspaceSession, err := gocqlx.WrapSession(cluster.CreateSession())
 	if err != nil {
 		log.Fatalf("Failed to connect to keyspace: %v", err)
 	}
 	defer keyspaceSession.Close()
 	
-	// Set global session for HTTP handlers
-	globalSession = keyspaceSession
+	// Manage the schema by hand: migrate up [n] | down [n] | status
+	if command == "migrate" {
+		if err := runMigrateCommand(keyspaceSession, args[1:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+	
+	// Otherwise bring the schema up to date before serving
+	applied, err := migrateUp(keyspaceSession, 0)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	for _, m := range applied {
+		fmt.Printf("✓ Applied migration %04d_%s\n", m.Version, m.Name)
+	}
+	
+	fmt.Println("Database initialized successfully!")
+	
+	users := NewScyllaUserRepository(keyspaceSession)
 	
 	// Run demo if requested
-	if len(os.Args) > 1 && os.Args[1] == "demo" {
-		runDemo(session)
+	if command == "demo" {
+		runDemo(users)
+		return
+	}
+	
+	// Backfill users_by_email for users created before it existed
+	if command == "reindex" {
+		n, err := users.reindexEmails(context.Background())
+		if err != nil {
+			log.Fatalf("Reindex failed after %d users: %v", n, err)
+		}
+		fmt.Printf("✓ Indexed %d users by email\n", n)
 		return
 	}
 	
 	// Setup HTTP routes
-	router := setupRoutes()
+	s := newServer(keyspaceSession)
+	if cfg.MultiTenant {
+		s.users, s.tenants = tenantUsers{}, newTenantRegistry(cfg, keyspaceSession)
+		defer s.tenants.Close()
+	}
+	router := setupRoutes(s)
 	
 	// Start HTTP server
-	fmt.Printf("🚀 Starting REST API server on http://localhost%s\n", ServerPort)
+	addr := ":" + strconv.Itoa(cfg.Port)
+	fmt.Printf("🚀 Starting REST API server on http://localhost%s\n", addr)
 	fmt.Println("📚 API Documentation:")
 	fmt.Println("   GET    /api/v1/health          - Health check")
 	fmt.Println("   GET    /api/v1/users           - Get all users")
 	fmt.Println("   POST   /api/v1/users           - Create user")
+	fmt.Printf("   POST   /api/v1/users/bulk      - Create up to %d users\n", maxBulkUsers)
+	fmt.Println("   GET    /api/v1/users/export?format=csv|ndjson - Download every user")
 	fmt.Println("   GET    /api/v1/users/{id}      - Get user by ID")
+	fmt.Println("   GET    /api/v1/users/by-email/{email} - Get users by email")
 	fmt.Println("   PUT    /api/v1/users/{id}      - Update user")
+	fmt.Println("   PATCH  /api/v1/users/{id}      - Change only the fields sent")
 	fmt.Println("   DELETE /api/v1/users/{id}      - Delete user")
-	fmt.Println("\n💡 Run with 'go run main.go demo' to see CRUD demo")
+	fmt.Println("   GET    /api/v1/users/{id}/events - History of a user's changes")
+	fmt.Println("   GET    /metrics                - Prometheus metrics")
+	fmt.Printf("⏱  Query timeouts: %s for reads, %s for writes\n", readTimeout, writeTimeout)
+	if cfg.MultiTenant {
+		fmt.Printf("🏢 Multi-tenant: %s picks the keyspace %s_<tenant>, up to %d tenants\n", tenantHeader, cfg.Keyspace, cfg.MaxTenants)
+	}
+	if slowQueryThreshold > 0 {
+		fmt.Printf("🐢 Logging queries slower than %s\n", slowQueryThreshold)
+	}
+	fmt.Println("\n💡 Run with 'go run . demo' to see CRUD demo")
+	fmt.Println("💡 Run with 'go run . reindex' to index users created before the email lookup")
+	fmt.Println("💡 Run with 'go run . migrate status' to see which schema migrations are applied")
 	
-	log.Fatal(http.ListenAndServe(ServerPort, router))
+	fmt.Println("💡 Run with -h to see the configuration flags")
+	
+	if err := serve(addr, router, cfg.ShutdownTimeout); err != nil {
+		keyspaceSession.Close() // log.Fatalf skips the deferred Close
+		log.Fatalf("Server stopped: %v", err)
+	}
+	fmt.Println("👋 Server stopped, closing the ScyllaDB session")
+}
+
+// serve runs the REST API on addr until SIGINT or SIGTERM, then stops
+// accepting connections and waits up to timeout for in-flight requests.
+// It returns once none is left, so the caller can close the session
+// without cutting a query short. Requests still running at the timeout
+// have their connections closed, which cancels their queries' contexts.
+func serve(addr string, handler http.Handler, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: addr, Handler: handler}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		return err // never started, e.g. the port is taken
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process right away
+	fmt.Printf("\n🛑 Shutting down, waiting up to %s for in-flight requests\n", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("requests still running after %s: %w", timeout, err)
+	}
+	return nil
 }
\ No newline at end of file
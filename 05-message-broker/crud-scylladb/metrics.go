@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms.
+// Single-partition reads and writes usually finish in a few milliseconds.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 10}
+
+// Outcomes of an operation or query. A lookup that finds no user is a
+// success, a write refused by its lightweight transaction a conflict, and an
+// operation that ran out of time a timeout.
+const (
+	outcomeSuccess  = "success"
+	outcomeError    = "error"
+	outcomeConflict = "conflict"
+	outcomeTimeout  = "timeout"
+)
+
+// dbMetrics counts the ScyllaUserRepository calls (Create, Get, ...) and the
+// CQL queries gocql sends for them. An operation can take several queries:
+// retries, and one per page when listing.
+type dbMetrics struct {
+	registry *prometheus.Registry
+
+	operations        *prometheus.CounterVec   // by operation and outcome
+	operationDuration *prometheus.HistogramVec // by operation and outcome
+	queries           *prometheus.HistogramVec // query attempts by outcome
+	retries           prometheus.Counter       // attempts after the first
+	errors            *prometheus.CounterVec   // failed attempts by error type
+	slow              *prometheus.CounterVec   // slow attempts by handler
+}
+
+// metrics is shared by the data functions, the gocql observer and /metrics
+var metrics = newDBMetrics()
+
+func newDBMetrics() *dbMetrics {
+	m := &dbMetrics{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scylla_operations_total",
+			Help: "Data function calls by operation and outcome.",
+		}, []string{"operation", "outcome"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "scylla_operation_duration_seconds",
+			Help:    "Time taken by each data function call, retries included.",
+			Buckets: latencyBuckets,
+		}, []string{"operation", "outcome"}),
+		queries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "scylla_query_duration_seconds",
+			Help:    "Time taken by each CQL query attempt.",
+			Buckets: latencyBuckets,
+		}, []string{"outcome"}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "scylla_query_retries_total",
+			Help: "Query attempts made by the retry policy after a failure.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scylla_query_errors_total",
+			Help: "Failed query attempts by error type.",
+		}, []string{"type"}),
+		slow: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scylla_slow_queries_total",
+			Help: "Query and batch attempts slower than the slow query threshold, by handler.",
+		}, []string{"handler"}),
+	}
+	m.registry.MustRegister(m.operations, m.operationDuration, m.queries, m.retries, m.errors, m.slow)
+	return m
+}
+
+// observeOperation records a data function call that started at start. It
+// is deferred with a pointer to the function's error result.
+func observeOperation(operation string, start time.Time, err *error) {
+	outcome := outcomeSuccess
+	switch {
+	case errors.Is(*err, errUserExists), errors.Is(*err, errVersionConflict):
+		outcome = outcomeConflict
+	case isTimeout(*err):
+		outcome = outcomeTimeout
+	case *err != nil:
+		outcome = outcomeError
+	}
+	metrics.operations.WithLabelValues(operation, outcome).Inc()
+	metrics.operationDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+}
+
+// ObserveQuery implements gocql.QueryObserver. It is called once per
+// attempt, so latency here is Scylla's, without the retry policy's waits.
+func (m *dbMetrics) ObserveQuery(_ context.Context, q gocql.ObservedQuery) {
+	outcome := outcomeSuccess
+	if q.Err != nil {
+		outcome = outcomeError
+	}
+	m.queries.WithLabelValues(outcome).Observe(q.End.Sub(q.Start).Seconds())
+	if q.Attempt > 0 {
+		m.retries.Inc()
+	}
+	if q.Err != nil {
+		m.errors.WithLabelValues(queryErrorType(q.Err)).Inc()
+	}
+}
+
+// observeSlowQuery counts a query or batch attempt slower than
+// slowQueryThreshold, sent by handler
+func (m *dbMetrics) observeSlowQuery(handler string) {
+	m.slow.WithLabelValues(handler).Inc()
+}
+
+// queryErrorType groups driver errors for the errors counter
+func queryErrorType(err error) string {
+	var (
+		readTimeout  *gocql.RequestErrReadTimeout
+		writeTimeout *gocql.RequestErrWriteTimeout
+		unavailable  *gocql.RequestErrUnavailable
+	)
+	switch {
+	case errors.As(err, &readTimeout):
+		return "read_timeout" // too few replicas answered in time
+	case errors.As(err, &writeTimeout):
+		return "write_timeout"
+	case errors.As(err, &unavailable):
+		return "unavailable" // too few replicas alive to try
+	case errors.Is(err, gocql.ErrTimeoutNoResponse), errors.Is(err, context.DeadlineExceeded):
+		return "client_timeout" // no answer within cluster.Timeout
+	default:
+		return "other"
+	}
+}
+
+// metricsHandler handles GET /metrics
+var metricsHandler = promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/scylladb/gocqlx/v2"
+	"github.com/scylladb/gocqlx/v2/qb"
+	"github.com/scylladb/gocqlx/v2/table"
+)
+
+// migrationFiles holds the schema as numbered CQL files:
+// NNNN_name.up.cql applies a change and NNNN_name.down.cql reverts it
+//
+//go:embed migrations/*.cql
+var migrationFiles embed.FS
+
+// migrationLockTTL bounds how long a crashed runner can hold the lock
+const migrationLockTTL = 10 * time.Minute
+
+// migration is one numbered schema change
+type migration struct {
+	Version  int
+	Name     string
+	Up, Down string // CQL, Down is empty when the change can't be reverted
+}
+
+// checksum identifies the up script's statements, so a file edited after it
+// was applied is noticed. Comments are left out, so they can be corrected.
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(strings.Join(cqlStatements(m.Up), ";\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	Version   int       `db:"version"`
+	Name      string    `db:"name"`
+	Checksum  string    `db:"checksum"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+var schemaMigrationsTable = table.New(table.Metadata{
+	Name:    "schema_migrations",
+	Columns: []string{"version", "name", "checksum", "applied_at"},
+	PartKey: []string{"version"},
+})
+
+// createKeyspace creates the keyspace the migrations run in. Replication is
+// a property of the environment rather than of the schema, so it stays here
+// and comes from the configuration.
+func createKeyspace(session gocqlx.Session, cfg Config) error {
+	keyspaceQuery := fmt.Sprintf(`
+		CREATE KEYSPACE IF NOT EXISTS %s
+		WITH replication = %s
+	`, cfg.Keyspace, cfg.replication())
+
+	if err := session.ExecStmt(keyspaceQuery); err != nil {
+		return fmt.Errorf("failed to create keyspace: %w", err)
+	}
+	return nil
+}
+
+// loadMigrations reads the embedded migrations, sorted by version
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".cql")
+		stem, direction := strings.TrimSuffix(base, path.Ext(base)), strings.TrimPrefix(path.Ext(base), ".")
+		prefix, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.cql or 0001_name.down.cql", entry.Name())
+		}
+		body, err := fs.ReadFile(migrationFiles, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %04d has two names: %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// cqlStatements splits a script on semicolons, dropping "--" comment lines.
+// Semicolons inside string literals aren't supported.
+func cqlStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	var statements []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// ensureMigrationTables creates schema_migrations and the lock table. The
+// session must be bound to the keyspace.
+func ensureMigrationTables(session gocqlx.Session) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version int PRIMARY KEY,
+			name text,
+			checksum text,
+			applied_at timestamp
+		)`,
+		`CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+			id int PRIMARY KEY,
+			owner text,
+			locked_at timestamp
+		)`,
+	}
+	for _, stmt := range stmts {
+		if err := session.ExecStmt(stmt); err != nil {
+			return fmt.Errorf("failed to create migration tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// appliedMigrations returns the rows of schema_migrations by version
+func appliedMigrations(session gocqlx.Session) (map[int]appliedMigration, error) {
+	var rows []appliedMigration
+	q := session.Query(schemaMigrationsTable.SelectAll())
+	if err := q.SelectRelease(&rows); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	applied := make(map[int]appliedMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// withMigrationLock runs fn while holding the lock row, so two instances
+// starting at once don't apply the same migration twice. The lock is a
+// lightweight transaction with a TTL, so a runner that dies releases it
+// after migrationLockTTL.
+func withMigrationLock(session gocqlx.Session, fn func() error) error {
+	if err := ensureMigrationTables(session); err != nil {
+		return err
+	}
+
+	owner, _ := os.Hostname()
+	owner += "/" + uuid.New().String()
+	existing := make(map[string]interface{})
+	acquired, err := session.Session.Query(
+		`INSERT INTO schema_migrations_lock (id, owner, locked_at) VALUES (1, ?, ?) IF NOT EXISTS USING TTL ?`,
+		owner, time.Now(), int(migrationLockTTL.Seconds()),
+	).MapScanCAS(existing)
+	if err != nil {
+		return fmt.Errorf("failed to take the migration lock: %w", err)
+	}
+	if !acquired {
+		return fmt.Errorf("migrations are locked by %v since %v; if that runner died, the lock expires within %s",
+			existing["owner"], existing["locked_at"], migrationLockTTL)
+	}
+	defer func() {
+		released := make(map[string]interface{})
+		if _, err := session.Session.Query(
+			`DELETE FROM schema_migrations_lock WHERE id = 1 IF owner = ?`, owner,
+		).MapScanCAS(released); err != nil {
+			fmt.Printf("⚠ Warning: failed to release the migration lock, it expires within %s: %v\n", migrationLockTTL, err)
+		}
+	}()
+
+	return fn()
+}
+
+// migrateUp applies pending migrations in order, at most steps of them (0 =
+// all), and returns the ones it applied. It refuses to run when an applied
+// migration's file has changed since.
+func migrateUp(session gocqlx.Session, steps int) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	err = withMigrationLock(session, func() error {
+		applied, err := appliedMigrations(session)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if row, ok := applied[m.Version]; ok {
+				if row.Checksum != m.checksum() {
+					return fmt.Errorf("migration %04d_%s was changed after it was applied; add a new migration instead", m.Version, m.Name)
+				}
+				continue
+			}
+			if steps > 0 && len(done) == steps {
+				break
+			}
+
+			for _, stmt := range cqlStatements(m.Up) {
+				if err := session.ExecStmt(stmt); err != nil {
+					return fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+				}
+			}
+			row := appliedMigration{Version: m.Version, Name: m.Name, Checksum: m.checksum(), AppliedAt: time.Now()}
+			if err := session.Query(schemaMigrationsTable.Insert()).BindStruct(row).ExecRelease(); err != nil {
+				return fmt.Errorf("migration %04d_%s was applied but not recorded: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// migrateDown reverts the most recently applied migrations, steps of them,
+// newest first, and returns the ones it reverted
+func migrateDown(session gocqlx.Session, steps int) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	err = withMigrationLock(session, func() error {
+		applied, err := appliedMigrations(session)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s has no down script", m.Version, m.Name)
+			}
+
+			for _, stmt := range cqlStatements(m.Down) {
+				if err := session.ExecStmt(stmt); err != nil {
+					return fmt.Errorf("reverting %04d_%s failed: %w", m.Version, m.Name, err)
+				}
+			}
+			q := session.Query(schemaMigrationsTable.Delete()).BindMap(qb.M{"version": m.Version})
+			if err := q.ExecRelease(); err != nil {
+				return fmt.Errorf("migration %04d_%s was reverted but is still recorded: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// printMigrationStatus lists every migration with when it was applied
+func printMigrationStatus(session gocqlx.Session) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationTables(session); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(session)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		row, ok := applied[m.Version]
+		switch {
+		case !ok:
+			fmt.Printf("   %04d_%-30s pending\n", m.Version, m.Name)
+		case row.Checksum != m.checksum():
+			fmt.Printf("   %04d_%-30s applied %s, file changed since\n", m.Version, m.Name, row.AppliedAt.Format(time.RFC3339))
+		default:
+			fmt.Printf("   %04d_%-30s applied %s\n", m.Version, m.Name, row.AppliedAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// runMigrateCommand handles `migrate up [n]`, `migrate down [n]` and
+// `migrate status`. up applies every pending migration unless n is given;
+// down reverts one unless n is given.
+func runMigrateCommand(session gocqlx.Session, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up [n] | down [n] | status")
+	}
+
+	steps := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("migrate %s: step count must be a positive integer", args[0])
+		}
+		steps = n
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := migrateUp(session, steps)
+		for _, m := range done {
+			fmt.Printf("✓ Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("✓ Schema is up to date")
+		}
+		return err
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		done, err := migrateDown(session, steps)
+		for _, m := range done {
+			fmt.Printf("✓ Reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("✓ No migrations to revert")
+		}
+		return err
+	case "status":
+		return printMigrationStatus(session)
+	default:
+		return fmt.Errorf("unknown migrate command %q: use up, down or status", args[0])
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestMigrationChecksum(t *testing.T) {
+	m := migration{Up: "-- Users\nCREATE TABLE users (id text PRIMARY KEY);\n"}
+	commented := migration{Up: "-- Users, keyed by ID.\n-- See the README.\nCREATE TABLE users (id text PRIMARY KEY);\n"}
+	changed := migration{Up: "-- Users\nCREATE TABLE users (id uuid PRIMARY KEY);\n"}
+
+	if m.checksum() != commented.checksum() {
+		t.Error("editing a comment changed the checksum")
+	}
+	if m.checksum() == changed.checksum() {
+		t.Error("editing a statement kept the checksum")
+	}
+}
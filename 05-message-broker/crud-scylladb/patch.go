@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/scylladb/gocqlx/v2/qb"
+)
+
+// patchAttempts is how often PATCH re-reads a user that changed under it
+// before answering 409 Conflict
+const patchAttempts = 3
+
+// PatchUserRequest is the body of PATCH /users/{id}. Its fields are the
+// mask: the ones present are changed, the ones left out are not written at
+// all, and fields the user doesn't have are refused.
+type PatchUserRequest struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+
+	// The version the client last read, as in UpdateUserRequest. Without it
+	// the patch applies to whatever version is current.
+	Version int64 `json:"version,omitempty"`
+}
+
+// UserPatch is a partial update of a user; nil fields are left alone
+type UserPatch struct {
+	Name  *string
+	Email *string
+}
+
+// validate checks a patch changes something, and nothing to empty
+func (p UserPatch) validate() error {
+	if p.Name == nil && p.Email == nil {
+		return errors.New("set at least one of name and email")
+	}
+	if (p.Name != nil && *p.Name == "") || (p.Email != nil && *p.Email == "") {
+		return errors.New("name and email can't be empty")
+	}
+	return nil
+}
+
+// columns are the users columns the patch writes
+func (p UserPatch) columns() []string {
+	var columns []string
+	if p.Name != nil {
+		columns = append(columns, "name")
+	}
+	if p.Email != nil {
+		columns = append(columns, "email")
+	}
+	return columns
+}
+
+// apply returns user with the patch's fields changed
+func (p UserPatch) apply(user User) User {
+	if p.Name != nil {
+		user.Name = *p.Name
+	}
+	if p.Email != nil {
+		user.Email = *p.Email
+	}
+	return user
+}
+
+// Patch writes only the columns the patch sets, with updated_at and the
+// next version. Like Update it only applies while the user is still at
+// previous.Version, so previous is exact for the lookup row and the event
+// diff, but the columns left out are never written: a concurrent change to
+// another field survives, and a retry after errVersionConflict is safe.
+//
+// The UPDATE is built per patch rather than through QueryBuilder. There are
+// only a few column sets, and gocql prepares each statement text once.
+func (r ScyllaUserRepository) Patch(ctx context.Context, previous User, patch UserPatch) (_ User, err error) {
+	defer observeOperation("patch_user", time.Now(), &err)
+	next := patch.apply(previous)
+	next.Version = previous.Version + 1
+	next.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+
+	update := userTable.UpdateBuilder(append(patch.columns(), "updated_at", "version")...)
+	if previous.Version == 0 {
+		update = update.If(qb.EqLit("version", "null"))
+	} else {
+		update = update.If(qb.EqNamed("version", "expected_version"))
+	}
+	applied, err := inRequest(ctx, r.session.Query(update.ToCql())).
+		BindStructMap(next, qb.M{"expected_version": previous.Version}).
+		ExecCASRelease()
+	if err != nil {
+		return User{}, fmt.Errorf("failed to patch user: %w", err)
+	}
+	if !applied {
+		return User{}, errVersionConflict
+	}
+
+	if err := r.moveEmailLookup(ctx, previous, next); err != nil {
+		return User{}, fmt.Errorf("user patched but its email lookup row was not moved: %w", err)
+	}
+	return next, nil
+}
+
+// patchUserHandler handles PATCH /users/{id}. Unlike PUT, a change to a
+// field the body leaves out doesn't make it fail: when the user changes
+// between the read and the write, the patch is applied again to the new
+// version, up to patchAttempts times. A client that sends its version gets
+// 409 Conflict instead, as with PUT.
+func (s *server) patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := mux.Vars(r)["id"]
+
+	var req PatchUserRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields() // a misspelt field would otherwise patch nothing
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+			Error:   err.Error(),
+		})
+		return
+	}
+	patch := UserPatch{Name: req.Name, Email: req.Email}
+	if err := patch.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid patch",
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// Every attempt's read and write share one deadline
+	ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+	defer cancel()
+
+	var current *User
+	for attempt := 0; attempt < patchAttempts; attempt++ {
+		var err error
+		if current, err = s.users.Get(ctx, userID); err != nil {
+			w.WriteHeader(dbErrorStatus(err))
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "Failed to get user",
+				Error:   err.Error(),
+			})
+			return
+		}
+		if current == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "User not found",
+			})
+			return
+		}
+		if req.Version != 0 && req.Version != current.Version {
+			writeVersionConflict(w, current)
+			return
+		}
+
+		patched, err := s.users.Patch(ctx, *current, patch)
+		if errors.Is(err, errVersionConflict) {
+			continue // changed or deleted since the read, which the next one shows
+		}
+		if err != nil {
+			w.WriteHeader(dbErrorStatus(err))
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "Failed to patch user",
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		if err := s.recordEvent(ctx, newUserEvent(r, eventUpdated, current, &patched)); err != nil {
+			writeEventError(w, eventUpdated, err, &patched)
+			return
+		}
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: true,
+			Message: "User patched successfully",
+			Data:    patched,
+		})
+		return
+	}
+
+	// Every attempt lost the race; current is the last version read
+	writeVersionConflict(w, current)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/scylladb/gocqlx/v2"
+	"github.com/scylladb/gocqlx/v2/qb"
+)
+
+// UserRepository is the storage behind the HTTP handlers.
+// ScyllaUserRepository is the real one; the handler tests use an in-memory
+// fake that keeps the same contract:
+//
+//   - Create returns errUserExists when the ID is taken
+//   - Get returns nil and no error for a missing user
+//   - GetByEmail returns the lookup rows: ID, name, email and created_at
+//   - Update returns errVersionConflict unless the stored user is still at
+//     previous.Version, and gives user its new version and updated_at
+//   - Patch likewise, writing only the fields the patch sets, and returns
+//     the user as the patch left it
+//   - Delete succeeds whether or not the user exists
+//   - CreateMany returns one error per user, nil for those created
+//   - RecordEvents likewise returns one error per event
+//   - Events returns a user's events oldest first, also once it is deleted
+//   - Export hands every user to page exactly once, in pages of at most
+//     exportPageSize, and stops at the first error page returns
+type UserRepository interface {
+	Create(ctx context.Context, user User) error
+	CreateMany(ctx context.Context, users []User) []error
+	Get(ctx context.Context, id string) (*User, error)
+	GetByEmail(ctx context.Context, email string) ([]User, error)
+	List(ctx context.Context) ([]User, error)
+	Export(ctx context.Context, page func([]User) error) error
+	Update(ctx context.Context, previous User, user *User) error
+	Patch(ctx context.Context, previous User, patch UserPatch) (User, error)
+	Delete(ctx context.Context, user User) error
+	RecordEvents(ctx context.Context, events []UserEvent) []error
+	Events(ctx context.Context, userID string) ([]UserEvent, error)
+}
+
+// ScyllaUserRepository stores users in the users and users_by_email tables
+type ScyllaUserRepository struct {
+	session *instrumentedSession
+}
+
+// NewScyllaUserRepository returns a repository on a session bound to the keyspace
+func NewScyllaUserRepository(session gocqlx.Session) ScyllaUserRepository {
+	return ScyllaUserRepository{session: newInstrumentedSession(session)}
+}
+
+// Create inserts a new user with INSERT ... IF NOT EXISTS, so an ID
+// collision returns errUserExists instead of overwriting, then writes its
+// email lookup row. A conditional write can't share a batch with another
+// table, so the lookup row follows separately. If that write fails,
+// reindexEmails restores it.
+func (r ScyllaUserRepository) Create(ctx context.Context, user User) (err error) {
+	defer observeOperation("create_user", time.Now(), &err)
+	if user.Version == 0 {
+		user.Version = 1
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = user.CreatedAt
+	}
+
+	applied, err := inRequest(ctx, r.session.QueryBuilder(insertUserIfNotExists)).BindStruct(user).ExecCASRelease()
+	if err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	if !applied {
+		return errUserExists
+	}
+	if err := inRequest(ctx, r.session.Query(usersByEmailTable.Insert())).BindStruct(user).ExecRelease(); err != nil {
+		return fmt.Errorf("user created but its email lookup row was not written: %w", err)
+	}
+	return nil
+}
+
+// Get retrieves a user by ID
+func (r ScyllaUserRepository) Get(ctx context.Context, id string) (_ *User, err error) {
+	defer observeOperation("get_user_by_id", time.Now(), &err)
+	var user User
+	q := inRequest(ctx, r.session.Query(userTable.Get())).BindMap(qb.M{"id": id})
+	if err := q.GetRelease(&user); err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return &user, nil
+}
+
+// GetByEmail retrieves the users with an email, usually one, from the
+// lookup table. The email must match exactly.
+func (r ScyllaUserRepository) GetByEmail(ctx context.Context, email string) (_ []User, err error) {
+	defer observeOperation("get_users_by_email", time.Now(), &err)
+	var users []User
+	q := inRequest(ctx, r.session.Query(usersByEmailTable.Select())).BindMap(qb.M{"email": email})
+	if err := q.SelectRelease(&users); err != nil {
+		return nil, fmt.Errorf("failed to get users by email: %w", err)
+	}
+	return users, nil
+}
+
+// Update updates an existing user's name and email. previous is the
+// stored user as it was read: the update only applies if its version is
+// still current, and returns errVersionConflict otherwise, also when the
+// user was deleted meanwhile. On success user gets its new version and
+// updated_at, and the lookup row is moved when the email changes.
+func (r ScyllaUserRepository) Update(ctx context.Context, previous User, user *User) (err error) {
+	defer observeOperation("update_user", time.Now(), &err)
+	next := *user
+	next.Version = previous.Version + 1
+	next.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond) // CQL timestamps have millisecond precision
+
+	update := updateUserIfVersion
+	if previous.Version == 0 {
+		update = updateUserIfUnversioned
+	}
+	applied, err := inRequest(ctx, r.session.QueryBuilder(update)).
+		BindStructMap(next, qb.M{"expected_version": previous.Version}).
+		ExecCASRelease()
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	if !applied {
+		return errVersionConflict
+	}
+	*user = next
+
+	if err := r.moveEmailLookup(ctx, previous, next); err != nil {
+		return fmt.Errorf("user updated but its email lookup row was not moved: %w", err)
+	}
+	return nil
+}
+
+// moveEmailLookup rewrites the lookup row of a user changed from previous
+// to next, deleting the old row when the email changed. The conditional
+// update before it can't share a batch with users_by_email, but the lookup
+// row's delete and insert still go together.
+func (r ScyllaUserRepository) moveEmailLookup(ctx context.Context, previous, next User) error {
+	lookup := next
+	lookup.CreatedAt = previous.CreatedAt // created_at is never updated
+
+	batch := newBatch(ctx, r.session)
+	// A delete and an insert of the same row in one batch share a timestamp,
+	// and the delete would win, so the old row is only deleted when it moves
+	if previous.Email != next.Email {
+		stmt, names := usersByEmailTable.Delete()
+		if err := addToBatch(batch, stmt, names, previous); err != nil {
+			return err
+		}
+	}
+	stmt, names := usersByEmailTable.Insert()
+	if err := addToBatch(batch, stmt, names, lookup); err != nil {
+		return err
+	}
+	return r.session.ExecuteBatch(batch)
+}
+
+// Delete removes a user and its email lookup row in one logged batch
+func (r ScyllaUserRepository) Delete(ctx context.Context, user User) (err error) {
+	defer observeOperation("delete_user", time.Now(), &err)
+	batch := newBatch(ctx, r.session)
+	stmt, names := userTable.Delete()
+	if err := addToBatch(batch, stmt, names, user); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	stmt, names = usersByEmailTable.Delete()
+	if err := addToBatch(batch, stmt, names, user); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if err := r.session.ExecuteBatch(batch); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
+
+// reindexEmails writes the lookup row of every user, for users created
+// before users_by_email existed. Rewriting an existing row is harmless.
+func (r ScyllaUserRepository) reindexEmails(ctx context.Context) (int, error) {
+	users, err := r.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i, user := range users {
+		q := inRequest(ctx, r.session.Query(usersByEmailTable.Insert())).BindStruct(user)
+		if err := q.ExecRelease(); err != nil {
+			return i, fmt.Errorf("failed to index user %s: %w", user.ID, err)
+		}
+	}
+	return len(users), nil
+}
+
+// newBatch starts a logged batch that is abandoned when ctx ends
+func newBatch(ctx context.Context, session *instrumentedSession) *gocql.Batch {
+	return requestBatch(ctx, session.NewBatch(gocql.LoggedBatch))
+}
+
+// addToBatch adds stmt to batch, bound to the fields of arg named by names.
+// gocqlx binds structs to queries but not to batches, whose entries take
+// positional values, so they are looked up with gocqlx's mapper, by db tag.
+func addToBatch(batch *gocql.Batch, stmt string, names []string, arg interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(arg))
+	values := make([]interface{}, len(names))
+	for i, index := range gocqlx.DefaultMapper.TraversalsByName(v.Type(), names) {
+		if len(index) == 0 {
+			return fmt.Errorf("could not find name %q in %T", names[i], arg)
+		}
+		values[i] = v.FieldByIndex(index).Interface()
+	}
+	batch.Query(stmt, values...)
+	return nil
+}
+
+// List retrieves all users from the database
+func (r ScyllaUserRepository) List(ctx context.Context) (_ []User, err error) {
+	defer observeOperation("get_all_users", time.Now(), &err)
+	var users []User
+	q := inRequest(ctx, r.session.Query(userTable.SelectAll()))
+	if err := q.SelectRelease(&users); err != nil {
+		return nil, fmt.Errorf("failed to get all users: %w", err)
+	}
+	return users, nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/google/uuid"
+)
+
+// memoryUserRepository is a UserRepository in a map, for tests that
+// exercise the handlers without a database. Setting fail makes every call
+// return it, the way a timed out or unreachable cluster would.
+type memoryUserRepository struct {
+	mu     sync.Mutex
+	users  map[string]User
+	events map[string][]UserEvent // by user ID, in the order recorded
+	fail   error
+}
+
+func newMemoryUserRepository() *memoryUserRepository {
+	return &memoryUserRepository{users: make(map[string]User), events: make(map[string][]UserEvent)}
+}
+
+func (m *memoryUserRepository) Create(_ context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+	if _, ok := m.users[user.ID]; ok {
+		return errUserExists
+	}
+	if user.Version == 0 {
+		user.Version = 1
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = user.CreatedAt
+	}
+	m.users[user.ID] = user
+	return nil
+}
+
+// CreateMany overwrites, as the unconditional batches of the real one do
+func (m *memoryUserRepository) CreateMany(_ context.Context, users []User) []error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	errs := make([]error, len(users))
+	for i, user := range users {
+		if m.fail != nil {
+			errs[i] = m.fail
+			continue
+		}
+		m.users[user.ID] = user
+	}
+	return errs
+}
+
+func (m *memoryUserRepository) Get(_ context.Context, id string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	user, ok := m.users[id]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+// GetByEmail returns what a users_by_email row holds, sorted by ID like its
+// clustering column
+func (m *memoryUserRepository) GetByEmail(_ context.Context, email string) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	var users []User
+	for _, u := range m.users {
+		if u.Email == email {
+			users = append(users, User{ID: u.ID, Name: u.Name, Email: u.Email, CreatedAt: u.CreatedAt})
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int { return strings.Compare(a.ID, b.ID) })
+	return users, nil
+}
+
+func (m *memoryUserRepository) List(_ context.Context) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, u)
+	}
+	slices.SortFunc(users, func(a, b User) int { return strings.Compare(a.ID, b.ID) })
+	return users, nil
+}
+
+// Export pages through the users in ID order, which stands in for token order
+func (m *memoryUserRepository) Export(ctx context.Context, page func([]User) error) error {
+	users, err := m.List(ctx)
+	if err != nil {
+		return err
+	}
+	for chunk := range slices.Chunk(users, exportPageSize) {
+		if err := page(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryUserRepository) Update(_ context.Context, previous User, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+	stored, ok := m.users[previous.ID]
+	if !ok || stored.Version != previous.Version {
+		return errVersionConflict
+	}
+	next := *user
+	next.Version = previous.Version + 1
+	next.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	*user = next
+
+	stored.Name, stored.Email = next.Name, next.Email
+	stored.UpdatedAt, stored.Version = next.UpdatedAt, next.Version
+	m.users[stored.ID] = stored
+	return nil
+}
+
+func (m *memoryUserRepository) Patch(_ context.Context, previous User, patch UserPatch) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return User{}, m.fail
+	}
+	stored, ok := m.users[previous.ID]
+	if !ok || stored.Version != previous.Version {
+		return User{}, errVersionConflict
+	}
+	next := patch.apply(stored)
+	next.Version = previous.Version + 1
+	next.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	m.users[next.ID] = next
+	return next, nil
+}
+
+func (m *memoryUserRepository) Delete(_ context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+	delete(m.users, user.ID)
+	return nil
+}
+
+func (m *memoryUserRepository) RecordEvents(_ context.Context, events []UserEvent) []error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	errs := make([]error, len(events))
+	for i, event := range events {
+		if m.fail != nil {
+			errs[i] = m.fail
+			continue
+		}
+		m.events[event.UserID] = append(m.events[event.UserID], event)
+	}
+	return errs
+}
+
+func (m *memoryUserRepository) Events(_ context.Context, userID string) ([]UserEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	return slices.Clone(m.events[userID]), nil
+}
+
+func (m *memoryUserRepository) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.users)
+	clear(m.events)
+}
+
+func newTestUser(name string) User {
+	return User{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Email:     name + "@example.com",
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond), // CQL timestamps have millisecond precision
+		Version:   1,
+	}
+}
+
+// The fake keeps the contract the integration tests hold ScyllaUserRepository to
+func TestMemoryUserRepository(t *testing.T) {
+	repo := newMemoryUserRepository()
+	testUserRepositoryContract(t, repo, func(*testing.T) { repo.reset() })
+}
+
+// testUserRepositoryContract checks the promises of UserRepository that
+// the handlers rely on. reset empties the repository.
+func testUserRepositoryContract(t *testing.T, repo UserRepository, reset func(t *testing.T)) {
+
+	t.Run("get missing user returns nil without error", func(t *testing.T) {
+		user, err := repo.Get(context.Background(), uuid.New().String())
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if user != nil {
+			t.Fatalf("expected nil user, got %+v", user)
+		}
+	})
+
+	t.Run("create then get round-trips every field", func(t *testing.T) {
+		want := newTestUser("alice")
+		if err := repo.Create(context.Background(), want); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		got, err := repo.Get(context.Background(), want.ID)
+		if err != nil || got == nil {
+			t.Fatalf("Get: user=%v err=%v", got, err)
+		}
+		if got.Name != want.Name || got.Email != want.Email || !got.CreatedAt.Equal(want.CreatedAt) || got.Version != 1 {
+			t.Fatalf("got %+v, want %+v", *got, want)
+		}
+	})
+
+	t.Run("update changes name and email only", func(t *testing.T) {
+		user := newTestUser("bob")
+		if err := repo.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		updated := user
+		updated.Name = "Robert"
+		updated.Email = "robert@example.com"
+		updated.CreatedAt = time.Time{}
+		if err := repo.Update(context.Background(), user, &updated); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		got, err := repo.Get(context.Background(), user.ID)
+		if err != nil || got == nil {
+			t.Fatalf("Get: user=%v err=%v", got, err)
+		}
+		if got.Name != "Robert" || got.Email != "robert@example.com" {
+			t.Fatalf("update not applied: %+v", *got)
+		}
+		if !got.CreatedAt.Equal(user.CreatedAt) {
+			t.Fatalf("created_at changed from %v to %v", user.CreatedAt, got.CreatedAt)
+		}
+		if got.Version != 2 || updated.Version != 2 || !got.UpdatedAt.Equal(updated.UpdatedAt) {
+			t.Fatalf("expected version 2 with updated_at %v, got %+v", updated.UpdatedAt, *got)
+		}
+	})
+
+	t.Run("patch writes only the fields it sets", func(t *testing.T) {
+		user := newTestUser("bea")
+		if err := repo.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		stored, err := repo.Get(context.Background(), user.ID)
+		if err != nil || stored == nil {
+			t.Fatalf("Get: user=%v err=%v", stored, err)
+		}
+		email := "beatrice@example.com"
+		patched, err := repo.Patch(context.Background(), *stored, UserPatch{Email: &email})
+		if err != nil {
+			t.Fatalf("Patch: %v", err)
+		}
+		if patched.Name != user.Name || patched.Email != email || patched.Version != 2 {
+			t.Fatalf("patch returned %+v", patched)
+		}
+		got, err := repo.Get(context.Background(), user.ID)
+		if err != nil || got == nil || got.Name != user.Name || got.Email != email || got.Version != 2 || !got.CreatedAt.Equal(user.CreatedAt) {
+			t.Fatalf("Get after patch: user=%+v err=%v", got, err)
+		}
+		if users, err := repo.GetByEmail(context.Background(), email); err != nil || len(users) != 1 || users[0].Name != user.Name {
+			t.Fatalf("GetByEmail(%q) after patch: users=%+v err=%v", email, users, err)
+		}
+
+		// A patch from the old read is refused, the current one applies
+		name := "Bea"
+		if _, err := repo.Patch(context.Background(), *stored, UserPatch{Name: &name}); !errors.Is(err, errVersionConflict) {
+			t.Fatalf("Patch from a stale read: got %v, want errVersionConflict", err)
+		}
+		if patched, err = repo.Patch(context.Background(), *got, UserPatch{Name: &name}); err != nil || patched.Name != name || patched.Email != email || patched.Version != 3 {
+			t.Fatalf("Patch: user=%+v err=%v", patched, err)
+		}
+	})
+
+	t.Run("delete removes the user and is idempotent", func(t *testing.T) {
+		user := newTestUser("carol")
+		if err := repo.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := repo.Delete(context.Background(), user); err != nil {
+				t.Fatalf("Delete (call %d): %v", i+1, err)
+			}
+		}
+		if got, err := repo.Get(context.Background(), user.ID); err != nil || got != nil {
+			t.Fatalf("expected user gone, got user=%v err=%v", got, err)
+		}
+	})
+
+	t.Run("events are kept oldest first, after the user is deleted too", func(t *testing.T) {
+		user := newTestUser("dave")
+		if err := repo.Create(context.Background(), user); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/users", nil)
+		req.Header.Set(actorHeader, "admin")
+		renamed := user
+		renamed.Name = "David"
+		want := []UserEvent{
+			newUserEvent(req, eventCreated, nil, &user),
+			newUserEvent(req, eventUpdated, &user, &renamed),
+		}
+		for i, err := range repo.RecordEvents(context.Background(), want) {
+			if err != nil {
+				t.Fatalf("RecordEvents (event %d): %v", i, err)
+			}
+		}
+		if err := repo.Delete(context.Background(), renamed); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+
+		got, err := repo.Events(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("Events: %v", err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %d events, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].EventID != want[i].EventID || got[i].Action != want[i].Action || got[i].Actor != "admin" ||
+				!got[i].OccurredAt.Equal(want[i].OccurredAt) || string(got[i].Diff) != string(want[i].Diff) {
+				t.Fatalf("event %d: got %+v, want %+v", i, got[i], want[i])
+			}
+		}
+		if events, err := repo.Events(context.Background(), uuid.New().String()); err != nil || len(events) != 0 {
+			t.Fatalf("events of an unknown user: %v, err=%v", events, err)
+		}
+	})
+
+	t.Run("list returns every user", func(t *testing.T) {
+		reset(t)
+		ids := make(map[string]bool)
+		for i := 0; i < 5; i++ {
+			user := newTestUser("list" + strconv.Itoa(i))
+			if err := repo.Create(context.Background(), user); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			ids[user.ID] = true
+		}
+		users, err := repo.List(context.Background())
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(users) != len(ids) {
+			t.Fatalf("got %d users, want %d", len(users), len(ids))
+		}
+		for _, u := range users {
+			if !ids[u.ID] {
+				t.Fatalf("unexpected user %+v", u)
+			}
+		}
+	})
+
+	t.Run("export pages through every user once", func(t *testing.T) {
+		reset(t)
+		previous := exportPageSize
+		exportPageSize = 2
+		t.Cleanup(func() { exportPageSize = previous })
+
+		ids := make(map[string]bool)
+		for i := 0; i < 5; i++ {
+			user := newTestUser("export" + strconv.Itoa(i))
+			if err := repo.Create(context.Background(), user); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			ids[user.ID] = true
+		}
+		seen := make(map[string]bool)
+		pages := 0
+		err := repo.Export(context.Background(), func(users []User) error {
+			pages++
+			if len(users) == 0 || len(users) > exportPageSize {
+				t.Fatalf("page of %d users, want 1 to %d", len(users), exportPageSize)
+			}
+			for _, u := range users {
+				if !ids[u.ID] || seen[u.ID] {
+					t.Fatalf("unexpected or repeated user %+v", u)
+				}
+				seen[u.ID] = true
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Export: %v", err)
+		}
+		// Pages don't span token ranges, so there can be more than 3
+		if len(seen) != len(ids) || pages < 3 {
+			t.Fatalf("exported %d of %d users in %d pages, want all in 3 or more", len(seen), len(ids), pages)
+		}
+
+		stop := errors.New("stop")
+		pages = 0
+		err = repo.Export(context.Background(), func([]User) error { pages++; return stop })
+		if !errors.Is(err, stop) || pages != 1 {
+			t.Fatalf("Export after a failing page: err=%v after %d pages, want stop after 1", err, pages)
+		}
+	})
+}
+
+func TestTokenRanges(t *testing.T) {
+	for _, n := range []int{1, 3, 64} {
+		ranges := tokenRanges(n)
+		if len(ranges) != n {
+			t.Fatalf("tokenRanges(%d) returned %d ranges", n, len(ranges))
+		}
+		if ranges[0].After != math.MinInt64 || ranges[n-1].UpTo != math.MaxInt64 {
+			t.Errorf("tokenRanges(%d) covers %d to %d, want the whole ring", n, ranges[0].After, ranges[n-1].UpTo)
+		}
+		for i, tr := range ranges {
+			if tr.UpTo <= tr.After {
+				t.Errorf("tokenRanges(%d)[%d] = %+v is empty", n, i, tr)
+			}
+			if i > 0 && tr.After != ranges[i-1].UpTo {
+				t.Errorf("tokenRanges(%d)[%d] starts at %d, want %d where the previous one ends", n, i, tr.After, ranges[i-1].UpTo)
+			}
+		}
+	}
+}
+
+func TestAddToBatch(t *testing.T) {
+	user := newTestUser("Ada")
+	batch := &gocql.Batch{}
+
+	stmt, names := usersByEmailTable.Insert()
+	if err := addToBatch(batch, stmt, names, user); err != nil {
+		t.Fatalf("add lookup insert: %v", err)
+	}
+	if err := addToBatch(batch, stmt, []string{"email", "nickname"}, user); err == nil {
+		t.Fatal("a name User has no field for was bound")
+	}
+
+	if len(batch.Entries) != 1 {
+		t.Fatalf("batch holds %d entries, want 1", len(batch.Entries))
+	}
+	entry := batch.Entries[0]
+	if entry.Stmt != stmt || len(entry.Args) != len(names) {
+		t.Fatalf("entry %q with %d values, want %q with %d", entry.Stmt, len(entry.Args), stmt, len(names))
+	}
+	byName := map[string]any{"id": user.ID, "name": user.Name, "email": user.Email, "created_at": user.CreatedAt}
+	for i, name := range names {
+		if want, ok := byName[name]; ok && entry.Args[i] != want {
+			t.Errorf("value %d (%s) = %v, want %v", i, name, entry.Args[i], want)
+		}
+	}
+}
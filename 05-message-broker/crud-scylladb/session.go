@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	"github.com/scylladb/gocqlx/v2"
+	"github.com/scylladb/gocqlx/v2/qb"
+)
+
+// slowQueryThreshold is the latency above which a query attempt is logged
+// and counted as slow; 0 logs none
+var slowQueryThreshold = 100 * time.Millisecond
+
+// instrumentedSession is the session ScyllaUserRepository queries through.
+// gocql prepares every statement on first use and keeps it in a cache per
+// session, keyed by its text. On top of that, instrumentedSession:
+//
+//   - builds each qb statement once and reuses its CQL, so a request
+//     doesn't render it again before the lookup in gocql's cache
+//   - observes every query and batch attempt it sends, for the metrics and
+//     to log the ones slower than slowQueryThreshold
+//   - attributes each slow attempt to the handler that sent it, from the
+//     name tagHandler put in the request's context
+type instrumentedSession struct {
+	gocqlx.Session
+	mu    sync.RWMutex
+	stmts map[qb.Builder]statement
+}
+
+// statement is the CQL of a qb builder and its bind names
+type statement struct {
+	cql   string
+	names []string
+}
+
+func newInstrumentedSession(session gocqlx.Session) *instrumentedSession {
+	return &instrumentedSession{Session: session, stmts: make(map[qb.Builder]statement)}
+}
+
+// Query returns a query observed by s
+func (s *instrumentedSession) Query(stmt string, names []string) *gocqlx.Queryx {
+	q := s.Session.Query(stmt, names)
+	q.Observer(s)
+	return q
+}
+
+// QueryBuilder returns a query of b's statement, built on its first use
+func (s *instrumentedSession) QueryBuilder(b qb.Builder) *gocqlx.Queryx {
+	s.mu.RLock()
+	st, ok := s.stmts[b]
+	s.mu.RUnlock()
+	if !ok {
+		st.cql, st.names = b.ToCql()
+		s.mu.Lock()
+		s.stmts[b] = st
+		s.mu.Unlock()
+	}
+	return s.Query(st.cql, st.names)
+}
+
+// ExecuteBatch executes batch, observed by s
+func (s *instrumentedSession) ExecuteBatch(batch *gocql.Batch) error {
+	batch.Observer(s)
+	return s.Session.ExecuteBatch(batch)
+}
+
+// ObserveQuery implements gocql.QueryObserver, replacing the cluster's
+// observer for the queries of s
+func (s *instrumentedSession) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	metrics.ObserveQuery(ctx, q)
+	observeSlow(ctx, q.Statement, q.End.Sub(q.Start), q.Attempt, q.Host, q.Err)
+}
+
+// ObserveBatch implements gocql.BatchObserver. Batches aren't in the query
+// metrics, which count single statements, but a slow one is still logged.
+func (s *instrumentedSession) ObserveBatch(ctx context.Context, b gocql.ObservedBatch) {
+	stmt := "BATCH"
+	if len(b.Statements) > 0 {
+		stmt = fmt.Sprintf("BATCH of %d: %s", len(b.Statements), b.Statements[0])
+	}
+	observeSlow(ctx, stmt, b.End.Sub(b.Start), b.Attempt, b.Host, b.Err)
+}
+
+// observeSlow logs and counts an attempt that took longer than
+// slowQueryThreshold. Bound values are left out of the log, they hold
+// users' names and emails.
+func observeSlow(ctx context.Context, stmt string, elapsed time.Duration, attempt int, host *gocql.HostInfo, err error) {
+	if slowQueryThreshold <= 0 || elapsed <= slowQueryThreshold {
+		return
+	}
+	handler := handlerName(ctx)
+	metrics.observeSlowQuery(handler)
+
+	addr := "unknown host"
+	if host != nil {
+		addr = host.ConnectAddressAndPort()
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = err.Error()
+	}
+	log.Printf("Slow query: %s on %s, handler %s, attempt %d (%s): %s",
+		elapsed.Round(time.Millisecond), addr, handler, attempt, outcome, stmt)
+}
+
+// handlerKey is the context key of the handler name
+type handlerKey struct{}
+
+// withHandler tags ctx, and every query run with it, with a handler name
+func withHandler(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, handlerKey{}, name)
+}
+
+// handlerName is the handler ctx was tagged with, "none" outside a request
+// such as in the demo or reindex
+func handlerName(ctx context.Context) string {
+	if name, ok := ctx.Value(handlerKey{}).(string); ok {
+		return name
+	}
+	return "none"
+}
+
+// tagHandler is the middleware that tags each request with the name of
+// the route that matched it
+func tagHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+			r = r.WithContext(withHandler(r.Context(), route.GetName()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
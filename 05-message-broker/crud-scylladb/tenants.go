@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/scylladb/gocqlx/v2"
+)
+
+// tenantHeader names the tenant of a request on a multi-tenant server
+const tenantHeader = "X-Tenant"
+
+// tenantID is what a tenant may be called: its keyspace name is built from
+// it, and CQL folds unquoted names to lower case
+var tenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9_]*$`)
+
+var (
+	errInvalidTenant  = errors.New("invalid tenant")
+	errTooManyTenants = errors.New("tenant limit reached")
+)
+
+// tenantRegistry gives each tenant its own keyspace, <keyspace>_<tenant>,
+// with the same tables as the default one. A tenant's keyspace is created
+// and migrated on the first request for it since the process started, so
+// new tenants need no setup and existing ones get new migrations lazily.
+// Every tenant holds a session, with connections to every node, so the
+// registry refuses tenants beyond max.
+type tenantRegistry struct {
+	keyspace  string // the default keyspace, prefix of the tenants'
+	max       int
+	provision func(keyspace string) (UserRepository, func(), error) // returns the repository and its closer
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+}
+
+// tenant is one registry entry. ready is closed once provisioning ended,
+// with users set or err saying why not.
+type tenant struct {
+	ready chan struct{}
+	users UserRepository
+	close func()
+	err   error
+}
+
+// newTenantRegistry provisions tenant keyspaces on the cluster of cfg.
+// admin is any session on it, to create the keyspaces.
+func newTenantRegistry(cfg Config, admin gocqlx.Session) *tenantRegistry {
+	return &tenantRegistry{
+		keyspace: cfg.Keyspace,
+		max:      cfg.MaxTenants,
+		tenants:  make(map[string]*tenant),
+		provision: func(keyspace string) (UserRepository, func(), error) {
+			tenantCfg := cfg
+			tenantCfg.Keyspace = keyspace
+			if err := createKeyspace(admin, tenantCfg); err != nil {
+				return nil, nil, err
+			}
+			cluster := cfg.newCluster()
+			cluster.Keyspace = keyspace
+			session, err := gocqlx.WrapSession(cluster.CreateSession())
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to connect to keyspace %s: %w", keyspace, err)
+			}
+			if _, err := migrateUp(session, 0); err != nil {
+				session.Close()
+				return nil, nil, fmt.Errorf("failed to migrate keyspace %s: %w", keyspace, err)
+			}
+			return NewScyllaUserRepository(session), session.Close, nil
+		},
+	}
+}
+
+// keyspaceOf returns the keyspace of tenant id, or errInvalidTenant when id
+// can't be one
+func (reg *tenantRegistry) keyspaceOf(id string) (string, error) {
+	keyspace := reg.keyspace + "_" + id
+	if !tenantID.MatchString(id) || !keyspaceName.MatchString(keyspace) {
+		return "", fmt.Errorf("%w: %q must be lower-case letters, digits and underscores, and at most %d characters",
+			errInvalidTenant, id, 47-len(reg.keyspace))
+	}
+	return keyspace, nil
+}
+
+// users returns the repository of tenant id, provisioning its keyspace on
+// first use. Concurrent first requests for a tenant wait for a single
+// provisioning; ctx only bounds the wait. A failed provisioning is retried
+// by the next request.
+func (reg *tenantRegistry) users(ctx context.Context, id string) (UserRepository, error) {
+	keyspace, err := reg.keyspaceOf(id)
+	if err != nil {
+		return nil, err
+	}
+
+	reg.mu.Lock()
+	t, found := reg.tenants[id]
+	if !found {
+		if len(reg.tenants) >= reg.max {
+			reg.mu.Unlock()
+			return nil, fmt.Errorf("%w: this server holds %d tenants", errTooManyTenants, reg.max)
+		}
+		t = &tenant{ready: make(chan struct{})}
+		reg.tenants[id] = t
+	}
+	reg.mu.Unlock()
+
+	if !found {
+		t.users, t.close, t.err = reg.provision(keyspace)
+		if t.err != nil {
+			log.Printf("Provisioning tenant %s failed: %v", id, t.err)
+			reg.mu.Lock()
+			delete(reg.tenants, id)
+			reg.mu.Unlock()
+		} else {
+			log.Printf("Tenant %s ready in keyspace %s", id, keyspace)
+		}
+		close(t.ready)
+	}
+
+	select {
+	case <-t.ready:
+		return t.users, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the session of every tenant provisioned
+func (reg *tenantRegistry) Close() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for id, t := range reg.tenants {
+		select {
+		case <-t.ready:
+			if t.err == nil {
+				t.close()
+			}
+		default: // still provisioning; the process is exiting anyway
+		}
+		delete(reg.tenants, id)
+	}
+}
+
+// middleware routes each request to its tenant's repository, from the
+// X-Tenant header. The health check is the cluster's, so it needs none.
+func (reg *tenantRegistry) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == "health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := r.Header.Get(tenantHeader)
+		if id == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "The " + tenantHeader + " header is required",
+			})
+			return
+		}
+		users, err := reg.users(r.Context(), id)
+		if err != nil {
+			status := dbErrorStatus(err)
+			switch {
+			case errors.Is(err, errInvalidTenant):
+				status = http.StatusBadRequest
+			case errors.Is(err, errTooManyTenants):
+				status = http.StatusServiceUnavailable
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "Tenant unavailable",
+				Error:   err.Error(),
+			})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, users)))
+	})
+}
+
+// tenantKey is the context key of the tenant's repository
+type tenantKey struct{}
+
+// tenantUsers is the UserRepository of a multi-tenant server: each call goes
+// to the repository the middleware put in its context
+type tenantUsers struct{}
+
+func (tenantUsers) of(ctx context.Context) UserRepository {
+	return ctx.Value(tenantKey{}).(UserRepository)
+}
+
+func (t tenantUsers) Create(ctx context.Context, user User) error {
+	return t.of(ctx).Create(ctx, user)
+}
+
+func (t tenantUsers) CreateMany(ctx context.Context, users []User) []error {
+	return t.of(ctx).CreateMany(ctx, users)
+}
+
+func (t tenantUsers) Get(ctx context.Context, id string) (*User, error) {
+	return t.of(ctx).Get(ctx, id)
+}
+
+func (t tenantUsers) GetByEmail(ctx context.Context, email string) ([]User, error) {
+	return t.of(ctx).GetByEmail(ctx, email)
+}
+
+func (t tenantUsers) List(ctx context.Context) ([]User, error) {
+	return t.of(ctx).List(ctx)
+}
+
+func (t tenantUsers) Export(ctx context.Context, page func([]User) error) error {
+	return t.of(ctx).Export(ctx, page)
+}
+
+func (t tenantUsers) Update(ctx context.Context, previous User, user *User) error {
+	return t.of(ctx).Update(ctx, previous, user)
+}
+
+func (t tenantUsers) Patch(ctx context.Context, previous User, patch UserPatch) (User, error) {
+	return t.of(ctx).Patch(ctx, previous, patch)
+}
+
+func (t tenantUsers) Delete(ctx context.Context, user User) error {
+	return t.of(ctx).Delete(ctx, user)
+}
+
+func (t tenantUsers) RecordEvents(ctx context.Context, events []UserEvent) []error {
+	return t.of(ctx).RecordEvents(ctx, events)
+}
+
+func (t tenantUsers) Events(ctx context.Context, userID string) ([]UserEvent, error) {
+	return t.of(ctx).Events(ctx, userID)
+}
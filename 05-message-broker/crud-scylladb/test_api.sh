@@ -107,9 +107,35 @@ if [[ -n "$user_id" ]]; then
     fi
 fi
 
-# Test 7: Delete User
+# Test 7: Stale Update
 if [[ -n "$user_id" ]]; then
-    print_test "7. Delete User"
+    print_test "7. Stale Update"
+    status=$(curl -s -o /dev/null -w "%{http_code}" -X PUT "$API_BASE/users/$user_id" \
+        -H "Content-Type: application/json" \
+        -d '{"name": "Stale Test User", "version": 1}')
+    if [[ $status == "409" ]]; then
+        print_success "Update based on version 1 rejected with 409"
+    else
+        print_error "Expected 409 for a stale version, got $status"
+    fi
+fi
+
+# Test 8: Get User by Email
+if [[ -n "$user_id" ]]; then
+    print_test "8. Get User by Email"
+    response=$(curl -s "$API_BASE/users/by-email/updated@example.com")
+    if [[ $response == *"$user_id"* ]]; then
+        print_success "Found user by updated email"
+        echo "Response: $response"
+    else
+        print_error "Failed to find user by email"
+        echo "Response: $response"
+    fi
+fi
+
+# Test 9: Delete User
+if [[ -n "$user_id" ]]; then
+    print_test "9. Delete User"
     response=$(curl -s -X DELETE "$API_BASE/users/$user_id")
     if [[ $? -eq 0 ]]; then
         print_success "User deleted successfully"
@@ -119,11 +145,11 @@ if [[ -n "$user_id" ]]; then
     fi
 fi
 
-# Test 8: Verify Deletion
+# Test 10: Verify Deletion
 if [[ -n "$user_id" ]]; then
-    print_test "8. Verify Deletion"
+    print_test "10. Verify Deletion"
     response=$(curl -s "$API_BASE/users/$user_id")
-    if [[ $response == *"user not found"* ]]; then
+    if [[ $response == *"User not found"* ]]; then
         print_success "Confirmed user deletion"
         echo "Response: $response"
     else
@@ -132,5 +158,59 @@ if [[ -n "$user_id" ]]; then
     fi
 fi
 
+# Test 11: Bulk Create Users
+print_test "11. Bulk Create Users"
+status=$(curl -s -o /tmp/bulk_response.json -w "%{http_code}" -X POST "$API_BASE/users/bulk" \
+    -H "Content-Type: application/json" \
+    -d '{"users": [{"name": "Bulk One", "email": "bulk@example.com"}, {"name": "Bulk Two", "email": "bulk@example.com"}, {"name": "", "email": "invalid@example.com"}]}')
+if [[ "$status" == "207" ]]; then
+    print_success "Created the valid users and reported the invalid one (207)"
+    echo "Response: $(cat /tmp/bulk_response.json)"
+else
+    print_error "Expected 207 Multi-Status, got $status"
+    echo "Response: $(cat /tmp/bulk_response.json)"
+fi
+
+# Test 12: User History
+if [[ -n "$user_id" ]]; then
+    print_test "12. User History"
+    response=$(curl -s "$API_BASE/users/$user_id/events")
+    if [[ $response == *'"action":"created"'* && $response == *'"action":"updated"'* && $response == *'"action":"deleted"'* ]]; then
+        print_success "History of the deleted user lists its create, update and delete"
+        echo "Response: $response"
+    else
+        print_error "History is missing events"
+        echo "Response: $response"
+    fi
+fi
+
+# Test 13: Export Users
+print_test "13. Export Users"
+status=$(curl -s -o /tmp/export_users.csv -D /tmp/export_headers.txt -w "%{http_code}" "$API_BASE/users/export?format=csv")
+if [[ "$status" == "200" ]] && grep -qi "^Content-Disposition: attachment" /tmp/export_headers.txt && [[ $(head -1 /tmp/export_users.csv) == id,name,email* ]]; then
+    print_success "Exported $(($(wc -l < /tmp/export_users.csv) - 1)) users as CSV"
+    head -3 /tmp/export_users.csv
+else
+    print_error "Expected a CSV attachment, got $status"
+    cat /tmp/export_headers.txt /tmp/export_users.csv
+fi
+
+# Test 14: Patch User
+print_test "14. Patch User"
+patch_id=$(curl -s -X POST "$API_BASE/users" \
+    -H "Content-Type: application/json" \
+    -d '{"name": "Patch Test User", "email": "patch@example.com"}' | grep -o '"id":"[^"]*' | cut -d'"' -f4)
+response=$(curl -s -X PATCH "$API_BASE/users/$patch_id" \
+    -H "Content-Type: application/json" \
+    -d '{"name": "Patched User"}')
+if [[ $response == *'"name":"Patched User"'* && $response == *'"email":"patch@example.com"'* ]]; then
+    print_success "Patched the name, kept the email"
+    echo "Response: $response"
+else
+    print_error "Patch should change the name only"
+    echo "Response: $response"
+fi
+curl -s -o /dev/null -X DELETE "$API_BASE/users/$patch_id"
+
 echo -e "\n${GREEN}🎉 API Testing Complete!${NC}"
 echo "================================="
\ No newline at end of file
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// headerEnqueuedAt carries the original enqueue time (Unix milliseconds). It
+// survives retries, unlike the AMQP timestamp which is reset on republish.
+const headerEnqueuedAt = "x-enqueued-at"
+
+// latencyWindow is how many recent deliveries the percentiles are computed over
+const latencyWindow = 10000
+
+// latencyReport is the JSON body of /analytics/latency
+type latencyReport struct {
+	Window         int     `json:"window"`
+	Sent           int64   `json:"sent"`
+	P50Seconds     float64 `json:"p50_seconds"`
+	P90Seconds     float64 `json:"p90_seconds"`
+	P95Seconds     float64 `json:"p95_seconds"`
+	P99Seconds     float64 `json:"p99_seconds"`
+	MaxSeconds     float64 `json:"max_seconds"`
+	BacklogAgeSecs float64 `json:"backlog_age_seconds"`
+	SLASeconds     float64 `json:"sla_seconds"`
+	OverSLA        int64   `json:"over_sla"`
+	SLABreached    bool    `json:"sla_breached"`
+	GeneratedAt    string  `json:"generated_at"`
+
+	sumSeconds float64 // total latency of every sent message, for the summary
+}
+
+// latencyTracker measures enqueue→SMTP-accept latency and how far behind the consumer is
+type latencyTracker struct {
+	mu         sync.Mutex
+	samples    []time.Duration // ring buffer of the last latencyWindow latencies
+	next       int
+	sent       int64
+	sum        time.Duration // total latency of every sent message
+	overSLA    int64
+	backlogAge time.Duration // queue wait of the most recently dequeued message
+	sla        time.Duration
+}
+
+// newLatencyTracker reads the SLA from LATENCY_SLA (default 5m)
+func newLatencyTracker() *latencyTracker {
+	sla, err := time.ParseDuration(mustEnv("LATENCY_SLA", "5m"))
+	if err != nil || sla <= 0 {
+		slog.Warn("invalid LATENCY_SLA, falling back to 5m", "error", err)
+		sla = 5 * time.Minute
+	}
+	return &latencyTracker{
+		samples: make([]time.Duration, 0, latencyWindow),
+		sla:     sla,
+	}
+}
+
+// enqueuedAt returns when the delivery was first enqueued, falling back to
+// the broker's timestamp for messages published without the header
+func enqueuedAt(d Delivery) (time.Time, bool) {
+	switch v := d.Headers[headerEnqueuedAt].(type) {
+	case int64:
+		return time.UnixMilli(v), true
+	case int32:
+		return time.UnixMilli(int64(v)), true
+	case string:
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.UnixMilli(ms), true
+		}
+	}
+	if !d.Timestamp.IsZero() {
+		return d.Timestamp, true
+	}
+	return time.Time{}, false
+}
+
+// observeDequeue records how long a message waited before the consumer picked it up
+func (t *latencyTracker) observeDequeue(d Delivery) {
+	if at, ok := enqueuedAt(d); ok {
+		t.mu.Lock()
+		t.backlogAge = time.Since(at)
+		t.mu.Unlock()
+	}
+}
+
+// observeSent records the enqueue→send latency of a delivered message
+func (t *latencyTracker) observeSent(d Delivery) {
+	at, ok := enqueuedAt(d)
+	if !ok {
+		return
+	}
+	latency := time.Since(at)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, latency)
+	} else {
+		t.samples[t.next] = latency
+	}
+	t.next = (t.next + 1) % latencyWindow
+	t.sent++
+	t.sum += latency
+	if latency > t.sla {
+		t.overSLA++
+	}
+}
+
+// report computes percentiles over the current window
+func (t *latencyTracker) report() latencyReport {
+	t.mu.Lock()
+	sorted := append([]time.Duration(nil), t.samples...)
+	r := latencyReport{
+		Window:         len(t.samples),
+		Sent:           t.sent,
+		BacklogAgeSecs: t.backlogAge.Seconds(),
+		SLASeconds:     t.sla.Seconds(),
+		OverSLA:        t.overSLA,
+		GeneratedAt:    time.Now().Format(time.RFC3339),
+		sumSeconds:     t.sum.Seconds(),
+	}
+	t.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	r.P50Seconds = percentile(sorted, 0.50).Seconds()
+	r.P90Seconds = percentile(sorted, 0.90).Seconds()
+	r.P95Seconds = percentile(sorted, 0.95).Seconds()
+	r.P99Seconds = percentile(sorted, 0.99).Seconds()
+	if len(sorted) > 0 {
+		r.MaxSeconds = sorted[len(sorted)-1].Seconds()
+	}
+	r.SLABreached = r.P95Seconds > r.SLASeconds || r.BacklogAgeSecs > r.SLASeconds
+	return r
+}
+
+// percentile uses the nearest-rank method on an ascending slice
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// latencyCollector exports a latencyTracker: the delivery latency as a
+// summary over the recent window, the backlog age and the count over the SLA
+type latencyCollector struct {
+	t                            *latencyTracker
+	latency, backlogAge, overSLA *prometheus.Desc
+}
+
+func newLatencyCollector(t *latencyTracker) *latencyCollector {
+	return &latencyCollector{
+		t:          t,
+		latency:    prometheus.NewDesc("email_queue_delivery_latency_seconds", "Enqueue to SMTP accept latency over the recent window.", nil, nil),
+		backlogAge: prometheus.NewDesc("email_queue_backlog_age_seconds", "How long the most recently dequeued message waited.", nil, nil),
+		overSLA:    prometheus.NewDesc("email_queue_over_sla_total", "Messages delivered later than LATENCY_SLA.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *latencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.latency
+	ch <- c.backlogAge
+	ch <- c.overSLA
+}
+
+// Collect implements prometheus.Collector
+func (c *latencyCollector) Collect(ch chan<- prometheus.Metric) {
+	rep := c.t.report()
+	ch <- prometheus.MustNewConstSummary(c.latency, uint64(rep.Sent), rep.sumSeconds, map[float64]float64{
+		0.5:  rep.P50Seconds,
+		0.9:  rep.P90Seconds,
+		0.95: rep.P95Seconds,
+		0.99: rep.P99Seconds,
+	})
+	ch <- prometheus.MustNewConstMetric(c.backlogAge, prometheus.GaugeValue, rep.BacklogAgeSecs)
+	ch <- prometheus.MustNewConstMetric(c.overSLA, prometheus.CounterValue, float64(rep.OverSLA))
+}
+
+// healthStatus is the JSON body of /healthz
+type healthStatus struct {
+	Status        string `json:"status"`         // "ok" or "unavailable"
+	AMQPConnected bool   `json:"amqp_connected"` // kept under this name whichever broker is configured
+	Paused        bool   `json:"paused"`
+}
+
+// serveMetrics exposes /metrics (Prometheus text format), /healthz,
+// /analytics/latency, /autoscale and /admin/intake (JSON). a is nil when
+// the broker can't report its queue depth.
+func serveMetrics(addr string, t *latencyTracker, m *workerMetrics, in *intake, b Broker, a *autoscaler) {
+	mux := http.NewServeMux()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newLatencyCollector(t))
+	reg.MustRegister(
+		gaugeFunc("email_queue_paused", "Whether intake is paused by a control command.", func() float64 {
+			return boolGauge(in.isPaused())
+		}),
+		counterFunc("email_queue_reconnects_total", "Times the broker connection was re-established.", func() float64 {
+			return float64(b.Reconnects())
+		}),
+		gaugeFunc("email_queue_amqp_connected", "Whether the broker connection is up.", func() float64 {
+			return boolGauge(b.Connected())
+		}),
+	)
+	reg.MustRegister(m.collectors()...)
+	if a != nil {
+		reg.MustRegister(a.collectors()...)
+	}
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	// Unhealthy only while the broker connection is down. A paused worker is
+	// healthy: it is doing what it was told.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h := healthStatus{Status: "ok", AMQPConnected: b.Connected(), Paused: in.isPaused()}
+		status := http.StatusOK
+		if !h.AMQPConnected {
+			h.Status, status = "unavailable", http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(h)
+	})
+
+	mux.HandleFunc("/analytics/latency", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(t.report())
+	})
+
+	mux.HandleFunc("/autoscale", a.serveHint)
+
+	mux.HandleFunc("/admin/intake", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(in.status())
+	})
+
+	slog.Info("metrics listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics server stopped", "error", err)
+	}
+}
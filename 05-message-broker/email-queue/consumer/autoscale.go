@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultSendSeconds stands in for the average SMTP send until the
+	// worker has timed one
+	defaultSendSeconds = 1.0
+
+	// autoscaleSmoothing is the weight of the newest sample in the arrival
+	// rate and send time averages, so one quiet or busy interval doesn't
+	// swing the hint
+	autoscaleSmoothing = 0.5
+)
+
+// queueStats is what a broker reports about emails.primary
+type queueStats struct {
+	Depth     int // messages ready for a worker
+	Consumers int // workers consuming, this one included
+}
+
+// queueInspector is implemented by brokers that can report the primary
+// queue's depth, which the autoscaling hints need. Only RabbitMQ does.
+type queueInspector interface {
+	QueueStats() (queueStats, error)
+}
+
+// autoscaleHint is the JSON body of /autoscale
+type autoscaleHint struct {
+	QueueDepth         int     `json:"queue_depth"`
+	Consumers          int     `json:"consumers"`
+	ArrivalRate        float64 `json:"arrival_rate_per_second"`
+	AvgSendSeconds     float64 `json:"avg_send_seconds"`
+	DesiredHandlers    int     `json:"desired_handlers"`    // sends in flight needed across all workers
+	Concurrency        int     `json:"concurrency"`         // this worker's handlers
+	DesiredConcurrency int     `json:"desired_concurrency"` // handlers per worker at the current worker count
+	DesiredWorkers     int     `json:"desired_workers"`     // workers needed at the per-worker maximum
+	Auto               bool    `json:"auto"`                // whether this worker resizes itself
+	GeneratedAt        string  `json:"generated_at,omitempty"`
+}
+
+// autoscaleSample is one reading, kept to compute rates from the next
+type autoscaleSample struct {
+	at        time.Time
+	depth     int
+	consumed  int64
+	sendSum   float64
+	sendCount uint64
+}
+
+// autoscaler works out how many sends should be in flight to keep up with
+// the queue, and from that how many workers, and how many handlers this
+// worker should run. By Little's law, keeping up with arrivals takes
+// arrival rate × send time handlers; clearing the backlog within the drain
+// target takes depth × send time / drain target more. With AUTOSCALE=true
+// the handler pool is resized to its share, within the configured bounds.
+type autoscaler struct {
+	inspector queueInspector
+	metrics   *workerMetrics
+	pool      *handlerPool
+	interval  time.Duration
+	drain     time.Duration // how quickly a backlog should be cleared
+	auto      bool
+	min, max  int // bounds on this worker's handlers
+
+	mu          sync.Mutex
+	prev        autoscaleSample
+	arrival     float64 // messages per second, smoothed
+	rated       bool    // arrival has been measured at least once
+	sendSeconds float64 // smoothed
+	sendTimed   bool    // sendSeconds is measured rather than defaultSendSeconds
+	hint        autoscaleHint
+}
+
+// newAutoscaler reads AUTOSCALE, AUTOSCALE_INTERVAL, AUTOSCALE_DRAIN_TARGET
+// and the WORKER_CONCURRENCY_MIN/MAX bounds. It returns nil for a broker
+// that can't report its queue depth.
+func newAutoscaler(b Broker, m *workerMetrics, p *handlerPool) (*autoscaler, error) {
+	auto := mustEnv("AUTOSCALE", "false") == "true"
+	inspector, ok := b.(queueInspector)
+	if !ok {
+		if auto {
+			slog.Warn("AUTOSCALE needs a broker that reports queue depth, keeping a fixed concurrency")
+		}
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(mustEnv("AUTOSCALE_INTERVAL", "15s"))
+	if err != nil || interval < time.Second {
+		return nil, fmt.Errorf("AUTOSCALE_INTERVAL: must be a duration of at least 1s")
+	}
+	drain, err := time.ParseDuration(mustEnv("AUTOSCALE_DRAIN_TARGET", "1m"))
+	if err != nil || drain <= 0 {
+		return nil, fmt.Errorf("AUTOSCALE_DRAIN_TARGET: must be a positive duration")
+	}
+	lo, err := strconv.Atoi(mustEnv("WORKER_CONCURRENCY_MIN", "1"))
+	if err != nil || lo < 1 {
+		return nil, fmt.Errorf("WORKER_CONCURRENCY_MIN: must be an integer >= 1")
+	}
+	hi, err := strconv.Atoi(mustEnv("WORKER_CONCURRENCY_MAX", strconv.Itoa(prefetchCount)))
+	if err != nil || hi < lo || hi > prefetchCount {
+		return nil, fmt.Errorf("WORKER_CONCURRENCY_MAX: must be an integer between WORKER_CONCURRENCY_MIN and the prefetch count (%d)", prefetchCount)
+	}
+
+	a := &autoscaler{
+		inspector:   inspector,
+		metrics:     m,
+		pool:        p,
+		interval:    interval,
+		drain:       drain,
+		auto:        auto,
+		min:         lo,
+		max:         hi,
+		sendSeconds: defaultSendSeconds,
+	}
+	if auto {
+		// WORKER_CONCURRENCY is where the pool starts
+		p.resize(min(max(p.limit(), lo), hi))
+	}
+	a.hint = autoscaleHint{Concurrency: p.limit(), Auto: auto}
+	return a, nil
+}
+
+// run updates the hint every interval, for as long as the worker runs
+func (a *autoscaler) run() {
+	slog.Info("autoscaling hints enabled", "auto", a.auto, "interval", a.interval, "min", a.min, "max", a.max)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	a.update() // the first reading only sets the baseline for rates
+	for range ticker.C {
+		a.update()
+	}
+}
+
+// update takes a reading, recomputes the hint and, with AUTOSCALE=true,
+// resizes the pool
+func (a *autoscaler) update() {
+	stats, err := a.inspector.QueueStats()
+	if err != nil {
+		slog.Warn("autoscale: queue stats unavailable", "error", err)
+		return
+	}
+	sendSum, sendCount := a.metrics.smtpLatencyTotals()
+	now := autoscaleSample{
+		at:        time.Now(),
+		depth:     stats.Depth,
+		consumed:  a.metrics.consumed.Load(),
+		sendSum:   sendSum,
+		sendCount: sendCount,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.prev.at.IsZero() {
+		// Every consumer is assumed to take about as much as this one, which
+		// round-robin delivery with equal prefetch makes roughly true
+		consumers := max(stats.Consumers, 1)
+		arrived := float64(now.depth-a.prev.depth) + float64(now.consumed-a.prev.consumed)*float64(consumers)
+		rate := max(arrived, 0) / now.at.Sub(a.prev.at).Seconds()
+		if a.rated {
+			rate = autoscaleSmoothing*rate + (1-autoscaleSmoothing)*a.arrival
+		}
+		a.arrival, a.rated = rate, true
+	}
+	if n := now.sendCount - a.prev.sendCount; n > 0 {
+		avg := (now.sendSum - a.prev.sendSum) / float64(n)
+		if a.sendTimed {
+			avg = autoscaleSmoothing*avg + (1-autoscaleSmoothing)*a.sendSeconds
+		}
+		a.sendSeconds, a.sendTimed = avg, true
+	}
+	a.prev = now
+
+	a.hint = a.compute(stats)
+	if a.auto && a.rated && a.hint.DesiredConcurrency != a.hint.Concurrency {
+		slog.Info("autoscale: resizing handler pool", "from", a.hint.Concurrency, "to", a.hint.DesiredConcurrency,
+			"queue_depth", stats.Depth, "arrival_rate", a.arrival, "avg_send_seconds", a.sendSeconds)
+		a.pool.resize(a.hint.DesiredConcurrency)
+		a.hint.Concurrency = a.hint.DesiredConcurrency
+	}
+}
+
+// compute turns the smoothed rates into a hint. The caller holds a.mu.
+func (a *autoscaler) compute(stats queueStats) autoscaleHint {
+	needed := a.arrival*a.sendSeconds + float64(stats.Depth)*a.sendSeconds/a.drain.Seconds()
+	handlers := int(math.Ceil(needed))
+	consumers := max(stats.Consumers, 1)
+
+	// Without AUTOSCALE another worker adds only as many handlers as this one has
+	capacity := a.pool.limit()
+	if a.auto {
+		capacity = a.max
+	}
+	return autoscaleHint{
+		QueueDepth:         stats.Depth,
+		Consumers:          stats.Consumers,
+		ArrivalRate:        a.arrival,
+		AvgSendSeconds:     a.sendSeconds,
+		DesiredHandlers:    handlers,
+		Concurrency:        a.pool.limit(),
+		DesiredConcurrency: min(max(ceilDiv(handlers, consumers), a.min), a.max),
+		DesiredWorkers:     max(ceilDiv(handlers, capacity), 1),
+		Auto:               a.auto,
+		GeneratedAt:        time.Now().Format(time.RFC3339),
+	}
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// report returns the latest hint
+func (a *autoscaler) report() autoscaleHint {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.hint
+}
+
+// collectors returns the hint as gauges for a Prometheus registry
+func (a *autoscaler) collectors() []prometheus.Collector {
+	hint := func(value func(h autoscaleHint) float64) func() float64 {
+		return func() float64 { return value(a.report()) }
+	}
+	return []prometheus.Collector{
+		gaugeFunc("email_queue_primary_depth", "Messages ready in emails.primary.",
+			hint(func(h autoscaleHint) float64 { return float64(h.QueueDepth) })),
+		gaugeFunc("email_queue_arrival_rate", "Estimated messages arriving on emails.primary per second.",
+			hint(func(h autoscaleHint) float64 { return h.ArrivalRate })),
+		gaugeFunc("email_queue_avg_send_seconds", "Smoothed average SMTP send time used for the autoscaling hints.",
+			hint(func(h autoscaleHint) float64 { return h.AvgSendSeconds })),
+		gaugeFunc("email_queue_desired_handlers", "Sends in flight needed across all workers to keep up and drain the backlog.",
+			hint(func(h autoscaleHint) float64 { return float64(h.DesiredHandlers) })),
+		gaugeFunc("email_queue_desired_workers", "Workers needed at the per-worker maximum concurrency.",
+			hint(func(h autoscaleHint) float64 { return float64(h.DesiredWorkers) })),
+		gaugeFunc("email_queue_worker_concurrency", "Deliveries this worker handles at once.",
+			hint(func(h autoscaleHint) float64 { return float64(h.Concurrency) })),
+	}
+}
+
+// serveHint handles /autoscale
+func (a *autoscaler) serveHint(w http.ResponseWriter, r *http.Request) {
+	if a == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "autoscaling hints need a broker that reports queue depth (rabbitmq)"})
+		return
+	}
+	writeJSON(w, http.StatusOK, a.report())
+}
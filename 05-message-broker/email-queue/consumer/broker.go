@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Values of BROKER
+const (
+	brokerRabbitMQ = "rabbitmq"
+	brokerKafka    = "kafka"
+	brokerNATS     = "nats"
+)
+
+// Message is a job as it travels through a broker. Headers hold the
+// x-attempts, x-correlation-id, x-enqueued-at and failure headers; backends
+// without typed headers hand them back as strings, which every reader of
+// them accepts.
+type Message struct {
+	ID       string // set once a job is dead-lettered, so the DLQ can address it
+	Body     []byte
+	Headers  map[string]any
+	Priority uint8 // honoured by RabbitMQ only
+}
+
+// Delivery is a Message handed to the worker. It must be acked once the
+// worker is done with it, even when it was retried or dead-lettered, since
+// those publish a copy.
+type Delivery struct {
+	Message
+	Seq         uint64    // AMQP delivery tag, Kafka offset or JetStream stream sequence
+	Redelivered bool      // the broker delivered it before, to this worker or another
+	Timestamp   time.Time // when it was published, if the broker records it
+
+	ack  func() error
+	nack func() error
+}
+
+// Ack tells the broker the delivery is done with
+func (d Delivery) Ack() error { return d.ack() }
+
+// Nack hands the delivery back so another worker gets it. The worker only
+// does this while stopping, or when it can't republish a delivery to a
+// retry tier, the DLQ or the quarantine. Kafka can't give back a single
+// message: the offset is left uncommitted, and the group redelivers from
+// there.
+func (d Delivery) Nack() error { return d.nack() }
+
+// Broker is the queue behind the worker. Retries wait in one queue per
+// retry tier and come back on the primary queue once the tier's delay has
+// passed; the DLQ and quarantine queues are only ever read by people.
+type Broker interface {
+	// Publish puts a fresh job on the primary queue
+	Publish(ctx context.Context, m Message) error
+
+	// Consume delivers jobs from the primary queue one at a time. The
+	// channel is closed when the broker is closed, or when the connection
+	// drops for a backend that doesn't reconnect under it.
+	Consume() (<-chan Delivery, error)
+
+	// Retry parks a copy of d in tier; it is back on the primary queue after delay
+	Retry(ctx context.Context, d Delivery, tier retryTier, delay time.Duration) error
+
+	// DeadLetter moves a copy of d to the dead letter queue
+	DeadLetter(ctx context.Context, d Delivery) error
+
+	// Quarantine moves a copy of d, which crashed the handler, out of the retry loop
+	Quarantine(ctx context.Context, d Delivery) error
+
+	Connected() bool   // whether the broker is reachable, for /healthz
+	Reconnects() int64 // times the connection was re-established
+	Close() error
+}
+
+// backends opens the brokers other than RabbitMQ, which the worker drives
+// itself for pausing and the DLQ admin API. Each registers itself from a
+// file built only with the tag of the same name, so the default build
+// doesn't need their client libraries.
+var backends = map[string]func(ctx context.Context) (Broker, error){}
+
+// openBroker connects to the broker named by BROKER
+func openBroker(ctx context.Context, kind string) (Broker, error) {
+	open, ok := backends[kind]
+	switch {
+	case ok:
+		return open(ctx)
+	case kind == brokerKafka || kind == brokerNATS:
+		return nil, fmt.Errorf("BROKER=%s needs a worker built with -tags %s", kind, kind)
+	default:
+		return nil, fmt.Errorf("unknown BROKER %q (use %s, %s or %s)", kind, brokerRabbitMQ, brokerKafka, brokerNATS)
+	}
+}
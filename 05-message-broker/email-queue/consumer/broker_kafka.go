@@ -0,0 +1,215 @@
+//go:build kafka
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func init() { backends[brokerKafka] = openKafka }
+
+// kafkaBroker keeps the queues in topics named after the RabbitMQ ones:
+// emails.primary, emails.retry.<tier>, emails.dlq and emails.quarantine.
+// Workers share a consumer group, so run at most one per partition of
+// emails.primary. Priorities are not supported: jobs are sent in the order
+// they were published.
+type kafkaBroker struct {
+	brokers []string
+	group   string
+	writer  *kafka.Writer
+
+	ctx    context.Context // cancelled by Close, which stops the readers
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	readers []*kafka.Reader
+}
+
+// openKafka reads KAFKA_BROKERS (comma separated) and KAFKA_GROUP. The
+// client connects lazily and redials on its own, so this doesn't fail when
+// the cluster is down.
+func openKafka(ctx context.Context) (Broker, error) {
+	brokers := strings.Split(mustEnv("KAFKA_BROKERS", "localhost:9092"), ",")
+	b := &kafkaBroker{
+		brokers: brokers,
+		group:   mustEnv("KAFKA_GROUP", consumerTag),
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	for _, tier := range retryTiers {
+		go b.forward(tier)
+	}
+	return b, nil
+}
+
+// Publish implements Broker
+func (b *kafkaBroker) Publish(ctx context.Context, m Message) error {
+	return b.write(ctx, subjectPrimary, m)
+}
+
+// Consume implements Broker. The offset of a delivery is committed when it
+// is acked.
+func (b *kafkaBroker) Consume() (<-chan Delivery, error) {
+	r := b.reader(subjectPrimary, b.group)
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for {
+			m, err := r.FetchMessage(b.ctx)
+			if err != nil {
+				if b.ctx.Err() == nil {
+					slog.Error("kafka fetch failed", "topic", subjectPrimary, "error", err)
+				}
+				return
+			}
+
+			d := fromKafka(m)
+			d.ack = func() error { return r.CommitMessages(context.Background(), m) }
+			d.nack = func() error { return nil } // uncommitted, so redelivered after a rebalance or restart
+			select {
+			case out <- d:
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Retry implements Broker
+func (b *kafkaBroker) Retry(ctx context.Context, d Delivery, tier retryTier, delay time.Duration) error {
+	d.Headers = parked(d.Headers, delay)
+	return b.write(ctx, tier.Queue(), d.Message)
+}
+
+// DeadLetter implements Broker
+func (b *kafkaBroker) DeadLetter(ctx context.Context, d Delivery) error {
+	return b.write(ctx, subjectDLQ, d.Message)
+}
+
+// Quarantine implements Broker
+func (b *kafkaBroker) Quarantine(ctx context.Context, d Delivery) error {
+	return b.write(ctx, subjectQuarantine, d.Message)
+}
+
+// Connected reports whether any of the brokers accepts a connection. The
+// client keeps no connection open between requests, so this dials.
+func (b *kafkaBroker) Connected() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, addr := range b.brokers {
+		if conn, err := kafka.DialContext(ctx, "tcp", addr); err == nil {
+			_ = conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// Reconnects is always 0: the client redials per request and doesn't count it
+func (b *kafkaBroker) Reconnects() int64 { return 0 }
+
+// Close implements Broker
+func (b *kafkaBroker) Close() error {
+	b.cancel()
+	b.mu.Lock()
+	for _, r := range b.readers {
+		_ = r.Close()
+	}
+	b.mu.Unlock()
+	return b.writer.Close()
+}
+
+// forward moves messages from a tier's topic back to emails.primary once
+// they are due. Each tier has its own consumer group.
+func (b *kafkaBroker) forward(tier retryTier) {
+	r := b.reader(tier.Queue(), b.group+"-"+tier.Queue())
+	for {
+		m, err := r.FetchMessage(b.ctx)
+		if err != nil {
+			return // closed
+		}
+
+		d := fromKafka(m)
+		if wait := time.Until(retryAt(d.Headers)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-b.ctx.Done():
+				return
+			}
+		}
+		delete(d.Headers, headerRetryAt)
+
+		// The reader won't hand the message out again this session, so keep
+		// trying rather than skip it
+		for {
+			err := b.write(b.ctx, subjectPrimary, d.Message)
+			if err == nil {
+				break
+			}
+			slog.Error("retry forward failed", "tier", tier.Name, "error", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-b.ctx.Done():
+				return
+			}
+		}
+		if err := r.CommitMessages(b.ctx, m); err != nil {
+			slog.Warn("retry commit failed; the job may be sent twice", "tier", tier.Name, "error", err)
+		}
+	}
+}
+
+func (b *kafkaBroker) reader(topic, group string) *kafka.Reader {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: b.brokers,
+		GroupID: group,
+		Topic:   topic,
+	})
+	b.mu.Lock()
+	b.readers = append(b.readers, r)
+	b.mu.Unlock()
+	return r
+}
+
+func (b *kafkaBroker) write(ctx context.Context, topic string, m Message) error {
+	headers := make([]kafka.Header, 0, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		headers = append(headers, kafka.Header{Key: k, Value: []byte(headerString(v))})
+	}
+	if m.ID != "" {
+		headers = append(headers, kafka.Header{Key: headerMessageID, Value: []byte(m.ID)})
+	}
+	return b.writer.WriteMessages(ctx, kafka.Message{Topic: topic, Value: m.Body, Headers: headers})
+}
+
+// fromKafka wraps a Kafka message for the worker; the caller sets ack and nack
+func fromKafka(m kafka.Message) Delivery {
+	d := Delivery{
+		Message: Message{
+			Body:    m.Value,
+			Headers: make(map[string]any, len(m.Headers)),
+		},
+		Seq:       uint64(m.Offset),
+		Timestamp: m.Time,
+	}
+	for _, h := range m.Headers {
+		if h.Key == headerMessageID {
+			d.ID = string(h.Value)
+			continue
+		}
+		d.Headers[h.Key] = string(h.Value)
+	}
+	return d
+}
@@ -0,0 +1,40 @@
+//go:build kafka
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var _ Broker = (*kafkaBroker)(nil)
+
+func TestKafkaRegistered(t *testing.T) {
+	if backends[brokerKafka] == nil {
+		t.Fatalf("BROKER=%s has no backend in a kafka build", brokerKafka)
+	}
+}
+
+func TestFromKafka(t *testing.T) {
+	at := time.UnixMilli(1_700_000_000_000)
+	d := fromKafka(kafka.Message{
+		Value:  []byte(`{}`),
+		Offset: 42,
+		Time:   at,
+		Headers: []kafka.Header{
+			{Key: headerAttempts, Value: []byte("2")},
+			{Key: headerMessageID, Value: []byte("msg-1")},
+		},
+	})
+	if d.ID != "msg-1" || d.Seq != 42 || !d.Timestamp.Equal(at) || string(d.Body) != `{}` {
+		t.Errorf("fromKafka() = %+v", d)
+	}
+	if d.Headers[headerAttempts] != "2" {
+		t.Errorf("%s = %v, want \"2\"", headerAttempts, d.Headers[headerAttempts])
+	}
+	if _, ok := d.Headers[headerMessageID]; ok {
+		t.Errorf("%s kept as a header, want it in ID only", headerMessageID)
+	}
+}
@@ -0,0 +1,230 @@
+//go:build nats
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func init() { backends[brokerNATS] = openNATS }
+
+const (
+	natsStream = "EMAILS"
+
+	// natsAckWait is how long JetStream waits for an ack before redelivering;
+	// it has to cover an SMTP send with all its timeouts
+	natsAckWait = 2 * time.Minute
+
+	natsFetchWait      = 5 * time.Second // how long an empty Fetch blocks
+	natsPublishTimeout = 5 * time.Second // for the stream's publish ack
+)
+
+// natsBroker keeps the queues as subjects of one work-queue stream, named
+// after the RabbitMQ queues. Priorities are not supported: jobs are sent in
+// the order they were published.
+type natsBroker struct {
+	nc *nats.Conn
+	js nats.JetStreamContext
+
+	ctx    context.Context // cancelled by Close, which stops the fetch loops
+	cancel context.CancelFunc
+}
+
+// openNATS connects to NATS_URL and creates the stream if it doesn't exist.
+// The connection reconnects on its own for as long as the worker runs.
+func openNATS(ctx context.Context) (Broker, error) {
+	url := mustEnv("NATS_URL", nats.DefaultURL)
+	nc, err := nats.Connect(url, nats.Name(consumerTag), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("connect %s: %w", url, err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	// A work queue deletes each message once it is acked. emails.dlq and
+	// emails.quarantine have no consumer, so their messages stay until an
+	// operator removes them.
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:      natsStream,
+		Subjects:  []string{"emails.>"},
+		Retention: nats.WorkQueuePolicy,
+		Storage:   nats.FileStorage,
+	})
+	if err != nil && !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		nc.Close()
+		return nil, fmt.Errorf("add stream %s: %w", natsStream, err)
+	}
+
+	b := &natsBroker{nc: nc, js: js}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	for _, tier := range retryTiers {
+		if err := b.forward(tier); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Publish implements Broker
+func (b *natsBroker) Publish(ctx context.Context, m Message) error {
+	return b.publish(ctx, subjectPrimary, m)
+}
+
+// Consume implements Broker
+func (b *natsBroker) Consume() (<-chan Delivery, error) {
+	sub, err := b.js.PullSubscribe(subjectPrimary, consumerTag,
+		nats.BindStream(natsStream), nats.ManualAck(), nats.AckWait(natsAckWait))
+	if err != nil {
+		return nil, fmt.Errorf("subscribe %s: %w", subjectPrimary, err)
+	}
+
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		b.fetch(sub, 1, func(m *nats.Msg) bool {
+			select {
+			case out <- fromNATS(m):
+				return true
+			case <-b.ctx.Done():
+				return false
+			}
+		})
+	}()
+	return out, nil
+}
+
+// Retry implements Broker
+func (b *natsBroker) Retry(ctx context.Context, d Delivery, tier retryTier, delay time.Duration) error {
+	d.Headers = parked(d.Headers, delay)
+	return b.publish(ctx, tier.Queue(), d.Message)
+}
+
+// DeadLetter implements Broker
+func (b *natsBroker) DeadLetter(ctx context.Context, d Delivery) error {
+	return b.publish(ctx, subjectDLQ, d.Message)
+}
+
+// Quarantine implements Broker
+func (b *natsBroker) Quarantine(ctx context.Context, d Delivery) error {
+	return b.publish(ctx, subjectQuarantine, d.Message)
+}
+
+func (b *natsBroker) Connected() bool   { return b.nc.IsConnected() }
+func (b *natsBroker) Reconnects() int64 { return int64(b.nc.Stats().Reconnects) }
+
+// Close flushes outstanding acks and closes the connection
+func (b *natsBroker) Close() error {
+	b.cancel()
+	err := b.nc.Flush()
+	b.nc.Close()
+	return err
+}
+
+// forward moves messages from a tier's subject back to emails.primary once
+// they are due. A message that isn't due yet is handed back with a delay
+// rather than waited on, so it doesn't hold up the fetch.
+func (b *natsBroker) forward(tier retryTier) error {
+	sub, err := b.js.PullSubscribe(tier.Queue(), consumerTag+"-retry-"+tier.Name,
+		nats.BindStream(natsStream), nats.ManualAck())
+	if err != nil {
+		return fmt.Errorf("subscribe %s: %w", tier.Queue(), err)
+	}
+
+	go b.fetch(sub, 10, func(m *nats.Msg) bool {
+		d := fromNATS(m)
+		if wait := time.Until(retryAt(d.Headers)); wait > 0 {
+			_ = m.NakWithDelay(wait)
+			return true
+		}
+		delete(d.Headers, headerRetryAt)
+		if err := b.publish(b.ctx, subjectPrimary, d.Message); err != nil {
+			slog.Error("retry forward failed", "tier", tier.Name, "error", err)
+			_ = m.Nak() // redelivered, and forwarded again
+			return true
+		}
+		_ = m.Ack()
+		return true
+	})
+	return nil
+}
+
+// fetch pulls up to batch messages at a time and hands each to handle until
+// the broker is closed or handle returns false. Fetch errors, such as while
+// the connection is down, are retried.
+func (b *natsBroker) fetch(sub *nats.Subscription, batch int, handle func(*nats.Msg) bool) {
+	for b.ctx.Err() == nil {
+		msgs, err := sub.Fetch(batch, nats.MaxWait(natsFetchWait))
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+				continue // nothing waiting
+			}
+			if b.ctx.Err() == nil {
+				slog.Warn("jetstream fetch failed", "subject", sub.Subject, "error", err)
+				select {
+				case <-time.After(time.Second):
+				case <-b.ctx.Done():
+				}
+			}
+			continue
+		}
+		for _, m := range msgs {
+			if !handle(m) {
+				return
+			}
+		}
+	}
+}
+
+func (b *natsBroker) publish(ctx context.Context, subject string, m Message) error {
+	ctx, cancel := context.WithTimeout(ctx, natsPublishTimeout)
+	defer cancel()
+
+	msg := nats.NewMsg(subject)
+	msg.Data = m.Body
+	for k, v := range m.Headers {
+		msg.Header.Set(k, headerString(v))
+	}
+	if m.ID != "" {
+		msg.Header.Set(headerMessageID, m.ID)
+	}
+	_, err := b.js.PublishMsg(msg, nats.Context(ctx))
+	return err
+}
+
+// fromNATS wraps a JetStream message for the worker
+func fromNATS(m *nats.Msg) Delivery {
+	d := Delivery{
+		Message: Message{
+			Body:    m.Data,
+			Headers: make(map[string]any, len(m.Header)),
+		},
+		ack:  func() error { return m.Ack() },
+		nack: func() error { return m.Nak() },
+	}
+	for k, v := range m.Header {
+		if len(v) == 0 {
+			continue
+		}
+		if k == headerMessageID {
+			d.ID = v[0]
+			continue
+		}
+		d.Headers[k] = v[0]
+	}
+	if meta, err := m.Metadata(); err == nil {
+		d.Seq = meta.Sequence.Stream
+		d.Redelivered = meta.NumDelivered > 1
+		d.Timestamp = meta.Timestamp
+	}
+	return d
+}
@@ -0,0 +1,35 @@
+//go:build nats
+
+package main
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+var _ Broker = (*natsBroker)(nil)
+
+func TestNATSRegistered(t *testing.T) {
+	if backends[brokerNATS] == nil {
+		t.Fatalf("BROKER=%s has no backend in a nats build", brokerNATS)
+	}
+}
+
+func TestFromNATS(t *testing.T) {
+	m := nats.NewMsg(subjectPrimary)
+	m.Data = []byte(`{}`)
+	m.Header.Set(headerAttempts, "2")
+	m.Header.Set(headerMessageID, "msg-1")
+
+	d := fromNATS(m)
+	if d.ID != "msg-1" || string(d.Body) != `{}` {
+		t.Errorf("fromNATS() = %+v", d)
+	}
+	if d.Headers[headerAttempts] != "2" {
+		t.Errorf("%s = %v, want \"2\"", headerAttempts, d.Headers[headerAttempts])
+	}
+	if _, ok := d.Headers[headerMessageID]; ok {
+		t.Errorf("%s kept as a header, want it in ID only", headerMessageID)
+	}
+}
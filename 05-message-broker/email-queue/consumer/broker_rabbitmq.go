@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/fajar/learn-go/amqpconn"
+	"github.com/fajar/learn-go/emailtopology"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// rabbitBroker is the RabbitMQ Broker. It publishes on the intake's channel,
+// which reconnect replaces after a drop, and consumes through the intake so
+// pausing keeps working.
+type rabbitBroker struct {
+	mq *amqpconn.Manager
+	in *intake
+}
+
+// Publish implements Broker
+func (b *rabbitBroker) Publish(ctx context.Context, m Message) error {
+	return b.publish(ctx, emailtopology.Exchange, emailtopology.SendKey, m, "")
+}
+
+// Consume implements Broker
+func (b *rabbitBroker) Consume() (<-chan Delivery, error) {
+	return b.in.start()
+}
+
+// Retry implements Broker. The message's own expiration carries the
+// jittered delay; the tier queue's TTL is the upper bound.
+func (b *rabbitBroker) Retry(ctx context.Context, d Delivery, tier retryTier, delay time.Duration) error {
+	return b.publish(ctx, emailtopology.DLX, tier.RoutingKey(), d.Message, strconv.FormatInt(delay.Milliseconds(), 10))
+}
+
+// DeadLetter implements Broker
+func (b *rabbitBroker) DeadLetter(ctx context.Context, d Delivery) error {
+	return b.publish(ctx, emailtopology.DLX, emailtopology.DeadKey, d.Message, "")
+}
+
+// Quarantine implements Broker
+func (b *rabbitBroker) Quarantine(ctx context.Context, d Delivery) error {
+	return b.publish(ctx, emailtopology.DLX, emailtopology.QuarantineKey, d.Message, "")
+}
+
+// QueueStats implements queueInspector. emails.primary always exists while
+// the worker consumes it, so the passive declare can't close the channel.
+func (b *rabbitBroker) QueueStats() (queueStats, error) {
+	q, err := b.mq.Channel().QueueDeclarePassive(emailtopology.PrimaryQueue, true, false, false, false, nil)
+	if err != nil {
+		return queueStats{}, err
+	}
+	return queueStats{Depth: q.Messages, Consumers: q.Consumers}, nil
+}
+
+func (b *rabbitBroker) Connected() bool   { return b.mq.Connected() }
+func (b *rabbitBroker) Reconnects() int64 { return b.mq.Reconnects() }
+func (b *rabbitBroker) Close() error      { return b.mq.Close() }
+
+func (b *rabbitBroker) publish(ctx context.Context, exchange, key string, m Message, expiration string) error {
+	return b.in.ch.PublishWithContext(ctx, exchange, key, false, false, amqp.Publishing{
+		MessageId:    m.ID,
+		Priority:     m.Priority, // kept through the tier queues, so a retried password reset still jumps the queue
+		ContentType:  "application/json",
+		Body:         m.Body,
+		DeliveryMode: amqp.Persistent,
+		Headers:      amqp.Table(m.Headers),
+		Timestamp:    time.Now(),
+		Expiration:   expiration,
+	})
+}
+
+// fromAMQP wraps an AMQP delivery for the worker
+func fromAMQP(d amqp.Delivery) Delivery {
+	return Delivery{
+		Message: Message{
+			ID:       d.MessageId,
+			Body:     d.Body,
+			Headers:  d.Headers,
+			Priority: d.Priority,
+		},
+		Seq:         d.DeliveryTag,
+		Redelivered: d.Redelivered,
+		Timestamp:   d.Timestamp,
+		ack:         func() error { return d.Ack(false) },
+		nack:        func() error { return d.Nack(false, true) },
+	}
+}
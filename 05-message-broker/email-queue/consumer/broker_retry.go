@@ -0,0 +1,54 @@
+//go:build kafka || nats
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fajar/learn-go/emailtopology"
+)
+
+// Topic or subject names on Kafka and JetStream, matching the RabbitMQ queues.
+// Retry tiers use retryTier.Queue().
+const (
+	subjectPrimary    = emailtopology.PrimaryQueue
+	subjectDLQ        = emailtopology.DLQ
+	subjectQuarantine = emailtopology.QuarantineQueue
+)
+
+// headerRetryAt is when a message parked in a retry tier is due back on
+// emails.primary (Unix milliseconds). Kafka and JetStream have no
+// per-message TTL, so a forwarder per tier holds each message until then.
+// Each tier has a fixed delay, so its messages fall due in the order they
+// arrive, give or take the jitter, as with the RabbitMQ tier queues.
+const headerRetryAt = "x-retry-at"
+
+// headerMessageID carries Message.ID on brokers without a message ID property
+const headerMessageID = "x-message-id"
+
+// headerString encodes a header value for a broker whose headers are strings
+func headerString(v any) string {
+	return fmt.Sprint(v)
+}
+
+// retryAt returns when a parked message is due; a zero time means now
+func retryAt(h map[string]any) time.Time {
+	s, _ := h[headerRetryAt].(string)
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// parked returns a copy of headers marked due after delay
+func parked(headers map[string]any, delay time.Duration) map[string]any {
+	h := make(map[string]any, len(headers)+1)
+	for k, v := range headers {
+		h[k] = v
+	}
+	h[headerRetryAt] = strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10)
+	return h
+}
@@ -0,0 +1,32 @@
+//go:build kafka || nats
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParked(t *testing.T) {
+	headers := map[string]any{headerAttempts: int32(1)}
+	before := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	h := parked(headers, time.Minute)
+
+	if _, ok := headers[headerRetryAt]; ok {
+		t.Error("parked modified the headers it was given")
+	}
+	if h[headerAttempts] != int32(1) {
+		t.Errorf("%s = %v, want it copied", headerAttempts, h[headerAttempts])
+	}
+	if at := retryAt(h); at.Before(before) || at.After(time.Now().Add(time.Minute)) {
+		t.Errorf("retryAt = %s, want a minute from now", at)
+	}
+}
+
+func TestRetryAtMissing(t *testing.T) {
+	for _, h := range []map[string]any{nil, {headerRetryAt: "soon"}} {
+		if at := retryAt(h); !at.IsZero() {
+			t.Errorf("retryAt(%v) = %s, want the zero time", h, at)
+		}
+	}
+}
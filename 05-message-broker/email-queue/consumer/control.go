@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/emailtopology"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// controlExchange is a fanout exchange, so every running worker receives
+// each pause/resume command
+const controlExchange = "emails.control"
+
+// consumerTag identifies the emails.primary consumer so it can be cancelled on pause
+const consumerTag = "email-worker"
+
+const (
+	commandPause  = "pause"
+	commandResume = "resume"
+)
+
+// controlCommand is the JSON body of a message on emails.control
+type controlCommand struct {
+	Command string `json:"command"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// intakeStatus is the JSON body of /admin/intake
+type intakeStatus struct {
+	Paused bool   `json:"paused"`
+	Since  string `json:"since,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// intake starts and stops consumption of emails.primary. While paused the
+// worker holds no deliveries, so jobs pile up in the queue instead of
+// failing into retries during SMTP maintenance.
+type intake struct {
+	ch      *amqp.Channel
+	metrics *workerMetrics
+
+	mu     sync.Mutex
+	paused bool
+	since  time.Time
+	reason string
+}
+
+func newIntake(ch *amqp.Channel, metrics *workerMetrics) *intake {
+	return &intake{ch: ch, metrics: metrics}
+}
+
+// start begins consuming emails.primary
+func (in *intake) start() (<-chan Delivery, error) {
+	msgs, err := in.ch.Consume(emailtopology.PrimaryQueue, consumerTag, false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return in.metrics.track(in.ch, msgs), nil
+}
+
+// cancel stops the consumer and requeues whatever was already prefetched,
+// returning how many deliveries went back to the queue
+func (in *intake) cancel(msgs <-chan Delivery) (int, error) {
+	if err := in.ch.Cancel(consumerTag, false); err != nil {
+		return 0, err
+	}
+	// The library closes msgs once the buffered deliveries have been handed over
+	requeued := 0
+	for d := range msgs {
+		_ = d.Nack()
+		requeued++
+	}
+	return requeued, nil
+}
+
+// pause cancels the consumer until the next resume. The returned channel is
+// nil, which blocks forever in a select.
+func (in *intake) pause(msgs <-chan Delivery, reason string) (<-chan Delivery, error) {
+	requeued, err := in.cancel(msgs)
+	if err != nil {
+		return msgs, err
+	}
+
+	in.mu.Lock()
+	in.paused, in.since, in.reason = true, time.Now(), reason
+	in.mu.Unlock()
+
+	slog.Info("intake paused", "reason", reasonOrNone(reason), "requeued", requeued)
+	return nil, nil
+}
+
+// resume starts a fresh consumer
+func (in *intake) resume(reason string) (<-chan Delivery, error) {
+	msgs, err := in.start()
+	if err != nil {
+		return nil, err
+	}
+
+	in.mu.Lock()
+	in.paused, in.since, in.reason = false, time.Time{}, ""
+	in.mu.Unlock()
+
+	slog.Info("intake resumed", "reason", reasonOrNone(reason))
+	return msgs, nil
+}
+
+// handle applies a control message and returns the delivery channel to read
+// from next. Unknown or repeated commands leave msgs unchanged.
+func (in *intake) handle(msgs <-chan Delivery, d amqp.Delivery) (<-chan Delivery, error) {
+	var cmd controlCommand
+	if err := json.Unmarshal(d.Body, &cmd); err != nil {
+		slog.Warn("bad control message", "error", err)
+		return msgs, nil
+	}
+
+	switch cmd.Command {
+	case commandPause:
+		if in.isPaused() {
+			return msgs, nil
+		}
+		return in.pause(msgs, cmd.Reason)
+	case commandResume:
+		if !in.isPaused() {
+			return msgs, nil
+		}
+		return in.resume(cmd.Reason)
+	default:
+		slog.Warn("unknown control command", "command", cmd.Command)
+		return msgs, nil
+	}
+}
+
+func (in *intake) isPaused() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.paused
+}
+
+func (in *intake) status() intakeStatus {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	s := intakeStatus{Paused: in.paused, Reason: in.reason}
+	if in.paused {
+		s.Since = in.since.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// subscribeControl binds an exclusive, auto-delete queue to the control
+// exchange. Commands are auto-acked: a worker that is down when one is sent
+// starts up consuming, whatever the last command was.
+func subscribeControl(ch *amqp.Channel) (<-chan amqp.Delivery, error) {
+	if err := ch.ExchangeDeclare(controlExchange, "fanout", true, false, false, false, nil); err != nil {
+		return nil, err
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.QueueBind(q.Name, "", controlExchange, false, nil); err != nil {
+		return nil, err
+	}
+	return ch.Consume(q.Name, "", true, true, false, false, nil)
+}
+
+func reasonOrNone(reason string) string {
+	if reason == "" {
+		return "no reason given"
+	}
+	return reason
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	smtp "github.com/fajar/learn-go/04-smtp"
+)
+
+// mailHeaderCampaign is the custom header producers tag campaigns with. The
+// delivery log copies it, so a replay can select one campaign.
+const mailHeaderCampaign = "X-Campaign"
+
+// Failure classes of dead-lettered jobs in the delivery log
+const (
+	failureBadPayload        = "bad_payload"        // the body isn't a valid job
+	failureRecipientRejected = "recipient_rejected" // the server refused some or all recipients
+	failureSMTPPermanent     = "smtp_permanent"     // a 5xx reply
+	failureSMTPTransient     = "smtp_transient"     // a 4xx reply, still failing after every retry
+	failureConnection        = "connection"         // the server couldn't be reached or TLS failed
+	failureOther             = "other"
+)
+
+// deliveryRecord is one line of the delivery log: the final outcome of a
+// delivery, with the job as the worker decoded it so it can be replayed
+type deliveryRecord struct {
+	Time           time.Time       `json:"time"`
+	Event          string          `json:"event"` // eventSent or eventDeadLettered
+	CorrelationID  string          `json:"correlation_id"`
+	EmailMessageID string          `json:"email_message_id,omitempty"` // Message-ID of the sent email
+	To             string          `json:"to,omitempty"`
+	ReturnPath     string          `json:"return_path,omitempty"` // envelope sender, which bounces come back to
+	Campaign       string          `json:"campaign,omitempty"`
+	Attempts       int             `json:"attempts"`
+	FailureClass   string          `json:"failure_class,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Priority       uint8           `json:"priority,omitempty"`
+	ReplayOf       string          `json:"replay_of,omitempty"` // correlation ID of the delivery this one replayed
+	Job            json.RawMessage `json:"job,omitempty"`       // absent when the body wasn't JSON
+}
+
+// deliveryLog appends deliveryRecords to the JSON-lines file named by
+// DELIVERY_LOG. A nil deliveryLog, when the variable is unset, records
+// nothing. The file is only appended to; rotate it with copytruncate.
+type deliveryLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openDeliveryLog opens DELIVERY_LOG for appending, or returns nil when it is unset
+func openDeliveryLog() (*deliveryLog, error) {
+	path := os.Getenv("DELIVERY_LOG")
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("DELIVERY_LOG: %w", err)
+	}
+	return &deliveryLog{file: f}, nil
+}
+
+// record appends rec as one line. A failed write is logged and otherwise
+// ignored: the email has already gone out or been dead-lettered.
+func (l *deliveryLog) record(rec deliveryRecord, log *slog.Logger) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Error("delivery log: encode record", "error", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Error("delivery log: write record", "error", err)
+	}
+}
+
+func (l *deliveryLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// newDeliveryRecord describes delivery d of job, whose decoded body is body
+func newDeliveryRecord(event string, d Delivery, body []byte, job EmailJob, attempts int) deliveryRecord {
+	rec := deliveryRecord{
+		Time:       time.Now().UTC(),
+		Event:      event,
+		To:         job.To,
+		ReturnPath: job.ReturnPath,
+		Campaign:   headerValue(job.Headers, mailHeaderCampaign),
+		Attempts:   attempts,
+		Priority:   d.Priority,
+	}
+	rec.CorrelationID, _ = d.Headers[headerCorrelationID].(string)
+	rec.ReplayOf, _ = d.Headers[headerReplayOf].(string)
+	if json.Valid(body) {
+		rec.Job = body
+	}
+	return rec
+}
+
+// failed sets the failure of a dead-lettered record
+func (rec deliveryRecord) failed(class string, cause error) deliveryRecord {
+	rec.FailureClass, rec.Error = class, cause.Error()
+	return rec
+}
+
+// failureClass groups the error of a send that was given up on
+func failureClass(err error) string {
+	var (
+		rcptErr *smtp.MultiRecipientError
+		smtpErr *textproto.Error
+		netErr  net.Error
+	)
+	switch {
+	case errors.As(err, &rcptErr):
+		return failureRecipientRejected
+	case errors.As(err, &smtpErr) && smtpErr.Code >= 500:
+		return failureSMTPPermanent
+	case errors.As(err, &smtpErr):
+		return failureSMTPTransient
+	case errors.As(err, &netErr), errors.Is(err, smtp.ErrTLSRequired):
+		return failureConnection
+	default:
+		return failureOther
+	}
+}
+
+// headerValue looks a mail header up by name, ignoring case
+func headerValue(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	smtp "github.com/fajar/learn-go/04-smtp"
+)
+
+// digestItem is a single notification waiting to be folded into a digest email
+type digestItem struct {
+	Subject    string    `json:"subject"`
+	Body       string    `json:"body"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// digestData is what the digest template is rendered with
+type digestData struct {
+	To    string
+	Count int
+	Items []digestItem
+}
+
+const defaultDigestTemplate = `You have {{.Count}} new notification(s):
+{{range $i, $item := .Items}}
+{{inc $i}}. {{$item.Subject}} ({{$item.ReceivedAt.Format "2006-01-02 15:04"}})
+{{$item.Body}}
+{{end}}`
+
+// digestAggregator buffers digest jobs per recipient until the next flush.
+// Handlers add to it concurrently while the worker loop flushes it. The
+// buffer is a JSON file rewritten on every change, like the suppression
+// list, so a job acked once it is buffered survives a crash or restart.
+type digestAggregator struct {
+	subject  string
+	tmpl     *template.Template
+	interval time.Duration
+	path     string
+
+	mu      sync.Mutex
+	pending map[string][]digestItem
+}
+
+// newDigestAggregator builds an aggregator from DIGEST_* environment variables
+func newDigestAggregator() *digestAggregator {
+	interval, err := time.ParseDuration(mustEnv("DIGEST_INTERVAL", "1h"))
+	if err != nil || interval <= 0 {
+		slog.Warn("invalid DIGEST_INTERVAL, falling back to 1h", "error", err)
+		interval = time.Hour
+	}
+
+	text := defaultDigestTemplate
+	if path := os.Getenv("DIGEST_TEMPLATE"); path != "" {
+		data, err := os.ReadFile(path)
+		must(err, "read digest template")
+		text = string(data)
+	}
+
+	tmpl, err := template.New("digest").Funcs(template.FuncMap{
+		"inc": func(i int) int { return i + 1 },
+	}).Parse(text)
+	must(err, "parse digest template")
+
+	a := &digestAggregator{
+		subject:  mustEnv("DIGEST_SUBJECT", "Your digest: %d new notification(s)"),
+		tmpl:     tmpl,
+		pending:  make(map[string][]digestItem),
+		interval: interval,
+		path:     mustEnv("DIGEST_FILE", "digests.json"),
+	}
+	must(a.load(), "digest file")
+	return a
+}
+
+// load reads the jobs buffered before a restart; a missing file is an empty buffer
+func (a *digestAggregator) load() error {
+	data, err := os.ReadFile(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &a.pending); err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	if a.pending == nil { // the file held null
+		a.pending = make(map[string][]digestItem)
+	}
+	return nil
+}
+
+// add buffers a job until the next flush. Once it returns nil the job is on
+// disk and its delivery can be acked.
+func (a *digestAggregator) add(job EmailJob) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	items := a.pending[job.To]
+	a.pending[job.To] = append(items, digestItem{
+		Subject:    job.Subject,
+		Body:       job.Body,
+		ReceivedAt: time.Now(),
+	})
+	if err := a.save(); err != nil {
+		if len(items) == 0 {
+			delete(a.pending, job.To)
+		} else {
+			a.pending[job.To] = items
+		}
+		return err
+	}
+	return nil
+}
+
+// save writes to a temporary file and renames it, so a crash never leaves a
+// truncated buffer behind. Callers hold mu.
+func (a *digestAggregator) save() error {
+	data, err := json.MarshalIndent(a.pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(a.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// flush renders one combined job per recipient and hands it to publish.
+// The items of a digest stay buffered until publish returns nil for it, so
+// a digest that fails to render or publish is tried again at the next
+// flush. Only the worker loop calls flush, never two at once.
+func (a *digestAggregator) flush(publish func(EmailJob) error) {
+	a.mu.Lock()
+	recipients := make([]string, 0, len(a.pending))
+	for to := range a.pending {
+		recipients = append(recipients, to)
+	}
+	sort.Strings(recipients)
+
+	jobs := make([]EmailJob, 0, len(recipients))
+	counts := make(map[string]int, len(recipients))
+	for _, to := range recipients {
+		items := a.pending[to]
+
+		var body bytes.Buffer
+		if err := a.tmpl.Execute(&body, digestData{To: to, Count: len(items), Items: items}); err != nil {
+			slog.Error("digest render failed", "to", to, "error", err)
+			continue
+		}
+
+		jobs = append(jobs, EmailJob{QueuedEmail: smtp.QueuedEmail{
+			To:      to,
+			Subject: a.subjectFor(len(items)),
+			Body:    body.String(),
+		}})
+		counts[to] = len(items)
+	}
+	a.mu.Unlock()
+
+	// Publishing waits on the broker, so handlers can keep adding meanwhile
+	var published []string
+	for _, job := range jobs {
+		if err := publish(job); err != nil {
+			continue
+		}
+		published = append(published, job.To)
+	}
+	if len(published) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, to := range published {
+		// Items added since the digest was rendered come after the ones in it
+		if rest := a.pending[to][counts[to]:]; len(rest) > 0 {
+			a.pending[to] = rest
+		} else {
+			delete(a.pending, to)
+		}
+	}
+	if err := a.save(); err != nil {
+		// The file still holds the published items, so a restart sends them again
+		slog.Error("digest file not updated after flush", "path", a.path, "error", err)
+	}
+}
+
+// subjectFor fills in the item count wherever the configured subject has
+// %d. The subject isn't a format string, so any other % is kept as is.
+func (a *digestAggregator) subjectFor(count int) string {
+	return strings.ReplaceAll(a.subject, "%d", strconv.Itoa(count))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	smtp "github.com/fajar/learn-go/04-smtp"
+)
+
+// newTestDigests builds an aggregator from the environment with its file
+// in a temporary directory
+func newTestDigests(t *testing.T) *digestAggregator {
+	t.Helper()
+	t.Setenv("DIGEST_FILE", filepath.Join(t.TempDir(), "digests.json"))
+	return newDigestAggregator()
+}
+
+func digestJob(to, subject string) EmailJob {
+	return EmailJob{QueuedEmail: smtp.QueuedEmail{To: to, Subject: subject, Body: subject + " body"}, Digest: true}
+}
+
+func TestSubjectFor(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"Your digest: %d new notification(s)", "Your digest: 3 new notification(s)"},
+		{"Digest", "Digest"},
+		{"100% done: %d items", "100% done: 3 items"},
+		{"%s and %v stay", "%s and %v stay"},
+		{"%d of %d", "3 of 3"},
+	}
+	for _, tt := range tests {
+		a := &digestAggregator{subject: tt.subject}
+		if got := a.subjectFor(3); got != tt.want {
+			t.Errorf("subjectFor(3) with %q = %q, want %q", tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestDigestSurvivesRestart(t *testing.T) {
+	a := newTestDigests(t)
+	for _, job := range []EmailJob{digestJob("a@example.com", "one"), digestJob("a@example.com", "two"), digestJob("b@example.com", "three")} {
+		if err := a.add(job); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	// A new aggregator on the same file picks up where the first stopped
+	restarted := newDigestAggregator()
+	var got []EmailJob
+	restarted.flush(func(job EmailJob) error {
+		got = append(got, job)
+		return nil
+	})
+	if len(got) != 2 {
+		t.Fatalf("flushed %d digests, want 2", len(got))
+	}
+	if got[0].To != "a@example.com" || !strings.Contains(got[0].Body, "one") || !strings.Contains(got[0].Body, "two") {
+		t.Errorf("first digest = %+v, want both of a@example.com's items", got[0].QueuedEmail)
+	}
+	if !strings.Contains(got[0].Subject, "2") {
+		t.Errorf("subject %q doesn't count 2 items", got[0].Subject)
+	}
+
+	if after := newDigestAggregator(); len(after.pending) != 0 {
+		t.Errorf("file still holds %v after a flush", after.pending)
+	}
+}
+
+func TestDigestKeptUntilPublished(t *testing.T) {
+	a := newTestDigests(t)
+	if err := a.add(digestJob("a@example.com", "one")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := a.add(digestJob("b@example.com", "two")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	// Only b's digest is published; a's stays for the next flush, on disk too
+	a.flush(func(job EmailJob) error {
+		if job.To == "a@example.com" {
+			return errors.New("broker down")
+		}
+		return nil
+	})
+	restarted := newDigestAggregator()
+	if len(restarted.pending) != 1 || len(restarted.pending["a@example.com"]) != 1 {
+		t.Fatalf("pending after a failed publish = %v, want a@example.com's item only", restarted.pending)
+	}
+
+	// An item added while the flush publishes goes into the next digest
+	a.flush(func(job EmailJob) error {
+		if err := a.add(digestJob(job.To, "late")); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		return nil
+	})
+	items := a.pending["a@example.com"]
+	if len(items) != 1 || items[0].Subject != "late" {
+		t.Errorf("pending after the flush = %v, want only the late item", items)
+	}
+}
+
+func TestDigestAddFails(t *testing.T) {
+	a := newTestDigests(t)
+	a.path = t.TempDir() // a directory, so the rename fails
+	if err := a.add(digestJob("a@example.com", "one")); err == nil {
+		t.Fatal("add succeeded with an unwritable file")
+	}
+	if len(a.pending) != 0 {
+		t.Errorf("pending = %v after a failed add, want it empty", a.pending)
+	}
+}
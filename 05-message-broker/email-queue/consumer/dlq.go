@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/amqpconn"
+	"github.com/fajar/learn-go/emailtopology"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	dlqName           = emailtopology.DLQ
+	dlqDefaultLimit   = 50
+	dlqMaxLimit       = 500
+	dlqRequestTimeout = 30 * time.Second
+)
+
+var errNotInDLQ = errors.New("message not found in the DLQ")
+
+// dlqMessage is one entry of GET /admin/dlq
+type dlqMessage struct {
+	ID          string    `json:"id"`
+	To          string    `json:"to,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	DeadAt      time.Time `json:"dead_lettered_at"`
+	Redelivered bool      `json:"redelivered"`    // peeked or requeued before
+	Body        string    `json:"body,omitempty"` // raw payload when it isn't a valid job
+}
+
+// dlqListing is the body of GET /admin/dlq
+type dlqListing struct {
+	Total    int          `json:"total"` // messages in the queue, including ones past the limit
+	Messages []dlqMessage `json:"messages"`
+}
+
+// dlqAdmin inspects and empties emails.dlq over its own connection, so
+// admin requests never touch the worker's channel. Operations hold a lock:
+// a peek takes messages off the queue for a moment, and two at once would
+// each see only part of it.
+type dlqAdmin struct {
+	mq *amqpconn.Manager
+	mu sync.Mutex
+}
+
+func newDLQAdmin(ctx context.Context, url string) (*dlqAdmin, error) {
+	mq, err := amqpconn.Dial(ctx, amqpconn.Config{
+		URL: url,
+		Setup: func(ch *amqp.Channel) error {
+			return ch.Confirm(false) // requeued messages are only removed from the DLQ once confirmed
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dlqAdmin{mq: mq}, nil
+}
+
+// channel returns a usable channel. A failed operation can close the
+// channel (or the connection can drop), so reconnect when that happened.
+func (a *dlqAdmin) channel(ctx context.Context) (*amqp.Channel, error) {
+	if ch := a.mq.Channel(); !ch.IsClosed() {
+		return ch, nil
+	}
+	return a.mq.Reconnect(ctx)
+}
+
+// peek lists up to limit messages from the head of the DLQ. Messages are
+// fetched unacked and put back, so they stay in the queue in order, marked
+// as redelivered.
+func (a *dlqAdmin) peek(ctx context.Context, limit int) (dlqListing, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ch, err := a.channel(ctx)
+	if err != nil {
+		return dlqListing{}, err
+	}
+	q, err := ch.QueueDeclarePassive(dlqName, true, false, false, false, nil)
+	if err != nil {
+		return dlqListing{}, err
+	}
+
+	listing := dlqListing{Total: q.Messages, Messages: []dlqMessage{}}
+	var last amqp.Delivery
+	for len(listing.Messages) < limit {
+		d, ok, err := ch.Get(dlqName, false)
+		if err != nil {
+			return dlqListing{}, err
+		}
+		if !ok {
+			break
+		}
+		listing.Messages = append(listing.Messages, describeDead(d))
+		last = d
+	}
+	if len(listing.Messages) > 0 {
+		if err := last.Nack(true, true); err != nil {
+			return dlqListing{}, err
+		}
+	}
+	return listing, nil
+}
+
+// requeue moves messages from the DLQ back to emails.primary with a fresh
+// attempt count. With an id, only that message moves; otherwise every
+// message in the queue when the call started does. Returns how many moved.
+func (a *dlqAdmin) requeue(ctx context.Context, id string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ch, err := a.channel(ctx)
+	if err != nil {
+		return 0, err
+	}
+	q, err := ch.QueueDeclarePassive(dlqName, true, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	var last *amqp.Delivery // the latest message fetched but not moved
+	var failed error
+	for range q.Messages {
+		d, ok, err := ch.Get(dlqName, false)
+		if err != nil {
+			failed = err
+			break
+		}
+		if !ok {
+			break
+		}
+		if id != "" && messageID(d) != id {
+			last = &d
+			continue
+		}
+
+		if err := republish(ctx, ch, d); err != nil {
+			last, failed = &d, err
+			break
+		}
+		if err := d.Ack(false); err != nil {
+			return moved, err
+		}
+		moved++
+		if id != "" {
+			break
+		}
+	}
+
+	// Put back everything that was fetched but not moved; a multiple nack
+	// skips the ones already acked
+	if last != nil {
+		if err := last.Nack(true, true); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		return moved, failed
+	}
+	if id != "" && moved == 0 {
+		return 0, errNotInDLQ
+	}
+	return moved, nil
+}
+
+// purge drops every message in the DLQ
+func (a *dlqAdmin) purge(ctx context.Context) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ch, err := a.channel(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return ch.QueuePurge(dlqName, false)
+}
+
+// republish sends a dead message back to the primary queue as a new job and
+// waits for the broker's confirm
+func republish(ctx context.Context, ch *amqp.Channel, d amqp.Delivery) error {
+	headers := amqp.Table{headerAttempts: int32(0), headerEnqueuedAt: time.Now().UnixMilli()}
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, emailtopology.Exchange, emailtopology.SendKey, false, false, amqp.Publishing{
+		MessageId:    d.MessageId,
+		Priority:     d.Priority,
+		ContentType:  "application/json",
+		Body:         d.Body,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+		Timestamp:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("broker nacked the requeued message")
+	}
+	return nil
+}
+
+// describeDead summarizes a DLQ message for the listing
+func describeDead(d amqp.Delivery) dlqMessage {
+	m := dlqMessage{
+		ID:          messageID(d),
+		Attempts:    getAttempts(d.Headers),
+		DeadAt:      d.Timestamp,
+		Redelivered: d.Redelivered,
+	}
+	if lastError, ok := d.Headers[headerLastError].(string); ok {
+		m.LastError = lastError
+	}
+
+	var job EmailJob
+	if err := json.Unmarshal(d.Body, &job); err != nil {
+		m.Body = string(d.Body)
+	} else {
+		m.To, m.Subject = job.To, job.Subject
+	}
+	return m
+}
+
+// messageID identifies a DLQ message. Messages dead-lettered before IDs were
+// assigned get one derived from their body and timestamp.
+func messageID(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return d.MessageId
+	}
+	h := sha256.New()
+	h.Write(d.Body)
+	h.Write([]byte(strconv.FormatInt(d.Timestamp.Unix(), 10)))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// newMessageID returns a random 16-character hex ID
+func newMessageID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// serveAdmin runs the DLQ admin API. Every route requires
+// "Authorization: Bearer <ADMIN_TOKEN>" when a token is configured, since
+// listings include recipients and error messages.
+func serveAdmin(addr, token string, a *dlqAdmin) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/dlq", func(w http.ResponseWriter, r *http.Request) {
+		limit := dlqDefaultLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > dlqMaxLimit {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("limit must be between 1 and %d", dlqMaxLimit)})
+				return
+			}
+			limit = n
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), dlqRequestTimeout)
+		defer cancel()
+
+		listing, err := a.peek(ctx, limit)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, listing)
+	})
+
+	mux.HandleFunc("POST /admin/dlq/requeue", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), dlqRequestTimeout)
+		defer cancel()
+
+		moved, err := a.requeue(ctx, "")
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]any{"error": err.Error(), "requeued": moved})
+			return
+		}
+		slog.Info("DLQ: requeued messages", "count", moved)
+		writeJSON(w, http.StatusOK, map[string]int{"requeued": moved})
+	})
+
+	mux.HandleFunc("POST /admin/dlq/{id}/requeue", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), dlqRequestTimeout)
+		defer cancel()
+
+		id := r.PathValue("id")
+		_, err := a.requeue(ctx, id)
+		switch {
+		case errors.Is(err, errNotInDLQ):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error(), "id": id})
+		case err != nil:
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		default:
+			slog.Info("DLQ: requeued message", "message_id", id)
+			writeJSON(w, http.StatusOK, map[string]any{"requeued": 1, "id": id})
+		}
+	})
+
+	mux.HandleFunc("DELETE /admin/dlq", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), dlqRequestTimeout)
+		defer cancel()
+
+		purged, err := a.purge(ctx)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		slog.Info("DLQ: purged messages", "count", purged)
+		writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+	})
+
+	var handler http.Handler = mux
+	if token == "" {
+		slog.Warn("ADMIN_TOKEN is not set, the DLQ admin API is unauthenticated", "addr", addr)
+	} else {
+		handler = requireToken(token, mux)
+	}
+
+	slog.Info("admin API listening", "addr", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		slog.Error("admin server stopped", "error", err)
+	}
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid admin token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,184 @@
+//go:build integration
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedMail is one message the fake SMTP server accepted
+type receivedMail struct {
+	From string
+	To   []string
+	Data string // the message as sent after DATA, headers included
+}
+
+// header parses the message and returns one of its headers
+func (m receivedMail) header(t *testing.T, name string) string {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(m.Data))
+	if err != nil {
+		t.Fatalf("parse received message: %v", err)
+	}
+	return msg.Header.Get(name)
+}
+
+// fakeSMTP is a plain-text SMTP server that keeps what it receives in
+// memory. It offers neither STARTTLS nor AUTH, so the 04-smtp sender skips
+// both on any port other than 465 and 587. MAIL commands can be scripted to
+// fail, which is how the tests make sends fail.
+type fakeSMTP struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	received []receivedMail
+	attempts int      // MAIL commands seen, failed ones included
+	failures []string // replies for the next MAIL commands, in order
+}
+
+// startFakeSMTP listens on a free local port
+func startFakeSMTP() (*fakeSMTP, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeSMTP{ln: ln}
+	go s.serve()
+	return s, nil
+}
+
+func (s *fakeSMTP) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) close() error {
+	return s.ln.Close()
+}
+
+// failNext answers the next n MAIL commands with reply, e.g.
+// "451 4.3.0 Try again later"
+func (s *fakeSMTP) failNext(n int, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range n {
+		s.failures = append(s.failures, reply)
+	}
+}
+
+// reset forgets everything received and any scripted failures
+func (s *fakeSMTP) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received, s.attempts, s.failures = nil, 0, nil
+}
+
+// snapshot returns the accepted messages and the number of send attempts
+func (s *fakeSMTP) snapshot() ([]receivedMail, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedMail(nil), s.received...), s.attempts
+}
+
+// waitForMail blocks until n messages have been accepted
+func (s *fakeSMTP) waitForMail(t *testing.T, n int) []receivedMail {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		received, attempts := s.snapshot()
+		if len(received) >= n {
+			return received
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d of %d messages after %d send attempts", len(received), n, attempts)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return // closed
+		}
+		go s.session(conn)
+	}
+}
+
+// session speaks just enough SMTP for net/smtp: EHLO, MAIL, RCPT, DATA,
+// RSET, NOOP and QUIT
+func (s *fakeSMTP) session(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	_ = c.PrintfLine("220 fake.local ESMTP")
+
+	var current receivedMail
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			_ = c.PrintfLine("250-fake.local\r\n250 8BITMIME")
+		case "MAIL":
+			if reply, failed := s.startMail(); failed {
+				_ = c.PrintfLine("%s", reply)
+				continue
+			}
+			current = receivedMail{From: addressArg(arg)}
+			_ = c.PrintfLine("250 2.1.0 OK")
+		case "RCPT":
+			current.To = append(current.To, addressArg(arg))
+			_ = c.PrintfLine("250 2.1.5 OK")
+		case "DATA":
+			_ = c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+			current.Data = string(data)
+			s.mu.Lock()
+			s.received = append(s.received, current)
+			s.mu.Unlock()
+			_ = c.PrintfLine("250 2.0.0 OK queued")
+		case "RSET", "NOOP":
+			_ = c.PrintfLine("250 2.0.0 OK")
+		case "QUIT":
+			_ = c.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			_ = c.PrintfLine("502 5.5.2 Command not implemented")
+		}
+	}
+}
+
+// startMail counts a send attempt and pops the next scripted failure
+func (s *fakeSMTP) startMail() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if len(s.failures) == 0 {
+		return "", false
+	}
+	reply := s.failures[0]
+	s.failures = s.failures[1:]
+	return reply, true
+}
+
+// addressArg extracts the address from "FROM:<a@b> ..." or "TO:<a@b>"
+func addressArg(arg string) string {
+	start, end := strings.Index(arg, "<"), strings.Index(arg, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return arg[start+1 : end]
+}
@@ -0,0 +1,436 @@
+//go:build integration
+
+// Integration tests for the worker against a real RabbitMQ started with
+// testcontainers and a fake SMTP server (fakesmtp_test.go). Run them with:
+//
+//	go test -tags integration -v ./...
+//
+// Docker must be running. The worker is the real one, topology included:
+// jobs are published to the emails exchange, handled by worker.process and
+// retried or dead-lettered through the broker. Only the retry tiers are
+// shortened, so a job goes through all of them in a couple of seconds.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	smtp "github.com/fajar/learn-go/04-smtp"
+	"github.com/fajar/learn-go/amqpconn"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// rabbitImage is pinned so test runs are reproducible
+const rabbitImage = "rabbitmq:3.13-alpine"
+
+const (
+	waitTimeout  = 20 * time.Second // how long a test waits for a message to show up
+	pollInterval = 50 * time.Millisecond
+
+	// tempFailure is what the fake SMTP server answers a scripted failure with
+	tempFailure = "451 4.3.0 Mailbox temporarily unavailable"
+)
+
+// testTiers replace retryTiers before the topology is declared. There are
+// as many as the real ones, since maxAttempts counts on it.
+var testTiers = []retryTier{
+	{Name: "t1", Delay: 200 * time.Millisecond},
+	{Name: "t2", Delay: 300 * time.Millisecond},
+	{Name: "t3", Delay: 400 * time.Millisecond},
+	{Name: "t4", Delay: 500 * time.Millisecond},
+}
+
+var (
+	testBroker *rabbitBroker
+	testWorker *worker
+	testSMTP   *fakeSMTP
+
+	// inspect is a separate channel the tests read the DLQ and quarantine with
+	inspect *amqp.Channel
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegration(m))
+}
+
+// runIntegration starts RabbitMQ, the fake SMTP server and the worker, runs
+// the tests and tears everything down. It is split from TestMain so the
+// deferred cleanup runs before os.Exit.
+func runIntegration(m *testing.M) int {
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        rabbitImage,
+			ExposedPorts: []string{"5672/tcp"},
+			WaitingFor: wait.ForAll(
+				wait.ForListeningPort("5672/tcp"),
+				wait.ForLog("Server startup complete"),
+			).WithDeadline(2 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		log.Printf("failed to start RabbitMQ container: %v", err)
+		return 1
+	}
+	defer func() {
+		if err := container.Terminate(context.Background()); err != nil {
+			log.Printf("failed to terminate RabbitMQ container: %v", err)
+		}
+	}()
+
+	amqpURL, err := containerURL(ctx, container)
+	if err != nil {
+		log.Printf("failed to get RabbitMQ address: %v", err)
+		return 1
+	}
+
+	dir, err := os.MkdirTemp("", "email-queue-integration")
+	if err != nil {
+		log.Printf("failed to create temp dir: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("QUARANTINE_DIR", filepath.Join(dir, "quarantine"))
+	os.Setenv("SUPPRESSION_FILE", filepath.Join(dir, "suppressions.json"))
+	os.Setenv("DIGEST_FILE", filepath.Join(dir, "digests.json"))
+
+	testSMTP, err = startFakeSMTP()
+	if err != nil {
+		log.Printf("failed to start fake SMTP server: %v", err)
+		return 1
+	}
+	defer testSMTP.close()
+
+	retryTiers = testTiers
+	mq, err := amqpconn.Dial(ctx, amqpconn.Config{URL: amqpURL, Setup: setupChannel})
+	if err != nil {
+		log.Printf("failed to connect to RabbitMQ: %v", err)
+		return 1
+	}
+	defer mq.Close()
+
+	testWorker, err = newTestWorker(testSMTP.port())
+	if err != nil {
+		log.Printf("failed to build worker: %v", err)
+		return 1
+	}
+	intake := newIntake(mq.Channel(), testWorker.metrics)
+	testBroker = &rabbitBroker{mq: mq, in: intake}
+	msgs, err := intake.start()
+	if err != nil {
+		log.Printf("failed to consume emails.primary: %v", err)
+		return 1
+	}
+	// One delivery at a time; the channel closes with mq
+	go func() {
+		for d := range msgs {
+			testWorker.process(testBroker, d)
+		}
+	}()
+
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		log.Printf("failed to open inspection connection: %v", err)
+		return 1
+	}
+	defer conn.Close()
+	if inspect, err = conn.Channel(); err != nil {
+		log.Printf("failed to open inspection channel: %v", err)
+		return 1
+	}
+
+	return m.Run()
+}
+
+// containerURL is the AMQP URL of the container's mapped port
+func containerURL(ctx context.Context, container testcontainers.Container) (string, error) {
+	host, err := container.Host(ctx)
+	if err != nil {
+		return "", err
+	}
+	port, err := container.MappedPort(ctx, "5672/tcp")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("amqp://guest:guest@%s:%s/", host, port.Port()), nil
+}
+
+// testVERP is the worker's return path, as if BOUNCE_DOMAIN were set
+var testVERP = &verpAddresser{local: "bounce", domain: "bounces.example.com"}
+
+// newTestWorker builds a worker the way main does, sending to the fake SMTP
+// server without a rate limit
+func newTestWorker(smtpPort int) (*worker, error) {
+	unsub, err := newUnsubscriber()
+	if err != nil {
+		return nil, err
+	}
+	return &worker{
+		digest:  newDigestAggregator(),
+		poison:  newQuarantine(),
+		latency: newLatencyTracker(),
+		metrics: newWorkerMetrics(),
+		sender: smtp.NewEmailSender(smtp.EmailConfig{
+			SMTPServer:  "127.0.0.1",
+			SMTPPort:    smtpPort,
+			SenderEmail: "queue@example.com",
+			SenderName:  "Email Queue",
+		}),
+		unsub:  unsub,
+		verp:   testVERP,
+		pool:   newHandlerPool(1),
+		schema: emailJobSchema,
+	}, nil
+}
+
+// resetQueues empties the queues and the fake SMTP server before and after
+// a test, so a job left over from one test never reaches the next
+func resetQueues(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		queues := []string{"emails.primary", "emails.dlq", "emails.quarantine"}
+		for _, tier := range retryTiers {
+			queues = append(queues, tier.Queue())
+		}
+		for _, queue := range queues {
+			if _, err := inspect.QueuePurge(queue, false); err != nil {
+				t.Fatalf("purge %s: %v", queue, err)
+			}
+		}
+		testSMTP.reset()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// publishJob enqueues a job the way the digest flush does and returns its
+// correlation ID
+func publishJob(t *testing.T, job EmailJob) string {
+	t.Helper()
+	id, err := enqueue(testBroker, job)
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	return id
+}
+
+// publishRaw puts a body on the primary queue as is, for payloads enqueue
+// would never produce
+func publishRaw(t *testing.T, body []byte, headers map[string]any) {
+	t.Helper()
+	if err := testBroker.Publish(context.Background(), Message{Body: body, Headers: headers, Priority: priorityNormal}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+}
+
+// waitForMessage takes the next message off queue, failing the test if
+// none arrives in time
+func waitForMessage(t *testing.T, queue string) amqp.Delivery {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		d, ok, err := inspect.Get(queue, true)
+		if err != nil {
+			t.Fatalf("get from %s: %v", queue, err)
+		}
+		if ok {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no message in %s after %s", queue, waitTimeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// queueDepth is the number of ready messages in queue
+func queueDepth(t *testing.T, queue string) int {
+	t.Helper()
+	q, err := inspect.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("inspect %s: %v", queue, err)
+	}
+	return q.Messages
+}
+
+func newTestJob(to string) EmailJob {
+	return EmailJob{QueuedEmail: smtp.QueuedEmail{
+		To:      to,
+		Subject: "Your invoice",
+		Body:    "Invoice 42 is attached.",
+	}}
+}
+
+// Delivery: a job comes out of the SMTP server as it went into the queue
+
+func TestJobIsDelivered(t *testing.T) {
+	resetQueues(t)
+
+	attachment := []byte("total: 10.00 EUR")
+	job := newTestJob("alice@example.com, bob@example.com")
+	job.HTMLBody = "<p>Invoice <b>42</b> is attached.</p>"
+	job.Headers = map[string]string{"X-Campaign": "invoices"}
+	job.Attachments = []smtp.QueuedAttachment{{Filename: "invoice-42.txt", ContentType: "text/plain", Data: attachment}}
+	id := publishJob(t, job)
+
+	got := testSMTP.waitForMail(t, 1)[0]
+	if want := testVERP.address(verpToken(id)); got.From != want {
+		t.Fatalf("MAIL FROM %q, want the VERP return path %q", got.From, want)
+	}
+	if token, ok := testVERP.token("<" + strings.ToUpper(got.From) + ">"); !ok || token != verpToken(id) {
+		t.Fatalf("token of %q is %q, want %q", got.From, token, verpToken(id))
+	}
+	if from := got.header(t, "From"); !strings.Contains(from, "queue@example.com") {
+		t.Fatalf("From %q, want the sender, not the return path", from)
+	}
+	if want := []string{"alice@example.com", "bob@example.com"}; !slices.Equal(got.To, want) {
+		t.Fatalf("RCPT TO %v, want %v", got.To, want)
+	}
+	if subject := got.header(t, "Subject"); subject != job.Subject {
+		t.Fatalf("Subject %q, want %q", subject, job.Subject)
+	}
+	if header := got.header(t, mailHeaderCorrelationID); header != id {
+		t.Fatalf("%s %q, want the job's correlation ID %q", mailHeaderCorrelationID, header, id)
+	}
+	if header := got.header(t, "X-Campaign"); header != "invoices" {
+		t.Fatalf("X-Campaign %q, want invoices", header)
+	}
+	for _, want := range []string{job.Body, "<b>42</b>", "invoice-42.txt", base64.StdEncoding.EncodeToString(attachment)} {
+		if !strings.Contains(got.Data, want) {
+			t.Errorf("message doesn't contain %q", want)
+		}
+	}
+
+	if _, attempts := testSMTP.snapshot(); attempts != 1 {
+		t.Fatalf("%d send attempts, want 1", attempts)
+	}
+	if n := queueDepth(t, "emails.dlq"); n != 0 {
+		t.Fatalf("%d messages in emails.dlq, want 0", n)
+	}
+}
+
+// Retries: failed sends go through the tier queues and back to the worker
+
+func TestFailedSendIsRetried(t *testing.T) {
+	resetQueues(t)
+	testSMTP.failNext(2, tempFailure)
+
+	id := publishJob(t, newTestJob("carol@example.com"))
+
+	got := testSMTP.waitForMail(t, 1)
+	if header := got[0].header(t, mailHeaderCorrelationID); header != id {
+		t.Fatalf("%s %q, want %q: retries must keep the correlation ID", mailHeaderCorrelationID, header, id)
+	}
+	// Give a duplicate time to show up before counting
+	time.Sleep(testTiers[0].Delay)
+	received, attempts := testSMTP.snapshot()
+	if len(received) != 1 || attempts != 3 {
+		t.Fatalf("%d messages after %d attempts, want 1 after 3", len(received), attempts)
+	}
+	if n := queueDepth(t, "emails.dlq"); n != 0 {
+		t.Fatalf("%d messages in emails.dlq, want 0", n)
+	}
+}
+
+func TestJobIsDeadLetteredAfterMaxAttempts(t *testing.T) {
+	resetQueues(t)
+	testSMTP.failNext(maxAttempts, tempFailure)
+
+	job := newTestJob("dave@example.com")
+	id := publishJob(t, job)
+
+	d := waitForMessage(t, "emails.dlq")
+	if got := d.Headers[headerAttempts]; got != int32(maxAttempts) {
+		t.Errorf("%s %v, want %d", headerAttempts, got, maxAttempts)
+	}
+	if got := d.Headers[headerSMTPCode]; got != int32(451) {
+		t.Errorf("%s %v, want 451", headerSMTPCode, got)
+	}
+	if got, _ := d.Headers[headerLastError].(string); !strings.Contains(got, "temporarily unavailable") {
+		t.Errorf("%s %q doesn't carry the SMTP error", headerLastError, got)
+	}
+	if _, ok := d.Headers[headerRetryTier]; ok {
+		t.Errorf("%s is still set on a dead-lettered message", headerRetryTier)
+	}
+	if got := d.Headers[headerCorrelationID]; got != id {
+		t.Errorf("%s %v, want %q", headerCorrelationID, got, id)
+	}
+	if d.MessageId == "" {
+		t.Error("dead-lettered message has no message ID for the DLQ admin API")
+	}
+	var dead EmailJob
+	if err := json.Unmarshal(d.Body, &dead); err != nil || dead.To != job.To {
+		t.Errorf("DLQ body %s is not the original job (%v)", d.Body, err)
+	}
+
+	received, attempts := testSMTP.snapshot()
+	if len(received) != 0 || attempts != maxAttempts {
+		t.Fatalf("%d messages after %d attempts, want none after %d", len(received), attempts, maxAttempts)
+	}
+}
+
+// Payloads the worker can't send go straight to the DLQ or quarantine
+
+func TestBadPayloadIsDeadLettered(t *testing.T) {
+	resetQueues(t)
+
+	body := []byte(`{"to": "erin@example.com", "subject": `)
+	publishRaw(t, body, map[string]any{headerCorrelationID: "bad-payload"})
+
+	d := waitForMessage(t, "emails.dlq")
+	if got := d.Headers[headerAttempts]; got != int32(1) {
+		t.Errorf("%s %v, want 1: a bad payload is never retried", headerAttempts, got)
+	}
+	if got, _ := d.Headers[headerLastError].(string); !strings.HasPrefix(got, "bad payload") {
+		t.Errorf("%s %q, want a bad payload error", headerLastError, got)
+	}
+	if string(d.Body) != string(body) {
+		t.Errorf("DLQ body %q, want %q", d.Body, body)
+	}
+	if _, attempts := testSMTP.snapshot(); attempts != 0 {
+		t.Fatalf("%d send attempts, want 0", attempts)
+	}
+}
+
+func TestUnknownSchemaVersionIsQuarantined(t *testing.T) {
+	resetQueues(t)
+
+	body, err := json.Marshal(newTestJob("frank@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishRaw(t, body, map[string]any{headerSchemaVersion: int32(currentSchemaVersion + 1)})
+
+	d := waitForMessage(t, "emails.quarantine")
+	if got, _ := d.Headers[headerQuarantineReason].(string); got == "" {
+		t.Errorf("quarantined message has no %s", headerQuarantineReason)
+	}
+	if n := queueDepth(t, "emails.dlq"); n != 0 {
+		t.Fatalf("%d messages in emails.dlq, want 0", n)
+	}
+	if _, attempts := testSMTP.snapshot(); attempts != 0 {
+		t.Fatalf("%d send attempts, want 0", attempts)
+	}
+}
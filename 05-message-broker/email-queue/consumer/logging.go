@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// headerCorrelationID ties together every log record about one job, from the
+// producer's publish through each attempt to the SMTP send. Retries and
+// dead-lettering copy the headers, so it survives both.
+const headerCorrelationID = "x-correlation-id"
+
+// mailHeaderCorrelationID carries the correlation ID in the sent email, so a
+// bounce or a complaint can be traced back to the job
+const mailHeaderCorrelationID = "X-Correlation-ID"
+
+// Lifecycle events, logged under the "event" key so one job's history can be
+// pulled out of the logs with a single filter on correlation_id
+const (
+	eventReceived     = "received"
+	eventSkipped      = "skipped"
+	eventBuffered     = "buffered"
+	eventAttempted    = "attempted"
+	eventSent         = "sent"
+	eventRetried      = "retried"
+	eventDeadLettered = "dead_lettered"
+	eventQuarantined  = "quarantined"
+)
+
+// setupLogging makes a structured logger the default, configured by
+// LOG_FORMAT (json or text, default json) and LOG_LEVEL (debug, info, warn
+// or error, default info). Output from the standard log package, such as
+// amqpconn's, goes through it too.
+func setupLogging() {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(mustEnv("LOG_LEVEL", "info")))
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if mustEnv("LOG_FORMAT", "json") == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if levelErr != nil {
+		slog.Warn("invalid LOG_LEVEL, falling back to info", "error", levelErr)
+	}
+}
+
+// correlationID returns the delivery's correlation ID. Jobs published
+// without one, e.g. by the 04-smtp AsyncSender, get one here; it is written
+// into the headers so retries and the DLQ keep it.
+func correlationID(d *Delivery) string {
+	if id, ok := d.Headers[headerCorrelationID].(string); ok && id != "" {
+		return id
+	}
+	id := newMessageID()
+	if d.Headers == nil {
+		d.Headers = map[string]any{}
+	}
+	d.Headers[headerCorrelationID] = id
+	return id
+}
+
+// deliveryLogger returns a logger that tags every record with the job's
+// correlation ID and message ID, and for a replay the correlation ID of the
+// delivery it replays
+func deliveryLogger(d Delivery, id string) *slog.Logger {
+	log := slog.With("correlation_id", id)
+	if d.ID != "" {
+		log = log.With("message_id", d.ID)
+	}
+	if original, ok := d.Headers[headerReplayOf].(string); ok && original != "" {
+		log = log.With("replay_of", original)
+	}
+	return log
+}
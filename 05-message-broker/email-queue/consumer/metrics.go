@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// prefetchCount is the QoS limit on unacked deliveries per consumer
+const prefetchCount = 10
+
+// smtpLatencyBuckets are the upper bounds, in seconds, of the SMTP send histogram
+var smtpLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// workerMetrics counts what the worker does with its deliveries. The
+// counters are only ever added to, so a restart shows up as a reset in
+// Prometheus rather than a drop.
+type workerMetrics struct {
+	consumed     atomic.Int64
+	sent         atomic.Int64
+	retried      atomic.Int64
+	deadLettered atomic.Int64
+	throttled    atomic.Int64 // sends held back by the account's rate limit
+	throttleWait atomic.Int64 // nanoseconds spent held back
+
+	schemaMigrated atomic.Int64 // jobs upgraded from an older schema version
+	schemaRejected atomic.Int64 // jobs quarantined for a schema version the worker can't read
+
+	smtpLatency prometheus.Histogram
+
+	waiting atomic.Int64 // delivered by the broker, not yet picked up by the worker loop
+	busy    atomic.Int64 // deliveries being handled, up to WORKER_CONCURRENCY
+}
+
+func newWorkerMetrics() *workerMetrics {
+	return &workerMetrics{smtpLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "email_queue_smtp_send_duration_seconds",
+		Help:    "Time taken by each SMTP send, failed ones included.",
+		Buckets: smtpLatencyBuckets,
+	})}
+}
+
+// track reads deliveries off in as soon as the client library has them and
+// hands them on in order, wrapped for the worker, so it can see how many
+// prefetched messages are waiting. The library's own buffer can't be inspected.
+//
+// When in closes because the channel went down, buffered deliveries are
+// dropped, as the library does: the broker has already requeued them. When
+// it closes because the consumer was cancelled, they are still handed on so
+// intake.cancel can nack them.
+func (m *workerMetrics) track(ch *amqp.Channel, in <-chan amqp.Delivery) <-chan Delivery {
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		defer m.waiting.Store(0)
+
+		var queue []Delivery
+		for in != nil || len(queue) > 0 {
+			var send chan<- Delivery // nil, so never ready, while the queue is empty
+			var next Delivery
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+
+			select {
+			case d, ok := <-in:
+				if !ok {
+					if ch.IsClosed() {
+						return
+					}
+					in = nil
+					continue
+				}
+				queue = append(queue, fromAMQP(d))
+			case send <- next:
+				queue = queue[1:]
+			}
+			m.waiting.Store(int64(len(queue)))
+		}
+	}()
+	return out
+}
+
+// handling counts a delivery as being handled until the returned func is called
+func (m *workerMetrics) handling() func() {
+	m.busy.Add(1)
+	return func() { m.busy.Add(-1) }
+}
+
+// prefetchUtilization is the share of the prefetch window in use: deliveries
+// waiting for the worker plus the ones it is handling
+func (m *workerMetrics) prefetchUtilization() float64 {
+	return float64(m.waiting.Load()+m.busy.Load()) / prefetchCount
+}
+
+// collectors returns the worker metrics for a Prometheus registry. The
+// counters and gauges read the fields above when scraped.
+func (m *workerMetrics) collectors() []prometheus.Collector {
+	count := func(v *atomic.Int64) func() float64 {
+		return func() float64 { return float64(v.Load()) }
+	}
+	return []prometheus.Collector{
+		counterFunc("email_queue_consumed_total", "Deliveries taken from emails.primary.", count(&m.consumed)),
+		counterFunc("email_queue_sent_total", "Emails accepted by the SMTP server.", count(&m.sent)),
+		counterFunc("email_queue_retried_total", "Failed sends parked in a retry tier.", count(&m.retried)),
+		counterFunc("email_queue_dead_lettered_total", "Messages moved to emails.dlq.", count(&m.deadLettered)),
+		counterFunc("email_queue_rate_limited_total", "Sends held back by the SMTP account's rate limit.", count(&m.throttled)),
+		counterFunc("email_queue_schema_migrated_total", "Jobs upgraded from an older schema version.", count(&m.schemaMigrated)),
+		counterFunc("email_queue_schema_rejected_total", "Jobs quarantined for a schema version the worker can't read.", count(&m.schemaRejected)),
+		counterFunc("email_queue_rate_limit_wait_seconds_total", "Time sends spent held back by the rate limit.", func() float64 {
+			return time.Duration(m.throttleWait.Load()).Seconds()
+		}),
+		m.smtpLatency,
+		gaugeFunc("email_queue_prefetch_limit", "Unacked deliveries the broker will hand this worker.", func() float64 { return prefetchCount }),
+		gaugeFunc("email_queue_handlers_busy", "Deliveries being handled right now.", count(&m.busy)),
+		gaugeFunc("email_queue_prefetch_utilization", "Share of the prefetch window in use (0-1).", m.prefetchUtilization),
+	}
+}
+
+// smtpLatencyTotals returns the sum, in seconds, and the count of the SMTP
+// sends timed so far
+func (m *workerMetrics) smtpLatencyTotals() (float64, uint64) {
+	var metric dto.Metric
+	_ = m.smtpLatency.Write(&metric) // only fails for invalid exemplars
+	h := metric.GetHistogram()
+	return h.GetSampleSum(), h.GetSampleCount()
+}
+
+func counterFunc(name, help string, value func() float64) prometheus.Collector {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, value)
+}
+
+func gaugeFunc(name, help string, value func() float64) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, value)
+}
+
+// boolGauge is 1 for true and 0 for false
+func boolGauge(ok bool) float64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestWorkerMetricsExposition(t *testing.T) {
+	m := newWorkerMetrics()
+	m.consumed.Add(3)
+	m.sent.Add(2)
+	m.throttleWait.Add(int64(1500 * time.Millisecond))
+	m.smtpLatency.Observe(0.2)
+	m.smtpLatency.Observe(4)
+	done := m.handling()
+	defer done()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m.collectors()...)
+	srv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"# TYPE email_queue_consumed_total counter\nemail_queue_consumed_total 3\n",
+		"email_queue_sent_total 2\n",
+		"email_queue_retried_total 0\n",
+		"email_queue_rate_limit_wait_seconds_total 1.5\n",
+		"# TYPE email_queue_smtp_send_duration_seconds histogram\n",
+		`email_queue_smtp_send_duration_seconds_bucket{le="0.25"} 1` + "\n",
+		`email_queue_smtp_send_duration_seconds_bucket{le="5"} 2` + "\n",
+		"email_queue_smtp_send_duration_seconds_count 2\n",
+		"email_queue_prefetch_limit 10\n",
+		"# TYPE email_queue_handlers_busy gauge\nemail_queue_handlers_busy 1\n",
+		"email_queue_prefetch_utilization 0.1\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("exposition lacks %q:\n%s", want, body)
+		}
+	}
+
+	sum, count := m.smtpLatencyTotals()
+	if sum != 4.2 || count != 2 {
+		t.Errorf("smtpLatencyTotals() = %g, %d, want 4.2, 2", sum, count)
+	}
+}
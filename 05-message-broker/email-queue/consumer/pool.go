@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// handlerPool runs up to size deliveries at once. Each handler still acks
+// its own delivery once the send is done, so a crash mid-send leaves every
+// in-flight delivery unacked for the broker to redeliver. The broker's
+// prefetch bounds how many deliveries can be waiting, so size is capped by
+// it. The autoscaler can change size while the worker runs.
+type handlerPool struct {
+	size  atomic.Int64
+	slots chan struct{} // as many as the prefetch count, the most size can be
+	freed chan struct{} // signalled when a slot frees up, so the worker loop reads again
+	wg    sync.WaitGroup
+}
+
+func newHandlerPool(size int) *handlerPool {
+	p := &handlerPool{
+		slots: make(chan struct{}, prefetchCount),
+		freed: make(chan struct{}, 1),
+	}
+	p.size.Store(int64(size))
+	return p
+}
+
+// workerConcurrency reads WORKER_CONCURRENCY, the deliveries handled at
+// once (default 1). It can't exceed the prefetch count, since the broker
+// never hands the worker more unacked deliveries than that.
+func workerConcurrency() (int, error) {
+	n, err := strconv.Atoi(mustEnv("WORKER_CONCURRENCY", "1"))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("WORKER_CONCURRENCY: must be an integer >= 1")
+	}
+	if n > prefetchCount {
+		slog.Warn("WORKER_CONCURRENCY is above the prefetch count, using the prefetch count", "requested", n, "prefetch", prefetchCount)
+		n = prefetchCount
+	}
+	return n, nil
+}
+
+// full reports whether every slot is taken. Only the worker loop starts
+// handlers, so a pool that isn't full has room for one more. After a
+// shrink, more than size can still be running until they finish.
+func (p *handlerPool) full() bool {
+	return int64(len(p.slots)) >= p.size.Load()
+}
+
+// limit is how many deliveries the pool handles at once
+func (p *handlerPool) limit() int {
+	return int(p.size.Load())
+}
+
+// resize changes how many deliveries are handled at once, up to the
+// prefetch count. Handlers over a smaller size finish their deliveries.
+func (p *handlerPool) resize(size int) {
+	p.size.Store(int64(min(max(size, 1), prefetchCount)))
+	p.wake() // a worker loop waiting for a free slot may have one now
+}
+
+// wake tells the worker loop to look at the pool again
+func (p *handlerPool) wake() {
+	select {
+	case p.freed <- struct{}{}:
+	default: // a wakeup is already pending
+	}
+}
+
+// run handles a delivery on its own goroutine. The caller checks full first.
+func (p *handlerPool) run(handle func()) {
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			<-p.slots
+			p.wake()
+		}()
+		handle()
+	}()
+}
+
+// wait blocks until every running handler has finished
+func (p *handlerPool) wait() {
+	p.wg.Wait()
+}
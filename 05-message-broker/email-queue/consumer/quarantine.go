@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	headerPanic      = "x-panic"
+	headerPanicStack = "x-panic-stack"
+
+	// AMQP headers travel in a single frame, so very deep stacks are cut short
+	maxStackHeader = 8 * 1024
+)
+
+// quarantineSample is the on-disk copy of a poison message kept for debugging
+type quarantineSample struct {
+	QuarantinedAt time.Time      `json:"quarantined_at"`
+	Panic         string         `json:"panic,omitempty"`
+	Stack         string         `json:"stack,omitempty"`
+	Reason        string         `json:"reason,omitempty"` // for messages rejected without a panic
+	Headers       map[string]any `json:"headers"`
+	Body          string         `json:"body"`
+}
+
+// quarantine moves messages that crash the handler, or that it can't read,
+// out of the retry loop
+type quarantine struct {
+	dir        string
+	sampleRate float64
+
+	mu   sync.Mutex
+	seen map[string]bool // panic values and reasons already sampled at least once
+}
+
+// newQuarantine builds a quarantine from QUARANTINE_* environment variables
+func newQuarantine() *quarantine {
+	rate, err := strconv.ParseFloat(mustEnv("QUARANTINE_SAMPLE_RATE", "0.1"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		slog.Warn("invalid QUARANTINE_SAMPLE_RATE, falling back to 0.1", "error", err)
+		rate = 0.1
+	}
+
+	return &quarantine{
+		dir:        mustEnv("QUARANTINE_DIR", "quarantine"),
+		sampleRate: rate,
+		seen:       make(map[string]bool),
+	}
+}
+
+// guard runs handle and quarantines the delivery if it panics
+func (q *quarantine) guard(b Broker, d Delivery, log *slog.Logger, handle func()) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		reason := fmt.Sprint(r)
+		stack := string(debug.Stack())
+		log.Error("handler panic, quarantining message", "event", eventQuarantined, "panic", reason)
+
+		headerStack := stack
+		if len(headerStack) > maxStackHeader {
+			headerStack = headerStack[:maxStackHeader]
+		}
+		q.publish(b, d, map[string]any{headerPanic: reason, headerPanicStack: headerStack}, reason,
+			quarantineSample{Panic: reason, Stack: stack}, log)
+	}()
+
+	handle()
+}
+
+// reject quarantines a delivery the handler can't read, such as a job in a
+// schema version this worker doesn't know, with the cause in
+// x-quarantine-reason
+func (q *quarantine) reject(b Broker, d Delivery, cause error, log *slog.Logger) {
+	log.Warn("job quarantined", "event", eventQuarantined, "reason", cause)
+	q.publish(b, d, map[string]any{headerQuarantineReason: cause.Error()}, cause.Error(),
+		quarantineSample{Reason: cause.Error()}, log)
+}
+
+// publish copies the delivery onto the quarantine queue with extra headers
+// attached, samples it under key and acks it. If the publish fails the
+// delivery is nacked instead, so the broker redelivers it rather than lose
+// it.
+func (q *quarantine) publish(b Broker, d Delivery, extra map[string]any, key string, s quarantineSample, log *slog.Logger) {
+	headers := map[string]any{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+	d.Headers = headers
+
+	if err := b.Quarantine(context.Background(), d); err != nil {
+		log.Error("quarantine publish failed, requeueing", "error", err)
+		_ = d.Nack()
+		return
+	}
+	q.sample(d, key, s, log)
+	_ = d.Ack()
+}
+
+// sample writes a copy of the message to disk. The first occurrence of each
+// distinct panic or reason is always kept; repeats are kept at the
+// configured rate.
+func (q *quarantine) sample(d Delivery, key string, s quarantineSample, log *slog.Logger) {
+	q.mu.Lock()
+	skip := q.seen[key] && rand.Float64() >= q.sampleRate
+	q.seen[key] = true
+	q.mu.Unlock()
+	if skip {
+		return
+	}
+
+	s.QuarantinedAt = time.Now()
+	s.Headers = d.Headers
+	s.Body = string(d.Body)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Error("quarantine sample encode failed", "error", err)
+		return
+	}
+
+	if err := os.MkdirAll(q.dir, 0o755); err != nil {
+		log.Error("quarantine sample dir", "error", err)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%d.json", time.Now().UTC().Format("20060102T150405"), d.Seq)
+	path := filepath.Join(q.dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		log.Error("quarantine sample write failed", "error", err)
+		return
+	}
+	log.Info("quarantine sample written", "path", path)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+// quarantineBroker is a Broker whose Quarantine returns err; the other
+// methods aren't called by the quarantine
+type quarantineBroker struct {
+	Broker
+	err         error
+	quarantined []Delivery
+}
+
+func (b *quarantineBroker) Quarantine(_ context.Context, d Delivery) error {
+	b.quarantined = append(b.quarantined, d)
+	return b.err
+}
+
+// settled records which of Ack and Nack a delivery got
+type settled struct{ acked, nacked int }
+
+func (s *settled) delivery() Delivery {
+	return Delivery{
+		Message: Message{Body: []byte(`{"to":"a@example.com"}`)},
+		ack:     func() error { s.acked++; return nil },
+		nack:    func() error { s.nacked++; return nil },
+	}
+}
+
+func TestQuarantinePanic(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := []struct {
+		name        string
+		err         error
+		acked       int
+		nacked      int
+		wantSamples int
+	}{
+		{"published", nil, 1, 0, 1},
+		{"publish fails", errors.New("channel closed"), 0, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &quarantine{dir: t.TempDir(), sampleRate: 1, seen: make(map[string]bool)}
+			b := &quarantineBroker{err: tt.err}
+			var s settled
+			q.guard(b, s.delivery(), log, func() { panic("boom") })
+
+			if len(b.quarantined) != 1 || b.quarantined[0].Headers[headerPanic] != "boom" {
+				t.Fatalf("quarantined %+v, want one delivery with %s: boom", b.quarantined, headerPanic)
+			}
+			if s.acked != tt.acked || s.nacked != tt.nacked {
+				t.Errorf("acked %d and nacked %d times, want %d and %d", s.acked, s.nacked, tt.acked, tt.nacked)
+			}
+			samples, _ := os.ReadDir(q.dir)
+			if len(samples) != tt.wantSamples {
+				t.Errorf("%d samples written, want %d", len(samples), tt.wantSamples)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	smtp "github.com/fajar/learn-go/04-smtp"
+	"github.com/fajar/learn-go/concurrency/sleep"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds each call to Redis, so a hung server falls back to the
+// local bucket instead of stalling the worker
+const redisTimeout = 2 * time.Second
+
+// tokenBucketScript takes a token from the bucket at KEYS[1], refilled at
+// ARGV[1] tokens per second up to ARGV[2] tokens. It returns 0 when a token
+// was taken, or the milliseconds until one is due. Time comes from the
+// Redis server, so workers with skewed clocks still agree.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate / 1000)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity * 1000 / rate) + 1000)
+return wait
+`)
+
+// redisLimiter is a token bucket kept in Redis, shared by every worker that
+// sends through the same SMTP account. While Redis can't be reached it
+// falls back to a bucket of its own with the same limits.
+type redisLimiter struct {
+	client   *redis.Client
+	key      string
+	rate     float64 // tokens per second
+	burst    int
+	fallback smtp.Limiter
+
+	degraded atomic.Bool // set while Redis is unreachable, so the switch is logged once
+}
+
+// Wait implements smtp.Limiter
+func (l *redisLimiter) Wait(ctx context.Context) error {
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+		ms, err := tokenBucketScript.Run(callCtx, l.client, []string{l.key}, l.rate, l.burst).Int64()
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !l.degraded.Swap(true) {
+				slog.Warn("rate limit store unreachable, limiting this worker on its own", "key", l.key, "error", err)
+			}
+			return l.fallback.Wait(ctx)
+		}
+		if l.degraded.Swap(false) {
+			slog.Info("rate limit store reachable again", "key", l.key)
+		}
+		if ms == 0 {
+			return nil
+		}
+
+		if err := sleep.Until(ctx, time.Duration(ms)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+}
+
+// newAccountLimiter builds the sending limit for the SMTP account from
+// SMTP_RATE_PER_MINUTE and SMTP_RATE_BURST, returning nil when no limit is
+// set. With REDIS_URL the bucket is shared by all workers on the account;
+// without it, each worker gets the whole quota to itself.
+func newAccountLimiter(host, user string) (smtp.Limiter, error) {
+	perMinute, err := strconv.ParseFloat(mustEnv("SMTP_RATE_PER_MINUTE", "0"), 64)
+	if err != nil || perMinute < 0 {
+		return nil, fmt.Errorf("SMTP_RATE_PER_MINUTE: must be a number >= 0")
+	}
+	burst, err := strconv.Atoi(mustEnv("SMTP_RATE_BURST", "1"))
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("SMTP_RATE_BURST: must be an integer >= 1")
+	}
+	if perMinute == 0 {
+		return nil, nil
+	}
+	local := smtp.NewTokenBucketLimiter(perMinute/60, burst)
+
+	redisURL := mustEnv("REDIS_URL", "")
+	if redisURL == "" {
+		slog.Warn("REDIS_URL not set; the rate limit applies to each worker separately", "per_minute", perMinute)
+		return local, nil
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("REDIS_URL: %w", err)
+	}
+
+	l := &redisLimiter{
+		client:   redis.NewClient(opts),
+		key:      "email-queue:ratelimit:" + user + "@" + host,
+		rate:     perMinute / 60,
+		burst:    burst,
+		fallback: local,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := l.client.Ping(ctx).Err(); err != nil {
+		// Not fatal: Wait retries Redis on every send
+		l.degraded.Store(true)
+		slog.Warn("rate limit store unreachable, limiting this worker on its own", "key", l.key, "error", err)
+	}
+	slog.Info("rate limit shared through redis", "key", l.key, "per_minute", perMinute, "burst", burst)
+	return l, nil
+}
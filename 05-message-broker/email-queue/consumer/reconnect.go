@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/fajar/learn-go/amqpconn"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// setupChannel runs on every channel the connection manager opens, so the
+// topology and prefetch are back in place after a broker restart
+func setupChannel(ch *amqp.Channel) error {
+	if err := declareTopology(ch); err != nil {
+		return err
+	}
+	return ch.Qos(prefetchCount, 0, false)
+}
+
+// reconnect replaces the channel after the connection drops and picks up
+// where the worker left off: the control queue is re-bound, and the consumer
+// restarts unless intake is paused. Deliveries that were in flight were
+// never acked, so the broker has already requeued them. Gives up once
+// shutdown begins.
+func reconnect(mq *amqpconn.Manager, in *intake, stopping <-chan struct{}) (msgs <-chan Delivery, control <-chan amqp.Delivery, err error) {
+	slog.Warn("connection lost, reconnecting")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		// Only fails once shutdown begins
+		ch, err := mq.Reconnect(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		in.ch = ch // also where the worker publishes
+		if msgs, control, err = subscribe(in); err == nil {
+			return msgs, control, nil
+		}
+		slog.Warn("resubscribe failed, reconnecting again", "error", err)
+	}
+}
+
+// subscribe starts the consumer, unless intake is paused, and binds the control queue
+func subscribe(in *intake) (msgs <-chan Delivery, control <-chan amqp.Delivery, err error) {
+	if !in.isPaused() {
+		if msgs, err = in.start(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if control, err = subscribeControl(in.ch); err != nil {
+		return nil, nil, err
+	}
+	return msgs, control, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/textproto"
+	"time"
+
+	"github.com/fajar/learn-go/emailtopology"
+)
+
+const (
+	headerRetryTier   = "x-retry-tier"
+	headerSMTPCode    = "x-last-smtp-code" // reply code of the last failure, when the SMTP server sent one
+	headerLastErrorAt = "x-last-error-at"  // Unix milliseconds
+
+	// retryJitter shortens each delay by up to this fraction, so a burst of
+	// failures doesn't come back as a burst
+	retryJitter = 0.2
+)
+
+// retryTier is one backoff step, with its own queue (or topic or subject)
+type retryTier = emailtopology.RetryTier
+
+// retryTiers are used in order, one per failed attempt. maxAttempts is the
+// first try plus one retry per tier.
+var retryTiers = emailtopology.RetryTiers
+
+// tierFor picks the tier for a message that has failed attempts times
+func tierFor(attempts int) retryTier {
+	i := min(max(attempts-1, 0), len(retryTiers)-1)
+	return retryTiers[i]
+}
+
+// jittered returns the delay for one message in tier t. Jitter only
+// shortens it, so the queue TTL stays an upper bound, and a message can
+// wait behind an earlier one by at most retryJitter of the tier's delay.
+func jittered(t retryTier) time.Duration {
+	return t.Delay - time.Duration(rand.Float64()*retryJitter*float64(t.Delay))
+}
+
+// retry parks a failed message in the tier for its attempt count. The
+// error is the broker's when the copy couldn't be published, in which case
+// the caller still holds the only copy.
+func retry(b Broker, d Delivery, attempts int, cause error, log *slog.Logger) error {
+	tier := tierFor(attempts)
+	d.Headers = failureHeaders(d.Headers, attempts, cause)
+	d.Headers[headerRetryTier] = tier.Name
+	delay := jittered(tier)
+
+	if err := b.Retry(context.Background(), d, tier, delay); err != nil {
+		log.Error("retry publish failed", "tier", tier.Name, "error", err)
+		return err
+	}
+	log.Info("job retried", "event", eventRetried, "tier", tier.Name, "delay", delay)
+	return nil
+}
+
+// failureHeaders records why the latest attempt failed, so a message that
+// ends up in the DLQ explains itself
+func failureHeaders(h map[string]any, attempts int, cause error) map[string]any {
+	if h == nil {
+		h = map[string]any{}
+	}
+	h[headerAttempts] = int32(attempts)
+	h[headerLastError] = cause.Error()
+	h[headerLastErrorAt] = time.Now().UnixMilli()
+
+	var smtpErr *textproto.Error
+	if errors.As(cause, &smtpErr) {
+		h[headerSMTPCode] = int32(smtpErr.Code)
+	} else {
+		delete(h, headerSMTPCode) // left over from an earlier attempt
+	}
+	return h
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestTierFor(t *testing.T) {
+	last := retryTiers[len(retryTiers)-1].Name
+	tests := []struct {
+		attempts int
+		want     string
+	}{
+		{0, "30s"},
+		{1, "30s"},
+		{2, "2m"},
+		{3, "10m"},
+		{4, "1h"},
+		{maxAttempts + 5, last}, // never past the last tier
+	}
+	for _, tt := range tests {
+		if got := tierFor(tt.attempts); got.Name != tt.want {
+			t.Errorf("tierFor(%d) = %s, want %s", tt.attempts, got.Name, tt.want)
+		}
+	}
+}
+
+func TestJitteredOnlyShortens(t *testing.T) {
+	for _, tier := range retryTiers {
+		floor := tier.Delay - time.Duration(retryJitter*float64(tier.Delay))
+		for range 100 {
+			if d := jittered(tier); d > tier.Delay || d < floor {
+				t.Fatalf("%s: jittered() = %s, want within [%s, %s]", tier.Name, d, floor, tier.Delay)
+			}
+		}
+	}
+}
+
+func TestFailureHeaders(t *testing.T) {
+	smtpErr := &textproto.Error{Code: 451, Msg: "try again later"}
+	h := failureHeaders(nil, 2, fmt.Errorf("send: %w", smtpErr))
+	if h[headerAttempts] != int32(2) {
+		t.Errorf("%s = %v, want 2", headerAttempts, h[headerAttempts])
+	}
+	if h[headerLastError] != "send: "+smtpErr.Error() {
+		t.Errorf("%s = %v", headerLastError, h[headerLastError])
+	}
+	if h[headerSMTPCode] != int32(451) {
+		t.Errorf("%s = %v, want 451", headerSMTPCode, h[headerSMTPCode])
+	}
+	if _, ok := h[headerLastErrorAt].(int64); !ok {
+		t.Errorf("%s = %v, want Unix milliseconds", headerLastErrorAt, h[headerLastErrorAt])
+	}
+
+	// A later failure without a reply code drops the earlier one
+	h = failureHeaders(h, 3, errors.New("connection refused"))
+	if _, ok := h[headerSMTPCode]; ok {
+		t.Errorf("%s = %v left over from the previous attempt", headerSMTPCode, h[headerSMTPCode])
+	}
+	if h[headerAttempts] != int32(3) {
+		t.Errorf("%s = %v, want 3", headerAttempts, h[headerAttempts])
+	}
+}
+
+// republishBroker is a Broker whose Retry and DeadLetter return err; the
+// other methods aren't called when a failed job is republished
+type republishBroker struct {
+	Broker
+	err                   error
+	retried, deadLettered int
+}
+
+func (b *republishBroker) Retry(_ context.Context, _ Delivery, _ retryTier, _ time.Duration) error {
+	b.retried++
+	return b.err
+}
+
+func (b *republishBroker) DeadLetter(_ context.Context, _ Delivery) error {
+	b.deadLettered++
+	return b.err
+}
+
+func TestRetryOrDeadLetter(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	down := errors.New("channel closed")
+	tests := []struct {
+		name                  string
+		attempts              int
+		err                   error
+		acked, nacked         int
+		retried, deadLettered int64
+	}{
+		{"retried", 1, nil, 1, 0, 1, 0},
+		{"retry publish fails", 1, down, 0, 1, 0, 0},
+		{"dead-lettered", maxAttempts, nil, 1, 0, 0, 1},
+		{"dead-letter publish fails", maxAttempts, down, 0, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &worker{metrics: newWorkerMetrics()}
+			b := &republishBroker{err: tt.err}
+			var s settled
+			w.retryOrDeadLetter(context.Background(), b, s.delivery(), tt.attempts, errors.New("send failed"), deliveryRecord{}, log)
+
+			if b.retried+b.deadLettered != 1 {
+				t.Fatalf("published %d retries and %d dead letters, want one in all", b.retried, b.deadLettered)
+			}
+			if s.acked != tt.acked || s.nacked != tt.nacked {
+				t.Errorf("acked %d and nacked %d times, want %d and %d", s.acked, s.nacked, tt.acked, tt.nacked)
+			}
+			if got := w.metrics.retried.Load(); got != tt.retried {
+				t.Errorf("retried metric = %d, want %d", got, tt.retried)
+			}
+			if got := w.metrics.deadLettered.Load(); got != tt.deadLettered {
+				t.Errorf("dead-lettered metric = %d, want %d", got, tt.deadLettered)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// headerSchemaVersion is the version of the job's JSON layout. The
+	// producer also writes it into the body as schema_version, which is
+	// read when a broker or tool dropped the header.
+	headerSchemaVersion = "x-schema-version"
+
+	// headerQuarantineReason says why a message that didn't crash the
+	// handler was quarantined anyway
+	headerQuarantineReason = "x-quarantine-reason"
+
+	// currentSchemaVersion is the layout EmailJob decodes. Jobs without a
+	// version, such as those from the 04-smtp AsyncSender or from producers
+	// older than versioning, are version 1.
+	currentSchemaVersion = 1
+)
+
+// migrations upgrade a job body one version at a time: migrations[n] turns
+// a version n job into a version n+1 job, editing the decoded JSON object
+// in place. Bumping currentSchemaVersion to n+1 needs an entry for n, so
+// jobs already queued are upgraded instead of quarantined. For example:
+//
+//	migrations[1] = func(job map[string]any) error {
+//		job["html_body"] = job["html"] // renamed in version 2
+//		delete(job, "html")
+//		return nil
+//	}
+var migrations = map[int]func(job map[string]any) error{}
+
+// jobSchema upgrades job bodies from older versions to current, using
+// migrations laid out like the package's migrations table
+type jobSchema struct {
+	current    int
+	migrations map[int]func(job map[string]any) error
+}
+
+// emailJobSchema is the layout this worker's EmailJob decodes
+var emailJobSchema = jobSchema{current: currentSchemaVersion, migrations: migrations}
+
+// schemaVersion returns the delivery's version from the header, then from
+// the body. A body that isn't JSON is reported as version 1, so decoding
+// it fails as a bad payload.
+func schemaVersion(d Delivery) (int, error) {
+	switch v := d.Headers[headerSchemaVersion].(type) {
+	case nil:
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case int:
+		return v, nil
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s header %q is not a number", headerSchemaVersion, v)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("%s header has type %T", headerSchemaVersion, v)
+	}
+
+	var body struct {
+		SchemaVersion *int `json:"schema_version"`
+	}
+	if json.Unmarshal(d.Body, &body) != nil || body.SchemaVersion == nil {
+		return 1, nil
+	}
+	return *body.SchemaVersion, nil
+}
+
+// upgrade returns the delivery's body in the current layout and the
+// version it arrived in. It fails for a version this worker can't read: one
+// newer than it knows, or an older one it has no migration for. Such jobs
+// are quarantined rather than dead-lettered, since retrying won't help but
+// a newer worker or a new migration will.
+func (s jobSchema) upgrade(d Delivery) ([]byte, int, error) {
+	version, err := schemaVersion(d)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case version == s.current:
+		return d.Body, version, nil
+	case version > s.current:
+		return nil, version, fmt.Errorf("schema version %d: newer than this worker's %d; upgrade the worker", version, s.current)
+	case version < 1:
+		return nil, version, fmt.Errorf("schema version %d: not a valid version", version)
+	}
+
+	var job map[string]any
+	dec := json.NewDecoder(bytes.NewReader(d.Body))
+	dec.UseNumber() // numbers pass through migrations unchanged
+	if err := dec.Decode(&job); err != nil {
+		return d.Body, version, nil // decoding fails again, as a bad payload
+	}
+	for v := version; v < s.current; v++ {
+		migrate, ok := s.migrations[v]
+		if !ok {
+			return nil, version, fmt.Errorf("schema version %d: no migration from version %d", version, v)
+		}
+		if err := migrate(job); err != nil {
+			return nil, version, fmt.Errorf("schema version %d: migration from version %d failed: %v", version, v, err)
+		}
+	}
+	job["schema_version"] = s.current
+
+	body, err := json.Marshal(job)
+	if err != nil {
+		return nil, version, fmt.Errorf("schema version %d: encode migrated job: %v", version, err)
+	}
+	return body, version, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  any
+		body    string
+		want    int
+		wantErr bool
+	}{
+		{name: "int32 header", header: int32(2), want: 2},
+		{name: "int64 header", header: int64(3), want: 3},
+		{name: "string header", header: "4", want: 4},
+		{name: "header wins over body", header: int32(1), body: `{"schema_version":2}`, want: 1},
+		{name: "body", body: `{"schema_version":2}`, want: 2},
+		{name: "neither", body: `{"to":["a@example.com"]}`, want: 1},
+		{name: "body not JSON", body: `not json`, want: 1},
+		{name: "string header not a number", header: "two", wantErr: true},
+		{name: "header of another type", header: 2.0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Delivery{Message: Message{Body: []byte(tt.body), Headers: map[string]any{}}}
+			if tt.header != nil {
+				d.Headers[headerSchemaVersion] = tt.header
+			}
+			got, err := schemaVersion(d)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("schemaVersion() = %d, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("schemaVersion() = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpgradePayload(t *testing.T) {
+	current := []byte(`{"to":["a@example.com"],"subject":"hi"}`)
+	d := Delivery{Message: Message{Body: current}}
+	body, version, err := emailJobSchema.upgrade(d)
+	if err != nil || version != currentSchemaVersion || string(body) != string(current) {
+		t.Fatalf("current version: got %s, %d, %v; want the body unchanged", body, version, err)
+	}
+
+	for _, v := range []int{currentSchemaVersion + 1, 0, -1} {
+		d := Delivery{Message: Message{Body: current, Headers: map[string]any{headerSchemaVersion: int32(v)}}}
+		if _, _, err := emailJobSchema.upgrade(d); err == nil {
+			t.Errorf("version %d: want an error", v)
+		}
+	}
+}
+
+// v3Schema is a schema at version 3 that can upgrade version 2 jobs, which
+// renamed html to html_body, but has no migration from version 1
+var v3Schema = jobSchema{current: 3, migrations: map[int]func(job map[string]any) error{
+	2: func(job map[string]any) error {
+		job["html_body"] = job["html"]
+		delete(job, "html")
+		return nil
+	},
+}}
+
+func TestUpgradeMigrates(t *testing.T) {
+	s := jobSchema{current: 2, migrations: map[int]func(job map[string]any) error{1: v3Schema.migrations[2]}}
+	d := Delivery{Message: Message{Body: []byte(`{"to":["a@example.com"],"html":"<p>hi</p>","priority":9007199254740993}`)}}
+	body, version, err := s.upgrade(d)
+	if err != nil || version != 1 {
+		t.Fatalf("upgrade() = %s, %d, %v; want version 1 migrated", body, version, err)
+	}
+
+	var job map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&job); err != nil {
+		t.Fatalf("migrated body %s: %v", body, err)
+	}
+	if _, ok := job["html"]; ok {
+		t.Errorf("migrated body %s still has html", body)
+	}
+	if job["html_body"] != "<p>hi</p>" {
+		t.Errorf("html_body = %v, want the old html", job["html_body"])
+	}
+	if job["schema_version"] != json.Number("2") {
+		t.Errorf("schema_version = %v, want 2", job["schema_version"])
+	}
+	if job["priority"] != json.Number("9007199254740993") {
+		t.Errorf("priority = %v, want the number unchanged", job["priority"])
+	}
+}
+
+func TestUpgradeMissingMigrationQuarantined(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := []struct {
+		name        string
+		version     int32
+		quarantined bool
+	}{
+		{"no step from version 1", 1, true},
+		{"newer than the worker", 4, true},
+		{"migrates from version 2", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Delivery{Message: Message{
+				Body:    []byte(`{"to":["a@example.com"],"html":"<p>hi</p>"}`),
+				Headers: map[string]any{headerSchemaVersion: tt.version},
+			}}
+			_, _, err := v3Schema.upgrade(d)
+			if (err != nil) != tt.quarantined {
+				t.Fatalf("upgrade() error = %v, want an error: %t", err, tt.quarantined)
+			}
+			if !tt.quarantined {
+				return
+			}
+
+			w := &worker{
+				poison:  &quarantine{dir: t.TempDir(), sampleRate: 1, seen: make(map[string]bool)},
+				metrics: newWorkerMetrics(),
+				schema:  v3Schema,
+			}
+			b := &quarantineBroker{}
+			var s settled
+			d.ack = func() error { s.acked++; return nil }
+			d.nack = func() error { s.nacked++; return nil }
+			w.handleDelivery(context.Background(), b, d, log)
+
+			if len(b.quarantined) != 1 || b.quarantined[0].Headers[headerQuarantineReason] != err.Error() {
+				t.Fatalf("quarantined %+v, want the delivery with %s: %v", b.quarantined, headerQuarantineReason, err)
+			}
+			if s.acked != 1 || s.nacked != 0 {
+				t.Errorf("acked %d and nacked %d times, want 1 and 0", s.acked, s.nacked)
+			}
+			if got := w.metrics.schemaRejected.Load(); got != 1 {
+				t.Errorf("schema rejected metric = %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long an in-flight send may hold up shutdown
+func shutdownTimeout() time.Duration {
+	d, err := time.ParseDuration(mustEnv("SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil || d <= 0 {
+		slog.Warn("invalid SHUTDOWN_TIMEOUT, using 30s")
+		return 30 * time.Second
+	}
+	return d
+}
+
+// watchSignals returns a channel that is closed on SIGINT or SIGTERM. The
+// worker loop stops taking deliveries, drains, waits for the ones in flight
+// and closes done. If that takes longer than timeout, the connection is
+// closed under the sends and the process exits; the broker redelivers every
+// unacked message.
+func watchSignals(conn io.Closer, timeout time.Duration, done <-chan struct{}) <-chan struct{} {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	stopping := make(chan struct{})
+	go func() {
+		sig := <-sigCh
+		signal.Stop(sigCh)
+		slog.Info("shutting down", "signal", sig.String(), "deadline", timeout)
+		close(stopping)
+
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			slog.Error("shutdown deadline exceeded, closing connection; unacked messages will be redelivered")
+			_ = conn.Close()
+			os.Exit(1)
+		}
+	}()
+	return stopping
+}
+
+// isStopping reports whether shutdown has begun
+func isStopping(stopping <-chan struct{}) bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain cancels the consumer and requeues prefetched deliveries, while
+// sends already in flight carry on. Once they are done the worker sends
+// buffered digests early, since their jobs were acked when they were buffered.
+func drain(in *intake, msgs <-chan Delivery) {
+	if msgs != nil { // nil while paused
+		requeued, err := in.cancel(msgs)
+		if err != nil {
+			slog.Error("cancel consumer", "error", err)
+		} else {
+			slog.Info("consumer cancelled", "requeued", requeued)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	smtp "github.com/fajar/learn-go/04-smtp"
+	"github.com/fajar/learn-go/emailtopology"
+	"github.com/fajar/learn-go/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the worker's spans. Each delivery continues the trace the
+// producer started: a queue wait span for the time in the queue, then a
+// process span with an smtp send span inside it. Retries and dead-lettering
+// copy the headers, so every attempt at a job lands in the same trace.
+var tracer = otel.Tracer("consumer")
+
+// traceDelivery starts the process span for d as a child of the publish span
+// in its traceparent header. Before it, it records the time d sat in the
+// queue as a span that ends now.
+func traceDelivery(d Delivery, correlationID string) (context.Context, trace.Span) {
+	ctx := tracing.Extract(context.Background(), d.Headers)
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.destination.name", emailtopology.PrimaryQueue),
+		attribute.String("messaging.message.conversation_id", correlationID),
+		attribute.Int("email.attempt", getAttempts(d.Headers)+1),
+	}
+
+	now := time.Now()
+	if since, ok := queuedSince(d); ok && since.Before(now) {
+		_, wait := tracer.Start(ctx, "queue wait", trace.WithTimestamp(since), trace.WithAttributes(attrs...))
+		wait.End(trace.WithTimestamp(now))
+	}
+	return tracer.Start(ctx, "process emails.primary",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(now),
+		trace.WithAttributes(attrs...),
+		trace.WithAttributes(attribute.String("messaging.operation.type", "process")),
+	)
+}
+
+// queuedSince is when the broker took this copy of d: its publish for a
+// first attempt, or the retry's publish for later ones. x-enqueued-at is
+// the fallback; it counts from the first publish, earlier retries included.
+func queuedSince(d Delivery) (time.Time, bool) {
+	if !d.Timestamp.IsZero() {
+		return d.Timestamp, true
+	}
+	return enqueuedAt(d)
+}
+
+// traceSend starts the span for one SMTP send
+func traceSend(ctx context.Context, cfg smtp.EmailConfig) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "smtp send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("server.address", cfg.SMTPServer),
+			attribute.Int("server.port", cfg.SMTPPort),
+		),
+	)
+}
+
+// endSpan ends span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceOutcome records on the delivery's span what became of it, using the
+// same names as the log's lifecycle events
+func traceOutcome(ctx context.Context, event string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("email.outcome", event))
+}
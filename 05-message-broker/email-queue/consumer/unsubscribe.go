@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	smtp "github.com/fajar/learn-go/04-smtp"
+)
+
+// oneClickHeader tells mail clients the https link accepts an RFC 8058
+// one-click POST, so they can show their own unsubscribe button
+const oneClickHeader = "List-Unsubscribe-Post"
+
+var errBadToken = errors.New("invalid unsubscribe token")
+
+// suppression is one entry of the suppression list
+type suppression struct {
+	At     time.Time `json:"unsubscribed_at"`
+	Source string    `json:"source"` // "link" or "one-click"
+}
+
+// suppressionList holds the addresses that must not be mailed again. It is a
+// JSON file rewritten on every change, so it survives restarts; workers on
+// other hosts need to share the file.
+type suppressionList struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]suppression // keyed by lowercased address
+}
+
+// loadSuppressionList reads the list from path; a missing file is an empty list
+func loadSuppressionList(path string) (*suppressionList, error) {
+	l := &suppressionList{path: path, entries: make(map[string]suppression)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
+
+func (l *suppressionList) contains(email string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[normalizeEmail(email)]
+	return ok
+}
+
+// add records an unsubscribe and writes the list out. Adding an address
+// twice keeps the first entry.
+func (l *suppressionList) add(email, source string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := normalizeEmail(email)
+	if _, ok := l.entries[key]; ok {
+		return nil
+	}
+	l.entries[key] = suppression{At: time.Now().UTC(), Source: source}
+	if err := l.save(); err != nil {
+		delete(l.entries, key)
+		return err
+	}
+	return nil
+}
+
+// save writes to a temporary file and renames it, so a crash never leaves a
+// truncated list behind. Callers hold mu.
+func (l *suppressionList) save() error {
+	data, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(l.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// filter drops suppressed addresses from every recipient list and reports
+// whether anyone is left in To
+func (l *suppressionList) filter(job *smtp.QueuedEmail) bool {
+	var to []string
+	for _, addr := range strings.Split(job.To, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" && !l.contains(addr) {
+			to = append(to, addr)
+		}
+	}
+	job.To = strings.Join(to, ", ")
+	job.Cc = l.without(job.Cc)
+	job.Bcc = l.without(job.Bcc)
+	return len(to) > 0
+}
+
+func (l *suppressionList) without(addrs []string) []string {
+	var kept []string
+	for _, addr := range addrs {
+		if !l.contains(addr) {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// unsubscriber signs per-recipient unsubscribe links and serves the page
+// they point to. Without UNSUBSCRIBE_SECRET and UNSUBSCRIBE_URL no links are
+// added, but the suppression list is still enforced.
+type unsubscriber struct {
+	secret  []byte
+	baseURL string // public URL of the unsubscribe endpoint
+	list    *suppressionList
+}
+
+// newUnsubscriber builds an unsubscriber from the UNSUBSCRIBE_* and
+// SUPPRESSION_FILE environment variables
+func newUnsubscriber() (*unsubscriber, error) {
+	list, err := loadSuppressionList(mustEnv("SUPPRESSION_FILE", "suppressions.json"))
+	if err != nil {
+		return nil, err
+	}
+	u := &unsubscriber{
+		secret:  []byte(os.Getenv("UNSUBSCRIBE_SECRET")),
+		baseURL: os.Getenv("UNSUBSCRIBE_URL"),
+		list:    list,
+	}
+	if !u.enabled() {
+		slog.Warn("UNSUBSCRIBE_SECRET or UNSUBSCRIBE_URL not set, sending without unsubscribe links")
+	}
+	return u, nil
+}
+
+func (u *unsubscriber) enabled() bool {
+	return len(u.secret) > 0 && u.baseURL != ""
+}
+
+// token encodes the address and an HMAC of it. Tokens don't expire: a link
+// in an old email has to keep working.
+func (u *unsubscriber) token(email string) string {
+	email = normalizeEmail(email)
+	return base64.RawURLEncoding.EncodeToString([]byte(email)) + "." +
+		base64.RawURLEncoding.EncodeToString(u.sign(email))
+}
+
+// verify returns the address a token was issued for
+func (u *unsubscriber) verify(token string) (string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errBadToken
+	}
+	email, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errBadToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, u.sign(string(email))) {
+		return "", errBadToken
+	}
+	return string(email), nil
+}
+
+func (u *unsubscriber) sign(email string) []byte {
+	mac := hmac.New(sha256.New, u.secret)
+	mac.Write([]byte("unsubscribe:" + email))
+	return mac.Sum(nil)
+}
+
+func (u *unsubscriber) link(email string) string {
+	sep := "?"
+	if strings.Contains(u.baseURL, "?") {
+		sep = "&"
+	}
+	return u.baseURL + sep + "token=" + u.token(email)
+}
+
+// embed adds the recipient's link to the List-Unsubscribe header and to the
+// end of both bodies. Tokens identify one address, so jobs with several To
+// recipients are sent without a link.
+func (u *unsubscriber) embed(job *smtp.QueuedEmail) {
+	if !u.enabled() || strings.Contains(job.To, ",") {
+		return
+	}
+	link := u.link(job.To)
+
+	job.ListUnsubscribe = append(job.ListUnsubscribe, link)
+	headers := make(map[string]string, len(job.Headers)+1)
+	for k, v := range job.Headers {
+		headers[k] = v
+	}
+	headers[oneClickHeader] = "List-Unsubscribe=One-Click"
+	job.Headers = headers
+
+	if job.Body != "" {
+		job.Body += "\n\n--\nUnsubscribe: " + link + "\n"
+	}
+	if job.HTMLBody != "" {
+		footer := `<p style="font-size:12px;color:#888"><a href="` + html.EscapeString(link) + `">Unsubscribe</a></p>`
+		if i := strings.LastIndex(strings.ToLower(job.HTMLBody), "</body>"); i >= 0 {
+			job.HTMLBody = job.HTMLBody[:i] + footer + job.HTMLBody[i:]
+		} else {
+			job.HTMLBody += footer
+		}
+	}
+}
+
+// unsubscribePage is shown for every outcome of the unsubscribe flow
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Unsubscribe</title></head>
+<body style="font-family:sans-serif;max-width:480px;margin:48px auto;padding:0 16px">
+{{if eq .State "confirm"}}
+<h1>Unsubscribe</h1>
+<p>Stop sending email to <strong>{{.Email}}</strong>?</p>
+<form method="post"><button type="submit">Unsubscribe</button></form>
+{{else if eq .State "done"}}
+<h1>You're unsubscribed</h1>
+<p><strong>{{.Email}}</strong> won't receive any more email from us.</p>
+{{else if eq .State "already"}}
+<h1>Already unsubscribed</h1>
+<p><strong>{{.Email}}</strong> is already unsubscribed.</p>
+{{else if eq .State "invalid"}}
+<h1>Invalid link</h1>
+<p>This unsubscribe link is invalid. Use the link from the most recent email you received.</p>
+{{else}}
+<h1>Something went wrong</h1>
+<p>We couldn't process your request. Please try again later.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// serveUnsubscribe runs the public unsubscribe endpoint. GET shows a
+// confirmation form rather than unsubscribing, so link scanners that fetch
+// every URL in an email don't unsubscribe anyone. POST records the
+// unsubscribe; it is also the RFC 8058 one-click target.
+func serveUnsubscribe(addr string, u *unsubscriber) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		email, err := u.verify(r.URL.Query().Get("token"))
+		switch {
+		case err != nil:
+			renderUnsubscribe(w, http.StatusBadRequest, "invalid", "")
+		case u.list.contains(email):
+			renderUnsubscribe(w, http.StatusOK, "already", email)
+		default:
+			renderUnsubscribe(w, http.StatusOK, "confirm", email)
+		}
+	})
+	mux.HandleFunc("POST /unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		email, err := u.verify(r.URL.Query().Get("token"))
+		if err != nil {
+			renderUnsubscribe(w, http.StatusBadRequest, "invalid", "")
+			return
+		}
+		source := "link"
+		if r.PostFormValue("List-Unsubscribe") == "One-Click" {
+			source = "one-click"
+		}
+		if err := u.list.add(email, source); err != nil {
+			slog.Error("unsubscribe failed", "email", email, "error", err)
+			renderUnsubscribe(w, http.StatusInternalServerError, "error", "")
+			return
+		}
+		slog.Info("unsubscribed", "email", email, "source", source)
+		renderUnsubscribe(w, http.StatusOK, "done", email)
+	})
+
+	slog.Info("unsubscribe endpoint listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("unsubscribe server stopped", "error", err)
+	}
+}
+
+func renderUnsubscribe(w http.ResponseWriter, status int, state, email string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = unsubscribePage.Execute(w, struct{ State, Email string }{state, email})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	smtp "github.com/fajar/learn-go/04-smtp"
+)
+
+// verpAddresser builds VERP return paths, bounce+<token>@domain: the
+// envelope sender of each email is unique to it, so a bounce, which goes
+// to the envelope sender, names the delivery it is about. A nil
+// verpAddresser, when BOUNCE_DOMAIN is unset, leaves the return path to
+// the sender.
+type verpAddresser struct {
+	local  string // local part before the +, e.g. "bounce"
+	domain string // the domain whose mailbox receives the bounces
+}
+
+// newVERP builds a verpAddresser from BOUNCE_DOMAIN and BOUNCE_LOCAL_PART,
+// or returns nil when BOUNCE_DOMAIN is unset
+func newVERP() (*verpAddresser, error) {
+	domain := strings.ToLower(strings.TrimSpace(os.Getenv("BOUNCE_DOMAIN")))
+	if domain == "" {
+		return nil, nil
+	}
+	v := &verpAddresser{local: mustEnv("BOUNCE_LOCAL_PART", "bounce"), domain: domain}
+	if strings.Contains(v.local, "+") {
+		return nil, fmt.Errorf("BOUNCE_LOCAL_PART %q must not contain +", v.local)
+	}
+	if err := smtp.Validate(v.address(verpToken("check"))); err != nil {
+		return nil, fmt.Errorf("BOUNCE_DOMAIN and BOUNCE_LOCAL_PART: %w", err)
+	}
+	return v, nil
+}
+
+// verpToken derives the token of a delivery from its correlation ID.
+// Producers choose their own correlation IDs, which needn't be valid in an
+// address, so the token is a hash of it. Retries keep the correlation ID
+// and so the token: a bounce for a recipient an earlier attempt reached
+// still matches.
+func verpToken(correlationID string) string {
+	sum := sha256.Sum256([]byte(correlationID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// address returns the return path carrying token
+func (v *verpAddresser) address(token string) string {
+	return v.local + "+" + token + "@" + v.domain
+}
+
+// token extracts the token from a VERP address, which may be bare or in
+// angle brackets, as in the To of a bounce. Mailboxes are matched without
+// regard to case, since some servers change it.
+func (v *verpAddresser) token(address string) (string, bool) {
+	if a, err := mail.ParseAddress(address); err == nil {
+		address = a.Address
+	}
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || !strings.EqualFold(domain, v.domain) {
+		return "", false
+	}
+	prefix := v.local + "+"
+	if len(local) <= len(prefix) || !strings.EqualFold(local[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.ToLower(local[len(prefix):]), true
+}
+
+// setReturnPath gives job the VERP return path of its delivery, unless the
+// producer chose a return path of its own
+func (v *verpAddresser) setReturnPath(job *EmailJob, correlationID string, log *slog.Logger) {
+	if v == nil || job.ReturnPath != "" {
+		return
+	}
+	job.ReturnPath = v.address(verpToken(correlationID))
+	log.Debug("return path set", "return_path", job.ReturnPath)
+}
+
+// matchBounces reads a delivery log and returns the record each token
+// belongs to, by the token of its return path. Like selectReplays, only
+// the last record of each correlation ID counts.
+func matchBounces(r io.Reader, v *verpAddresser, tokens []string) (map[string]deliveryRecord, error) {
+	wanted := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		wanted[t] = true
+	}
+	matched := make(map[string]deliveryRecord)
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var rec deliveryRecord
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("delivery log record %d: %w", n, err)
+		}
+		if t, ok := v.token(rec.ReturnPath); ok && wanted[t] {
+			matched[t] = rec
+		}
+	}
+	return matched, nil
+}
+
+// runBounce implements `consumer bounce`. It looks up the deliveries that
+// the recipients of bounces, the VERP return paths, belong to:
+//
+//	consumer bounce bounce+3f9a0c1d2e4b5a69@bounces.example.com
+func runBounce(args []string) error {
+	fs := flag.NewFlagSet("bounce", flag.ContinueOnError)
+	path := fs.String("log", os.Getenv("DELIVERY_LOG"), "delivery log to read (default $DELIVERY_LOG)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	v, err := newVERP()
+	switch {
+	case err != nil:
+		return err
+	case v == nil:
+		return errors.New("BOUNCE_DOMAIN is not set, so there are no VERP addresses to match")
+	case *path == "":
+		return errors.New("no delivery log: pass -log or set DELIVERY_LOG")
+	case fs.NArg() == 0:
+		return errors.New("pass the return paths to look up")
+	}
+
+	tokens := make([]string, fs.NArg())
+	for i, address := range fs.Args() {
+		t, ok := v.token(address)
+		if !ok {
+			return fmt.Errorf("%s is not a return path of %s", address, v.address("<token>"))
+		}
+		tokens[i] = t
+	}
+
+	f, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	matched, err := matchBounces(f, v, tokens)
+	if err != nil {
+		return err
+	}
+	for i, address := range fs.Args() {
+		rec, ok := matched[tokens[i]]
+		if !ok {
+			fmt.Printf("%s  no delivery\n", address)
+			continue
+		}
+		fmt.Printf("%s  %s  %-13s %s  %s  message_id=%q campaign=%q\n",
+			address, rec.Time.Format(time.RFC3339), rec.Event, rec.CorrelationID, rec.To, rec.EmailMessageID, rec.Campaign)
+	}
+	fmt.Printf("%d of %d return paths matched\n", len(matched), len(tokens))
+	return nil
+}
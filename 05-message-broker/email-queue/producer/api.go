@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"producer/publisher"
+)
+
+// maxRequestBytes caps a request body; attachments arrive base64 encoded
+const maxRequestBytes = 32 << 20
+
+// headerIdempotencyKey makes a request safe to send again: a job published
+// under the same key within DEDUP_WINDOW is not published twice
+const headerIdempotencyKey = "Idempotency-Key"
+
+// maxIdempotencyKey leaves room in the dedup table's 255-character key for
+// the ":index" a batch job's key gets
+const maxIdempotencyKey = 200
+
+// emailRequest is the body of POST /emails and one entry of a batch. The
+// fields match the job JSON the consumer reads.
+type emailRequest struct {
+	To          string                 `json:"to" binding:"required,email"`
+	Subject     string                 `json:"subject" binding:"required,max=998"`
+	Body        string                 `json:"body" binding:"required_without=HTMLBody"`
+	HTMLBody    string                 `json:"html_body"`
+	Attachments []publisher.Attachment `json:"attachments" binding:"max=20"`
+	Digest      bool                   `json:"digest"`
+	Priority    publisher.Priority     `json:"queue_priority" binding:"omitempty,oneof=transactional normal marketing"`
+}
+
+// batchRequest is the body of POST /emails/batch
+type batchRequest struct {
+	Emails []emailRequest `json:"emails" binding:"required,min=1,max=500,dive"`
+}
+
+// jobStatus reports what happened to one job of a request
+type jobStatus struct {
+	Index  int    `json:"index"`
+	JobID  string `json:"job_id,omitempty"` // the correlation ID the consumer logs the job under; none for a duplicate
+	Status string `json:"status"`           // queued, duplicate or failed
+	Error  string `json:"error,omitempty"`
+}
+
+func (r emailRequest) job() EmailJob {
+	return EmailJob{
+		To:            r.To,
+		Subject:       r.Subject,
+		Body:          r.Body,
+		HTMLBody:      r.HTMLBody,
+		Attachments:   r.Attachments,
+		Digest:        r.Digest,
+		Priority:      r.Priority,
+		CorrelationID: publisher.NewCorrelationID(),
+	}
+}
+
+// emailAPI enqueues jobs for services that can't use the Go publisher.
+// Requests publish concurrently on the one Publisher.
+type emailAPI struct {
+	pub *publisher.Publisher
+}
+
+// serveAPI runs the REST producer on addr. When token is set, every route
+// but /healthz requires "Authorization: Bearer <token>".
+func serveAPI(pub *publisher.Publisher, addr, token string) error {
+	if err := setupAPIDedup(pub); err != nil {
+		return err
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	a := &emailAPI{pub: pub}
+	r.GET("/healthz", a.health)
+
+	emails := r.Group("/emails")
+	if token == "" {
+		slog.Warn("API_TOKEN is not set, the email API is unauthenticated", "addr", addr)
+	} else {
+		emails.Use(requireToken(token))
+	}
+	emails.Use(limitBody(maxRequestBytes), traceRequests())
+	emails.POST("", a.enqueue)
+	emails.POST("/batch", a.enqueueBatch)
+
+	slog.Info("email API listening", "addr", addr)
+	return r.Run(addr)
+}
+
+// setupAPIDedup gives pub the store for Idempotency-Key: the SQL store in
+// DB_DSN when it is set, so every instance sees the keys, or else one in
+// memory
+func setupAPIDedup(pub *publisher.Publisher) error {
+	window, err := dedupWindow()
+	if err != nil {
+		return err
+	}
+	pub.DedupWindow = window
+	if os.Getenv("DB_DSN") == "" {
+		pub.Dedup = publisher.NewMemoryDedupStore()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, err := openDedupDB(ctx)
+	if err != nil {
+		return err
+	}
+	pub.Dedup = &publisher.SQLDedupStore{DB: db} // open for the life of the process
+	return nil
+}
+
+// idempotencyKey returns the request's Idempotency-Key, "" when it has none
+func idempotencyKey(c *gin.Context) (string, error) {
+	key := strings.TrimSpace(c.GetHeader(headerIdempotencyKey))
+	if len(key) > maxIdempotencyKey {
+		return "", fmt.Errorf("%s must be at most %d characters", headerIdempotencyKey, maxIdempotencyKey)
+	}
+	return key, nil
+}
+
+// enqueue handles POST /emails, answering 202 once the broker has confirmed
+// the job. With an Idempotency-Key already used within DEDUP_WINDOW it
+// publishes nothing and answers 200 with status "duplicate".
+func (a *emailAPI) enqueue(c *gin.Context) {
+	key, err := idempotencyKey(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req emailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(bindError(err))
+		return
+	}
+
+	job := req.job()
+	enqueued, err := a.publish(c.Request.Context(), key, job)
+	if err != nil {
+		slog.Error("job not confirmed", "to", job.To, "correlation_id", job.CorrelationID, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"job_id": job.CorrelationID, "status": "failed", "error": err.Error()})
+		return
+	}
+	if !enqueued {
+		slog.Info("duplicate job skipped", "to", job.To, "idempotency_key", key, "source", "api")
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		return
+	}
+
+	slog.Info("job published", "to", job.To, "correlation_id", job.CorrelationID, "priority", job.Priority, "source", "api")
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.CorrelationID, "status": "queued"})
+}
+
+// publish publishes job and reports whether it was enqueued, which it isn't
+// when key is set and was already used within DEDUP_WINDOW
+func (a *emailAPI) publish(ctx context.Context, key string, job EmailJob) (bool, error) {
+	if key == "" {
+		return true, a.pub.PublishContext(ctx, job)
+	}
+	return a.pub.PublishDedup(ctx, key, job)
+}
+
+// enqueueBatch handles POST /emails/batch. A batch with an invalid entry is
+// rejected whole; otherwise every job is published and reported. The
+// status is 202 when all were confirmed, 207 when some were and 503 when
+// none were. With an Idempotency-Key each job is keyed by its index as
+// well, so sending a 207 batch again publishes only the jobs that failed.
+func (a *emailAPI) enqueueBatch(c *gin.Context) {
+	key, err := idempotencyKey(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(bindError(err))
+		return
+	}
+
+	jobs := make([]EmailJob, len(req.Emails))
+	for i, e := range req.Emails {
+		jobs[i] = e.job()
+	}
+	results := make([]jobStatus, len(jobs))
+	for i, job := range jobs {
+		results[i] = jobStatus{Index: i, JobID: job.CorrelationID, Status: "queued"}
+	}
+
+	var failed []publisher.FailedJob
+	duplicates := 0
+	if key == "" {
+		failed = a.pub.PublishBatchContext(c.Request.Context(), jobs)
+	} else {
+		// Each key is reserved on its own, so the jobs publish one by one
+		for i, job := range jobs {
+			enqueued, err := a.pub.PublishDedup(c.Request.Context(), key+":"+strconv.Itoa(i), job)
+			switch {
+			case err != nil:
+				failed = append(failed, publisher.FailedJob{Index: i, Job: job, Err: err})
+			case !enqueued:
+				results[i] = jobStatus{Index: i, Status: "duplicate"}
+				duplicates++
+			}
+		}
+	}
+
+	for _, f := range failed {
+		results[f.Index].Status = "failed"
+		results[f.Index].Error = f.Err.Error()
+		slog.Error("job not confirmed", "to", f.Job.To, "correlation_id", f.Job.CorrelationID, "error", f.Err)
+	}
+	queued := len(jobs) - len(failed) - duplicates
+	slog.Info("batch published", "confirmed", queued, "duplicates", duplicates, "total", len(jobs), "source", "api")
+
+	status := http.StatusAccepted
+	switch {
+	case len(failed) == len(jobs):
+		status = http.StatusServiceUnavailable
+	case len(failed) > 0:
+		status = http.StatusMultiStatus
+	}
+	body := gin.H{"queued": queued, "failed": len(failed), "jobs": results}
+	if key != "" {
+		body["duplicates"] = duplicates
+	}
+	c.JSON(status, body)
+}
+
+// health handles GET /healthz
+func (a *emailAPI) health(c *gin.Context) {
+	if !a.pub.Connected() {
+		// Still up: the next publish reconnects
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "reconnecting"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func requireToken(token string) gin.HandlerFunc {
+	want := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), want) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid API token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// traceRequests starts a server span for each request, continuing the
+// caller's trace when it sends a traceparent header. The jobs' publish
+// spans are its children.
+func traceRequests() gin.HandlerFunc {
+	tracer := otel.Tracer("producer/api")
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+c.FullPath(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", c.FullPath()),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+func limitBody(n int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, n)
+		c.Next()
+	}
+}
+
+// bindError turns a binding failure into a response naming each bad field,
+// e.g. "emails[2].to: must be a valid email address"
+func bindError(err error) (int, gin.H) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body larger than %d bytes", tooLarge.Limit)}
+	}
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return http.StatusBadRequest, gin.H{"error": "invalid JSON: " + err.Error()}
+	}
+
+	msgs := make([]string, len(verrs))
+	for i, fe := range verrs {
+		msgs[i] = jsonPath(fe.Namespace()) + ": " + ruleMessage(fe)
+	}
+	return http.StatusBadRequest, gin.H{"error": strings.Join(msgs, "; ")}
+}
+
+// jsonPath turns a validator namespace such as batchRequest.Emails[2].HTMLBody
+// into the JSON path emails[2].html_body
+func jsonPath(namespace string) string {
+	parts := strings.Split(namespace, ".")[1:] // drop the struct name
+	for i, part := range parts {
+		name, index, _ := strings.Cut(part, "[")
+		if index != "" {
+			index = "[" + index
+		}
+		if json, ok := jsonNames[name]; ok {
+			name = json
+		}
+		parts[i] = name + index
+	}
+	return strings.Join(parts, ".")
+}
+
+var jsonNames = map[string]string{
+	"To": "to", "Subject": "subject", "Body": "body", "HTMLBody": "html_body",
+	"Attachments": "attachments", "Priority": "queue_priority", "Emails": "emails",
+}
+
+func ruleMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "required_without":
+		return "body or html_body is required"
+	case "email":
+		return "must be a valid email address"
+	case "oneof":
+		return "must be one of " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "min":
+		return "must have at least " + fe.Param() + " entries"
+	case "max":
+		if fe.Kind().String() == "string" {
+			return "must be at most " + fe.Param() + " characters"
+		}
+		return "must have at most " + fe.Param() + " entries"
+	}
+	return "failed " + fe.Tag()
+}
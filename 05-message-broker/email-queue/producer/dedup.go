@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"producer/publisher"
+)
+
+// publishDeduped publishes each job at most once per DEDUP_WINDOW for
+// key:recipient, remembering keys in DB_DSN so repeated runs see them
+func publishDeduped(pub *publisher.Publisher, key string, jobs []EmailJob) error {
+	window, err := dedupWindow()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, err := openDedupDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	pub.Dedup = &publisher.SQLDedupStore{DB: db}
+	pub.DedupWindow = window
+
+	for _, job := range jobs {
+		enqueued, err := pub.PublishDedup(ctx, key+":"+job.To, job)
+		switch {
+		case err != nil:
+			return fmt.Errorf("publish to %s: %w", job.To, err)
+		case enqueued:
+			slog.Info("job published", "to", job.To, "correlation_id", job.CorrelationID)
+		default:
+			slog.Info("duplicate job skipped", "to", job.To, "dedup_key", key, "window", window)
+		}
+	}
+	return nil
+}
+
+// dedupWindow reads DEDUP_WINDOW
+func dedupWindow() (time.Duration, error) {
+	window, err := time.ParseDuration(mustEnv("DEDUP_WINDOW", publisher.DefaultDedupWindow.String()))
+	if err != nil {
+		return 0, fmt.Errorf("DEDUP_WINDOW: %w", err)
+	}
+	return window, nil
+}
+
+// openDedupDB opens DB_DSN and creates SQLDedupStore's table in it
+func openDedupDB(ctx context.Context) (*sql.DB, error) {
+	db, err := sql.Open("mysql", mustEnv("DB_DSN", defaultDSN))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, publisher.DedupSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create dedup table: %w", err)
+	}
+	return db, nil
+}
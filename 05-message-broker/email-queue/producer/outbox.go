@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+
+	"producer/publisher"
+)
+
+// defaultDSN is 06-mysql-demo's database, so the outbox sits next to its
+// users table and can share its transactions
+const defaultDSN = "root:root@tcp(127.0.0.1:3306)/testdb?parseTime=true&charset=utf8mb4&loc=Local"
+
+// publishViaOutbox writes the jobs into the outbox in one transaction, as an
+// application would alongside its own writes, then relays them to the
+// broker. A service would run publisher.Relay.Run in a goroutine instead.
+func publishViaOutbox(pub *publisher.Publisher, jobs []EmailJob) error {
+	db, err := sql.Open("mysql", mustEnv("DB_DSN", defaultDSN))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, publisher.OutboxSchema); err != nil {
+		return fmt.Errorf("create outbox table: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if _, err := publisher.EnqueueTx(ctx, tx, job); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("jobs written to outbox", "count", len(jobs))
+
+	// Relay until nothing more goes out; unconfirmed rows stay for the next run
+	relay := &publisher.Relay{DB: db, Publisher: pub}
+	total := 0
+	for {
+		sent, err := relay.RelayOnce(ctx)
+		if err != nil {
+			return fmt.Errorf("relay: %w", err)
+		}
+		if sent == 0 {
+			break
+		}
+		total += sent
+	}
+	slog.Info("outbox relayed", "published", total)
+	return nil
+}
@@ -0,0 +1,158 @@
+package publisher
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultDedupWindow is used when Publisher.DedupWindow is zero
+const DefaultDedupWindow = 10 * time.Minute
+
+// ErrNoDedupStore is returned by PublishDedup on a Publisher without a DedupStore
+var ErrNoDedupStore = errors.New("publisher has no DedupStore")
+
+// DedupStore remembers the dedup keys of recently published jobs. Reserve
+// must be atomic, so that of two concurrent calls with one key only one
+// gets true; with a store shared between processes, that holds across them.
+type DedupStore interface {
+	// Reserve records key for window and reports true, unless key is
+	// already recorded and hasn't expired
+	Reserve(ctx context.Context, key string, window time.Duration) (bool, error)
+
+	// Release forgets key, so a job that failed to publish can be sent again
+	Release(ctx context.Context, key string) error
+}
+
+// PublishDedup publishes job unless a job with the same key was published
+// within DedupWindow, and reports whether it was newly enqueued. Use it for
+// jobs an upstream may submit twice, such as after a double click or a
+// retried API call, with a key derived from that request.
+//
+// The key is reserved before publishing and released if the publish fails,
+// so a failed job can be retried with the same key. A call made while the
+// first one is still publishing reports false, even if that publish then
+// fails.
+func (p *Publisher) PublishDedup(ctx context.Context, key string, job EmailJob) (bool, error) {
+	if p.Dedup == nil {
+		return false, ErrNoDedupStore
+	}
+	window := p.DedupWindow
+	if window == 0 {
+		window = DefaultDedupWindow
+	}
+
+	reserved, err := p.Dedup.Reserve(ctx, key, window)
+	if err != nil {
+		return false, err
+	}
+	if !reserved {
+		return false, nil
+	}
+
+	if err := p.PublishContext(ctx, job); err != nil {
+		// Use a fresh context: ctx may be what cut the publish short
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if relErr := p.Dedup.Release(releaseCtx, key); relErr != nil {
+			return false, errors.Join(err, relErr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// MemoryDedupStore keeps dedup keys in memory. It only catches duplicates
+// within one process; use SQLDedupStore when several producers run.
+type MemoryDedupStore struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryDedupStore() *MemoryDedupStore {
+	return &MemoryDedupStore{expires: make(map[string]time.Time)}
+}
+
+// Reserve implements DedupStore
+func (s *MemoryDedupStore) Reserve(ctx context.Context, key string, window time.Duration) (bool, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired keys once a minute, so the map doesn't grow without bound
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, exp := range s.expires {
+			if !now.Before(exp) {
+				delete(s.expires, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if exp, ok := s.expires[key]; ok && now.Before(exp) {
+		return false, nil
+	}
+	s.expires[key] = now.Add(window)
+	return true, nil
+}
+
+// Release implements DedupStore
+func (s *MemoryDedupStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.expires, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// DedupSchema creates SQLDedupStore's table (MySQL or MariaDB)
+const DedupSchema = `CREATE TABLE IF NOT EXISTS email_dedup (
+	dedup_key  VARCHAR(255) NOT NULL PRIMARY KEY,
+	expires_at DATETIME(3)  NOT NULL,
+	KEY idx_email_dedup_expires (expires_at)
+)`
+
+// SQLDedupStore keeps dedup keys in MySQL, so every producer sharing the
+// database sees them. Expiry uses the database clock, not the producers'.
+type SQLDedupStore struct {
+	DB *sql.DB
+}
+
+// Reserve implements DedupStore. The upsert only replaces an expired row,
+// and MySQL reports 1 affected row for an insert, 2 for a replaced row and
+// 0 for a row left alone, so a single statement decides.
+func (s *SQLDedupStore) Reserve(ctx context.Context, key string, window time.Duration) (bool, error) {
+	res, err := s.DB.ExecContext(ctx,
+		`INSERT INTO email_dedup (dedup_key, expires_at)
+		 VALUES (?, NOW(3) + INTERVAL ? MICROSECOND)
+		 ON DUPLICATE KEY UPDATE expires_at = IF(expires_at <= NOW(3), VALUES(expires_at), expires_at)`,
+		key, window.Microseconds(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Release implements DedupStore
+func (s *SQLDedupStore) Release(ctx context.Context, key string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM email_dedup WHERE dedup_key = ?`, key)
+	return err
+}
+
+// Purge deletes expired keys and returns how many there were. Expired keys
+// are already ignored, so this only keeps the table small.
+func (s *SQLDedupStore) Purge(ctx context.Context) (int64, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM email_dedup WHERE expires_at <= NOW(3)`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,200 @@
+package publisher
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/sleep"
+)
+
+// OutboxSchema creates the outbox table. It needs MySQL 8 or MariaDB 10.6
+// for the relay's FOR UPDATE SKIP LOCKED.
+const OutboxSchema = `CREATE TABLE IF NOT EXISTS email_outbox (
+	id             BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	correlation_id VARCHAR(64)     NOT NULL,
+	job            JSON            NOT NULL,
+	created_at     DATETIME(3)     NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+	sent_at        DATETIME(3)     NULL,
+	attempts       INT UNSIGNED    NOT NULL DEFAULT 0,
+	last_error     VARCHAR(1024)   NULL,
+	KEY idx_email_outbox_pending (sent_at, id)
+)`
+
+// EnqueueTx writes job into the outbox as part of tx, so the email goes out
+// if and only if tx commits. It is published later by a Relay. The job is
+// validated here, since a job the relay can't encode would never leave the
+// outbox. Returns the job's correlation ID, generated when empty.
+func EnqueueTx(ctx context.Context, tx *sql.Tx, job EmailJob) (string, error) {
+	if _, err := job.Priority.level(); err != nil {
+		return "", err
+	}
+	if job.CorrelationID == "" {
+		job.CorrelationID = NewCorrelationID()
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		return "", fmt.Errorf("encode job: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO email_outbox (correlation_id, job) VALUES (?, ?)`,
+		job.CorrelationID, body,
+	); err != nil {
+		return "", fmt.Errorf("insert into outbox: %w", err)
+	}
+	return job.CorrelationID, nil
+}
+
+// Relay publishes outbox rows and marks them sent. Rows are claimed with
+// FOR UPDATE SKIP LOCKED, so several relays can share one outbox.
+//
+// A row is marked sent in the same transaction that claimed it, once the
+// broker has confirmed it, so no committed job is lost. A job is published
+// twice only if the relay dies between the confirm and that commit; it
+// keeps its correlation ID, so the copy can be spotted in the logs.
+type Relay struct {
+	DB        *sql.DB
+	Publisher *Publisher
+	Interval  time.Duration // how often Run polls, ±10% (0 = 1s)
+	BatchSize int           // rows per transaction (0 = 100)
+}
+
+// outboxRow is a claimed outbox row
+type outboxRow struct {
+	id  uint64
+	job EmailJob
+}
+
+// Run relays pending rows until ctx is done. A failed pass is logged and
+// tried again on the next tick.
+func (r *Relay) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	// Relays started together drift apart instead of polling in step and
+	// contending for the same rows
+	ticker := sleep.NewTicker(ctx, interval, interval/10)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while full batches come back, so a backlog drains at
+		// broker speed rather than one batch per tick
+		for {
+			sent, err := r.RelayOnce(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("outbox relay failed", "error", err)
+				}
+				break
+			}
+			if sent < r.batchSize() {
+				break
+			}
+		}
+
+		if _, ok := <-ticker.C; !ok {
+			return // ctx is done
+		}
+	}
+}
+
+func (r *Relay) batchSize() int {
+	if r.BatchSize == 0 {
+		return 100
+	}
+	return r.BatchSize
+}
+
+// RelayOnce publishes one batch of pending rows, oldest first, and returns
+// how many were confirmed. Rows the broker didn't confirm stay pending with
+// the error recorded.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := claim(ctx, tx, r.batchSize())
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+
+	jobs := make([]EmailJob, len(rows))
+	for i, row := range rows {
+		jobs[i] = row.job
+	}
+	failed := r.Publisher.PublishBatchContext(ctx, jobs)
+
+	unconfirmed := make(map[int]bool, len(failed))
+	for _, f := range failed {
+		unconfirmed[f.Index] = true
+		msg := f.Err.Error()
+		if len(msg) > 1024 {
+			msg = msg[:1024]
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE email_outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?`,
+			msg, rows[f.Index].id,
+		); err != nil {
+			return 0, fmt.Errorf("record failure: %w", err)
+		}
+	}
+
+	var sent []any
+	for i, row := range rows {
+		if !unconfirmed[i] {
+			sent = append(sent, row.id)
+		}
+	}
+	if len(sent) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(sent)), ",")
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE email_outbox SET sent_at = CURRENT_TIMESTAMP(3), attempts = attempts + 1, last_error = NULL WHERE id IN (`+placeholders+`)`,
+			sent...,
+		); err != nil {
+			return 0, fmt.Errorf("mark sent: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	for _, f := range failed {
+		slog.Warn("outbox job not confirmed, will retry", "outbox_id", rows[f.Index].id, "correlation_id", f.Job.CorrelationID, "error", f.Err)
+	}
+	return len(sent), nil
+}
+
+// claim locks up to limit pending rows, skipping ones another relay holds
+func claim(ctx context.Context, tx *sql.Tx, limit int) ([]outboxRow, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, correlation_id, job FROM email_outbox
+		 WHERE sent_at IS NULL ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("claim outbox rows: %w", err)
+	}
+	defer rows.Close()
+
+	var claimed []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		var body []byte
+		if err := rows.Scan(&row.id, &row.job.CorrelationID, &body); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(body, &row.job); err != nil {
+			return nil, fmt.Errorf("outbox row %d: %w", row.id, err)
+		}
+		claimed = append(claimed, row)
+	}
+	return claimed, rows.Err()
+}
@@ -0,0 +1,401 @@
+// Package publisher publishes email jobs onto the email-queue RabbitMQ
+// topology with publisher confirms. A Publisher created with Dial also
+// survives connection drops: it reconnects and republishes whatever the
+// drop left unconfirmed. Each publish is traced, and its trace context is
+// sent in the message headers for the consumer to continue.
+package publisher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/amqpconn"
+	"github.com/fajar/learn-go/emailtopology"
+	"github.com/fajar/learn-go/tracing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records a span per published job. It is a no-op until the
+// program installs a tracer provider, such as with tracing.Setup.
+var tracer = otel.Tracer("producer/publisher")
+
+// EmailJob is the JSON message the consumer reads from emails.primary
+type EmailJob struct {
+	To          string       `json:"to"`
+	Subject     string       `json:"subject"`
+	Body        string       `json:"body"`                // text/plain part
+	HTMLBody    string       `json:"html_body,omitempty"` // optional text/html alternative
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Digest      bool         `json:"digest,omitempty"`
+
+	// Priority is sent as the AMQP message priority; empty means PriorityNormal.
+	// It is also kept in the body so it shows up when the job is inspected.
+	Priority Priority `json:"queue_priority,omitempty"`
+
+	// CorrelationID is sent in the x-correlation-id header and tags every log
+	// record the consumer writes about the job. Empty means one is generated.
+	CorrelationID string `json:"-"`
+
+	// SchemaVersion is set to the package's SchemaVersion on publish. It is
+	// also sent in the x-schema-version header, so the consumer can tell
+	// the job's layout before decoding it.
+	SchemaVersion int `json:"schema_version"`
+}
+
+// HeaderCorrelationID is the AMQP header carrying EmailJob.CorrelationID
+const HeaderCorrelationID = "x-correlation-id"
+
+// HeaderSchemaVersion is the AMQP header carrying EmailJob.SchemaVersion
+const HeaderSchemaVersion = "x-schema-version"
+
+// SchemaVersion is the version of EmailJob's JSON layout. Bump it with any
+// change a consumer of the previous version would misread, and give the
+// consumer a migration from the previous version first: it quarantines
+// versions it doesn't know.
+const SchemaVersion = 1
+
+// NewCorrelationID returns a random ID in the format the consumer generates
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Priority decides which jobs the consumer takes first when emails.primary is backed up
+type Priority string
+
+const (
+	PriorityTransactional Priority = "transactional" // password resets, receipts: never wait behind bulk mail
+	PriorityNormal        Priority = "normal"
+	PriorityMarketing     Priority = "marketing" // newsletters and other bulk sends
+)
+
+// level maps a Priority to the AMQP message priority
+func (p Priority) level() (uint8, error) {
+	switch p {
+	case PriorityTransactional:
+		return 9, nil
+	case "", PriorityNormal:
+		return 5, nil
+	case PriorityMarketing:
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q (use transactional, normal or marketing)", p)
+}
+
+// Attachment is a file sent with the email; Data is base64 in JSON
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// LoadAttachment reads a file and guesses its content type from the extension
+func LoadAttachment(path string) (Attachment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Attachment{}, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return Attachment{Filename: filepath.Base(path), ContentType: contentType, Data: data}, nil
+}
+
+// ErrNacked is reported for a job the broker refused to take responsibility for
+var ErrNacked = errors.New("broker nacked the job")
+
+// ErrChannelClosed is reported for a job whose confirm was lost because the
+// channel closed first; the broker may or may not have queued it
+var ErrChannelClosed = errors.New("channel closed before the job was confirmed")
+
+// FailedJob is a job from a batch that was not confirmed by the broker
+type FailedJob struct {
+	Index int // position in the batch passed to PublishBatch
+	Job   EmailJob
+	Err   error
+}
+
+// Publisher publishes EmailJobs and tracks the broker's confirm for each one.
+// It is safe for concurrent use: publishes share the channel, each waiting
+// for its own jobs' confirms, and after a drop the first publish to notice
+// reconnects while the others wait for it and carry on on its channel.
+type Publisher struct {
+	// Channel is the channel jobs are published on. Set it before the first
+	// publish; with Conn set it is replaced after a reconnect, so use
+	// Connected rather than reading it while publishes may be running.
+	Channel    *amqp.Channel
+	Exchange   string        // defaults to "emails"
+	RoutingKey string        // defaults to "send"
+	Timeout    time.Duration // how long a batch may wait for confirms, and each reconnect may take (0 = 30s)
+
+	// Conn, if set, replaces Channel when the connection drops. Jobs the
+	// drop left unconfirmed are published again, up to MaxReconnects times
+	// per batch; a job may then reach the queue twice.
+	Conn          *amqpconn.Manager
+	MaxReconnects int // default 3
+
+	// Dedup and DedupWindow are used by PublishDedup
+	Dedup       DedupStore
+	DedupWindow time.Duration // default DefaultDedupWindow
+
+	mu sync.Mutex // guards Channel against a reconnect
+}
+
+// New declares the topology on ch and puts the channel into confirm mode.
+// The channel is then owned by the Publisher.
+func New(ch *amqp.Channel) (*Publisher, error) {
+	if err := setup(ch); err != nil {
+		return nil, err
+	}
+	return &Publisher{Channel: ch}, nil
+}
+
+// Dial connects to url, retrying with backoff until ctx is done, and returns
+// a Publisher that reconnects on its own. Close p.Conn when done.
+func Dial(ctx context.Context, url string) (*Publisher, error) {
+	conn, err := amqpconn.Dial(ctx, amqpconn.Config{URL: url, Setup: setup})
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{Channel: conn.Channel(), Conn: conn}, nil
+}
+
+// setup prepares a channel for publishing; it runs again after every reconnect
+func setup(ch *amqp.Channel) error {
+	if err := DeclareTopology(ch); err != nil {
+		return fmt.Errorf("declare topology: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("enable publisher confirms: %w", err)
+	}
+	return nil
+}
+
+// Publish sends a single job and waits for its confirm
+func (p *Publisher) Publish(job EmailJob) error {
+	return p.PublishContext(context.Background(), job)
+}
+
+// PublishContext is Publish with the job's span a child of the span in
+// ctx, such as the request that asked for the email. ctx is only used for
+// tracing: a publish isn't abandoned when it is canceled.
+func (p *Publisher) PublishContext(ctx context.Context, job EmailJob) error {
+	if failed := p.PublishBatchContext(ctx, []EmailJob{job}); len(failed) > 0 {
+		return failed[0].Err
+	}
+	return nil
+}
+
+// PublishBatch publishes every job without waiting in between, then waits
+// for the broker's confirms and returns the jobs that were not confirmed:
+// nacked, timed out, or never published. A nil result means the whole
+// batch is safely queued. Jobs without a CorrelationID are given one, which
+// shows up in the FailedJob and is kept if the job is published again.
+//
+// With Conn set, a batch interrupted by a dropped connection is finished
+// on a new one: every failed job except nacked ones is published again.
+func (p *Publisher) PublishBatch(jobs []EmailJob) []FailedJob {
+	return p.PublishBatchContext(context.Background(), jobs)
+}
+
+// PublishBatchContext is PublishBatch with each job's span a child of the
+// span in ctx. ctx is only used for tracing, as in PublishContext.
+func (p *Publisher) PublishBatchContext(ctx context.Context, jobs []EmailJob) []FailedJob {
+	pending := make([]FailedJob, len(jobs))
+	for i, job := range jobs {
+		if job.CorrelationID == "" {
+			job.CorrelationID = NewCorrelationID()
+		}
+		pending[i] = FailedJob{Index: i, Job: job}
+	}
+
+	ch := p.channel()
+	failed := p.publish(ctx, ch, pending)
+	maxReconnects := p.MaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = 3
+	}
+	for attempt := 0; p.Conn != nil && attempt < maxReconnects && len(failed) > 0 && ch.IsClosed(); attempt++ {
+		var retry, nacked []FailedJob
+		for _, f := range failed {
+			if errors.Is(f.Err, ErrNacked) {
+				nacked = append(nacked, f) // the broker saw it and said no
+			} else {
+				retry = append(retry, f)
+			}
+		}
+		if len(retry) == 0 {
+			break
+		}
+
+		next, err := p.reconnect(ch)
+		if err != nil {
+			break // report the failures from the dropped connection
+		}
+		ch = next
+		failed = append(nacked, p.publish(ctx, ch, retry)...)
+	}
+
+	// Report failures in batch order
+	sort.Slice(failed, func(a, b int) bool { return failed[a].Index < failed[b].Index })
+	return failed
+}
+
+// Connected reports whether the current channel is open. A Publisher with
+// Conn set reconnects on the next publish when it isn't.
+func (p *Publisher) Connected() bool {
+	return !p.channel().IsClosed()
+}
+
+func (p *Publisher) channel() *amqp.Channel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Channel
+}
+
+// reconnect returns the channel to use instead of dead, which closed under
+// a publish. Only the first publish to get here reconnects; the ones behind
+// it find Channel already replaced and use the new one.
+func (p *Publisher) reconnect(dead *amqp.Channel) (*amqp.Channel, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Channel != dead {
+		return p.Channel, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	ch, err := p.Conn.Reconnect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.Channel = ch
+	return ch, nil
+}
+
+func (p *Publisher) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return p.Timeout
+}
+
+// publish makes one pass over jobs on ch. Index and Job are taken from each
+// entry; Err is filled in for the ones that failed. Every attempt gets its
+// own span, ended once the job's confirm arrives.
+func (p *Publisher) publish(parent context.Context, ch *amqp.Channel, jobs []FailedJob) []FailedJob {
+	exchange := p.Exchange
+	if exchange == "" {
+		exchange = emailtopology.Exchange
+	}
+	routingKey := p.RoutingKey
+	if routingKey == "" {
+		routingKey = emailtopology.SendKey
+	}
+
+	// The parent only supplies the span; the timeout alone bounds the publish
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(parent), p.timeout())
+	defer cancel()
+
+	var failed []FailedJob
+	fail := func(span trace.Span, f FailedJob) {
+		span.RecordError(f.Err)
+		span.SetStatus(codes.Error, f.Err.Error())
+		span.End()
+		failed = append(failed, f)
+	}
+	confirms := make([]*amqp.DeferredConfirmation, len(jobs))
+	spans := make([]trace.Span, len(jobs))
+
+	for i, pending := range jobs {
+		job := pending.Job
+		job.SchemaVersion = SchemaVersion
+		spanCtx, span := tracer.Start(ctx, "publish "+exchange,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "rabbitmq"),
+				attribute.String("messaging.operation.type", "send"),
+				attribute.String("messaging.destination.name", exchange),
+				attribute.String("messaging.rabbitmq.destination.routing_key", routingKey),
+				attribute.String("messaging.message.conversation_id", job.CorrelationID),
+			),
+		)
+		spans[i] = span
+
+		priority, err := job.Priority.level()
+		if err != nil {
+			fail(span, FailedJob{Index: pending.Index, Job: job, Err: err})
+			continue
+		}
+		body, err := json.Marshal(job)
+		if err != nil {
+			fail(span, FailedJob{Index: pending.Index, Job: job, Err: fmt.Errorf("encode job: %w", err)})
+			continue
+		}
+
+		// x-enqueued-at survives retries so the consumer can measure end-to-end latency
+		headers := amqp.Table{
+			"x-attempts":        int32(0),
+			"x-enqueued-at":     time.Now().UnixMilli(),
+			HeaderCorrelationID: job.CorrelationID,
+			HeaderSchemaVersion: int32(SchemaVersion),
+		}
+		tracing.Inject(spanCtx, headers) // traceparent, so the consumer's spans join this trace
+		confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, false, false, amqp.Publishing{
+			Priority:     priority,
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			Headers:      headers,
+			Timestamp:    time.Now(),
+		})
+		if err != nil {
+			fail(span, FailedJob{Index: pending.Index, Job: job, Err: fmt.Errorf("publish: %w", err)})
+			continue
+		}
+		if confirm == nil {
+			fail(span, FailedJob{Index: pending.Index, Job: job, Err: errors.New("channel is not in confirm mode")})
+			continue
+		}
+		confirms[i] = confirm
+	}
+
+	for i, confirm := range confirms {
+		if confirm == nil {
+			continue // already reported above
+		}
+		acked, err := confirm.WaitContext(ctx)
+		switch {
+		case err != nil:
+			fail(spans[i], FailedJob{Index: jobs[i].Index, Job: jobs[i].Job, Err: fmt.Errorf("wait for confirm: %w", err)})
+		case !acked && ch.IsClosed():
+			// Closing a channel resolves its pending confirms as nacks
+			fail(spans[i], FailedJob{Index: jobs[i].Index, Job: jobs[i].Job, Err: ErrChannelClosed})
+		case !acked:
+			fail(spans[i], FailedJob{Index: jobs[i].Index, Job: jobs[i].Job, Err: ErrNacked})
+		default:
+			spans[i].End()
+		}
+	}
+	return failed
+}
+
+// DeclareTopology declares the exchanges, queues and bindings the consumer uses
+func DeclareTopology(ch *amqp.Channel) error {
+	return emailtopology.Declare(ch, emailtopology.RetryTiers)
+}
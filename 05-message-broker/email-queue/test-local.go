@@ -133,6 +133,7 @@ func declareTopology(ch *amqp.Channel) {
 
 	_, _ = ch.QueueDeclare("emails.primary", true, false, false, false, amqp.Table{
 		"x-dead-letter-exchange": "emails.dlx",
+		"x-max-priority":         int32(10),
 	})
 	_, _ = ch.QueueDeclare("emails.retry", true, false, false, false, amqp.Table{
 		"x-dead-letter-exchange":    "emails",
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseAPITokens(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string // token to principal
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"s3cret:alice", map[string]string{"s3cret": "alice"}, false},
+		{"s3cret:alice, 0ther:importer ,", map[string]string{"s3cret": "alice", "0ther": "importer"}, false},
+		{"tok:svc:batch", map[string]string{"tok": "svc:batch"}, false}, // only the first colon splits
+		{"s3cret", nil, true},
+		{":alice", nil, true},
+		{"s3cret:", nil, true},
+		{"good:alice,bad", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAPITokens(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseAPITokens(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAPITokens(%q): %v", tt.in, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseAPITokens(%q) = %d tokens, want %d", tt.in, len(got), len(tt.want))
+		}
+		for _, tok := range got {
+			if p, ok := tt.want[string(tok.token)]; !ok || p != tok.principal {
+				t.Errorf("parseAPITokens(%q) has %s:%s, want %v", tt.in, tok.token, tok.principal, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fajar/learn-go/httpdelete"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// maxBatchOperations caps one POST /users/batch request
+const maxBatchOperations = 100
+
+// Operations accepted by POST /users/batch
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// BatchOperation is one item of a bulk request. Create takes name and
+// email, update takes id, name and email (a full replace, like PUT), and
+// delete takes id.
+type BatchOperation struct {
+	Op    string `json:"op"`
+	ID    uint64 `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// BatchRequest is the body of POST /users/batch
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchItemResult is the outcome of one operation, with the status the
+// single-user endpoint would have answered
+type BatchItemResult struct {
+	Index         int    `json:"index"`
+	Op            string `json:"op"`
+	ID            uint64 `json:"id,omitempty"`
+	Status        int    `json:"status"`
+	User          *User  `json:"user,omitempty"` // created or updated user
+	Error         string `json:"error,omitempty"`
+	Code          string `json:"code,omitempty"`  // the apiError code of a failure
+	Field         string `json:"field,omitempty"` // the field at fault, e.g. of a 409
+	AlreadyAbsent bool   `json:"already_absent,omitempty"`
+}
+
+func (r BatchItemResult) ok() bool {
+	return r.Status < 400
+}
+
+// BatchResponse is the body answered by POST /users/batch
+type BatchResponse struct {
+	Atomic     bool              `json:"atomic"`
+	Succeeded  int               `json:"succeeded"`
+	Failed     int               `json:"failed"`
+	RolledBack bool              `json:"rolled_back,omitempty"`
+	Error      string            `json:"error,omitempty"` // why an atomic batch was rolled back
+	Results    []BatchItemResult `json:"results"`
+}
+
+// execer is what batch operations run against: the database, or the
+// transaction of an atomic batch
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// batchUsers serves POST /users/batch. Operations run in order, each one
+// seeing the ones before it. By default every operation stands alone: the
+// response is 200 when all succeed and 207 when some fail. With
+// ?atomic=true they run in one transaction, and the first failure rolls
+// back the others and becomes the status of the response.
+func (a *App) batchUsers(c *gin.Context) {
+	atomic, err := strconv.ParseBool(c.DefaultQuery("atomic", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "atomic must be true or false"})
+		return
+	}
+	var in BatchRequest
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(in.Operations) == 0 || len(in.Operations) > maxBatchOperations {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("operations must hold between 1 and %d items", maxBatchOperations)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	if atomic {
+		a.runAtomicBatch(ctx, c, in.Operations)
+		return
+	}
+
+	resp := BatchResponse{Results: make([]BatchItemResult, len(in.Operations))}
+	for i, op := range in.Operations {
+		res, event := a.runBatchOperation(ctx, a.DB, i, op)
+		a.recordBatchDelete(c.Request, op, res, nil)
+		if event != nil {
+			a.events.publish(event.Type, event.User)
+		}
+		resp.Results[i] = res
+		resp.count(res)
+	}
+
+	status := http.StatusOK
+	if resp.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, resp)
+}
+
+// runAtomicBatch runs the operations in one transaction. Events are only
+// published once it commits, and deletes are audited as rolled back when it
+// doesn't.
+func (a *App) runAtomicBatch(ctx context.Context, c *gin.Context, ops []BatchOperation) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		a.respondDBError(ctx, c, err, User{})
+		return
+	}
+	defer tx.Rollback() // a no-op once committed
+
+	resp := BatchResponse{Atomic: true, Results: make([]BatchItemResult, len(ops))}
+	var events []UserEvent
+	for i, op := range ops {
+		res, event := a.runBatchOperation(ctx, tx, i, op)
+		if !res.ok() {
+			_ = tx.Rollback()
+			resp.Results[i] = res
+			a.recordBatchDelete(c.Request, op, res, nil)
+			a.abortBatch(c, &resp, ops, i, res.Status, fmt.Sprintf("operation %d failed: %s", i, res.Error))
+			return
+		}
+		resp.Results[i] = res
+		if event != nil {
+			events = append(events, *event)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		e := mapDBError(err)
+		a.abortBatch(c, &resp, ops, len(ops), e.Status, "commit failed: "+e.Message)
+		return
+	}
+
+	for i, res := range resp.Results {
+		a.recordBatchDelete(c.Request, ops[i], res, nil)
+		resp.count(res)
+	}
+	for _, e := range events {
+		a.events.publish(e.Type, e.User)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// abortBatch answers an atomic batch that was rolled back because of the
+// operation at failed (len(ops) when the commit itself failed). Operations
+// before it are reported as rolled back and the ones after as not attempted,
+// both with 424 Failed Dependency.
+func (a *App) abortBatch(c *gin.Context, resp *BatchResponse, ops []BatchOperation, failed, status int, cause string) {
+	resp.RolledBack, resp.Error = true, cause
+	for i, op := range ops {
+		res := BatchItemResult{Index: i, Op: op.Op, ID: op.ID, Status: http.StatusFailedDependency}
+		switch {
+		case i == failed:
+			resp.count(resp.Results[i])
+			continue
+		case i < failed:
+			res.Error = "rolled back: " + cause
+			// the audit log has to show the delete didn't happen after all
+			a.recordBatchDelete(c.Request, op, resp.Results[i], &httpdelete.Error{Status: res.Status, Message: res.Error})
+		default:
+			res.Error = "not attempted: " + cause
+		}
+		resp.Results[i] = res
+		resp.count(res)
+	}
+	c.JSON(status, resp)
+}
+
+func (r *BatchResponse) count(res BatchItemResult) {
+	if res.ok() {
+		r.Succeeded++
+	} else {
+		r.Failed++
+	}
+}
+
+// runBatchOperation runs one operation against q and returns its result,
+// and the event to publish once the change is final
+func (a *App) runBatchOperation(ctx context.Context, q execer, i int, op BatchOperation) (BatchItemResult, *UserEvent) {
+	res := BatchItemResult{Index: i, Op: op.Op, ID: op.ID}
+	users := userStore{q: q}
+	fail := func(status int, msg string) (BatchItemResult, *UserEvent) {
+		res.Status, res.Error = status, msg
+		return res, nil
+	}
+	// failDB fails with what the single-user endpoint answers for err
+	failDB := func(err error) (BatchItemResult, *UserEvent) {
+		e := mapDBError(err)
+		res.Code, res.Field = e.Code, e.Field
+		return fail(e.Status, e.Message)
+	}
+
+	switch op.Op {
+	case BatchCreate, BatchUpdate:
+		if op.Op == BatchUpdate && op.ID == 0 {
+			return fail(http.StatusBadRequest, "id is required")
+		}
+		in := User{Name: op.Name, Email: op.Email}
+		if err := binding.Validator.ValidateStruct(in); err != nil {
+			return fail(http.StatusBadRequest, err.Error())
+		}
+
+		id, status, eventType := op.ID, http.StatusOK, EventUserUpdated
+		var err error
+		if op.Op == BatchCreate {
+			if id, err = users.create(ctx, in); err == nil {
+				status, eventType = http.StatusCreated, EventUserCreated
+			}
+		} else {
+			err = users.update(ctx, id, in)
+		}
+		if err != nil {
+			return failDB(err)
+		}
+
+		// MySQL reports no affected rows for an update that changes nothing,
+		// so a missing user shows up here instead, as sql.ErrNoRows
+		u, err := users.get(ctx, id)
+		if err != nil {
+			return failDB(err)
+		}
+		res.ID, res.Status, res.User = u.ID, status, &u
+		return res, &UserEvent{Type: eventType, User: u}
+
+	case BatchDelete:
+		if op.ID == 0 {
+			return fail(http.StatusBadRequest, "id is required")
+		}
+		existed, err := users.delete(ctx, op.ID)
+		if err != nil {
+			return failDB(err)
+		}
+		if !existed {
+			// Absent is a success or a 404, as DELETE_ABSENT_STATUS says
+			res.Status, res.AlreadyAbsent = a.deletes.AbsentStatus, true
+			if res.Status == 0 {
+				res.Status = http.StatusNoContent
+			}
+			if !res.ok() {
+				res.Error = "user not found"
+			}
+			return res, nil
+		}
+		res.Status = http.StatusNoContent
+		return res, &UserEvent{Type: EventUserDeleted, User: User{ID: op.ID}}
+
+	default:
+		return fail(http.StatusBadRequest, fmt.Sprintf("op must be %s, %s or %s", BatchCreate, BatchUpdate, BatchDelete))
+	}
+}
+
+// recordBatchDelete audits a delete operation the way DELETE /users/{id}
+// does. undone, if set, replaces the outcome of a delete that was rolled
+// back or never attempted.
+func (a *App) recordBatchDelete(r *http.Request, op BatchOperation, res BatchItemResult, undone error) {
+	if op.Op != BatchDelete || op.ID == 0 || res.Status == http.StatusBadRequest {
+		return
+	}
+	var err error
+	switch {
+	case undone != nil:
+		err = undone
+	case res.Status >= 500:
+		err = errors.New(res.Error)
+	}
+	a.deletes.Record(r, "user", strconv.FormatUint(op.ID, 10), res.Status == http.StatusNoContent && !res.AlreadyAbsent, err)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL server errors mapped to API errors
+const (
+	erDupEntry        = 1062 // ER_DUP_ENTRY: a write hit a unique index
+	erBadNull         = 1048 // ER_BAD_NULL_ERROR
+	erDataTooLong     = 1406 // ER_DATA_TOO_LONG, in strict mode
+	erTruncatedValue  = 1366 // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD, e.g. a 4-byte character in utf8mb3
+	erLockWaitTimeout = 1205 // ER_LOCK_WAIT_TIMEOUT
+	erLockDeadlock    = 1213 // ER_LOCK_DEADLOCK
+)
+
+// Codes of an apiError, for clients to branch on rather than the message
+const (
+	codeConflict     = "conflict"
+	codeInvalidValue = "invalid_value"
+	codeNotFound     = "not_found"
+	codeBusy         = "busy"
+	codeTimeout      = "timeout"
+	codeUnavailable  = "unavailable"
+	codeInternal     = "internal"
+)
+
+// apiError is a failed database call as the API answers it: a status, a
+// code and a message safe to show, and the user field at fault if there is
+// one. MySQL's own message is only logged, since it can hold table names,
+// index names and other users' values.
+type apiError struct {
+	Status  int    `json:"-"`
+	Message string `json:"error"`
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// dupKeyRe pulls the index name out of "Duplicate entry 'x' for key 'users.email'"
+var dupKeyRe = regexp.MustCompile(`for key '([^']+)'`)
+
+// columnRe pulls the column out of "Data too long for column 'name' at
+// row 1", "Column 'email' cannot be null" and the like
+var columnRe = regexp.MustCompile(`[Cc]olumn '([^']+)'`)
+
+// duplicateField returns the user field whose unique index err violated, or
+// "" if err is not a duplicate-key error
+func duplicateField(err error) string {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) || me.Number != erDupEntry {
+		return ""
+	}
+	m := dupKeyRe.FindStringSubmatch(me.Message)
+	if m == nil {
+		return ""
+	}
+	// MySQL 8 prefixes the index with the table name; MariaDB doesn't
+	key := m[1][strings.LastIndex(m[1], ".")+1:]
+	if strings.Contains(key, "email") {
+		return "email"
+	}
+	return key
+}
+
+// mapDBError converts an error of a userStore call into the apiError the
+// API answers with. Errors it doesn't know are 500s, logged with the raw
+// error and answered with a generic message.
+func mapDBError(err error) *apiError {
+	var me *mysql.MySQLError
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return &apiError{Status: http.StatusNotFound, Message: "not found", Code: codeNotFound}
+	case errors.Is(err, errNoPrincipal):
+		return &apiError{Status: http.StatusInternalServerError, Message: err.Error(), Code: codeInternal}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &apiError{Status: http.StatusGatewayTimeout, Message: "database timed out", Code: codeTimeout}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		return &apiError{Status: http.StatusServiceUnavailable, Message: "database unavailable", Code: codeUnavailable}
+	case errors.As(err, &me):
+		if e := mapMySQLError(me); e != nil {
+			return e
+		}
+	}
+	log.Printf("database error: %v", err)
+	return &apiError{Status: http.StatusInternalServerError, Message: "database error", Code: codeInternal}
+}
+
+// mapMySQLError maps the server errors a users write can cause, nil for
+// the others
+func mapMySQLError(me *mysql.MySQLError) *apiError {
+	field := ""
+	if m := columnRe.FindStringSubmatch(me.Message); m != nil {
+		field = m[1]
+	}
+	switch me.Number {
+	case erDupEntry:
+		field := duplicateField(me)
+		return &apiError{Status: http.StatusConflict, Message: about(field, "already in use"), Code: codeConflict, Field: field}
+	case erDataTooLong:
+		return &apiError{Status: http.StatusBadRequest, Message: about(field, "is too long"), Code: codeInvalidValue, Field: field}
+	case erBadNull:
+		return &apiError{Status: http.StatusBadRequest, Message: about(field, "is required"), Code: codeInvalidValue, Field: field}
+	case erTruncatedValue:
+		return &apiError{Status: http.StatusBadRequest, Message: about(field, "holds characters the database can't store"), Code: codeInvalidValue, Field: field}
+	case erLockWaitTimeout, erLockDeadlock:
+		// Another transaction held the rows; the same request can succeed
+		return &apiError{Status: http.StatusServiceUnavailable, Message: "database busy, retry", Code: codeBusy}
+	}
+	return nil
+}
+
+// about names field in a message, or "a value" when MySQL didn't say which
+func about(field, what string) string {
+	if field == "" {
+		return "a value " + what
+	}
+	return field + " " + what
+}
+
+// respondDBError answers a failed userStore call with its apiError. The
+// existing user's ID is only added to a duplicate email's 409 when
+// CONFLICT_EXPOSE_ID is set, since it lets callers probe which emails
+// exist; in is the user that was being written.
+func (a *App) respondDBError(ctx context.Context, c *gin.Context, err error, in User) {
+	e := mapDBError(err)
+	if e.Code == codeBusy {
+		c.Header("Retry-After", "1")
+	}
+	if !(a.exposeConflictIDs && e.Code == codeConflict && e.Field == "email") {
+		c.JSON(e.Status, e)
+		return
+	}
+
+	body := gin.H{"error": e.Message, "code": e.Code, "field": e.Field}
+	var id uint64
+	if err := a.DB.QueryRowContext(ctx, `SELECT id FROM users WHERE email = ?`, in.Email).Scan(&id); err == nil {
+		body["existing_id"] = id
+	}
+	c.JSON(e.Status, body)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDuplicateField(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"mysql 8", &mysql.MySQLError{Number: erDupEntry, Message: "Duplicate entry 'a@example.com' for key 'users.uniq_email'"}, "email"},
+		{"mariadb", &mysql.MySQLError{Number: erDupEntry, Message: "Duplicate entry 'a@example.com' for key 'uniq_email'"}, "email"},
+		{"other index", &mysql.MySQLError{Number: erDupEntry, Message: "Duplicate entry '1' for key 'users.PRIMARY'"}, "PRIMARY"},
+		{"wrapped", fmt.Errorf("insert: %w", &mysql.MySQLError{Number: erDupEntry, Message: "Duplicate entry 'x' for key 'uniq_email'"}), "email"},
+		{"no key in message", &mysql.MySQLError{Number: erDupEntry, Message: "Duplicate entry"}, ""},
+		{"other server error", &mysql.MySQLError{Number: erDataTooLong, Message: "Data too long for column 'name' at row 1"}, ""},
+		{"not a server error", errors.New("for key 'uniq_email'"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := duplicateField(tt.err); got != tt.want {
+				t.Errorf("duplicateField() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMapDBError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		field  string
+	}{
+		{"no rows", sql.ErrNoRows, http.StatusNotFound, codeNotFound, ""},
+		{"wrapped no rows", fmt.Errorf("get: %w", sql.ErrNoRows), http.StatusNotFound, codeNotFound, ""},
+		{"no principal", errNoPrincipal, http.StatusInternalServerError, codeInternal, ""},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout, codeTimeout, ""},
+		{"bad conn", driver.ErrBadConn, http.StatusServiceUnavailable, codeUnavailable, ""},
+		{"invalid conn", mysql.ErrInvalidConn, http.StatusServiceUnavailable, codeUnavailable, ""},
+		{"duplicate email", &mysql.MySQLError{Number: erDupEntry, Message: "Duplicate entry 'a@example.com' for key 'users.uniq_email'"}, http.StatusConflict, codeConflict, "email"},
+		{"too long", &mysql.MySQLError{Number: erDataTooLong, Message: "Data too long for column 'name' at row 1"}, http.StatusBadRequest, codeInvalidValue, "name"},
+		{"null", &mysql.MySQLError{Number: erBadNull, Message: "Column 'email' cannot be null"}, http.StatusBadRequest, codeInvalidValue, "email"},
+		{"truncated", &mysql.MySQLError{Number: erTruncatedValue, Message: "Incorrect string value: '\\xF0\\x9F' for column `demo`.`users`.`name` at row 1"}, http.StatusBadRequest, codeInvalidValue, ""},
+		{"lock wait", &mysql.MySQLError{Number: erLockWaitTimeout, Message: "Lock wait timeout exceeded"}, http.StatusServiceUnavailable, codeBusy, ""},
+		{"deadlock", &mysql.MySQLError{Number: erLockDeadlock, Message: "Deadlock found"}, http.StatusServiceUnavailable, codeBusy, ""},
+		{"unknown server error", &mysql.MySQLError{Number: 1146, Message: "Table 'demo.users' doesn't exist"}, http.StatusInternalServerError, codeInternal, ""},
+		{"unknown error", errors.New("boom"), http.StatusInternalServerError, codeInternal, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := mapDBError(tt.err)
+			if e.Status != tt.status || e.Code != tt.code || e.Field != tt.field {
+				t.Errorf("mapDBError() = %d %s field %q, want %d %s field %q", e.Status, e.Code, e.Field, tt.status, tt.code, tt.field)
+			}
+		})
+	}
+}
+
+func TestMapDBErrorHidesServerMessage(t *testing.T) {
+	e := mapDBError(&mysql.MySQLError{Number: 1146, Message: "Table 'demo.users' doesn't exist"})
+	if e.Message != "database error" {
+		t.Errorf("message = %q, want the generic one", e.Message)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event types pushed on GET /users/events
+const (
+	EventUserCreated = "created"
+	EventUserUpdated = "updated"
+	EventUserDeleted = "deleted"
+)
+
+// UserEvent describes a change to a user. For deletes only User.ID is set.
+type UserEvent struct {
+	Type string    `json:"type"`
+	User User      `json:"user"`
+	At   time.Time `json:"at"`
+}
+
+// eventFilter narrows the events a connection receives; empty sets match everything
+type eventFilter struct {
+	types map[string]bool
+	ids   map[uint64]bool
+}
+
+func (f eventFilter) match(e UserEvent) bool {
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+	if len(f.ids) > 0 && !f.ids[e.User.ID] {
+		return false
+	}
+	return true
+}
+
+type subscriber struct {
+	ch     chan UserEvent
+	filter eventFilter
+}
+
+// eventHub fans user change events out to connected clients. A client
+// that falls behind loses events rather than slowing down writes.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*subscriber]struct{})}
+}
+
+func (h *eventHub) subscribe(filter eventFilter) *subscriber {
+	sub := &subscriber{ch: make(chan UserEvent, 64), filter: filter}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+	h.mu.Unlock()
+}
+
+// publish sends an event to every matching subscriber without blocking
+func (h *eventHub) publish(eventType string, u User) {
+	e := UserEvent{Type: eventType, User: u, At: time.Now()}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !sub.filter.match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+// closeAll ends every open stream so shutdown isn't held up by idle clients
+func (h *eventHub) closeAll() {
+	h.mu.Lock()
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+	h.mu.Unlock()
+}
+
+// parseEventFilter reads ?types=created,deleted&ids=1,2
+func parseEventFilter(c *gin.Context) (eventFilter, error) {
+	var f eventFilter
+	if types := c.Query("types"); types != "" {
+		f.types = make(map[string]bool)
+		for _, t := range strings.Split(types, ",") {
+			switch t = strings.TrimSpace(t); t {
+			case EventUserCreated, EventUserUpdated, EventUserDeleted:
+				f.types[t] = true
+			default:
+				return f, errors.New("types must be a comma-separated list of created, updated, deleted")
+			}
+		}
+	}
+	if ids := c.Query("ids"); ids != "" {
+		f.ids = make(map[uint64]bool)
+		for _, s := range strings.Split(ids, ",") {
+			id, err := paramID(strings.TrimSpace(s))
+			if err != nil {
+				return f, errors.New("ids must be a comma-separated list of user ids")
+			}
+			f.ids[id] = true
+		}
+	}
+	return f, nil
+}
+
+// streamUserEvents serves GET /users/events as a Server-Sent Events stream
+func (a *App) streamUserEvents(c *gin.Context) {
+	filter, err := parseEventFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub := a.events.subscribe(filter)
+	defer a.events.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	c.Status(http.StatusOK)
+	c.Writer.Flush() // let the client know it's connected before the first event
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			// SSE comment line; keeps proxies from closing an idle connection
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case e, ok := <-sub.ch:
+			if !ok {
+				return false
+			}
+			c.SSEvent(e.Type, e)
+			return true
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /users pages: limit defaults to defaultListLimit and is capped at
+// maxListLimit, like the crawler's results
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+// listSorts are the sort keys of GET /users, with their column and the
+// order used when the request names none
+var listSorts = map[string]struct {
+	column string
+	desc   bool
+}{
+	"created_at": {column: "created_at", desc: true}, // newest first
+	"name":       {column: "name"},
+}
+
+// userQuery selects a page of GET /users: the users whose name and email
+// contain Name and Email, sorted by Sort, from Offset
+type userQuery struct {
+	Name, Email string
+	Sort        string // a key of listSorts
+	Desc        bool
+	Limit       int
+	Offset      int
+}
+
+// UserPage is the body of GET /users
+type UserPage struct {
+	Users      []User     `json:"users"`
+	Pagination Pagination `json:"pagination"`
+}
+
+// Pagination says where a UserPage sits: Total is the number of users
+// matching the filters, so there are more pages while Offset+Limit < Total
+type Pagination struct {
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	Total  int    `json:"total"`
+	Sort   string `json:"sort"`
+	Order  string `json:"order"`
+}
+
+// parseUserQuery reads ?limit, ?offset, ?sort=name|created_at,
+// ?order=asc|desc and the ?name and ?email substring filters. Unlike the
+// crawler it refuses values it can't honour rather than ignoring them, so a
+// typo doesn't silently return another page.
+func parseUserQuery(c *gin.Context) (userQuery, error) {
+	q := userQuery{
+		Name:  c.Query("name"),
+		Email: c.Query("email"),
+		Sort:  c.DefaultQuery("sort", "created_at"),
+		Limit: defaultListLimit,
+	}
+
+	sort, ok := listSorts[q.Sort]
+	if !ok {
+		return q, errors.New("sort must be name or created_at")
+	}
+	switch order := c.Query("order"); order {
+	case "":
+		q.Desc = sort.desc
+	case "asc", "desc":
+		q.Desc = order == "desc"
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		q.Limit = n
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return q, errors.New("offset must be a non-negative integer")
+		}
+		q.Offset = n
+	}
+	return q, nil
+}
+
+// where is the WHERE clause of q's filters, with its arguments
+func (q userQuery) where() (string, []any) {
+	var conds []string
+	var args []any
+	if q.Name != "" {
+		conds = append(conds, `name LIKE ? ESCAPE '!'`)
+		args = append(args, "%"+escapeLike(q.Name)+"%")
+	}
+	if q.Email != "" {
+		conds = append(conds, `email LIKE ? ESCAPE '!'`)
+		args = append(args, "%"+escapeLike(q.Email)+"%")
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return ` WHERE ` + strings.Join(conds, ` AND `), args
+}
+
+// orderBy is the ORDER BY clause of q. The column comes from listSorts,
+// never from the request, and id breaks ties so pages don't overlap.
+func (q userQuery) orderBy() string {
+	dir := ` ASC`
+	if q.Desc {
+		dir = ` DESC`
+	}
+	return ` ORDER BY ` + listSorts[q.Sort].column + dir + `, id` + dir
+}
+
+// order is "asc" or "desc"
+func (q userQuery) order() string {
+	if q.Desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// likeEscaper escapes LIKE's wildcards with '!', which, unlike the default
+// backslash, means the same whatever NO_BACKSLASH_ESCAPES is set to
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// escapeLike makes s match itself in a LIKE pattern
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// listUsers serves GET /users, a page of users with the total count
+func (a *App) listUsers(c *gin.Context) {
+	q, err := parseUserQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	users, total, err := a.users().list(ctx, q)
+	if err != nil {
+		a.respondDBError(ctx, c, err, User{})
+		return
+	}
+	c.JSON(http.StatusOK, UserPage{
+		Users: users,
+		Pagination: Pagination{
+			Limit:  q.Limit,
+			Offset: q.Offset,
+			Total:  total,
+			Sort:   q.Sort,
+			Order:  q.order(),
+		},
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseUserQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    userQuery
+		wantErr bool
+	}{
+		{"", userQuery{Sort: "created_at", Desc: true, Limit: defaultListLimit}, false},
+		{"sort=name", userQuery{Sort: "name", Limit: defaultListLimit}, false},
+		{"sort=name&order=desc", userQuery{Sort: "name", Desc: true, Limit: defaultListLimit}, false},
+		{"sort=created_at&order=asc", userQuery{Sort: "created_at", Limit: defaultListLimit}, false},
+		{"limit=10&offset=20", userQuery{Sort: "created_at", Desc: true, Limit: 10, Offset: 20}, false},
+		{"limit=1000", userQuery{Sort: "created_at", Desc: true, Limit: maxListLimit}, false},
+		{"name=ann&email=example", userQuery{Name: "ann", Email: "example", Sort: "created_at", Desc: true, Limit: defaultListLimit}, false},
+		{"sort=email", userQuery{}, true},
+		{"order=up", userQuery{}, true},
+		{"limit=0", userQuery{}, true},
+		{"limit=1001", userQuery{}, true},
+		{"limit=ten", userQuery{}, true},
+		{"offset=-1", userQuery{}, true},
+		{"offset=x", userQuery{}, true},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/users?"+tt.query, nil)
+		got, err := parseUserQuery(c)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseUserQuery(%q) = %+v, want an error", tt.query, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseUserQuery(%q) = %+v, %v, want %+v", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"ann", "ann"},
+		{"100%", "100!%"},
+		{"a_b", "a!_b"},
+		{"wow!", "wow!!"},
+		{"!%_", "!!!%!_"},
+		{`back\slash`, `back\slash`},
+	}
+	for _, tt := range tests {
+		if got := escapeLike(tt.in); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
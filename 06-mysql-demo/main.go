@@ -3,13 +3,14 @@ package main
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/fajar/learn-go/httpdelete"
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -18,12 +19,20 @@ type User struct {
 	ID        uint64    `json:"id"`
 	Name      string    `json:"name" binding:"required"`
 	Email     string    `json:"email" binding:"required,email"`
+	CreatedBy string    `json:"created_by"` // principal, set by userStore
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedBy string    `json:"updated_by"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type App struct {
-	DB *sql.DB
+	DB       *sql.DB
+	draining atomic.Bool // set on shutdown so /readyz reports not ready
+	events   *eventHub   // pushes user changes to GET /users/events clients
+
+	exposeConflictIDs bool // include the existing user's ID in 409 responses
+	deletes           *httpdelete.Handler
+	tokens            []apiToken // from API_TOKENS; none means anonymous access
 }
 
 func main() {
@@ -45,14 +54,61 @@ func main() {
 		log.Fatalf("DB not reachable: %v", err)
 	}
 
-	app := &App{DB: db}
+	// Manage the schema by hand: migrate up [n] | down [n] | status | baseline <version>
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		err := runMigrateCommand(ctx, db, os.Args[2:])
+		cancel()
+		db.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Otherwise bring the schema up to date before serving, so the users
+	// table needn't be created by hand. Deployments that migrate as a
+	// separate step set MIGRATE_ON_START=false.
+	migrateOnStart, err := strconv.ParseBool(env("MIGRATE_ON_START", "true"))
+	if err != nil {
+		log.Fatalf("invalid MIGRATE_ON_START: %v", err)
+	}
+	if migrateOnStart {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		err := migrateUp(ctx, db)
+		cancel()
+		if err != nil {
+			log.Fatalf("migrating the schema: %v", err)
+		}
+	}
+
+	app := &App{DB: db, events: newEventHub()}
+	app.exposeConflictIDs, _ = strconv.ParseBool(env("CONFLICT_EXPOSE_ID", "false"))
+	if app.deletes, err = httpdelete.FromEnv("users"); err != nil {
+		log.Fatal(err)
+	}
+	app.deletes.Actor = principalActor
+	if app.tokens, err = parseAPITokens(os.Getenv("API_TOKENS")); err != nil {
+		log.Fatal(err)
+	}
+	if len(app.tokens) == 0 {
+		log.Printf("API_TOKENS is not set: /users is open and changes are attributed to %q", anonymous)
+	}
 
 	r := SetupRouter(app)
 
-	log.Println("listening on :8080")
-	if err := r.Run(":8080"); err != nil {
+	srv := &http.Server{
+		Addr:              ":8080",
+		Handler:           r,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if err := serve(app, srv); err != nil {
 		log.Fatal(err)
 	}
+
+	if err := db.Close(); err != nil {
+		log.Printf("closing db: %v", err)
+	}
 }
 
 func env(key, def string) string {
@@ -80,46 +136,20 @@ func (a *App) createUser(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
 	defer cancel()
 
-	res, err := a.DB.ExecContext(ctx,
-		`INSERT INTO users (name, email) VALUES (?, ?)`,
-		in.Name, in.Email,
-	)
+	id, err := a.users().create(ctx, in)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		a.respondDBError(ctx, c, err, in)
 		return
 	}
-	id, _ := res.LastInsertId()
-	u, err := a.getUserByID(ctx, uint64(id))
+	u, err := a.getUserByID(ctx, id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "created but fetch failed"})
 		return
 	}
+	a.events.publish(EventUserCreated, u)
 	c.JSON(http.StatusCreated, u)
 }
 
-func (a *App) listUsers(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
-	defer cancel()
-
-	rows, err := a.DB.QueryContext(ctx, `SELECT id, name, email, created_at, updated_at FROM users ORDER BY id DESC`)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	defer rows.Close()
-
-	var users []User
-	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.CreatedAt, &u.UpdatedAt); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		users = append(users, u)
-	}
-	c.JSON(http.StatusOK, users)
-}
-
 func (a *App) getUser(c *gin.Context) {
 	id, err := paramID(c.Param("id"))
 	if err != nil {
@@ -131,11 +161,7 @@ func (a *App) getUser(c *gin.Context) {
 
 	u, err := a.getUserByID(ctx, id)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		a.respondDBError(ctx, c, err, User{})
 		return
 	}
 	c.JSON(http.StatusOK, u)
@@ -156,20 +182,18 @@ func (a *App) updateUser(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
 	defer cancel()
 
-	_, err = a.DB.ExecContext(ctx,
-		`UPDATE users SET name = ?, email = ? WHERE id = ?`,
-		in.Name, in.Email, id,
-	)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := a.users().update(ctx, id, in); err != nil {
+		a.respondDBError(ctx, c, err, in)
 		return
 	}
 
 	u, err := a.getUserByID(ctx, id)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "updated but fetch failed"})
+		// a user that doesn't exist is only noticed here: the UPDATE matches no row
+		a.respondDBError(ctx, c, err, in)
 		return
 	}
+	a.events.publish(EventUserUpdated, u)
 	c.JSON(http.StatusOK, u)
 }
 
@@ -180,27 +204,27 @@ func (a *App) deleteUser(c *gin.Context) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
-	defer cancel()
+	a.deletes.Delete(c.Writer, c.Request, "user", c.Param("id"), func(ctx context.Context) (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
 
-	res, err := a.DB.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	aff, _ := res.RowsAffected()
-	c.JSON(http.StatusOK, gin.H{"deleted": aff})
+		existed, err := a.users().delete(ctx, id)
+		if existed && err == nil {
+			a.events.publish(EventUserDeleted, User{ID: id})
+		}
+		return existed, err
+	})
 }
 
 // helpers
 
+// users is the repository outside of a transaction
+func (a *App) users() userStore {
+	return userStore{q: a.DB}
+}
+
 func (a *App) getUserByID(ctx context.Context, id uint64) (User, error) {
-	var u User
-	err := a.DB.QueryRowContext(ctx,
-		`SELECT id, name, email, created_at, updated_at FROM users WHERE id = ?`,
-		id,
-	).Scan(&u.ID, &u.Name, &u.Email, &u.CreatedAt, &u.UpdatedAt)
-	return u, err
+	return a.users().get(ctx, id)
 }
 
 func paramID(s string) (uint64, error) {
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// migrationFiles holds the schema as numbered SQL files:
+// NNNN_name.up.sql applies a change and NNNN_name.down.sql reverts it
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the GET_LOCK name that keeps two instances starting at
+// once from applying the same migration twice
+const migrationLock = "users_schema_migrations"
+
+// migrationLockWait is how long a runner waits for another to finish
+const migrationLockWait = time.Minute
+
+// MySQL server errors of a change the schema already has
+const (
+	erTableExists  = 1050 // ER_TABLE_EXISTS_ERROR
+	erDupFieldName = 1060 // ER_DUP_FIELDNAME
+	erDupKeyName   = 1061 // ER_DUP_KEYNAME
+)
+
+// migration is one numbered schema change
+type migration struct {
+	Version  int
+	Name     string
+	Up, Down string // Down is empty when the change can't be reverted
+}
+
+func (m migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// checksum identifies the up script, so a file edited after it was applied
+// is noticed
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// loadMigrations reads the embedded migrations, sorted by version
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		stem, direction := strings.TrimSuffix(base, path.Ext(base)), strings.TrimPrefix(path.Ext(base), ".")
+		prefix, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql or 0001_name.down.sql", entry.Name())
+		}
+		body, err := fs.ReadFile(migrationFiles, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %04d has two names: %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %s has no up script", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// sqlStatements splits a script on semicolons, dropping "--" comment lines,
+// since the driver runs one statement per call. Semicolons inside string
+// literals aren't supported.
+func sqlStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	var statements []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// alreadyAppliedHint explains a migration that failed because the schema
+// already has its change, typically made by hand before the migrations
+// existed, such as the audit columns the users table had to be altered
+// for. Recording it with baseline is then enough; "" for other errors.
+func alreadyAppliedHint(err error, mig migration) string {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) {
+		return ""
+	}
+	switch me.Number {
+	case erTableExists, erDupFieldName, erDupKeyName:
+		return fmt.Sprintf(" (the schema already has this change; if it was made by hand, check it matches and run `migrate baseline %d`)", mig.Version)
+	}
+	return ""
+}
+
+// migrator runs migrations on one connection, which holds the migration
+// lock. MySQL commits DDL implicitly, so each migration is recorded right
+// after its statements ran and a failed one is left half-applied for a
+// person to look at, never retried blindly.
+type migrator struct {
+	conn       *sql.Conn
+	migrations []migration
+}
+
+// withMigrator runs fn with a migrator holding the migration lock, after
+// creating schema_migrations
+func withMigrator(ctx context.Context, db *sql.DB, fn func(*migrator) error) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The lock belongs to the connection, so a runner that dies releases it
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, migrationLock, int(migrationLockWait.Seconds())).Scan(&got); err != nil {
+		return fmt.Errorf("taking the migration lock: %w", err)
+	}
+	if got.Int64 != 1 {
+		return fmt.Errorf("migrations are locked by another runner, still after %s", migrationLockWait)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, migrationLock); err != nil {
+			log.Printf("releasing the migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	) ENGINE=InnoDB`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	return fn(&migrator{conn: conn, migrations: migrations})
+}
+
+// applied returns the rows of schema_migrations by version
+func (m *migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	rows, err := m.conn.QueryContext(ctx, `SELECT version, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var row appliedMigration
+		if err := rows.Scan(&version, &row.Checksum, &row.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = row
+	}
+	return applied, rows.Err()
+}
+
+// record marks mig applied without running it, or after it ran
+func (m *migrator) record(ctx context.Context, mig migration) error {
+	_, err := m.conn.ExecContext(ctx,
+		`INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)`,
+		mig.Version, mig.Name, mig.checksum(),
+	)
+	return err
+}
+
+// up applies pending migrations in order, at most steps of them (0 = all),
+// and returns the ones it applied. It refuses to run when an applied
+// migration's file has changed since.
+func (m *migrator) up(ctx context.Context, steps int) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, mig := range m.migrations {
+		if row, ok := applied[mig.Version]; ok {
+			if row.Checksum != mig.checksum() {
+				return done, fmt.Errorf("migration %s was changed after it was applied; add a new migration instead", mig)
+			}
+			continue
+		}
+		if steps > 0 && len(done) == steps {
+			break
+		}
+
+		for _, stmt := range sqlStatements(mig.Up) {
+			if _, err := m.conn.ExecContext(ctx, stmt); err != nil {
+				return done, fmt.Errorf("migration %s failed: %w%s", mig, err, alreadyAppliedHint(err, mig))
+			}
+		}
+		if err := m.record(ctx, mig); err != nil {
+			return done, fmt.Errorf("migration %s was applied but not recorded: %w", mig, err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// down reverts the most recently applied migrations, steps of them, newest
+// first, and returns the ones it reverted
+func (m *migrator) down(ctx context.Context, steps int) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		if mig.Down == "" {
+			return done, fmt.Errorf("migration %s has no down script", mig)
+		}
+
+		for _, stmt := range sqlStatements(mig.Down) {
+			if _, err := m.conn.ExecContext(ctx, stmt); err != nil {
+				return done, fmt.Errorf("reverting %s failed: %w", mig, err)
+			}
+		}
+		if _, err := m.conn.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, mig.Version); err != nil {
+			return done, fmt.Errorf("migration %s was reverted but is still recorded: %w", mig, err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// baseline records every migration up to version as applied without
+// running it, for a database whose schema was created by hand
+func (m *migrator) baseline(ctx context.Context, version int) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, mig := range m.migrations {
+		if mig.Version > version {
+			break
+		}
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		if err := m.record(ctx, mig); err != nil {
+			return done, fmt.Errorf("recording %s: %w", mig, err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// status logs every migration with when it was applied
+func (m *migrator) status(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for _, mig := range m.migrations {
+		row, ok := applied[mig.Version]
+		switch {
+		case !ok:
+			log.Printf("%-30s pending", mig)
+		case row.Checksum != mig.checksum():
+			log.Printf("%-30s applied %s, file changed since", mig, row.AppliedAt.Format(time.RFC3339))
+		default:
+			log.Printf("%-30s applied %s", mig, row.AppliedAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// migrateUp brings the schema up to date, as the server does on start
+func migrateUp(ctx context.Context, db *sql.DB) error {
+	return withMigrator(ctx, db, func(m *migrator) error {
+		done, err := m.up(ctx, 0)
+		for _, mig := range done {
+			log.Printf("applied migration %s", mig)
+		}
+		return err
+	})
+}
+
+// runMigrateCommand handles `migrate up [n]`, `migrate down [n]`,
+// `migrate status` and `migrate baseline <version>`. up applies every
+// pending migration unless n is given; down reverts one unless n is given.
+func runMigrateCommand(ctx context.Context, db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up [n] | down [n] | status | baseline <version>")
+	}
+	n := 0
+	if len(args) > 1 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+			return fmt.Errorf("migrate %s: %q must be a positive integer", args[0], args[1])
+		}
+	}
+
+	return withMigrator(ctx, db, func(m *migrator) error {
+		var done []migration
+		var err error
+		verb := "applied"
+		switch args[0] {
+		case "up":
+			done, err = m.up(ctx, n)
+		case "down":
+			if n == 0 {
+				n = 1
+			}
+			verb = "reverted"
+			done, err = m.down(ctx, n)
+		case "baseline":
+			if n == 0 {
+				return errors.New("migrate baseline: give the last version the schema already has")
+			}
+			verb = "marked applied"
+			done, err = m.baseline(ctx, n)
+		case "status":
+			return m.status(ctx)
+		default:
+			return fmt.Errorf("unknown migrate command %q: use up, down, status or baseline", args[0])
+		}
+		for _, mig := range done {
+			log.Printf("%s %s", verb, mig)
+		}
+		if err == nil && len(done) == 0 {
+			log.Printf("nothing to do")
+		}
+		return err
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestSQLStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"one", "CREATE TABLE t (id INT);", []string{"CREATE TABLE t (id INT)"}},
+		{"no trailing semicolon", "DROP TABLE t", []string{"DROP TABLE t"}},
+		{"several", "ALTER TABLE t ADD a INT;\n\nALTER TABLE t ADD b INT;\n", []string{"ALTER TABLE t ADD a INT", "ALTER TABLE t ADD b INT"}},
+		{"comments", "-- why\n  -- indented\nALTER TABLE t\n  ADD a INT; -- trailing comments stay\n", []string{"ALTER TABLE t\n  ADD a INT", "-- trailing comments stay"}},
+		{"only comments", "-- nothing here\n", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sqlStatements(tt.script); !slices.Equal(got, tt.want) {
+				t.Errorf("sqlStatements() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations loaded")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d is %s, want versions numbered from 1 without gaps", i, m)
+		}
+		if strings.TrimSpace(m.Up) == "" || len(sqlStatements(m.Up)) == 0 {
+			t.Errorf("migration %s has no up statements", m)
+		}
+		if m.Name == "" || strings.Contains(m.Name, ".") {
+			t.Errorf("migration %d has name %q", m.Version, m.Name)
+		}
+	}
+	if first := migrations[0]; first.String() != "0001_create_users" || first.Down == "" {
+		t.Errorf("first migration = %s with down %q, want 0001_create_users with a down script", first, first.Down)
+	}
+}
+
+func TestMigrationChecksum(t *testing.T) {
+	a := migration{Version: 1, Name: "x", Up: "CREATE TABLE t (id INT)"}
+	b := a
+	b.Down = "DROP TABLE t"
+	if a.checksum() != b.checksum() {
+		t.Error("checksum changed with the down script, want it to cover the up script only")
+	}
+	b.Up += " ENGINE=InnoDB"
+	if a.checksum() == b.checksum() {
+		t.Error("checksum unchanged after editing the up script")
+	}
+}
+
+func TestAlreadyAppliedHint(t *testing.T) {
+	mig := migration{Version: 2, Name: "add_audit_columns"}
+	tests := []struct {
+		name string
+		err  error
+		hint bool
+	}{
+		{"duplicate column", &mysql.MySQLError{Number: erDupFieldName, Message: "Duplicate column name 'created_by'"}, true},
+		{"table exists", &mysql.MySQLError{Number: erTableExists, Message: "Table 'users' already exists"}, true},
+		{"duplicate index", fmt.Errorf("exec: %w", &mysql.MySQLError{Number: erDupKeyName, Message: "Duplicate key name 'uniq_email'"}), true},
+		{"syntax error", &mysql.MySQLError{Number: 1064, Message: "You have an error in your SQL syntax"}, false},
+		{"not a server error", errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		got := alreadyAppliedHint(tt.err, mig)
+		if tt.hint != (got != "") {
+			t.Errorf("%s: alreadyAppliedHint() = %q, want a hint: %v", tt.name, got, tt.hint)
+		}
+		if tt.hint && !strings.Contains(got, "migrate baseline 2") {
+			t.Errorf("%s: hint %q doesn't name the baseline to run", tt.name, got)
+		}
+	}
+}
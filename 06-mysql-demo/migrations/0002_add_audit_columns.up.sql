@@ -0,0 +1,5 @@
+-- The principal that created and last changed each user, stamped by
+-- userStore. Rows written before this migration have both empty.
+ALTER TABLE users
+  ADD COLUMN created_by VARCHAR(255) NOT NULL DEFAULT '' AFTER email,
+  ADD COLUMN updated_by VARCHAR(255) NOT NULL DEFAULT '' AFTER created_at;
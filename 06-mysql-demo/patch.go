@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// UserPatch is the body of PATCH /users/:id. The fields present are
+// changed and the ones left out keep their value; both columns are NOT
+// NULL, so null is the same as leaving a field out. Each present field is
+// held to the rules PUT applies to it.
+type UserPatch struct {
+	Name  *string `json:"name" binding:"omitnil,min=1,max=255"`
+	Email *string `json:"email" binding:"omitnil,email,max=255"`
+}
+
+// validate checks every present field, and that there is one. The error
+// is a patchError naming the first field at fault, with all of them in
+// details.
+func (p UserPatch) validate() error {
+	if p.Name == nil && p.Email == nil {
+		return &patchError{apiError: apiError{Status: http.StatusBadRequest, Message: "set at least one of name and email", Code: codeInvalidValue}}
+	}
+	err := binding.Validator.ValidateStruct(p)
+	var fields validator.ValidationErrors
+	if !errors.As(err, &fields) {
+		return err
+	}
+
+	details := make([]string, len(fields))
+	for i, fe := range fields {
+		details[i] = patchFieldName(fe) + " " + patchFieldProblem(fe)
+	}
+	first := patchFieldName(fields[0])
+	return &patchError{
+		apiError: apiError{Status: http.StatusBadRequest, Message: first + " " + patchFieldProblem(fields[0]), Code: codeInvalidValue, Field: first},
+		Details:  strings.Join(details, "; "),
+	}
+}
+
+// patchError is the apiError of an invalid patch, with every field at fault
+type patchError struct {
+	apiError
+	Details string `json:"details,omitempty"`
+}
+
+// patchFieldName is the JSON name of the field fe is about
+func patchFieldName(fe validator.FieldError) string {
+	return strings.ToLower(fe.Field())
+}
+
+// patchFieldProblem says what is wrong with a field, for the rule it broke
+func patchFieldProblem(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "min":
+		return "can't be empty"
+	case "max":
+		return "is longer than " + fe.Param() + " characters"
+	case "email":
+		return "must be an email address"
+	}
+	return "is invalid"
+}
+
+// patchUser serves PATCH /users/:id. Unlike PUT, a field the body leaves out
+// is not written at all, so a concurrent change to it survives.
+func (a *App) patchUser(c *gin.Context) {
+	id, err := paramID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var in UserPatch
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields() // a misspelt field would otherwise patch nothing
+	if err := decoder.Decode(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := in.validate(); err != nil {
+		var pe *patchError
+		if errors.As(err, &pe) {
+			c.JSON(pe.Status, pe)
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	// What respondDBError looks up on a duplicate email
+	var written User
+	if in.Email != nil {
+		written.Email = *in.Email
+	}
+	if err := a.users().patch(ctx, id, in); err != nil {
+		a.respondDBError(ctx, c, err, written)
+		return
+	}
+
+	u, err := a.getUserByID(ctx, id)
+	if err != nil {
+		// a user that doesn't exist is only noticed here, as with PUT
+		a.respondDBError(ctx, c, err, written)
+		return
+	}
+	a.events.publish(EventUserUpdated, u)
+	c.JSON(http.StatusOK, u)
+}
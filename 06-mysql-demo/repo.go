@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// errNoPrincipal is returned by a write whose context carries no
+// authenticated principal, see withPrincipal
+var errNoPrincipal = errors.New("no authenticated principal to attribute the change to")
+
+// userColumnList is the columns read into a User, in scanUser's order
+const userColumnList = `id, name, email, created_by, created_at, updated_by, updated_at`
+
+// userStore is the only code that writes the users table. Every write
+// stamps the principal of its context into the audit columns and is
+// refused without one, so a new handler can't forget to. The columns are
+// added by migrations/0002_add_audit_columns.up.sql; rows written before
+// they existed have both empty. A database whose columns were added by
+// hand fails that migration on start, and records it with
+// `migrate baseline 2` instead.
+type userStore struct {
+	q execer // the database, or the transaction of an atomic batch
+}
+
+// create inserts a user, created and last updated by the principal, and
+// returns its ID
+func (s userStore) create(ctx context.Context, in User) (uint64, error) {
+	who, err := requirePrincipal(ctx)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.q.ExecContext(ctx,
+		`INSERT INTO users (name, email, created_by, updated_by) VALUES (?, ?, ?, ?)`,
+		in.Name, in.Email, who, who,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return uint64(id), err
+}
+
+// update replaces a user's name and email. MySQL reports no affected rows
+// for an update that changes nothing, so a missing user only shows up when
+// it is read back.
+func (s userStore) update(ctx context.Context, id uint64, in User) error {
+	who, err := requirePrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.q.ExecContext(ctx,
+		`UPDATE users SET name = ?, email = ?, updated_by = ? WHERE id = ?`,
+		in.Name, in.Email, who, id,
+	)
+	return err
+}
+
+// patch changes only the fields p sets, leaving the others as they are.
+// Like update, a missing user only shows up when it is read back.
+func (s userStore) patch(ctx context.Context, id uint64, p UserPatch) error {
+	who, err := requirePrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	set, args := []string{`updated_by = ?`}, []any{who}
+	if p.Name != nil {
+		set, args = append(set, `name = ?`), append(args, *p.Name)
+	}
+	if p.Email != nil {
+		set, args = append(set, `email = ?`), append(args, *p.Email)
+	}
+	_, err = s.q.ExecContext(ctx,
+		`UPDATE users SET `+strings.Join(set, `, `)+` WHERE id = ?`,
+		append(args, id)...,
+	)
+	return err
+}
+
+// delete removes a user and reports whether it existed. The row is gone
+// afterwards, so the principal is recorded by the delete audit event.
+func (s userStore) delete(ctx context.Context, id uint64) (bool, error) {
+	if _, err := requirePrincipal(ctx); err != nil {
+		return false, err
+	}
+	res, err := s.q.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	aff, err := res.RowsAffected()
+	return aff > 0, err
+}
+
+// get reads one user, sql.ErrNoRows if there is none
+func (s userStore) get(ctx context.Context, id uint64) (User, error) {
+	return scanUser(s.q.QueryRowContext(ctx, `SELECT `+userColumnList+` FROM users WHERE id = ?`, id))
+}
+
+// list reads the page of users q selects, and how many users match its
+// filters across all pages. The count and the page are two queries, so a
+// write between them can make the total off by the rows it added or removed.
+func (s userStore) list(ctx context.Context, q userQuery) ([]User, int, error) {
+	where, args := q.where()
+
+	var total int
+	if err := s.q.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.q.QueryContext(ctx,
+		`SELECT `+userColumnList+` FROM users`+where+q.orderBy()+` LIMIT ? OFFSET ?`,
+		append(args, q.Limit, q.Offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+// scanUser reads the userColumnList columns of a *sql.Row or *sql.Rows
+func scanUser(row interface{ Scan(dest ...any) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.CreatedBy, &u.CreatedAt, &u.UpdatedBy, &u.UpdatedAt)
+	return u, err
+}
+
+func requirePrincipal(ctx context.Context) (string, error) {
+	who, ok := principalFrom(ctx)
+	if !ok {
+		return "", errNoPrincipal
+	}
+	return who, nil
+}
@@ -18,11 +18,30 @@ func SetupRouter(app *App) *gin.Engine {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
-	r.POST("/users", app.createUser)
-	r.GET("/users", app.listUsers)
-	r.GET("/users/:id", app.getUser)
-	r.PUT("/users/:id", app.updateUser)
-	r.DELETE("/users/:id", app.deleteUser)
+	// readiness: fails while draining so load balancers stop sending traffic
+	r.GET("/readyz", func(c *gin.Context) {
+		if app.draining.Load() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+			return
+		}
+		if err := pingWithTimeout(app.DB, 2*time.Second); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	})
+
+	// every /users request carries its caller, for the audit columns
+	users := r.Group("/users", authenticate(app.tokens))
+	users.POST("", app.createUser)
+	users.GET("", app.listUsers)
+	users.POST("/batch", app.batchUsers)
+	users.GET("/events", app.streamUserEvents)
+	users.GET("/export", app.exportUsers)
+	users.GET("/:id", app.getUser)
+	users.PUT("/:id", app.updateUser)
+	users.PATCH("/:id", app.patchUser)
+	users.DELETE("/:id", app.deleteUser)
 
 	return r
 }
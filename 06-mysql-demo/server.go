@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs the HTTP server until SIGINT/SIGTERM, then drains it:
+// /readyz flips to 503 so the load balancer stops routing new traffic,
+// and in-flight requests get until the shutdown deadline to finish.
+func serve(app *App, srv *http.Server) error {
+	drainDelay := envDuration("DRAIN_DELAY", 5*time.Second)
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("listening on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-sigCh:
+		log.Printf("received %s, draining", sig)
+	}
+
+	// Fail readiness and stop reusing connections, then give the
+	// load balancer time to notice before we stop accepting requests
+	app.draining.Store(true)
+	srv.SetKeepAlivesEnabled(false)
+	app.events.closeAll() // event streams never finish on their own
+	time.Sleep(drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	log.Println("server drained")
+	return nil
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(env(key, def.String()))
+	if err != nil {
+		log.Printf("invalid %s, using %s: %v", key, def, err)
+		return def
+	}
+	return d
+}
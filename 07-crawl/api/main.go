@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +16,9 @@ import (
 
 	"crawler-api/urlfrontier"
 
+	"github.com/fajar/learn-go/concurrency/sleep"
+	"github.com/fajar/learn-go/crawlengine"
+	"github.com/fajar/learn-go/httpdelete"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
@@ -45,6 +51,7 @@ type CrawlStatus struct {
 	StartTime   time.Time `json:"start_time"`
 	EndTime     *time.Time `json:"end_time,omitempty"`
 	Results     []CrawlResult `json:"results,omitempty"`
+	ResultsReleased bool      `json:"results_released,omitempty"` // dropped from memory to relieve the result store
 }
 
 // CrawlResult represents a single crawled page result
@@ -64,17 +71,22 @@ type URLFrontierClient struct {
 	client *urlfrontier.Client
 }
 
-// CrawlManager manages crawl jobs and their status
+// CrawlManager manages crawl jobs and their status. mutex guards the
+// fields of each CrawlStatus; the jobs store guards itself.
 type CrawlManager struct {
-	jobs           map[string]*CrawlStatus
+	jobs           *crawlengine.Jobs[*CrawlStatus]
 	urlFrontier    *URLFrontierClient
 	resultStore    *ResultStore
+	parquetSink    *ParquetSink // optional; completed crawls are exported here
+	simulations    map[string]context.CancelFunc // running simulations, stopped when their crawl is cancelled
+	shedder        *LoadShedder
 	mutex          sync.RWMutex
 }
 
 // ResultStore handles storage and retrieval of crawl results
 type ResultStore struct {
 	results map[string][]CrawlResult
+	count   int // results across all crawls, the backlog load shedding watches
 	mutex   sync.RWMutex
 }
 
@@ -94,6 +106,24 @@ func (rs *ResultStore) AddResult(crawlID string, result CrawlResult) {
 		rs.results[crawlID] = make([]CrawlResult, 0)
 	}
 	rs.results[crawlID] = append(rs.results[crawlID], result)
+	rs.count++
+}
+
+// Len returns how many results the store holds across all crawls
+func (rs *ResultStore) Len() int {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	return rs.count
+}
+
+// Release drops a crawl's results and returns how many there were
+func (rs *ResultStore) Release(crawlID string) int {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	n := len(rs.results[crawlID])
+	delete(rs.results, crawlID)
+	rs.count -= n
+	return n
 }
 
 // GetResults retrieves results for a crawl ID with pagination
@@ -137,8 +167,10 @@ func (rs *ResultStore) GetAllResults(crawlID string) []CrawlResult {
 // NewCrawlManager creates a new crawl manager
 func NewCrawlManager() *CrawlManager {
 	return &CrawlManager{
-		jobs:        make(map[string]*CrawlStatus),
+		jobs:        crawlengine.NewJobs[*CrawlStatus](),
 		resultStore: NewResultStore(),
+		simulations: make(map[string]context.CancelFunc),
+		shedder:     NewLoadShedder(100000, 80000, 30*time.Second, 10*time.Minute),
 	}
 }
 
@@ -171,9 +203,7 @@ func (cm *CrawlManager) SubmitCrawlJob(req *CrawlRequest) (*CrawlResponse, error
 		Results:       []CrawlResult{},
 	}
 	
-	cm.mutex.Lock()
-	cm.jobs[crawlID] = status
-	cm.mutex.Unlock()
+	cm.jobs.Add(crawlID, status)
 	
 	// Generate seed URLs based on domains and keywords
 	seedURLs := cm.generateSeedURLs(req.Domains, req.Keywords)
@@ -187,7 +217,7 @@ func (cm *CrawlManager) SubmitCrawlJob(req *CrawlRequest) (*CrawlResponse, error
 		}
 	}
 	
-	status.Status = "running"
+	status.Status = crawlengine.JobRunning
 	status.TotalURLs = len(seedURLs)
 	
 	// Start simulating crawl results for demonstration
@@ -203,9 +233,7 @@ func (cm *CrawlManager) SubmitCrawlJob(req *CrawlRequest) (*CrawlResponse, error
 
 // GetCrawlStatus retrieves the status of a crawl job
 func (cm *CrawlManager) GetCrawlStatus(crawlID string) (*CrawlStatus, error) {
-	cm.mutex.RLock()
-	status, exists := cm.jobs[crawlID]
-	cm.mutex.RUnlock()
+	status, exists := cm.jobs.Get(crawlID)
 	
 	if !exists {
 		return nil, fmt.Errorf("crawl job not found")
@@ -236,33 +264,55 @@ func (cm *CrawlManager) updateCrawlStatusFromFrontier(status *CrawlStatus) {
 	}
 	
 	// Update status based on queue statistics
+	cm.mutex.Lock()
 	status.ProcessedURLs = queueStats.Completed
 	if status.TotalURLs > 0 {
 		status.Progress = (status.ProcessedURLs * 100) / status.TotalURLs
 	}
+	cm.mutex.Unlock()
 	
-	// Update status based on progress
+	// The crawl is done once the frontier has nothing left for it. Only
+	// the call that completes it exports it, off the request's goroutine.
 	if queueStats.ActiveURLs == 0 && queueStats.InProcess == 0 && queueStats.Completed > 0 {
-		status.Status = "completed"
-		if status.EndTime == nil {
-			now := time.Now()
-			status.EndTime = &now
+		if cm.markCompleted(status.CrawlID) {
+			go cm.exportParquet(status.CrawlID)
 		}
-	} else if queueStats.ActiveURLs > 0 || queueStats.InProcess > 0 {
-		status.Status = "running"
 	}
 }
 
+// markCompleted moves a crawl to completed and reports whether it did. A
+// crawl that was cancelled, failed or already completed is left as it is,
+// so a finished crawl is exported once and a cancelled one never.
+func (cm *CrawlManager) markCompleted(crawlID string) bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	status, exists := cm.jobs.Get(crawlID)
+	if !exists {
+		return false
+	}
+	switch status.Status {
+	case "cancelled", "failed", crawlengine.JobCompleted:
+		return false
+	}
+	status.Status = crawlengine.JobCompleted
+	if status.EndTime == nil {
+		now := time.Now()
+		status.EndTime = &now
+	}
+	return true
+}
+
 // API Handlers
 
-func setupRoutes(cm *CrawlManager) *gin.Engine {
+func setupRoutes(cm *CrawlManager, rl *RateLimiter, deletes *httpdelete.Handler) *gin.Engine {
 	r := gin.Default()
 	
 	// Add CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+		c.Header("Access-Control-Expose-Headers", "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset")
 		
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -274,24 +324,45 @@ func setupRoutes(cm *CrawlManager) *gin.Engine {
 	
 	api := r.Group("/api/v1")
 	{
-		api.POST("/crawl", handleSubmitCrawl(cm))
-		api.GET("/crawl/:crawl_id", handleGetCrawlStatus(cm))
-		api.GET("/crawl/:crawl_id/results", handleGetCrawlResults(cm))
-		api.GET("/crawl", handleListCrawls(cm))
-		api.DELETE("/crawl/:crawl_id", handleCancelCrawl(cm))
+		// Submitting crawls is expensive, so it only gets a tenth of the tier's allowance
+		// and is refused outright while the result store is full
+		api.POST("/crawl", rl.Middleware("submit", 0.1), cm.shedder.Middleware("submit", cm.resultStore.Len), handleSubmitCrawl(cm))
+		api.GET("/crawl/:crawl_id", rl.Middleware("status", 1), handleGetCrawlStatus(cm))
+		api.GET("/crawl/:crawl_id/results", rl.Middleware("results", 1), handleGetCrawlResults(cm))
+		api.GET("/crawl/:crawl_id/sample", rl.Middleware("results", 1), handleSampleResults(cm))
+		api.GET("/crawl", rl.Middleware("list", 1), handleListCrawls(cm))
+		api.DELETE("/crawl/:crawl_id", rl.Middleware("cancel", 1), handleCancelCrawl(cm, deletes))
 		
 		// New endpoint for getting all crawl results in JSON format
-		api.GET("/results/:crawl_id", handleGetAllCrawlResults(cm))
+		api.GET("/results/:crawl_id", rl.Middleware("results", 1), handleGetAllCrawlResults(cm))
+		
+		// Parquet export for analytics (DuckDB/Spark)
+		api.GET("/crawl/:crawl_id/export/parquet", rl.Middleware("export", 0.1), handleDownloadParquet(cm))
+		api.POST("/crawl/:crawl_id/export/parquet", rl.Middleware("export", 0.1), handleExportParquet(cm))
+
+		// Spreadsheet report (?format=csv|xlsx)
+		api.GET("/crawl/:crawl_id/export/report", rl.Middleware("export", 0.1), handleDownloadReport(cm))
 	}
 	
-	// Health check endpoint
+	// Health check endpoint; degraded while load shedding
 	r.GET("/health", func(c *gin.Context) {
+		backlog := cm.resultStore.Len()
+		health := "healthy"
+		shedding := cm.shedder.overloaded(backlog)
+		if shedding {
+			health = "degraded"
+		}
 		c.JSON(http.StatusOK, gin.H{
-			"status": "healthy",
+			"status": health,
 			"timestamp": time.Now().Format(time.RFC3339),
+			"result_backlog": backlog,
+			"load_shedding": shedding,
 		})
 	})
 	
+	// Prometheus metrics: result backlog and load shedding
+	r.GET("/metrics", handleMetrics(cm))
+	
 	return r
 }
 
@@ -440,9 +511,10 @@ func handleListCrawls(cm *CrawlManager) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var crawls []map[string]interface{}
 		
-		for crawlID, status := range cm.jobs {
+		cm.mutex.RLock()
+		for _, status := range cm.jobs.All() {
 			crawls = append(crawls, map[string]interface{}{
-				"crawl_id": crawlID,
+				"crawl_id": status.CrawlID,
 				"status": status.Status,
 				"progress": status.Progress,
 				"total_urls": status.TotalURLs,
@@ -451,6 +523,7 @@ func handleListCrawls(cm *CrawlManager) gin.HandlerFunc {
 				"end_time": status.EndTime,
 			})
 		}
+		cm.mutex.RUnlock()
 		
 		c.JSON(http.StatusOK, gin.H{
 			"crawls": crawls,
@@ -459,39 +532,51 @@ func handleListCrawls(cm *CrawlManager) gin.HandlerFunc {
 	}
 }
 
-func handleCancelCrawl(cm *CrawlManager) gin.HandlerFunc {
+// handleCancelCrawl cancels a crawl. Cancelling one that is unknown or
+// already cancelled is a no-op; a crawl that already finished can't be
+// cancelled and gets a 409.
+func handleCancelCrawl(cm *CrawlManager, deletes *httpdelete.Handler) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		crawlID := c.Param("crawl_id")
-		
-		status, exists := cm.jobs[crawlID]
-		if !exists {
-			c.JSON(http.StatusNotFound, gin.H{
-				"error": "Crawl job not found",
-				"crawl_id": crawlID,
-			})
-			return
-		}
-		
-		if status.Status == "completed" || status.Status == "failed" || status.Status == "cancelled" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Cannot cancel crawl job in current status",
-				"status": status.Status,
-			})
-			return
-		}
-		
-		// Cancel the crawl job (placeholder implementation)
-		status.Status = "cancelled"
-		now := time.Now()
-		status.EndTime = &now
-		
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Crawl job cancelled successfully",
-			"crawl_id": crawlID,
+		deletes.Delete(c.Writer, c.Request, "crawl", crawlID, func(ctx context.Context) (bool, error) {
+			cm.mutex.Lock()
+			status, exists := cm.jobs.Get(crawlID)
+			if !exists || status.Status == "cancelled" {
+				cm.mutex.Unlock()
+				return false, nil
+			}
+			if status.Status == crawlengine.JobCompleted || status.Status == "failed" {
+				cm.mutex.Unlock()
+				return false, &httpdelete.Error{
+					Status:  http.StatusConflict,
+					Message: "Cannot cancel crawl job in current status",
+					Fields:  map[string]any{"status": status.Status},
+				}
+			}
+
+			// Cancel the crawl job (placeholder implementation)
+			status.Status = "cancelled"
+			now := time.Now()
+			status.EndTime = &now
+			cm.mutex.Unlock()
+
+			cm.stopSimulation(crawlID)
+			return true, nil
 		})
 	}
 }
 
+// apiKeyActor names the caller in audit events by a fingerprint of its API
+// key, so the key itself never reaches the logs
+func apiKeyActor(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:4])
+}
+
 func main() {
 	// Initialize crawl manager
 	cm := NewCrawlManager()
@@ -503,8 +588,29 @@ func main() {
 		log.Println("API will start but crawl functionality may be limited")
 	}
 	
+	// Export completed crawls as partitioned Parquet files when configured
+	if dir := os.Getenv("PARQUET_EXPORT_DIR"); dir != "" {
+		cm.parquetSink = NewParquetSink(dir)
+		log.Printf("Parquet export enabled: %s", dir)
+	}
+	
+	// Refuse new crawls and pause running ones while the result store is full
+	shedder, err := NewLoadShedderFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cm.shedder = shedder
+	go cm.relieve(context.Background())
+	
+	// DELETE semantics shared with the users API
+	deletes, err := httpdelete.FromEnv("crawler-api")
+	if err != nil {
+		log.Fatal(err)
+	}
+	deletes.Actor = apiKeyActor
+
 	// Setup routes
-	r := setupRoutes(cm)
+	r := setupRoutes(cm, NewRateLimiterFromEnv(), deletes)
 	
 	// Start server
 	port := ":8081"
@@ -523,9 +629,7 @@ func handleGetAllCrawlResults(cm *CrawlManager) gin.HandlerFunc {
 		crawlID := c.Param("crawl_id")
 		
 		// Check if crawl exists
-		cm.mutex.RLock()
-		status, exists := cm.jobs[crawlID]
-		cm.mutex.RUnlock()
+		status, exists := cm.jobs.Get(crawlID)
 		
 		if !exists {
 			c.JSON(http.StatusNotFound, gin.H{
@@ -634,23 +738,37 @@ func (cm *CrawlManager) generateSampleResults(domains []string, keywords []strin
 
 // SimulateCrawlResults simulates crawl results for demonstration
 func (cm *CrawlManager) SimulateCrawlResults(crawlID string, domains []string, keywords []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cm.mutex.Lock()
+	cm.simulations[crawlID] = cancel
+	cm.mutex.Unlock()
+
 	go func() {
+		defer cm.stopSimulation(crawlID)
+
 		// Wait a bit before starting to simulate processing
-		time.Sleep(2 * time.Second)
+		if sleep.Until(ctx, 2*time.Second) != nil {
+			return // cancelled; the cancel handler already set the status
+		}
 		
 		// Generate some sample results
 		sampleResults := cm.generateSampleResults(domains, keywords)
 		
 		for i, result := range sampleResults {
 			// Add delay between results to simulate real crawling
-			time.Sleep(time.Duration(rand.Intn(3)+1) * time.Second)
+			if sleep.Until(ctx, time.Duration(rand.Intn(3)+1)*time.Second) != nil {
+				return
+			}
 			
-			// Add result to store
+			// Add result to store, once it has room
+			if cm.waitForIntake(ctx, crawlID) != nil {
+				return
+			}
 			cm.resultStore.AddResult(crawlID, result)
 			
 			// Update crawl status
 			cm.mutex.Lock()
-			if status, exists := cm.jobs[crawlID]; exists {
+			if status, exists := cm.jobs.Get(crawlID); exists {
 				status.ProcessedURLs = i + 1
 				if status.TotalURLs > 0 {
 					status.Progress = (status.ProcessedURLs * 100) / status.TotalURLs
@@ -660,32 +778,45 @@ func (cm *CrawlManager) SimulateCrawlResults(crawlID string, domains []string, k
 			cm.mutex.Unlock()
 		}
 		
-		// Mark as completed
-		cm.mutex.Lock()
-		if status, exists := cm.jobs[crawlID]; exists {
-			status.Status = "completed"
-			now := time.Now()
-			status.EndTime = &now
+		// Mark as completed and export, unless the crawl was cancelled meanwhile
+		if ctx.Err() == nil && cm.markCompleted(crawlID) {
+			cm.exportParquet(crawlID)
 		}
-		cm.mutex.Unlock()
 	}()
 }
 
-// generateSeedURLs creates seed URLs from domains and keywords
+// stopSimulation cancels a crawl's simulation, if it is still running
+func (cm *CrawlManager) stopSimulation(crawlID string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	if cancel, ok := cm.simulations[crawlID]; ok {
+		cancel()
+		delete(cm.simulations, crawlID)
+	}
+}
+
+// generateSeedURLs creates seed URLs from domains and keywords. They go
+// through a crawlengine.Frontier, which normalizes them as the crawlers do,
+// so a domain or keyword given twice is only crawled once.
 func (cm *CrawlManager) generateSeedURLs(domains []string, keywords []string) []string {
 	var seedURLs []string
+	seen := crawlengine.NewFrontier(0, len(domains)*(len(keywords)+1))
+	add := func(rawURL string) {
+		if seen.Add(rawURL, 0) {
+			seedURLs = append(seedURLs, rawURL)
+		}
+	}
 	
 	for _, domain := range domains {
 		// Add base domain
 		if !strings.HasPrefix(domain, "http") {
 			domain = "https://" + domain
 		}
-		seedURLs = append(seedURLs, domain)
+		add(domain)
 		
 		// Add search URLs with keywords (example patterns)
 		for _, keyword := range keywords {
-			searchURL := fmt.Sprintf("%s/search?q=%s", domain, strings.ReplaceAll(keyword, " ", "+"))
-			seedURLs = append(seedURLs, searchURL)
+			add(fmt.Sprintf("%s/search?q=%s", domain, strings.ReplaceAll(keyword, " ", "+")))
 		}
 	}
 	
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetRow is the columnar layout of a CrawlResult. crawl_id and date are
+// not stored as columns because they are encoded in the partition path.
+type parquetRow struct {
+	URL        string            `parquet:"url"`
+	Title      string            `parquet:"title"`
+	Content    string            `parquet:"content"`
+	Domain     string            `parquet:"domain"`
+	Keywords   []string          `parquet:"keywords,list"`
+	Timestamp  time.Time         `parquet:"timestamp,timestamp"`
+	StatusCode int32             `parquet:"status_code"`
+	Metadata   map[string]string `parquet:"metadata"`
+}
+
+// ParquetSink writes crawl results as Hive-partitioned Parquet files:
+// <dir>/crawl_id=<id>/date=<YYYY-MM-DD>/results.parquet
+type ParquetSink struct {
+	dir string
+}
+
+// NewParquetSink creates a sink rooted at dir
+func NewParquetSink(dir string) *ParquetSink {
+	return &ParquetSink{dir: dir}
+}
+
+// WriteCrawl writes all results of a crawl, one file per day, replacing earlier exports
+func (ps *ParquetSink) WriteCrawl(crawlID string, results []CrawlResult) ([]string, error) {
+	byDate := make(map[string][]CrawlResult)
+	for _, result := range results {
+		date := result.Timestamp.UTC().Format("2006-01-02")
+		byDate[date] = append(byDate[date], result)
+	}
+
+	dates := make([]string, 0, len(byDate))
+	for date := range byDate {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	files := make([]string, 0, len(dates))
+	for _, date := range dates {
+		partition := filepath.Join(ps.dir, "crawl_id="+crawlID, "date="+date)
+		if err := os.MkdirAll(partition, 0o755); err != nil {
+			return files, fmt.Errorf("failed to create partition %s: %v", partition, err)
+		}
+
+		// Write to a temp file first so readers never see a half-written file
+		path := filepath.Join(partition, "results.parquet")
+		tmp := path + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return files, fmt.Errorf("failed to create %s: %v", tmp, err)
+		}
+		if err := writeParquet(f, byDate[date]); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return files, err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(tmp)
+			return files, fmt.Errorf("failed to close %s: %v", tmp, err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return files, fmt.Errorf("failed to finalize %s: %v", path, err)
+		}
+		files = append(files, path)
+	}
+
+	return files, nil
+}
+
+// writeParquet encodes results as a single Parquet file
+func writeParquet(w io.Writer, results []CrawlResult) error {
+	rows := make([]parquetRow, len(results))
+	for i, result := range results {
+		rows[i] = parquetRow{
+			URL:        result.URL,
+			Title:      result.Title,
+			Content:    result.Content,
+			Domain:     result.Domain,
+			Keywords:   result.Keywords,
+			Timestamp:  result.Timestamp.UTC(),
+			StatusCode: int32(result.StatusCode),
+			Metadata:   result.Metadata,
+		}
+	}
+
+	pw := parquet.NewGenericWriter[parquetRow](w)
+	if _, err := pw.Write(rows); err != nil {
+		return fmt.Errorf("failed to write parquet rows: %v", err)
+	}
+	if err := pw.Close(); err != nil {
+		return fmt.Errorf("failed to close parquet writer: %v", err)
+	}
+	return nil
+}
+
+// exportParquet writes a finished crawl to the configured sink, if any
+func (cm *CrawlManager) exportParquet(crawlID string) {
+	if cm.parquetSink == nil {
+		return
+	}
+
+	files, err := cm.parquetSink.WriteCrawl(crawlID, cm.resultStore.GetAllResults(crawlID))
+	if err != nil {
+		log.Printf("Parquet export failed for crawl %s: %v", crawlID, err)
+		return
+	}
+	log.Printf("Exported crawl %s to %d Parquet file(s)", crawlID, len(files))
+}
+
+// handleDownloadParquet streams all results of a crawl as one Parquet file
+func handleDownloadParquet(cm *CrawlManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		crawlID := c.Param("crawl_id")
+
+		_, exists := cm.jobs.Get(crawlID)
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error":    "Crawl job not found",
+				"crawl_id": crawlID,
+			})
+			return
+		}
+
+		results := cm.resultStore.GetAllResults(crawlID)
+
+		c.Header("Content-Type", "application/vnd.apache.parquet")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="crawl-%s.parquet"`, crawlID))
+		c.Status(http.StatusOK)
+		if err := writeParquet(c.Writer, results); err != nil {
+			log.Printf("Parquet download failed for crawl %s: %v", crawlID, err)
+		}
+	}
+}
+
+// handleExportParquet writes a crawl's results to the partitioned Parquet sink on demand
+func handleExportParquet(cm *CrawlManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		crawlID := c.Param("crawl_id")
+
+		if cm.parquetSink == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Parquet export is not configured (set PARQUET_EXPORT_DIR)",
+			})
+			return
+		}
+
+		_, exists := cm.jobs.Get(crawlID)
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error":    "Crawl job not found",
+				"crawl_id": crawlID,
+			})
+			return
+		}
+
+		files, err := cm.parquetSink.WriteCrawl(crawlID, cm.resultStore.GetAllResults(crawlID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to export results",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"crawl_id": crawlID,
+			"files":    files,
+		})
+	}
+}
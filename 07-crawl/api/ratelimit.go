@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitTier defines how many requests a class of API key may make
+type RateLimitTier struct {
+	Name              string
+	RequestsPerMinute int
+	Burst             int
+}
+
+// Default tiers; keys not listed in CRAWLER_API_KEYS are treated as anonymous
+var defaultRateLimitTiers = map[string]RateLimitTier{
+	"anonymous": {Name: "anonymous", RequestsPerMinute: 30, Burst: 10},
+	"basic":     {Name: "basic", RequestsPerMinute: 120, Burst: 30},
+	"premium":   {Name: "premium", RequestsPerMinute: 600, Burst: 100},
+}
+
+// tokenBucket tracks the remaining allowance for one client on one endpoint
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	capacity float64
+	rate     float64 // tokens per second
+}
+
+// take refills the bucket and consumes a token if available
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// untilNext returns how long until the next token is available
+func (b *tokenBucket) untilNext() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// untilFull returns how long until the bucket is back at capacity
+func (b *tokenBucket) untilFull() time.Duration {
+	return time.Duration((b.capacity - b.tokens) / b.rate * float64(time.Second))
+}
+
+// RateLimiter keeps a token bucket per API key and endpoint
+type RateLimiter struct {
+	tiers   map[string]RateLimitTier
+	keys    map[string]string // API key -> tier name
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter with the given tiers and key assignments
+func NewRateLimiter(tiers map[string]RateLimitTier, keys map[string]string) *RateLimiter {
+	rl := &RateLimiter{
+		tiers:   tiers,
+		keys:    keys,
+		buckets: make(map[string]*tokenBucket),
+	}
+	go rl.cleanup(10 * time.Minute)
+	return rl
+}
+
+// NewRateLimiterFromEnv reads key assignments from CRAWLER_API_KEYS ("key1:basic,key2:premium")
+func NewRateLimiterFromEnv() *RateLimiter {
+	keys := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("CRAWLER_API_KEYS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		if _, ok := defaultRateLimitTiers[parts[1]]; ok {
+			keys[parts[0]] = parts[1]
+		}
+	}
+	return NewRateLimiter(defaultRateLimitTiers, keys)
+}
+
+// identify resolves the caller's bucket identity and tier
+func (rl *RateLimiter) identify(c *gin.Context) (string, RateLimitTier) {
+	if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+		if tierName, ok := rl.keys[apiKey]; ok {
+			return "key:" + apiKey, rl.tiers[tierName]
+		}
+	}
+	return "ip:" + c.ClientIP(), rl.tiers["anonymous"]
+}
+
+// Middleware limits an endpoint; share scales the tier's allowance (e.g. 0.1 for expensive endpoints)
+func (rl *RateLimiter) Middleware(endpoint string, share float64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, tier := rl.identify(c)
+
+		limit := int(math.Max(1, math.Round(float64(tier.RequestsPerMinute)*share)))
+		burst := int(math.Max(1, math.Round(float64(tier.Burst)*share)))
+
+		now := time.Now()
+		rl.mutex.Lock()
+		key := identity + "|" + endpoint
+		bucket, exists := rl.buckets[key]
+		if !exists {
+			bucket = &tokenBucket{
+				tokens:   float64(burst),
+				last:     now,
+				capacity: float64(burst),
+				rate:     float64(limit) / 60,
+			}
+			rl.buckets[key] = bucket
+		}
+		allowed := bucket.take(now)
+		remaining := int(bucket.tokens)
+		reset := now.Add(bucket.untilFull())
+		retryAfter := bucket.untilNext()
+		rl.mutex.Unlock()
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+		if !allowed {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":       "Rate limit exceeded",
+				"tier":        tier.Name,
+				"retry_after": seconds,
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// cleanup periodically drops buckets that have refilled completely
+func (rl *RateLimiter) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		rl.mutex.Lock()
+		for key, bucket := range rl.buckets {
+			if now.Sub(bucket.last) > bucket.untilFull() {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mutex.Unlock()
+	}
+}
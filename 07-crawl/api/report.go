@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/fajar/learn-go/report"
+	"github.com/gin-gonic/gin"
+)
+
+// resultColumns are the columns of the Results sheet
+var resultColumns = []report.Column{
+	{Header: "URL", Width: 60},
+	{Header: "Title", Width: 40},
+	{Header: "Domain", Width: 24},
+	{Header: "Status", Format: report.Integer},
+	{Header: "Keywords", Width: 30},
+	{Header: "Crawled At", Format: report.DateTime},
+}
+
+func resultRow(r CrawlResult) report.Row {
+	return report.Row{r.URL, r.Title, r.Domain, r.StatusCode, strings.Join(r.Keywords, ", "), r.Timestamp}
+}
+
+// domainSummary is a row of the Domains sheet
+type domainSummary struct {
+	domain       string
+	pages        int
+	withKeywords int
+}
+
+// summarizeDomains counts pages per domain, busiest first
+func summarizeDomains(results []CrawlResult) []domainSummary {
+	byDomain := make(map[string]*domainSummary)
+	for _, r := range results {
+		s, ok := byDomain[r.Domain]
+		if !ok {
+			s = &domainSummary{domain: r.Domain}
+			byDomain[r.Domain] = s
+		}
+		s.pages++
+		if len(r.Keywords) > 0 {
+			s.withKeywords++
+		}
+	}
+
+	summaries := make([]domainSummary, 0, len(byDomain))
+	for _, s := range byDomain {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].pages != summaries[j].pages {
+			return summaries[i].pages > summaries[j].pages
+		}
+		return summaries[i].domain < summaries[j].domain
+	})
+	return summaries
+}
+
+// reportSheets builds the sheets of a crawl report. XLSX gets a per-domain
+// summary sheet as well; CSV holds only the results.
+func reportSheets(results []CrawlResult, fileType report.FileType) []report.Sheet {
+	sheets := []report.Sheet{{
+		Name:    "Results",
+		Columns: resultColumns,
+		Rows:    report.FromSlice(results, resultRow),
+	}}
+	if fileType != report.XLSX {
+		return sheets
+	}
+
+	return append(sheets, report.Sheet{
+		Name: "Domains",
+		Columns: []report.Column{
+			{Header: "Domain", Width: 24},
+			{Header: "Pages", Format: report.Integer},
+			{Header: "Pages With Keywords", Format: report.Integer},
+			{Header: "Keyword Hit Rate", Format: report.Percent},
+		},
+		Rows: report.FromSlice(summarizeDomains(results), func(s domainSummary) report.Row {
+			return report.Row{s.domain, s.pages, s.withKeywords, float64(s.withKeywords) / float64(s.pages)}
+		}),
+	})
+}
+
+// handleDownloadReport streams a crawl's results as CSV or XLSX (?format=csv|xlsx)
+func handleDownloadReport(cm *CrawlManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		crawlID := c.Param("crawl_id")
+
+		fileType, err := report.ParseFileType(c.Query("format"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "format must be csv or xlsx",
+			})
+			return
+		}
+
+		_, exists := cm.jobs.Get(crawlID)
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error":    "Crawl job not found",
+				"crawl_id": crawlID,
+			})
+			return
+		}
+
+		results := cm.resultStore.GetAllResults(crawlID)
+
+		c.Header("Content-Type", fileType.ContentType())
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileType.Filename("crawl-"+crawlID)))
+		c.Status(http.StatusOK)
+		if err := report.Write(c.Writer, fileType, reportSheets(results, fileType)...); err != nil {
+			log.Printf("Report download failed for crawl %s: %v", crawlID, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSampleSize = 20
+	maxSampleSize     = 200
+)
+
+// Sampling strategies for GET /crawl/:crawl_id/sample
+const (
+	sampleRandom    = "random"     // uniform over all results
+	samplePerDomain = "per_domain" // round-robin over domains, random within each
+	sampleTopScore  = "top_score"  // highest scoring first
+)
+
+// resultScore ranks a result for top_score sampling: the crawler's own
+// score when it recorded one, otherwise how many keywords the page matched
+func resultScore(r CrawlResult) float64 {
+	if s, err := strconv.ParseFloat(r.Metadata["score"], 64); err == nil {
+		return s
+	}
+	return float64(len(r.Keywords))
+}
+
+// sampleResults picks up to n results. The random strategies are
+// reproducible for a given seed.
+func sampleResults(results []CrawlResult, n int, strategy string, seed int64) []CrawlResult {
+	if n > len(results) {
+		n = len(results)
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	switch strategy {
+	case sampleTopScore:
+		ranked := append([]CrawlResult(nil), results...)
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return resultScore(ranked[i]) > resultScore(ranked[j])
+		})
+		return ranked[:n]
+
+	case samplePerDomain:
+		// Shuffle each domain's pages, then take one page per domain per round
+		// so a domain with thousands of pages can't crowd out the rest
+		var domains []string
+		byDomain := make(map[string][]CrawlResult)
+		for _, r := range results {
+			if _, ok := byDomain[r.Domain]; !ok {
+				domains = append(domains, r.Domain)
+			}
+			byDomain[r.Domain] = append(byDomain[r.Domain], r)
+		}
+		sort.Strings(domains)
+		for _, d := range domains {
+			pages := byDomain[d]
+			rng.Shuffle(len(pages), func(i, j int) { pages[i], pages[j] = pages[j], pages[i] })
+		}
+
+		sample := make([]CrawlResult, 0, n)
+		for round := 0; len(sample) < n; round++ {
+			for _, d := range domains {
+				if pages := byDomain[d]; round < len(pages) && len(sample) < n {
+					sample = append(sample, pages[round])
+				}
+			}
+		}
+		return sample
+
+	default: // sampleRandom
+		sample := make([]CrawlResult, n)
+		for i, j := range rng.Perm(len(results))[:n] {
+			sample[i] = results[j]
+		}
+		return sample
+	}
+}
+
+// handleSampleResults returns a small sample of a crawl's results for spot
+// checks (?n=20&strategy=random|per_domain|top_score&seed=...)
+func handleSampleResults(cm *CrawlManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		crawlID := c.Param("crawl_id")
+
+		n := defaultSampleSize
+		if s := c.Query("n"); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 1 || v > maxSampleSize {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "n must be between 1 and " + strconv.Itoa(maxSampleSize),
+				})
+				return
+			}
+			n = v
+		}
+
+		strategy := c.DefaultQuery("strategy", sampleRandom)
+		if strategy != sampleRandom && strategy != samplePerDomain && strategy != sampleTopScore {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "strategy must be random, per_domain or top_score",
+			})
+			return
+		}
+
+		seed := time.Now().UnixNano()
+		if s := c.Query("seed"); s != "" {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "seed must be an integer",
+				})
+				return
+			}
+			seed = v
+		}
+
+		status, exists := cm.jobs.Get(crawlID)
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error":    "Crawl job not found",
+				"crawl_id": crawlID,
+			})
+			return
+		}
+
+		results := cm.resultStore.GetAllResults(crawlID)
+		sample := sampleResults(results, n, strategy, seed)
+
+		response := gin.H{
+			"crawl_id":      crawlID,
+			"status":        status.Status,
+			"strategy":      strategy,
+			"total_results": len(results),
+			"sample_size":   len(sample),
+			"results":       sample,
+		}
+		if strategy != sampleTopScore {
+			// Pass it back as ?seed= to get the same sample again
+			response["seed"] = strconv.FormatInt(seed, 10)
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/sleep"
+	"github.com/fajar/learn-go/crawlengine"
+	"github.com/gin-gonic/gin"
+)
+
+// shedPoll is how often paused crawls and the relief loop look at the backlog
+const shedPoll = 5 * time.Second
+
+// LoadShedder protects the result store. Once the number of results held
+// in memory reaches the high-water mark, new crawls are refused with 503
+// and running crawls pause before storing another result. Both resume once
+// the backlog is back down to the low-water mark, so the API doesn't flap
+// around a single threshold.
+type LoadShedder struct {
+	highWater  int
+	lowWater   int
+	retryAfter time.Duration
+	retention  time.Duration // finished crawls younger than this keep their results
+
+	mutex    sync.Mutex
+	shedding bool
+	shed     map[string]uint64 // refused requests by endpoint
+	pauses   uint64            // times a running crawl paused its intake
+	paused   map[string]bool   // crawls paused right now
+	released uint64            // results released from finished crawls
+}
+
+// NewLoadShedder creates a shedder for the given marks
+func NewLoadShedder(highWater, lowWater int, retryAfter, retention time.Duration) *LoadShedder {
+	return &LoadShedder{
+		highWater:  highWater,
+		lowWater:   lowWater,
+		retryAfter: retryAfter,
+		retention:  retention,
+		shed:       make(map[string]uint64),
+		paused:     make(map[string]bool),
+	}
+}
+
+// NewLoadShedderFromEnv reads RESULT_BACKLOG_HIGH_WATER (default 100000
+// results), RESULT_BACKLOG_LOW_WATER (default 80% of the high-water mark),
+// SHED_RETRY_AFTER (default 30s) and RESULT_RETENTION (default 10m)
+func NewLoadShedderFromEnv() (*LoadShedder, error) {
+	high, err := envInt("RESULT_BACKLOG_HIGH_WATER", 100000)
+	if err != nil {
+		return nil, err
+	}
+	low, err := envInt("RESULT_BACKLOG_LOW_WATER", high*8/10)
+	if err != nil {
+		return nil, err
+	}
+	if high < 1 || low < 0 || low >= high {
+		return nil, fmt.Errorf("RESULT_BACKLOG_LOW_WATER (%d) must be below RESULT_BACKLOG_HIGH_WATER (%d), and both positive", low, high)
+	}
+	retryAfter, err := envDuration("SHED_RETRY_AFTER", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	retention, err := envDuration("RESULT_RETENTION", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return NewLoadShedder(high, low, retryAfter, retention), nil
+}
+
+func envInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, got %q", name, value)
+	}
+	return n, nil
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a duration such as 30s, got %q", name, value)
+	}
+	return d, nil
+}
+
+// overloaded updates the shedding state for backlog and reports it
+func (s *LoadShedder) overloaded(backlog int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case !s.shedding && backlog >= s.highWater:
+		s.shedding = true
+		log.Printf("Result backlog at %d (high-water %d), shedding new crawls and pausing intake", backlog, s.highWater)
+	case s.shedding && backlog <= s.lowWater:
+		s.shedding = false
+		log.Printf("Result backlog down to %d (low-water %d), accepting crawls again", backlog, s.lowWater)
+	}
+	return s.shedding
+}
+
+// Middleware refuses requests to endpoint with 503 and Retry-After while
+// the backlog is over the high-water mark
+func (s *LoadShedder) Middleware(endpoint string, backlog func() int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.overloaded(backlog()) {
+			c.Next()
+			return
+		}
+		s.mutex.Lock()
+		s.shed[endpoint]++
+		s.mutex.Unlock()
+
+		seconds := int(math.Ceil(s.retryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error":       "Result store is full, try again later",
+			"retry_after": seconds,
+		})
+	}
+}
+
+// waitForIntake holds a running crawl's next result while the backlog is
+// over the high-water mark, with the crawl shown as paused. It returns
+// ctx.Err() if the crawl is cancelled meanwhile.
+func (cm *CrawlManager) waitForIntake(ctx context.Context, crawlID string) error {
+	s := cm.shedder
+	if !s.overloaded(cm.resultStore.Len()) {
+		return nil
+	}
+
+	s.mutex.Lock()
+	s.pauses++
+	s.paused[crawlID] = true
+	s.mutex.Unlock()
+	cm.setRunning(crawlID, crawlengine.JobRunning, "paused")
+	log.Printf("Crawl %s paused until the result backlog drains", crawlID)
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.paused, crawlID)
+		s.mutex.Unlock()
+	}()
+	for s.overloaded(cm.resultStore.Len()) {
+		if err := sleep.Until(ctx, shedPoll); err != nil {
+			return err
+		}
+	}
+	cm.setRunning(crawlID, "paused", crawlengine.JobRunning)
+	log.Printf("Crawl %s resumed", crawlID)
+	return nil
+}
+
+// setRunning moves a crawl from one running state to another, unless it
+// has since been cancelled or finished
+func (cm *CrawlManager) setRunning(crawlID, from, to string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	if status, ok := cm.jobs.Get(crawlID); ok && status.Status == from {
+		status.Status = to
+	}
+}
+
+// relieve runs until ctx is done. While the store is over the high-water
+// mark, it releases the results of finished crawls, oldest first, until
+// the backlog is down to the low-water mark. Crawls finished less than
+// the retention period ago are kept, so their results can still be read.
+func (cm *CrawlManager) relieve(ctx context.Context) {
+	for sleep.Until(ctx, shedPoll) == nil {
+		if !cm.shedder.overloaded(cm.resultStore.Len()) {
+			continue
+		}
+
+		type finished struct {
+			crawlID string
+			ended   time.Time
+		}
+		var candidates []finished
+		cutoff := time.Now().Add(-cm.shedder.retention)
+		cm.mutex.RLock()
+		for _, status := range cm.jobs.All() {
+			if status.EndTime != nil && status.EndTime.Before(cutoff) && !status.ResultsReleased {
+				candidates = append(candidates, finished{status.CrawlID, *status.EndTime})
+			}
+		}
+		cm.mutex.RUnlock()
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].ended.Before(candidates[j].ended) })
+
+		for _, f := range candidates {
+			if cm.resultStore.Len() <= cm.shedder.lowWater {
+				break
+			}
+			n := cm.releaseResults(f.crawlID)
+			cm.shedder.mutex.Lock()
+			cm.shedder.released += uint64(n)
+			cm.shedder.mutex.Unlock()
+			log.Printf("Released %d results of crawl %s to relieve the result store", n, f.crawlID)
+		}
+	}
+}
+
+// releaseResults drops a finished crawl's results from memory. Its status
+// stays, marked results_released; a Parquet export, if configured, was
+// written when it completed.
+func (cm *CrawlManager) releaseResults(crawlID string) int {
+	n := cm.resultStore.Release(crawlID)
+	cm.mutex.Lock()
+	if status, ok := cm.jobs.Get(crawlID); ok {
+		status.Results = nil
+		status.ResultsReleased = true
+	}
+	cm.mutex.Unlock()
+	return n
+}
+
+// handleMetrics serves the load shedding state in Prometheus text format
+func handleMetrics(cm *CrawlManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4")
+		cm.shedder.write(c.Writer, cm.resultStore.Len())
+	}
+}
+
+func (s *LoadShedder) write(w io.Writer, backlog int) {
+	shedding := s.overloaded(backlog)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP crawler_api_result_backlog Crawl results held in memory.")
+	fmt.Fprintln(w, "# TYPE crawler_api_result_backlog gauge")
+	fmt.Fprintf(w, "crawler_api_result_backlog %d\n", backlog)
+	fmt.Fprintln(w, "# HELP crawler_api_result_backlog_high_water Backlog at which load shedding starts.")
+	fmt.Fprintln(w, "# TYPE crawler_api_result_backlog_high_water gauge")
+	fmt.Fprintf(w, "crawler_api_result_backlog_high_water %d\n", s.highWater)
+	fmt.Fprintln(w, "# HELP crawler_api_result_backlog_low_water Backlog at which load shedding stops.")
+	fmt.Fprintln(w, "# TYPE crawler_api_result_backlog_low_water gauge")
+	fmt.Fprintf(w, "crawler_api_result_backlog_low_water %d\n", s.lowWater)
+	fmt.Fprintln(w, "# HELP crawler_api_load_shedding Whether new crawls are being refused.")
+	fmt.Fprintln(w, "# TYPE crawler_api_load_shedding gauge")
+	fmt.Fprintf(w, "crawler_api_load_shedding %d\n", boolGauge(shedding))
+
+	fmt.Fprintln(w, "# HELP crawler_api_shed_requests_total Requests refused with 503 because the result store was full.")
+	fmt.Fprintln(w, "# TYPE crawler_api_shed_requests_total counter")
+	endpoints := make([]string, 0, len(s.shed))
+	for endpoint := range s.shed {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "crawler_api_shed_requests_total{endpoint=%q} %d\n", endpoint, s.shed[endpoint])
+	}
+
+	fmt.Fprintln(w, "# HELP crawler_api_intake_pauses_total Times a running crawl paused until the backlog drained.")
+	fmt.Fprintln(w, "# TYPE crawler_api_intake_pauses_total counter")
+	fmt.Fprintf(w, "crawler_api_intake_pauses_total %d\n", s.pauses)
+	fmt.Fprintln(w, "# HELP crawler_api_paused_crawls Crawls paused right now.")
+	fmt.Fprintln(w, "# TYPE crawler_api_paused_crawls gauge")
+	fmt.Fprintf(w, "crawler_api_paused_crawls %d\n", len(s.paused))
+	fmt.Fprintln(w, "# HELP crawler_api_results_released_total Results of finished crawls released to relieve the store.")
+	fmt.Fprintln(w, "# TYPE crawler_api_results_released_total counter")
+	fmt.Fprintf(w, "crawler_api_results_released_total %d\n", s.released)
+}
+
+func boolGauge(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
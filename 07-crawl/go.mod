@@ -4,8 +4,12 @@ go 1.24.2
 
 require (
 	github.com/gin-gonic/gin v1.9.1
-	github.com/google/uuid v1.4.0
+	github.com/google/uuid v1.6.0
 	golang.org/x/net v0.45.0
-	google.golang.org/grpc v1.59.0
-	google.golang.org/protobuf v1.31.0
+	google.golang.org/grpc v1.75.0
+	google.golang.org/protobuf v1.36.8
 )
+
+require github.com/fajar/learn-go v0.0.0-00010101000000-000000000000
+
+replace github.com/fajar/learn-go => ..
@@ -2,248 +2,182 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/fajar/learn-go/concurrency/fanin"
+	"github.com/fajar/learn-go/concurrency/sleep"
+	"github.com/fajar/learn-go/crawlengine"
 	"golang.org/x/net/html"
 )
 
-// URLStatus represents the status of a URL during crawling
-type URLStatus int
-
+// Parse limits reported in crawlengine.Result.LimitsHit
 const (
-	StatusPending URLStatus = iota
-	StatusFetched
-	StatusError
-	StatusRedirect
-)
-
-// CrawlResult represents the result of crawling a URL
-type CrawlResult struct {
-	URL         string
-	Status      URLStatus
-	Content     string
-	Links       []string
-	Error       error
-	StatusCode  int
-	RedirectURL string
-}
-
-// URLFrontier manages the queue of URLs to be crawled
-type URLFrontier struct {
-	urls     chan string
-	visited  map[string]bool
-	mu       sync.RWMutex
-	maxDepth int
-	depth    map[string]int
-}
-
-// NewURLFrontier creates a new URL frontier
-func NewURLFrontier(maxDepth int) *URLFrontier {
-	return &URLFrontier{
-		urls:     make(chan string, 1000),
-		visited:  make(map[string]bool),
-		maxDepth: maxDepth,
-		depth:    make(map[string]int),
-	}
-}
-
-// AddURL adds a URL to the frontier if not already visited
-func (uf *URLFrontier) AddURL(rawURL string, currentDepth int) {
-	uf.mu.Lock()
-	defer uf.mu.Unlock()
-
-	// Normalize URL
-	parsedURL, err := url.Parse(rawURL)
-	if err != nil {
-		return
-	}
-	normalizedURL := parsedURL.String()
-
-	// Check if already visited or max depth exceeded
-	if uf.visited[normalizedURL] || currentDepth >= uf.maxDepth {
-		return
-	}
+	limitMaxNodes = "max_nodes"
+	limitMaxDepth = "max_depth"
+	limitMaxLinks = "max_links"
 
-	uf.visited[normalizedURL] = true
-	uf.depth[normalizedURL] = currentDepth
-
-	select {
-	case uf.urls <- normalizedURL:
-	default:
-		// Channel is full, skip this URL
-	}
-}
-
-// GetURL retrieves the next URL to crawl
-func (uf *URLFrontier) GetURL() (string, int, bool) {
-	select {
-	case url := <-uf.urls:
-		uf.mu.RLock()
-		depth := uf.depth[url]
-		uf.mu.RUnlock()
-		return url, depth, true
-	default:
-		return "", 0, false
-	}
-}
+	// The HTML parser rejected the page, e.g. for nesting deeper than 512
+	// elements, so it has no links at all
+	limitParseError = "parse_error"
+)
 
-// Close closes the URL frontier
-func (uf *URLFrontier) Close() {
-	close(uf.urls)
+// ParseLimits bounds the work done on one page, so a hostile or broken
+// document can't exhaust the crawler. Zero means no limit.
+type ParseLimits struct {
+	MaxNodes int // nodes visited
+	MaxDepth int // element nesting; deeper subtrees are skipped
+	MaxLinks int // links kept
 }
 
-// Fetcher handles HTTP requests with politeness and rate limiting
-type Fetcher struct {
-	client      *http.Client
-	userAgent   string
-	rateLimiter map[string]time.Time
-	mu          sync.Mutex
-	delay       time.Duration
+// DefaultParseLimits are far above what real pages need
+var DefaultParseLimits = ParseLimits{
+	MaxNodes: 200000,
+	MaxDepth: 256,
+	MaxLinks: 5000,
 }
 
-// NewFetcher creates a new fetcher with rate limiting
-func NewFetcher(delay time.Duration) *Fetcher {
-	return &Fetcher{
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-		userAgent:   "GoCrawler/1.0 (+https://example.com/bot)",
-		rateLimiter: make(map[string]time.Time),
-		delay:       delay,
+// parseLimitsFromEnv reads PARSE_MAX_NODES, PARSE_MAX_DEPTH and
+// PARSE_MAX_LINKS over the defaults
+func parseLimitsFromEnv() (ParseLimits, error) {
+	limits := DefaultParseLimits
+	settings := []struct {
+		env   string
+		limit *int
+	}{
+		{"PARSE_MAX_NODES", &limits.MaxNodes},
+		{"PARSE_MAX_DEPTH", &limits.MaxDepth},
+		{"PARSE_MAX_LINKS", &limits.MaxLinks},
 	}
-}
-
-// Fetch retrieves content from a URL with politeness
-func (f *Fetcher) Fetch(rawURL string) *CrawlResult {
-	result := &CrawlResult{
-		URL:    rawURL,
-		Status: StatusPending,
-	}
-
-	// Parse URL to get hostname for rate limiting
-	parsedURL, err := url.Parse(rawURL)
-	if err != nil {
-		result.Status = StatusError
-		result.Error = err
-		return result
-	}
-
-	hostname := parsedURL.Hostname()
-
-	// Apply rate limiting per hostname
-	f.mu.Lock()
-	if lastRequest, exists := f.rateLimiter[hostname]; exists {
-		if time.Since(lastRequest) < f.delay {
-			time.Sleep(f.delay - time.Since(lastRequest))
+	for _, setting := range settings {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
 		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return ParseLimits{}, fmt.Errorf("%s must be a number >= 0, got %q", setting.env, value)
+		}
+		*setting.limit = n
 	}
-	f.rateLimiter[hostname] = time.Now()
-	f.mu.Unlock()
-
-	// Create request
-	req, err := http.NewRequest("GET", rawURL, nil)
-	if err != nil {
-		result.Status = StatusError
-		result.Error = err
-		return result
-	}
-
-	req.Header.Set("User-Agent", f.userAgent)
-
-	// Perform request
-	resp, err := f.client.Do(req)
-	if err != nil {
-		result.Status = StatusError
-		result.Error = err
-		return result
-	}
-	defer resp.Body.Close()
-
-	result.StatusCode = resp.StatusCode
-
-	// Handle redirects
-	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
-		result.Status = StatusRedirect
-		result.RedirectURL = resp.Header.Get("Location")
-		return result
-	}
-
-	// Read content
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		result.Status = StatusError
-		result.Error = err
-		return result
-	}
-
-	result.Content = string(body)
-	result.Status = StatusFetched
-	return result
+	return limits, nil
 }
 
 // Parser extracts links and content from HTML
 type Parser struct {
 	baseURL *url.URL
+	limits  ParseLimits
 }
 
-// NewParser creates a new HTML parser
+// NewParser creates a new HTML parser with the default limits
 func NewParser(baseURL string) (*Parser, error) {
 	parsedURL, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, err
 	}
-	return &Parser{baseURL: parsedURL}, nil
+	return &Parser{baseURL: parsedURL, limits: DefaultParseLimits}, nil
 }
 
-// Parse extracts links from HTML content
-func (p *Parser) Parse(content string, currentURL string) []string {
-	var links []string
-
+// Parse extracts links from HTML content. limitsHit names the parse limits
+// the page reached, in which case the links are only those found before.
+func (p *Parser) Parse(content string, currentURL string) (links []string, limitsHit []string) {
 	// Parse current URL for resolving relative links
 	currentParsedURL, err := url.Parse(currentURL)
 	if err != nil {
-		return links
+		return nil, nil
 	}
 
 	doc, err := html.Parse(strings.NewReader(content))
 	if err != nil {
-		return links
+		return nil, []string{limitParseError}
 	}
 
-	// Extract links recursively
-	p.extractLinks(doc, currentParsedURL, &links)
-
-	return links
+	return p.extractLinks(doc, currentParsedURL)
 }
 
-// extractLinks recursively extracts links from HTML nodes
-func (p *Parser) extractLinks(n *html.Node, baseURL *url.URL, links *[]string) {
-	if n.Type == html.ElementNode && n.Data == "a" {
-		for _, attr := range n.Attr {
-			if attr.Key == "href" {
-				// Resolve relative URLs
-				if resolvedURL, err := baseURL.Parse(attr.Val); err == nil {
-					// Only include HTTP/HTTPS URLs
-					if resolvedURL.Scheme == "http" || resolvedURL.Scheme == "https" {
-						*links = append(*links, resolvedURL.String())
-					}
+// extractLinks walks the tree under root in document order, with an
+// explicit stack rather than recursion, so nesting depth can't overflow the
+// goroutine stack. It stops at the parser's limits and reports which it hit.
+func (p *Parser) extractLinks(root *html.Node, baseURL *url.URL) (links []string, limitsHit []string) {
+	type entry struct {
+		node  *html.Node
+		depth int
+	}
+	hit := make(map[string]bool)
+	stack := []entry{{root, 0}}
+	nodes := 0
+
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		nodes++
+		if p.limits.MaxNodes > 0 && nodes > p.limits.MaxNodes {
+			hit[limitMaxNodes] = true
+			break
+		}
+
+		n := e.node
+		if n.Type == html.ElementNode && n.Data == "a" {
+			if link, ok := resolveHref(n, baseURL); ok {
+				if p.limits.MaxLinks > 0 && len(links) >= p.limits.MaxLinks {
+					hit[limitMaxLinks] = true
+					break
 				}
+				links = append(links, link)
 			}
 		}
+
+		if n.FirstChild == nil {
+			continue
+		}
+		if p.limits.MaxDepth > 0 && e.depth >= p.limits.MaxDepth {
+			hit[limitMaxDepth] = true
+			continue
+		}
+		// Push children last to first, so the first child is visited next
+		for c := n.LastChild; c != nil; c = c.PrevSibling {
+			stack = append(stack, entry{c, e.depth + 1})
+		}
+	}
+
+	for _, limit := range []string{limitMaxNodes, limitMaxDepth, limitMaxLinks} {
+		if hit[limit] {
+			limitsHit = append(limitsHit, limit)
+		}
 	}
+	return links, limitsHit
+}
 
-	// Recursively process child nodes
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		p.extractLinks(c, baseURL, links)
+// resolveHref returns the absolute URL of an <a> element's href, if it is
+// an HTTP or HTTPS link
+func resolveHref(n *html.Node, baseURL *url.URL) (string, bool) {
+	for _, attr := range n.Attr {
+		if attr.Key != "href" {
+			continue
+		}
+		// Resolve relative URLs
+		resolvedURL, err := baseURL.Parse(attr.Val)
+		if err != nil {
+			return "", false
+		}
+		// Only include HTTP/HTTPS URLs
+		if resolvedURL.Scheme == "http" || resolvedURL.Scheme == "https" {
+			return resolvedURL.String(), true
+		}
+		return "", false
 	}
+	return "", false
 }
 
 // Indexer handles the indexing/output of crawled content
@@ -257,21 +191,24 @@ func NewIndexer(output io.Writer) *Indexer {
 }
 
 // Index processes and outputs the crawled content
-func (i *Indexer) Index(result *CrawlResult) {
+func (i *Indexer) Index(result *crawlengine.Result) {
 	switch result.Status {
-	case StatusFetched:
+	case crawlengine.StatusFetched:
 		// Extract text content (simplified)
 		text := i.extractText(result.Content)
 		fmt.Fprintf(i.output, "=== CRAWLED: %s ===\n", result.URL)
 		fmt.Fprintf(i.output, "Status Code: %d\n", result.StatusCode)
 		fmt.Fprintf(i.output, "Content Length: %d bytes\n", len(result.Content))
 		fmt.Fprintf(i.output, "Links Found: %d\n", len(result.Links))
+		if len(result.LimitsHit) > 0 {
+			fmt.Fprintf(i.output, "Parse Limits Hit: %s (links incomplete)\n", strings.Join(result.LimitsHit, ", "))
+		}
 		fmt.Fprintf(i.output, "Text Preview: %s\n", i.truncate(text, 200))
 		fmt.Fprintf(i.output, "Links: %v\n", result.Links[:min(len(result.Links), 5)])
 		fmt.Fprintln(i.output, "")
-	case StatusError:
+	case crawlengine.StatusError:
 		fmt.Fprintf(i.output, "ERROR crawling %s: %v\n", result.URL, result.Error)
-	case StatusRedirect:
+	case crawlengine.StatusRedirect:
 		fmt.Fprintf(i.output, "REDIRECT %s -> %s\n", result.URL, result.RedirectURL)
 	}
 }
@@ -307,98 +244,122 @@ func min(a, b int) int {
 
 // Crawler orchestrates the crawling process
 type Crawler struct {
-	frontier *URLFrontier
-	fetcher  *Fetcher
-	parser   *Parser
-	indexer  *Indexer
-	workers  int
+	frontier    *crawlengine.Frontier
+	fetcher     crawlengine.Fetcher
+	parser      *Parser
+	indexer     *Indexer
+	workers     int
+	parseLimits ParseLimits
+	limitsHit   map[string]int // pages that reached each parse limit
+	mu          sync.Mutex
 }
 
 // NewCrawler creates a new crawler
 func NewCrawler(maxDepth, workers int, delay time.Duration) *Crawler {
 	return &Crawler{
-		frontier: NewURLFrontier(maxDepth),
-		fetcher:  NewFetcher(delay),
-		indexer:  NewIndexer(os.Stdout),
-		workers:  workers,
+		frontier:    crawlengine.NewFrontier(maxDepth, crawlengine.DefaultFrontierSize),
+		fetcher:     crawlengine.NewHTTPFetcher(delay),
+		indexer:     NewIndexer(os.Stdout),
+		workers:     workers,
+		parseLimits: DefaultParseLimits,
+		limitsHit:   make(map[string]int),
 	}
 }
 
-// Crawl starts the crawling process
-func (c *Crawler) Crawl(startURL string) error {
+// SetParseLimits bounds the work done parsing each page
+func (c *Crawler) SetParseLimits(limits ParseLimits) {
+	c.parseLimits = limits
+}
+
+// recordLimitsHit counts the pages that reached each parse limit
+func (c *Crawler) recordLimitsHit(limits []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, limit := range limits {
+		c.limitsHit[limit]++
+	}
+}
+
+// LimitsHit returns how many pages reached each parse limit
+func (c *Crawler) LimitsHit() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int, len(c.limitsHit))
+	for limit, pages := range c.limitsHit {
+		counts[limit] = pages
+	}
+	return counts
+}
+
+// Crawl starts the crawling process. Cancelling ctx stops the workers after
+// their current fetch.
+func (c *Crawler) Crawl(ctx context.Context, startURL string) error {
 	// Initialize parser with base URL
 	parser, err := NewParser(startURL)
 	if err != nil {
 		return err
 	}
+	parser.limits = c.parseLimits
 	c.parser = parser
 
 	// Add initial URL
-	c.frontier.AddURL(startURL, 0)
-
-	// Start worker goroutines
-	var wg sync.WaitGroup
-	results := make(chan *CrawlResult, 100)
+	c.frontier.Add(startURL, 0)
 
-	// Start workers
-	for i := 0; i < c.workers; i++ {
-		wg.Add(1)
-		go c.worker(&wg, results)
+	// Fan out to the workers, then fan their results back in. Indexing
+	// happens here, so Crawl returns once every result is indexed.
+	workers := make([]fanin.Producer[*crawlengine.Result], c.workers)
+	for i := range workers {
+		workers[i] = c.work
+	}
+	results, errc := fanin.MergeResults(ctx, workers...)
+	for result := range results {
+		c.indexer.Index(result)
 	}
 
-	// Start result processor
-	go c.processResults(results)
-
-	// Wait for all workers to complete
-	wg.Wait()
-	close(results)
-
-	return nil
+	return <-errc
 }
 
-// worker processes URLs from the frontier
-func (c *Crawler) worker(wg *sync.WaitGroup, results chan<- *CrawlResult) {
-	defer wg.Done()
-
-	for {
-		url, depth, ok := c.frontier.GetURL()
+// work processes URLs from the frontier and sends their results until the
+// frontier runs dry or ctx is done. A failed fetch is a result, not an
+// error, so it always returns nil.
+func (c *Crawler) work(ctx context.Context, results chan<- *crawlengine.Result) error {
+	for ctx.Err() == nil {
+		url, depth, ok := c.frontier.Next()
 		if !ok {
 			// No more URLs, wait a bit and try again
-			time.Sleep(100 * time.Millisecond)
-			if _, _, stillOk := c.frontier.GetURL(); !stillOk {
+			if sleep.Until(ctx, 100*time.Millisecond) != nil {
+				break
+			}
+			if c.frontier.Len() == 0 {
 				break
 			}
 			continue
 		}
 
 		// Fetch the URL
-		result := c.fetcher.Fetch(url)
+		result := c.fetcher.Fetch(ctx, url)
 
 		// Parse links if successful
-		if result.Status == StatusFetched {
-			links := c.parser.Parse(result.Content, url)
+		if result.Status == crawlengine.StatusFetched {
+			links, limitsHit := c.parser.Parse(result.Content, url)
 			result.Links = links
+			result.LimitsHit = limitsHit
+			c.recordLimitsHit(limitsHit)
 
 			// Add new URLs to frontier
 			for _, link := range links {
-				c.frontier.AddURL(link, depth+1)
+				c.frontier.Add(link, depth+1)
 			}
 		}
 
 		// Send result for processing
 		select {
 		case results <- result:
-		default:
-			// Results channel is full, skip
+		case <-ctx.Done():
+			return nil
 		}
 	}
-}
-
-// processResults processes crawl results
-func (c *Crawler) processResults(results <-chan *CrawlResult) {
-	for result := range results {
-		c.indexer.Index(result)
-	}
+	return nil
 }
 
 func main() {
@@ -432,16 +393,37 @@ func main() {
 	fmt.Println("   - Max Depth: 2")
 	fmt.Println("   - Workers: 3")
 	fmt.Println("   - Delay: 1s between requests per host")
+
+	// PARSE_MAX_NODES, PARSE_MAX_DEPTH and PARSE_MAX_LINKS bound each page
+	limits, err := parseLimitsFromEnv()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	fmt.Printf("   - Parse limits: %d nodes, depth %d, %d links per page (0 = none)\n",
+		limits.MaxNodes, limits.MaxDepth, limits.MaxLinks)
 	fmt.Println()
 
 	// Create and start crawler
 	crawler := NewCrawler(2, 3, 1*time.Second)
+	crawler.SetParseLimits(limits)
 	
+	// Ctrl+C stops the crawl without waiting out politeness delays
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	start := time.Now()
-	if err := crawler.Crawl(startURL); err != nil {
+	if err := crawler.Crawl(ctx, startURL); err != nil {
 		fmt.Printf("❌ Crawl failed: %v\n", err)
 		return
 	}
+	if ctx.Err() != nil {
+		fmt.Printf("\n⏹️  Crawl interrupted after %v\n", time.Since(start))
+		return
+	}
 
 	fmt.Printf("\n✅ Crawl completed in %v\n", time.Since(start))
+	for limit, pages := range crawler.LimitsHit() {
+		fmt.Printf("⚠️  %d pages reached the %s parse limit\n", pages, limit)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// sniffLength is how much of a body http.DetectContentType looks at
+const sniffLength = 512
+
+// Extensions of links that are never followed: images, fonts, media,
+// stylesheets, scripts and downloads
+var defaultAssetExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif", ".svg", ".ico", ".bmp", ".tif", ".tiff",
+	".woff", ".woff2", ".ttf", ".otf", ".eot",
+	".mp3", ".mp4", ".m4a", ".webm", ".ogg", ".wav", ".mov", ".avi",
+	".css", ".js", ".mjs", ".map",
+	".pdf", ".zip", ".gz", ".tar", ".rar", ".7z", ".exe", ".dmg", ".apk", ".iso",
+}
+
+// Path fragments used by common image CDNs and static bundles, whose URLs
+// often have no extension
+var defaultAssetPaths = []string{
+	"/cdn-cgi/image/",
+	"/_next/image",
+	"/_next/static/",
+	"/wp-content/uploads/",
+	"/wp-includes/",
+}
+
+// AssetFilterConfig controls how static assets are kept out of the crawl.
+// The filter is on unless Disabled is set.
+type AssetFilterConfig struct {
+	Disabled        bool     `json:"disabled"`         // follow every link and download whatever comes back
+	ExtraExtensions []string `json:"extra_extensions"` // added to the built-in list, e.g. [".heic"]
+	ExtraPaths      []string `json:"extra_paths"`      // path fragments that mark an asset, e.g. ["/media/"]
+}
+
+// AssetStats reports what the asset filter kept out of the crawl
+type AssetStats struct {
+	SkippedLinks   int64            `json:"skipped_links"`   // links not followed because their path looks like an asset
+	AbortedFetches int64            `json:"aborted_fetches"` // downloads closed after the headers or the first 512 bytes
+	ByContentType  map[string]int64 `json:"by_content_type"` // aborted downloads by declared or sniffed type
+}
+
+// assetStats holds the live counters behind AssetStats
+type assetStats struct {
+	links, aborted atomic.Int64
+
+	mu     sync.Mutex
+	byType map[string]int64
+}
+
+func newAssetStats() *assetStats {
+	return &assetStats{byType: make(map[string]int64)}
+}
+
+func (s *assetStats) abort(contentType string) {
+	s.aborted.Add(1)
+	s.mu.Lock()
+	s.byType[contentType]++
+	s.mu.Unlock()
+}
+
+// snapshot returns the current counters
+func (s *assetStats) snapshot() AssetStats {
+	s.mu.Lock()
+	byType := make(map[string]int64, len(s.byType))
+	for k, v := range s.byType {
+		byType[k] = v
+	}
+	s.mu.Unlock()
+
+	return AssetStats{
+		SkippedLinks:   s.links.Load(),
+		AbortedFetches: s.aborted.Load(),
+		ByContentType:  byType,
+	}
+}
+
+// assetFilter decides from a URL alone whether a link points at an asset
+type assetFilter struct {
+	extensions map[string]bool
+	paths      []string
+}
+
+func newAssetFilter(cfg AssetFilterConfig) *assetFilter {
+	f := &assetFilter{extensions: make(map[string]bool)}
+	for _, ext := range append(defaultAssetExtensions, cfg.ExtraExtensions...) {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		f.extensions[strings.ToLower(ext)] = true
+	}
+	for _, p := range append(defaultAssetPaths, cfg.ExtraPaths...) {
+		f.paths = append(f.paths, strings.ToLower(p))
+	}
+	return f
+}
+
+// isAsset reports whether rawURL's path has an asset extension or contains
+// one of the asset path fragments
+func (f *assetFilter) isAsset(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	p := strings.ToLower(u.Path)
+	if f.extensions[path.Ext(p)] {
+		return true
+	}
+	for _, fragment := range f.paths {
+		if strings.Contains(p, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// assetSkippedError is returned by sniffTransport for a download it aborted
+type assetSkippedError struct {
+	contentType string
+}
+
+func (e *assetSkippedError) Error() string {
+	return "not an HTML page: " + e.contentType
+}
+
+// sniffTransport is the safety net for assets the URL filter can't spot. It
+// aborts a GET whose declared type is binary as soon as the headers arrive,
+// and otherwise reads the first 512 bytes and aborts if they sniff as an
+// image, video, archive or other binary. Closing the body early means the
+// rest of the file is never downloaded.
+type sniffTransport struct {
+	next  http.RoundTripper
+	stats *assetStats
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *sniffTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp, err
+	}
+
+	declared := resp.Header.Get("Content-Type")
+	declaredType, _, _ := mime.ParseMediaType(declared)
+	if declared != "" && declaredType != "application/octet-stream" && !isTextContent(declared) {
+		return t.abort(resp, declaredType)
+	}
+
+	// A body the transport didn't decompress can't be sniffed; go by the
+	// declared type alone
+	if resp.Header.Get("Content-Encoding") != "" && !resp.Uncompressed {
+		return resp, nil
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		resp.Body.Close()
+		return nil, err
+	}
+	head = head[:n]
+
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	switch {
+	case sniffed == "application/octet-stream":
+		// The sniffer couldn't tell; trust a declared text type
+		if declared == "" || declaredType == "application/octet-stream" {
+			return t.abort(resp, sniffed)
+		}
+	case !isTextContent(sniffed):
+		return t.abort(resp, sniffed)
+	}
+
+	// Put the sniffed bytes back in front of the rest of the body
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	return resp, nil
+}
+
+func (t *sniffTransport) abort(resp *http.Response, contentType string) (*http.Response, error) {
+	resp.Body.Close()
+	t.stats.abort(contentType)
+	return nil, &assetSkippedError{contentType: contentType}
+}
+
+// SetAssetFilter stops the crawl from following asset links and aborts
+// downloads that turn out not to be HTML
+func (ac *AdvancedCrawler) SetAssetFilter(cfg AssetFilterConfig) {
+	ac.assets = newAssetFilter(cfg)
+	ac.fetcher = &sniffTransport{next: ac.fetcher, stats: ac.job.assetStats}
+	ac.collector.WithTransport(ac.fetcher)
+}
+
+// skipAsset reports whether a discovered link should be left alone because
+// it points at an asset. Callers hold ac.mu.
+func (ac *AdvancedCrawler) skipAsset(link string) bool {
+	if ac.assets == nil || !ac.assets.isAsset(link) {
+		return false
+	}
+	// Mark it visited so a link repeated on every page is only counted once
+	ac.markVisited(link)
+	ac.job.assetStats.links.Add(1)
+	fmt.Printf("Skipping asset link: %s\n", link)
+	return true
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/fajar/learn-go/crawlengine"
 	"github.com/gin-gonic/gin"
 	"github.com/gocolly/colly"
 	"github.com/gocolly/colly/debug"
@@ -22,6 +26,44 @@ type CrawlRequest struct {
 	Depth     int      `json:"depth"`
 	Parallel  int      `json:"parallel"`
 	Delay     int      `json:"delay"` // delay in seconds
+
+	// Wall-clock limit in seconds; when it passes, the crawl finishes what is in flight and completes (0 = no limit)
+	MaxDuration int `json:"max_duration"`
+
+	// Early-exit mode: stop once this many matching pages are stored (0 = crawl up to max_pages)
+	TargetMatches int     `json:"target_matches"`
+	MinRelevance  float64 `json:"min_relevance"` // fraction of keywords a page must contain to count as a match
+
+	// Connection pooling for the fetcher; omitted fields keep the defaults
+	Transport TransportConfig `json:"transport"`
+
+	// Optional HEAD request before each GET to skip large, binary or unchanged resources
+	Precheck PrecheckConfig `json:"precheck"`
+
+	// Asset links are not followed and non-HTML downloads are aborted unless this is disabled
+	Assets AssetFilterConfig `json:"assets"`
+
+	// Tenant whose retention policy applies to the results (default "default")
+	Tenant string `json:"tenant"`
+
+	// JavaScript rendering through the headless browser service, budgeted per domain
+	Render RenderConfig `json:"render"`
+
+	// Optional start time (RFC 3339); seed domains are prewarmed shortly before it
+	StartAt *time.Time    `json:"start_at"`
+	Prewarm PrewarmConfig `json:"prewarm"`
+
+	// Check every internal link found and report the broken ones
+	LinkCheck LinkCheckConfig `json:"link_check"`
+
+	// Harvest image, video and audio URLs into each result
+	Media MediaConfig `json:"media"`
+
+	// Time-of-day restrictions per domain; URLs are held while their domain's window is closed
+	Windows []CrawlWindow `json:"windows"`
+
+	// Accept-Language per domain, optionally with variants each page is fetched with as well
+	Languages []LanguageConfig `json:"languages"`
 }
 
 // CrawlResult represents a single crawl result
@@ -34,18 +76,40 @@ type CrawlResult struct {
 	Timestamp   time.Time         `json:"timestamp"`
 	StatusCode  int               `json:"status_code"`
 	Metadata    map[string]string `json:"metadata"`
+	Media       []string          `json:"media,omitempty"` // only when media harvesting is enabled
+	Language    string            `json:"language,omitempty"` // language the page was served in, when it says
 }
 
 // CrawlJob represents a crawl job
 type CrawlJob struct {
-	ID           string        `json:"crawl_id"`
-	Status       string        `json:"status"`
-	StartTime    time.Time     `json:"start_time"`
-	EndTime      *time.Time    `json:"end_time,omitempty"`
-	Progress     int           `json:"progress"`
-	TotalResults int           `json:"total_results"`
-	Results      []CrawlResult `json:"results"`
-	mu           sync.RWMutex
+	ID            string        `json:"crawl_id"`
+	Status        string        `json:"status"`
+	StartTime     time.Time     `json:"start_time"`
+	EndTime       *time.Time    `json:"end_time,omitempty"`
+	Progress      int           `json:"progress"`
+	TotalResults  int           `json:"total_results"`
+	Matches       int           `json:"matches"`
+	StopReason    string        `json:"stop_reason,omitempty"`
+	Tenant        string        `json:"tenant"`
+	Tier          string        `json:"tier"` // full, then summary once downsampled
+	DownsampledAt *time.Time    `json:"downsampled_at,omitempty"`
+	Results       []CrawlResult `json:"results"`
+	// Summary records that replace Results once the crawl is downsampled
+	archive       []ArchivedResult
+	entities      *EntityGlossary
+	connStats     *connStats
+	precheckStats *precheckStats
+	assetStats    *assetStats
+	deadline      *time.Time    // set when max_duration is
+	render        *renderBudget // nil unless rendering is enabled
+	dynamic       *dynamicStats // pages whose content is likely built by JavaScript
+	sitemap       []byte        // sitemap.xml, generated when the crawl completes
+	sitemapURLs   int
+	prewarm       *PrewarmReport // set before a scheduled crawl starts fetching
+	links         *linkChecker   // nil unless link checking is enabled
+	windows       *windowGate    // nil unless crawl windows are set
+	languages     *languageTracker // nil unless languages are set
+	mu            sync.RWMutex
 }
 
 // CrawlResponse represents the response structure
@@ -85,23 +149,38 @@ type SummaryResponse struct {
 }
 
 // Global storage for crawl jobs
-var crawlJobs = make(map[string]*CrawlJob)
-var jobsMutex sync.RWMutex
+var crawlJobs = crawlengine.NewJobs[*CrawlJob]()
 
 // AdvancedCrawler represents the advanced crawler with Colly
 type AdvancedCrawler struct {
 	collector     *colly.Collector
 	job           *CrawlJob
 	keywords      []string
+	keywordsLower [][]byte // keywords lowercased once, for matchKeywords
 	maxPages      int
 	pageCount     int
 	mu            sync.Mutex
 	allowedDomains []string
-	visitedURLs   map[string]bool
+	frontier      *crawlengine.Frontier // colly schedules the requests; the frontier only remembers what was visited
+	targetMatches int     // stop after this many matching pages (0 = disabled)
+	minRelevance  float64 // minimum keyword coverage for a page to count as a match
+	stopped       bool    // set once the target is reached; pending requests are aborted
+	maxDuration   time.Duration
+	draining      bool // set once max_duration has passed; new requests are aborted, in-flight pages are still stored
+	halted        context.Context    // done once the crawl stops or drains, which ends its waits early
+	halt          context.CancelFunc // called as stopped or draining is set
+	precheckConfig PrecheckConfig
+	headClient     *http.Client      // shares the fetcher's transport so HEAD and GET reuse connections
+	fetcher        http.RoundTripper // static page fetches, before any rendering
+	assets         *assetFilter      // nil when the asset filter is disabled
+	transport      *http.Transport   // under fetcher; prewarming uses it directly
+	startAt        time.Time         // zero unless the crawl is scheduled
+	prewarmConfig  PrewarmConfig
+	mediaConfig    MediaConfig
 }
 
 // NewAdvancedCrawler creates a new advanced crawler instance
-func NewAdvancedCrawler(domains []string, keywords []string, maxPages, depth, parallel, delay int) *AdvancedCrawler {
+func NewAdvancedCrawler(domains []string, keywords []string, maxPages, depth, parallel, delay int, transport TransportConfig) *AdvancedCrawler {
 	// Expand domains to include www subdomains and vice versa
 	expandedDomains := make([]string, 0, len(domains)*2)
 	for _, domain := range domains {
@@ -140,31 +219,114 @@ func NewAdvancedCrawler(domains []string, keywords []string, maxPages, depth, pa
 
 	// Create crawl job
 	job := &CrawlJob{
-		ID:        uuid.New().String(),
-		Status:    "running",
-		StartTime: time.Now(),
-		Progress:  0,
-		Results:   make([]CrawlResult, 0),
+		ID:            uuid.New().String(),
+		Status:        crawlengine.JobRunning,
+		StartTime:     time.Now(),
+		Progress:      0,
+		Tenant:        defaultTenant,
+		Tier:          tierFull,
+		Results:       make([]CrawlResult, 0),
+		entities:      NewEntityGlossary(),
+		connStats:     &connStats{},
+		precheckStats: &precheckStats{},
+		assetStats:    newAssetStats(),
+		dynamic:       newDynamicStats(),
+	}
+
+	// Tune connection pooling and count how often connections are reused
+	base := newTransport(transport)
+	fetcher := &tracingTransport{
+		next:  base,
+		stats: job.connStats,
 	}
+	c.WithTransport(fetcher)
 
+	halted, halt := context.WithCancel(context.Background())
 	crawler := &AdvancedCrawler{
 		collector:      c,
 		job:            job,
 		keywords:       keywords,
+		keywordsLower:  lowerKeywords(keywords),
 		maxPages:       maxPages,
 		pageCount:      0,
 		allowedDomains: expandedDomains,
-		visitedURLs:    make(map[string]bool),
+		frontier:       crawlengine.NewFrontier(0, 0),
+		headClient:     &http.Client{Transport: fetcher, Timeout: 10 * time.Second},
+		fetcher:        fetcher,
+		transport:      base,
+		halted:         halted,
+		halt:           halt,
 	}
 
 	// Store job globally
-	jobsMutex.Lock()
-	crawlJobs[job.ID] = job
-	jobsMutex.Unlock()
+	crawlJobs.Add(job.ID, job)
 
 	return crawler
 }
 
+// SetTarget enables early-exit mode: the crawl stops as soon as n pages whose
+// keyword relevance is at least minRelevance have been stored
+func (ac *AdvancedCrawler) SetTarget(n int, minRelevance float64) {
+	ac.targetMatches = n
+	ac.minRelevance = minRelevance
+}
+
+// SetMaxDuration limits how long the crawl runs, counted from the job's start
+func (ac *AdvancedCrawler) SetMaxDuration(d time.Duration) {
+	ac.maxDuration = d
+	deadline := ac.job.StartTime.Add(d)
+	ac.job.mu.Lock()
+	ac.job.deadline = &deadline
+	ac.job.mu.Unlock()
+}
+
+// expire runs when max_duration passes. Pages already being fetched are
+// still processed and stored, but no new URLs are queued or fetched.
+func (ac *AdvancedCrawler) expire() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.stopped || ac.draining {
+		return
+	}
+	ac.draining = true
+	ac.halt()
+
+	ac.job.mu.Lock()
+	ac.job.StopReason = "max_duration"
+	ac.job.mu.Unlock()
+	fmt.Printf("Crawl %s reached its max duration of %s, draining in-flight requests\n", ac.job.ID, ac.maxDuration)
+}
+
+// SetPrecheck enables HEAD pre-checks before each GET
+func (ac *AdvancedCrawler) SetPrecheck(cfg PrecheckConfig) {
+	ac.precheckConfig = cfg
+}
+
+// SetRender fetches pages through the headless browser service until their
+// domain's rendering budget runs out, then falls back to static fetches
+func (ac *AdvancedCrawler) SetRender(cfg RenderConfig) {
+	ac.job.render = newRenderBudget(cfg)
+	ac.collector.WithTransport(&renderTransport{
+		next:   ac.fetcher, // static fetches, asset sniffing included
+		budget: ac.job.render,
+	})
+}
+
+// SetTenant assigns the crawl to a tenant for retention
+func (ac *AdvancedCrawler) SetTenant(tenant string) {
+	ac.job.mu.Lock()
+	ac.job.Tenant = tenant
+	ac.job.mu.Unlock()
+}
+
+// relevance returns the fraction of crawl keywords found on a page
+func (ac *AdvancedCrawler) relevance(foundKeywords []string) float64 {
+	if len(ac.keywords) == 0 {
+		return 0
+	}
+	return float64(len(foundKeywords)) / float64(len(ac.keywords))
+}
+
 // isAllowedDomain checks if a URL belongs to one of the allowed domains
 func (ac *AdvancedCrawler) isAllowedDomain(urlStr string) bool {
 	for _, domain := range ac.allowedDomains {
@@ -177,12 +339,12 @@ func (ac *AdvancedCrawler) isAllowedDomain(urlStr string) bool {
 
 // hasVisited checks if a URL has already been visited
 func (ac *AdvancedCrawler) hasVisited(urlStr string) bool {
-	return ac.visitedURLs[urlStr]
+	return ac.frontier.Seen(urlStr)
 }
 
 // markVisited marks a URL as visited
 func (ac *AdvancedCrawler) markVisited(urlStr string) {
-	ac.visitedURLs[urlStr] = true
+	ac.frontier.MarkSeen(urlStr)
 }
 
 // SetupCallbacks sets up the crawler callbacks
@@ -195,6 +357,16 @@ func (ac *AdvancedCrawler) SetupCallbacks() {
 		// Mark this URL as visited first
 		ac.markVisited(e.Request.URL.String())
 
+		if ac.stopped {
+			return
+		}
+
+		// A language variant the site ignored is the page already stored
+		if ac.job.languages != nil && ac.job.languages.identicalVariant(e.Request, contentHash(e.ChildText("body"))) {
+			fmt.Printf("Language variant of %s is identical, skipping\n", e.Request.URL.String())
+			return
+		}
+
 		// Increment page count
 		ac.pageCount++
 		
@@ -209,23 +381,16 @@ func (ac *AdvancedCrawler) SetupCallbacks() {
 		content := e.ChildText("body")
 		
 		// Check if content contains any of the keywords
-		contentLower := strings.ToLower(content)
-		titleLower := strings.ToLower(title)
-		foundKeywords := make([]string, 0)
-		
-		for _, keyword := range ac.keywords {
-			keywordLower := strings.ToLower(keyword)
-			if strings.Contains(contentLower, keywordLower) || strings.Contains(titleLower, keywordLower) {
-				foundKeywords = append(foundKeywords, keyword)
-			}
-		}
+		foundKeywords := ac.matchKeywords(title, content)
+		relevance := ac.relevance(foundKeywords)
+		isMatch := len(foundKeywords) > 0 && relevance >= ac.minRelevance
 
 		// Store all results, but mark which ones contain keywords
 		// This allows us to see what pages are being crawled
 		result := CrawlResult{
 			URL:        e.Request.URL.String(),
 			Title:      title,
-			Content:    content[:min(500, len(content))], // Limit content length
+			Content:    strings.Clone(content[:min(500, len(content))]), // Limit content length; a copy, so the result doesn't keep the whole page alive
 			Domain:     e.Request.URL.Host,
 			Keywords:   foundKeywords, // Will be empty if no keywords found
 			Timestamp:  time.Now(),
@@ -235,15 +400,66 @@ func (ac *AdvancedCrawler) SetupCallbacks() {
 				"method":          "GET",
 				"keywords_found":  fmt.Sprintf("%d", len(foundKeywords)),
 				"content_length":  fmt.Sprintf("%d", len(content)),
+				"relevance":       fmt.Sprintf("%.2f", relevance),
+				"content_hash":    contentHash(content), // full text, kept when results are downsampled
 			},
 		}
+		// Canonical URL and publish/modified dates, used for the sitemap
+		pageMetadata(e, result.Metadata)
+		var source string
+		result.Language, source = negotiatedLanguage(e)
+		if source != "" {
+			result.Metadata["language_source"] = source
+		}
+		if acceptLanguage := e.Request.Headers.Get("Accept-Language"); acceptLanguage != "" {
+			result.Metadata["accept_language"] = acceptLanguage
+		}
+		if ac.job.languages != nil {
+			ac.job.languages.record(e.Request, result.Language, result.Metadata["content_hash"])
+		}
+		if ac.mediaConfig.Enabled {
+			result.Media = harvestMedia(e, ac.mediaConfig.MaxPerPage)
+		}
+		if ac.job.render != nil {
+			result.Metadata["fetch_mode"] = e.Response.Headers.Get(fetchModeHeader)
+			if scriptResults := e.Response.Headers.Get(scriptResultsHeader); scriptResults != "" {
+				mergeScriptResults(scriptResults, result.Metadata)
+			}
+		}
+		// Rendered pages already show their scripted content
+		if e.Response.Headers.Get(fetchModeHeader) != "rendered" {
+			dynamic := detectDynamic(e).likelyDynamic()
+			result.Metadata["likely_dynamic"] = strconv.FormatBool(dynamic)
+			ac.job.dynamic.record(result.Domain, result.URL, dynamic)
+		}
+
+		// Feed the full page text into the crawl's entity glossary
+		ac.job.entities.AddPage(title, content)
 
 		ac.job.mu.Lock()
 		ac.job.Results = append(ac.job.Results, result)
 		ac.job.TotalResults = len(ac.job.Results)
 		ac.job.Progress = (ac.pageCount * 100) / ac.maxPages
+		if isMatch {
+			ac.job.Matches++
+		}
+		if ac.targetMatches > 0 {
+			// In early-exit mode, progress is measured against the target
+			if targetProgress := (ac.job.Matches * 100) / ac.targetMatches; targetProgress > ac.job.Progress {
+				ac.job.Progress = targetProgress
+			}
+			if ac.job.Matches >= ac.targetMatches {
+				ac.stopped = true
+				ac.halt()
+				ac.job.StopReason = "target_reached"
+			}
+		}
 		ac.job.mu.Unlock()
 
+		if ac.stopped {
+			fmt.Printf("Reached target of %d matching pages, stopping crawl\n", ac.targetMatches)
+		}
+
 		fmt.Printf("Stored result #%d: %s (Title: %s, Keywords found: %d, Content length: %d)\n", 
 			len(ac.job.Results), e.Request.URL.String(), title, len(foundKeywords), len(content))
 	})
@@ -257,6 +473,9 @@ func (ac *AdvancedCrawler) SetupCallbacks() {
 			fmt.Printf("Max pages reached (%d), skipping link discovery\n", ac.maxPages)
 			return
 		}
+		if ac.stopped || ac.draining {
+			return
+		}
 
 		link := e.Attr("href")
 		
@@ -265,8 +484,11 @@ func (ac *AdvancedCrawler) SetupCallbacks() {
 			return
 		}
 		
-		// Convert relative URLs to absolute
-		absoluteURL := e.Request.AbsoluteURL(link)
+		// Convert relative URLs to absolute, honouring <base href>
+		absoluteURL := resolveLink(e, link)
+		if absoluteURL == "" {
+			return
+		}
 		
 		// Debug: Print all found links for analysis
 		fmt.Printf("Found link: %s -> %s\n", link, absoluteURL)
@@ -282,6 +504,11 @@ func (ac *AdvancedCrawler) SetupCallbacks() {
 			fmt.Printf("Already visited: %s\n", absoluteURL)
 			return
 		}
+
+		// Images, stylesheets and downloads never have keywords worth finding
+		if ac.skipAsset(absoluteURL) {
+			return
+		}
 		
 		// Skip if it's the same as current URL
 		if absoluteURL == e.Request.URL.String() {
@@ -292,46 +519,134 @@ func (ac *AdvancedCrawler) SetupCallbacks() {
 		// Only follow links that look like article URLs (contain path segments)
 		if strings.Count(absoluteURL, "/") > 3 {
 			fmt.Printf("Following internal link: %s\n", absoluteURL)
-			e.Request.Visit(absoluteURL)
+			ac.visit(e.Request, absoluteURL)
 		} else {
 			fmt.Printf("Skipping homepage-like URL: %s\n", absoluteURL)
 		}
 	})
 
+	// Paginated listings announce their next page in the head
+	ac.collector.OnHTML(`link[rel~="next"][href]`, func(e *colly.HTMLElement) {
+		if next := resolveLink(e, e.Attr("href")); next != "" {
+			ac.followNext(e.Request, next)
+		}
+	})
+
 	// On request
 	ac.collector.OnRequest(func(r *colly.Request) {
+		ac.mu.Lock()
+		stopped := ac.stopped || ac.draining
+		ac.mu.Unlock()
+
+		// Release the remaining budget once the target or the deadline has been reached
+		if stopped {
+			r.Abort()
+			return
+		}
+
+		// Before the pre-check, so HEAD negotiates the same language
+		if ac.job.languages != nil {
+			ac.job.languages.prepare(r)
+		}
+
+		if ac.precheckConfig.Enabled {
+			if reason := ac.precheck(r.URL.String(), *r.Headers); reason != "" {
+				fmt.Printf("Skipping %s after HEAD pre-check: %s\n", r.URL.String(), reason)
+				r.Abort()
+				return
+			}
+		}
 		fmt.Printf("Visiting: %s\n", r.URL.String())
 	})
 
+	// Record links for checking, including ones the crawl won't follow
+	if ac.job.links != nil {
+		ac.collector.OnHTML("a[href]", ac.recordLink)
+	}
+
 	// On error
 	ac.collector.OnError(func(r *colly.Response, err error) {
+		var skipped *assetSkippedError
+		if errors.As(err, &skipped) {
+			fmt.Printf("Aborted download of %s: %s\n", r.Request.URL.String(), skipped)
+			return
+		}
 		fmt.Printf("Error visiting %s: %s\n", r.Request.URL.String(), err.Error())
 	})
 
 	// On response
 	ac.collector.OnResponse(func(r *colly.Response) {
 		fmt.Printf("Response from %s: %d\n", r.Request.URL.String(), r.StatusCode)
+
+		// Remember Last-Modified so later crawls can skip unchanged pages
+		if lastModified := r.Headers.Get("Last-Modified"); lastModified != "" {
+			recordLastModified(r.Request.URL.String(), lastModified)
+		}
+
+		// APIs and some listings announce their next page in a Link header
+		ac.nextFromHeaders(r)
 	})
+
+	// Registered after the "html" callback above, so the page is stored first
+	if ac.job.languages != nil {
+		ac.collector.OnHTML("html", ac.fetchLanguageVariants)
+	}
 }
 
 // Start begins the crawling process
 func (ac *AdvancedCrawler) Start(domains []string) {
+	defer ac.halt()
+	if ac.waitForStart(domains) {
+		ac.crawl(domains)
+	}
+	ac.finish()
+}
+
+// crawl fetches from the seed domains until the crawl is exhausted, stopped
+// or drained, then waits for held URLs and link checks
+func (ac *AdvancedCrawler) crawl(domains []string) {
 	ac.SetupCallbacks()
 
+	if ac.maxDuration > 0 {
+		timer := time.AfterFunc(time.Until(ac.job.StartTime.Add(ac.maxDuration)), ac.expire)
+		defer timer.Stop()
+	}
+
 	// Start crawling from domain homepages
 	for _, domain := range domains {
 		if !strings.HasPrefix(domain, "http") {
 			domain = "https://" + domain
 		}
-		ac.collector.Visit(domain)
+		ac.visit(nil, domain)
 	}
 
-	// Wait for all requests to finish
+	// Wait for all requests to finish, then for URLs held by crawl windows
 	ac.collector.Wait()
+	ac.releaseHeld()
+	if ac.job.links != nil {
+		ac.job.links.wait() // the report is complete when the crawl is
+	}
+}
 
-	// Mark job as completed
+// finish marks the job completed, with why it stopped and its sitemap
+func (ac *AdvancedCrawler) finish() {
 	ac.job.mu.Lock()
-	ac.job.Status = "completed"
+	if ac.job.StopReason == "" {
+		ac.job.StopReason = "crawl_exhausted"
+		if ac.pageCount >= ac.maxPages {
+			ac.job.StopReason = "max_pages"
+		}
+	}
+	if sitemap, urls, err := buildSitemap(ac.job.Results); err != nil {
+		fmt.Printf("Failed to generate sitemap for crawl %s: %v\n", ac.job.ID, err)
+	} else {
+		ac.job.sitemap = sitemap
+		ac.job.sitemapURLs = urls
+	}
+	ac.job.Status = crawlengine.JobCompleted
+	if ac.job.StopReason == "max_duration" {
+		ac.job.Status = crawlengine.JobCompleted + " (time-limited)"
+	}
 	endTime := time.Now()
 	ac.job.EndTime = &endTime
 	ac.job.Progress = 100
@@ -356,6 +671,49 @@ func submitCrawl(c *gin.Context) {
 		return
 	}
 
+	if req.TargetMatches < 0 || req.MinRelevance < 0 || req.MinRelevance > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target_matches must be >= 0 and min_relevance between 0 and 1"})
+		return
+	}
+	if req.Precheck.MaxContentLength < -1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "precheck.max_content_length must be >= -1"})
+		return
+	}
+	if req.Render.MaxPagesPerDomain < 0 || req.Render.MaxSecondsPerDomain < 0 || req.Render.WaitSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "render budgets and wait_seconds must be >= 0"})
+		return
+	}
+	if err := validateRenderScripts(req.Render); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MaxDuration < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_duration must be >= 0"})
+		return
+	}
+	if req.Prewarm.Concurrency < 0 || req.Prewarm.TimeoutSeconds < 0 || req.Prewarm.LeadSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prewarm concurrency, timeout_seconds and lead_seconds must be >= 0"})
+		return
+	}
+	if req.LinkCheck.Concurrency < 0 || req.LinkCheck.TimeoutSeconds < 0 || req.LinkCheck.MaxLinks < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "link_check concurrency, timeout_seconds and max_links must be >= 0"})
+		return
+	}
+	if req.Media.MaxPerPage < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "media.max_per_page must be >= 0"})
+		return
+	}
+	windows, err := parseWindows(req.Windows)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	languages, err := parseLanguages(req.Languages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Set defaults
 	if req.MaxPages == 0 {
 		req.MaxPages = 10
@@ -371,7 +729,40 @@ func submitCrawl(c *gin.Context) {
 	}
 
 	// Create and start crawler in goroutine
-	crawler := NewAdvancedCrawler(req.Domains, req.Keywords, req.MaxPages, req.Depth, req.Parallel, req.Delay)
+	crawler := NewAdvancedCrawler(req.Domains, req.Keywords, req.MaxPages, req.Depth, req.Parallel, req.Delay, req.Transport)
+	if req.TargetMatches > 0 {
+		crawler.SetTarget(req.TargetMatches, req.MinRelevance)
+	}
+	if req.Precheck.Enabled {
+		crawler.SetPrecheck(req.Precheck)
+	}
+	if !req.Assets.Disabled {
+		crawler.SetAssetFilter(req.Assets) // before SetRender, which falls back to the sniffing fetcher
+	}
+	if req.Render.Enabled {
+		crawler.SetRender(req.Render)
+	}
+	if req.StartAt != nil && req.StartAt.After(time.Now()) {
+		crawler.SetSchedule(*req.StartAt, req.Prewarm) // before SetMaxDuration, which counts from the start
+	}
+	if req.MaxDuration > 0 {
+		crawler.SetMaxDuration(time.Duration(req.MaxDuration) * time.Second)
+	}
+	if req.Tenant != "" {
+		crawler.SetTenant(req.Tenant)
+	}
+	if req.LinkCheck.Enabled {
+		crawler.SetLinkCheck(req.LinkCheck)
+	}
+	if req.Media.Enabled {
+		crawler.SetMedia(req.Media)
+	}
+	if len(windows) > 0 {
+		crawler.SetWindows(windows)
+	}
+	if len(languages) > 0 {
+		crawler.SetLanguages(languages)
+	}
 	
 	go crawler.Start(req.Domains)
 
@@ -388,9 +779,7 @@ func getResults(c *gin.Context) {
 	crawlID := c.Param("crawl_id")
 	format := c.Query("format")
 
-	jobsMutex.RLock()
-	job, exists := crawlJobs[crawlID]
-	jobsMutex.RUnlock()
+	job, exists := crawlJobs.Get(crawlID)
 
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Crawl job not found"})
@@ -400,6 +789,20 @@ func getResults(c *gin.Context) {
 	job.mu.RLock()
 	defer job.mu.RUnlock()
 
+	// Downsampled crawls only have summary records left, whatever the format
+	if job.Tier == tierSummary {
+		c.JSON(http.StatusOK, ArchivedResultsResponse{
+			CrawlID:       job.ID,
+			GeneratedAt:   time.Now(),
+			Status:        job.Status,
+			Tier:          job.Tier,
+			DownsampledAt: job.DownsampledAt,
+			TotalResults:  job.TotalResults,
+			Results:       job.archive,
+		})
+		return
+	}
+
 	if format == "summary" {
 		summaryResults := make([]SummaryResult, len(job.Results))
 		for i, result := range job.Results {
@@ -442,9 +845,7 @@ func getResults(c *gin.Context) {
 func getStatus(c *gin.Context) {
 	crawlID := c.Param("crawl_id")
 
-	jobsMutex.RLock()
-	job, exists := crawlJobs[crawlID]
-	jobsMutex.RUnlock()
+	job, exists := crawlJobs.Get(crawlID)
 
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Crawl job not found"})
@@ -459,16 +860,136 @@ func getStatus(c *gin.Context) {
 		"status":        job.Status,
 		"progress":      job.Progress,
 		"total_results": job.TotalResults,
+		"matches":       job.Matches,
 		"start_time":    job.StartTime,
+		"tenant":        job.Tenant,
+		"tier":          job.Tier,
+	}
+
+	if job.StopReason != "" {
+		status["stop_reason"] = job.StopReason
+	}
+
+	if job.deadline != nil {
+		status["deadline"] = *job.deadline
 	}
 
 	if job.EndTime != nil {
 		status["end_time"] = *job.EndTime
 	}
 
+	if job.prewarm != nil {
+		status["prewarm"] = job.prewarm
+	}
+
+	if job.DownsampledAt != nil {
+		status["downsampled_at"] = *job.DownsampledAt
+	}
+
+	if job.sitemap != nil {
+		status["sitemap_urls"] = job.sitemapURLs
+	}
+
 	c.JSON(http.StatusOK, status)
 }
 
+// getSitemap handles GET /api/v1/sitemap/{crawl_id}
+func getSitemap(c *gin.Context) {
+	crawlID := c.Param("crawl_id")
+
+	job, exists := crawlJobs.Get(crawlID)
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Crawl job not found"})
+		return
+	}
+
+	job.mu.RLock()
+	sitemap := job.sitemap
+	job.mu.RUnlock()
+
+	if sitemap == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sitemap is generated when the crawl completes"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="sitemap-%s.xml"`, crawlID))
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", sitemap)
+}
+
+// getStats handles GET /api/v1/stats/{crawl_id}
+func getStats(c *gin.Context) {
+	crawlID := c.Param("crawl_id")
+
+	job, exists := crawlJobs.Get(crawlID)
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Crawl job not found"})
+		return
+	}
+
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l >= 0 {
+			limit = l
+		}
+	}
+
+	entityType := EntityType(c.Query("type"))
+	switch entityType {
+	case "", EntityPerson, EntityOrganization, EntityLocation, EntityMisc:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be one of person, organization, location, misc"})
+		return
+	}
+
+	job.mu.RLock()
+	pagesWithKeywords := 0
+	domains := make(map[string]int)
+	for _, result := range job.Results {
+		if len(result.Keywords) > 0 {
+			pagesWithKeywords++
+		}
+		domains[result.Domain]++
+	}
+	if job.Tier == tierSummary {
+		pagesWithKeywords, domains = archivedStats(job.archive)
+	}
+	stats := gin.H{
+		"crawl_id":            job.ID,
+		"status":              job.Status,
+		"total_results":       job.TotalResults,
+		"pages_with_keywords": pagesWithKeywords,
+		"domains":             domains,
+	}
+	job.mu.RUnlock()
+
+	stats["connections"] = job.connStats.snapshot()
+	stats["precheck"] = job.precheckStats.snapshot()
+	stats["assets"] = job.assetStats.snapshot()
+	if job.render != nil {
+		stats["rendering"] = job.render.snapshot()
+		if len(job.render.cfg.Scripts) > 0 {
+			stats["render_scripts"] = job.render.scriptSnapshot()
+		}
+	}
+	stats["dynamic_content"] = job.dynamic.report()
+	if job.links != nil {
+		stats["links"] = job.links.stats()
+	}
+	if job.windows != nil {
+		stats["crawl_windows"] = job.windows.snapshot(time.Now())
+	}
+	if job.languages != nil {
+		stats["languages"] = job.languages.snapshot()
+	}
+	stats["entity_totals"] = job.entities.TypeTotals()
+	stats["entities"] = job.entities.Top(entityType, limit)
+	stats["generated_at"] = time.Now()
+
+	c.JSON(http.StatusOK, stats)
+}
+
 func main() {
 	// Create Gin router
 	r := gin.Default()
@@ -479,8 +1000,20 @@ func main() {
 		api.POST("/crawl", submitCrawl)
 		api.GET("/results/:crawl_id", getResults)
 		api.GET("/status/:crawl_id", getStatus)
+		api.GET("/stats/:crawl_id", getStats)
+		api.GET("/sitemap/:crawl_id", getSitemap)
+		api.GET("/broken-links/:crawl_id", getBrokenLinks)
+
+		// Retention administration
+		api.GET("/admin/retention", getRetention)
+		api.PUT("/admin/retention/:tenant", putRetentionPolicy)
+		api.DELETE("/admin/retention/:tenant", deleteRetentionPolicy)
+		api.POST("/admin/retention/compact", runCompaction)
 	}
 
+	// Downsample and expire old crawls in the background
+	go runRetention(compactionInterval)
+
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -496,6 +1029,11 @@ func main() {
 	fmt.Println("  GET  /api/v1/results/{crawl_id} - Get crawl results")
 	fmt.Println("  GET  /api/v1/results/{crawl_id}?format=summary - Get summary results")
 	fmt.Println("  GET  /api/v1/status/{crawl_id} - Get crawl status")
+	fmt.Println("  GET  /api/v1/stats/{crawl_id} - Get crawl stats and entity glossary")
+	fmt.Println("  GET  /api/v1/sitemap/{crawl_id} - Download sitemap.xml of a completed crawl")
+	fmt.Println("  GET  /api/v1/admin/retention - Retention policies and compaction metrics")
+	fmt.Println("  PUT  /api/v1/admin/retention/{tenant} - Set a tenant's retention policy")
+	fmt.Println("  POST /api/v1/admin/retention/compact - Run compaction now")
 	fmt.Println("  GET  /health - Health check")
 
 	log.Fatal(http.ListenAndServe(":8082", r))
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gocolly/colly"
+)
+
+// baseContextKey caches a page's resolved <base href> in its request context,
+// so it is looked up once per page rather than once per link
+const baseContextKey = "base_url"
+
+// Elements whose URLs are harvested as media, with the attribute holding the
+// URL. Images with a srcset are handled separately, see harvestMedia.
+var mediaSelectors = []struct {
+	selector, attr string
+}{
+	{`meta[property="og:image"]`, "content"},
+	{`meta[property="og:image:url"]`, "content"},
+	{`link[rel="image_src"]`, "href"},
+	{"video[poster]", "poster"},
+	{"video[src]", "src"},
+	{"video source[src]", "src"},
+	{"audio[src]", "src"},
+	{"audio source[src]", "src"},
+}
+
+// MediaConfig turns on harvesting of image, video and audio URLs from
+// crawled pages. The URLs are stored with each result; the files themselves
+// are never downloaded.
+type MediaConfig struct {
+	Enabled    bool `json:"enabled"`
+	MaxPerPage int  `json:"max_per_page"` // URLs kept per page, default 50
+}
+
+// SetMedia enables media harvesting
+func (ac *AdvancedCrawler) SetMedia(cfg MediaConfig) {
+	if cfg.MaxPerPage <= 0 {
+		cfg.MaxPerPage = 50
+	}
+	ac.mediaConfig = cfg
+}
+
+// documentBase returns the URL that relative links on e's page resolve
+// against: the first <base href>, itself resolved against the page URL, or
+// else the page URL. colly keeps a relative base href such as "/en/" as it
+// is, which leaves every link resolved against it without a host.
+func documentBase(e *colly.HTMLElement) *url.URL {
+	if base, ok := e.Request.Ctx.GetAny(baseContextKey).(*url.URL); ok {
+		return base
+	}
+	base := e.Request.URL
+	if href, ok := e.DOM.Closest("html").Find("base[href]").First().Attr("href"); ok {
+		if u, err := e.Request.URL.Parse(strings.TrimSpace(href)); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			base = u
+		}
+	}
+	e.Request.Ctx.Put(baseContextKey, base)
+	return base
+}
+
+// resolveLink turns an href or src found on e's page into an absolute URL
+// without its fragment. It returns "" for fragment-only references and for
+// anything that isn't http or https (javascript:, mailto:, data: and so on).
+func resolveLink(e *colly.HTMLElement, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return ""
+	}
+	u, err := documentBase(e).Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// linkHeaderTargets returns the targets of a Link header (RFC 8288) that
+// carry the given relation, e.g. the "next" page of a paginated listing.
+// Targets are returned as written; resolve them against the request URL.
+func linkHeaderTargets(values []string, rel string) []string {
+	var targets []string
+	for _, value := range values {
+		for {
+			start := strings.IndexByte(value, '<')
+			end := strings.IndexByte(value, '>')
+			if start < 0 || end < start {
+				break
+			}
+			target, params := value[start+1:end], value[end+1:]
+			value = ""
+			if next := strings.IndexByte(params, '<'); next >= 0 {
+				params, value = params[:next], params[next:]
+			}
+
+			for _, param := range strings.Split(params, ";") {
+				name, relations, _ := strings.Cut(param, "=")
+				if !strings.EqualFold(strings.TrimSpace(name), "rel") {
+					continue
+				}
+				// rel may list several space-separated relations
+				for _, r := range strings.Fields(strings.Trim(strings.TrimSpace(relations), `", `)) {
+					if strings.EqualFold(r, rel) {
+						targets = append(targets, strings.TrimSpace(target))
+					}
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// followNext queues the next page of a paginated listing, announced by a
+// Link header or a <link rel="next">. Pagination URLs are followed even
+// when they look like a homepage, e.g. "/?page=2".
+func (ac *AdvancedCrawler) followNext(r *colly.Request, next string) {
+	ac.mu.Lock()
+	follow := ac.pageCount < ac.maxPages && !ac.stopped && !ac.draining &&
+		ac.isAllowedDomain(next) && !ac.hasVisited(next) && next != r.URL.String() &&
+		!ac.skipAsset(next)
+	ac.mu.Unlock()
+
+	// Visit fetches synchronously and the page's callbacks take ac.mu
+	if follow {
+		fmt.Printf("Following rel=next link: %s\n", next)
+		ac.visit(r, next)
+	}
+}
+
+// nextFromHeaders follows the rel="next" targets of a response's Link headers
+func (ac *AdvancedCrawler) nextFromHeaders(r *colly.Response) {
+	if r.Headers == nil {
+		return
+	}
+	for _, target := range linkHeaderTargets(r.Headers.Values("Link"), "next") {
+		u, err := r.Request.URL.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		u.Fragment = ""
+		ac.followNext(r.Request, u.String())
+	}
+}
+
+// harvestMedia collects the page's image, video and audio URLs, up to limit,
+// resolved against <base href> and without duplicates. An image with a
+// srcset contributes its largest candidate instead of its src, and
+// <picture> sources their largest candidate too.
+func harvestMedia(e *colly.HTMLElement, limit int) []string {
+	seen := make(map[string]bool)
+	var media []string
+	add := func(ref string) {
+		if len(media) >= limit {
+			return
+		}
+		if u := resolveLink(e, ref); u != "" && !seen[u] {
+			seen[u] = true
+			media = append(media, u)
+		}
+	}
+
+	e.ForEach("img", func(_ int, img *colly.HTMLElement) {
+		if src := largestCandidate(img.Attr("srcset")); src != "" {
+			add(src)
+			return
+		}
+		add(img.Attr("src"))
+	})
+	e.ForEach("picture source[srcset]", func(_ int, source *colly.HTMLElement) {
+		add(largestCandidate(source.Attr("srcset")))
+	})
+	for _, s := range mediaSelectors {
+		e.ForEach(s.selector, func(_ int, el *colly.HTMLElement) {
+			add(el.Attr(s.attr))
+		})
+	}
+	return media
+}
+
+// largestCandidate returns the URL of the widest (or densest) candidate in a
+// srcset such as "a.jpg 480w, b.jpg 1080w", or "" when there is none. A
+// candidate without a descriptor counts as 1x.
+func largestCandidate(srcset string) string {
+	var best string
+	var bestWidth, bestDensity float64
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		width, density := 0.0, 1.0
+		if len(fields) > 1 {
+			descriptor := fields[1]
+			value, err := strconv.ParseFloat(descriptor[:len(descriptor)-1], 64)
+			if err != nil {
+				continue
+			}
+			switch descriptor[len(descriptor)-1] {
+			case 'w':
+				width = value
+			case 'x':
+				density = value
+			default:
+				continue
+			}
+		}
+		// Width descriptors say more than densities, so they win when mixed
+		if width > bestWidth || (width == bestWidth && density > bestDensity) {
+			best, bestWidth, bestDensity = fields[0], width, density
+		}
+	}
+	return best
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// EntityType classifies an extracted named entity
+type EntityType string
+
+const (
+	EntityPerson       EntityType = "person"
+	EntityOrganization EntityType = "organization"
+	EntityLocation     EntityType = "location"
+	EntityMisc         EntityType = "misc"
+)
+
+// EntityCount is one row of a crawl's entity frequency table
+type EntityCount struct {
+	Name  string     `json:"name"`
+	Type  EntityType `json:"type"`
+	Count int        `json:"count"` // total mentions across the crawl
+	Pages int        `json:"pages"` // number of pages mentioning the entity
+}
+
+// Dictionaries of well-known entities, keyed by lowercase name. They take
+// precedence over the cue-word heuristics below.
+var (
+	knownPersons = map[string]bool{
+		"joko widodo": true, "jokowi": true, "prabowo subianto": true, "prabowo": true,
+		"gibran rakabuming": true, "anies baswedan": true, "sri mulyani": true,
+		"joe biden": true, "donald trump": true, "elon musk": true, "bill gates": true,
+		"mark zuckerberg": true, "sundar pichai": true, "tim cook": true, "satya nadella": true,
+	}
+	knownOrganizations = map[string]bool{
+		"google": true, "microsoft": true, "apple": true, "amazon": true, "meta": true,
+		"facebook": true, "openai": true, "tesla": true, "nvidia": true, "samsung": true,
+		"gojek": true, "tokopedia": true, "grab": true, "pertamina": true, "telkom": true,
+		"united nations": true, "world bank": true, "imf": true, "asean": true,
+		"kpk": true, "dpr": true, "polri": true, "tni": true, "bank indonesia": true,
+	}
+	knownLocations = map[string]bool{
+		"indonesia": true, "jakarta": true, "bandung": true, "surabaya": true, "bali": true,
+		"medan": true, "yogyakarta": true, "makassar": true, "semarang": true, "java": true,
+		"jawa": true, "sumatra": true, "sumatera": true, "kalimantan": true, "papua": true,
+		"singapore": true, "malaysia": true, "china": true, "japan": true, "india": true,
+		"america": true, "united states": true, "europe": true, "london": true, "tokyo": true,
+		"beijing": true, "washington": true, "new york": true, "australia": true,
+	}
+)
+
+// Cue words that hint at an entity's type when the name is not in a dictionary
+var (
+	personTitles = map[string]bool{
+		"mr": true, "mrs": true, "ms": true, "dr": true, "prof": true, "president": true,
+		"minister": true, "pak": true, "bu": true, "ibu": true, "bapak": true, "presiden": true,
+		"menteri": true, "ceo": true, "governor": true, "gubernur": true,
+	}
+	organizationCues = map[string]bool{
+		"inc": true, "corp": true, "corporation": true, "ltd": true, "llc": true, "co": true,
+		"tbk": true, "pt": true, "company": true, "group": true, "bank": true, "university": true,
+		"universitas": true, "ministry": true, "kementerian": true, "agency": true, "badan": true,
+		"institute": true, "foundation": true, "association": true, "party": true, "partai": true,
+	}
+	locationCues = map[string]bool{
+		"city": true, "kota": true, "province": true, "provinsi": true, "island": true,
+		"pulau": true, "river": true, "sungai": true, "mount": true, "gunung": true,
+		"street": true, "jalan": true, "regency": true, "kabupaten": true, "district": true,
+	}
+	// Lowercase words allowed inside a capitalized run ("Bank of America")
+	entityConnectors = map[string]bool{
+		"of": true, "de": true, "&": true, "van": true, "von": true, "bin": true, "binti": true,
+	}
+	// Capitalized words that start sentences or headlines far more often than
+	// they name anything
+	entityStopwords = map[string]bool{
+		"the": true, "a": true, "an": true, "this": true, "that": true, "these": true,
+		"those": true, "it": true, "its": true, "in": true, "on": true, "at": true,
+		"for": true, "with": true, "we": true, "you": true, "they": true, "he": true,
+		"she": true, "i": true, "our": true, "your": true, "but": true, "and": true,
+		"or": true, "if": true, "when": true, "what": true, "how": true, "why": true,
+		"read": true, "more": true, "home": true, "news": true, "login": true, "share": true,
+		"yang": true, "dan": true, "di": true, "ini": true, "itu": true, "dari": true,
+		"untuk": true, "baca": true, "juga": true, "selengkapnya": true,
+	}
+)
+
+// entityKey identifies an entity independent of its mention counts
+type entityKey struct {
+	Name string
+	Type EntityType
+}
+
+// extractEntities finds named entities in texts using capitalized-sequence
+// heuristics and returns the number of mentions for each one. An entity
+// never runs from one text into the next.
+func extractEntities(texts ...string) map[entityKey]int {
+	mentions := make(map[entityKey]int)
+
+	var run []string
+	flush := func() {
+		// Trailing connectors do not belong to the entity
+		for len(run) > 0 && entityConnectors[strings.ToLower(run[len(run)-1])] {
+			run = run[:len(run)-1]
+		}
+		if len(run) > 0 {
+			if name, typ, ok := classifyEntity(run); ok {
+				mentions[entityKey{Name: name, Type: typ}]++
+			}
+		}
+		run = run[:0]
+	}
+
+	for _, text := range texts {
+		for field := range strings.FieldsSeq(text) {
+			word := strings.TrimFunc(field, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '&'
+			})
+			if word == "" {
+				flush()
+				continue
+			}
+
+			first, _ := utf8.DecodeRuneInString(word)
+			switch {
+			case unicode.IsUpper(first):
+				run = append(run, word)
+			case len(run) > 0 && entityConnectors[word]:
+				run = append(run, word)
+			default:
+				flush()
+			}
+
+			// Sentence punctuation ends the run even if the next word is capitalized
+			if strings.ContainsAny(field[len(field)-1:], ".,;:!?)\"") {
+				flush()
+			}
+		}
+		flush()
+	}
+
+	return mentions
+}
+
+// classifyEntity normalizes a capitalized run and decides its type. It
+// returns false for runs that are unlikely to be names.
+func classifyEntity(words []string) (string, EntityType, bool) {
+	// Strip leading stopwords ("The Jakarta Post" keeps "Jakarta Post")
+	for len(words) > 0 && entityStopwords[strings.ToLower(words[0])] {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return "", "", false
+	}
+
+	// A leading title marks a person but is not part of the name
+	typ := EntityType("")
+	if len(words) > 1 && personTitles[strings.ToLower(words[0])] {
+		typ = EntityPerson
+		words = words[1:]
+	}
+
+	name := strings.Join(words, " ")
+	key := strings.ToLower(name)
+	// Single letters are noise
+	if utf8.RuneCountInString(name) < 2 {
+		return "", "", false
+	}
+
+	switch {
+	case knownPersons[key]:
+		return name, EntityPerson, true
+	case knownOrganizations[key]:
+		return name, EntityOrganization, true
+	case knownLocations[key]:
+		return name, EntityLocation, true
+	case typ != "":
+		return name, typ, true
+	}
+
+	for _, w := range words {
+		lw := strings.ToLower(w)
+		if organizationCues[lw] {
+			return name, EntityOrganization, true
+		}
+		if locationCues[lw] {
+			return name, EntityLocation, true
+		}
+	}
+
+	// Lone capitalized words are usually sentence starts; keep them only if
+	// they look like short acronyms ("OJK", not the shouted "BREAKING")
+	if len(words) == 1 {
+		if isAllCaps(name) && len(name) <= 5 {
+			return name, EntityOrganization, true
+		}
+		return "", "", false
+	}
+
+	return name, EntityMisc, true
+}
+
+// isAllCaps reports whether every letter in s is uppercase
+func isAllCaps(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) && !unicode.IsUpper(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// EntityGlossary accumulates entity frequencies across all pages of a crawl
+type EntityGlossary struct {
+	entries map[entityKey]*EntityCount
+	mu      sync.RWMutex
+}
+
+// NewEntityGlossary creates an empty glossary
+func NewEntityGlossary() *EntityGlossary {
+	return &EntityGlossary{
+		entries: make(map[entityKey]*EntityCount),
+	}
+}
+
+// AddPage extracts entities from a page's texts, such as its title and
+// body, and merges them into the glossary
+func (g *EntityGlossary) AddPage(texts ...string) {
+	mentions := extractEntities(texts...)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for key, count := range mentions {
+		entry, exists := g.entries[key]
+		if !exists {
+			// A one-word name is a slice of the page text; copy it so the
+			// glossary doesn't keep the whole page alive
+			key.Name = strings.Clone(key.Name)
+			entry = &EntityCount{Name: key.Name, Type: key.Type}
+			g.entries[key] = entry
+		}
+		entry.Count += count
+		entry.Pages++
+	}
+}
+
+// Top returns the most frequent entities, optionally filtered by type. A
+// limit of zero or less returns every entity.
+func (g *EntityGlossary) Top(typ EntityType, limit int) []EntityCount {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	entities := make([]EntityCount, 0, len(g.entries))
+	for _, entry := range g.entries {
+		if typ != "" && entry.Type != typ {
+			continue
+		}
+		entities = append(entities, *entry)
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].Count != entities[j].Count {
+			return entities[i].Count > entities[j].Count
+		}
+		if entities[i].Pages != entities[j].Pages {
+			return entities[i].Pages > entities[j].Pages
+		}
+		return entities[i].Name < entities[j].Name
+	})
+
+	if limit > 0 && len(entities) > limit {
+		entities = entities[:limit]
+	}
+	return entities
+}
+
+// TypeTotals returns the number of distinct entities of each type
+func (g *EntityGlossary) TypeTotals() map[EntityType]int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	totals := make(map[EntityType]int)
+	for _, entry := range g.entries {
+		totals[entry.Type]++
+	}
+	return totals
+}
@@ -51,3 +51,7 @@ require (
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/protobuf v1.36.10 // indirect
 )
+
+require github.com/fajar/learn-go v0.0.0-00010101000000-000000000000
+
+replace github.com/fajar/learn-go => ..
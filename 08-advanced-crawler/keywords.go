@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fajar/learn-go/pool"
+)
+
+// lowerKeywords lowercases the crawl's keywords once, instead of on every page
+func lowerKeywords(keywords []string) [][]byte {
+	lower := make([][]byte, len(keywords))
+	for i, keyword := range keywords {
+		lower[i] = []byte(strings.ToLower(keyword))
+	}
+	return lower
+}
+
+// matchKeywords returns the keywords found in a page's title or text,
+// ignoring case. The lowercased page goes into a pooled buffer rather than
+// two new strings per page.
+func (ac *AdvancedCrawler) matchKeywords(title, content string) []string {
+	buf := pool.Get(len(title) + len(content))
+	defer pool.Put(buf)
+
+	lower := appendLower(buf.AvailableBuffer(), title)
+	titleLen := len(lower)
+	lower = appendLower(lower, content)
+	titleLower, contentLower := lower[:titleLen], lower[titleLen:]
+
+	foundKeywords := make([]string, 0)
+	for i, keyword := range ac.keywordsLower {
+		if bytes.Contains(contentLower, keyword) || bytes.Contains(titleLower, keyword) {
+			foundKeywords = append(foundKeywords, ac.keywords[i])
+		}
+	}
+	return foundKeywords
+}
+
+// appendLower appends s lowercased to dst, as strings.ToLower would
+// lowercase it, with a fast path for ASCII
+func appendLower(dst []byte, s string) []byte {
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			dst = append(dst, c)
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		dst = utf8.AppendRune(dst, unicode.ToLower(r))
+		i += size
+	}
+	return dst
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gocolly/colly"
+)
+
+// LanguageConfig sets the Accept-Language a domain, and its subdomains, is
+// crawled with. Sites that negotiate the language serve each page once per
+// variant as well.
+type LanguageConfig struct {
+	Domain         string   `json:"domain"`
+	AcceptLanguage string   `json:"accept_language"` // e.g. "id-ID,id;q=0.9"
+	Variants       []string `json:"variants"`        // more Accept-Language values to fetch each page with, e.g. "en-US,en;q=0.8"
+}
+
+// DomainLanguageStats reports the languages a domain's pages came back in
+type DomainLanguageStats struct {
+	AcceptLanguage    string         `json:"accept_language"`
+	Variants          []string       `json:"variants,omitempty"`
+	Pages             map[string]int `json:"pages"`              // stored results by negotiated language, "" when the page didn't say
+	VariantsFetched   int            `json:"variants_fetched"`   // variant requests queued for pages whose response varies by language
+	VariantsIdentical int            `json:"variants_identical"` // variants with the same text as the primary page, not stored
+}
+
+// languageRange is one entry of an Accept-Language header, e.g. "id;q=0.9"
+var languageRange = regexp.MustCompile(`^(\*|[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*)(\s*;\s*q=(0(\.\d{0,3})?|1(\.0{0,3})?))?$`)
+
+// validAcceptLanguage reports whether s is a well-formed Accept-Language value
+func validAcceptLanguage(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range strings.Split(s, ",") {
+		if !languageRange.MatchString(strings.TrimSpace(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLanguages validates the languages of a crawl request
+func parseLanguages(languages []LanguageConfig) ([]LanguageConfig, error) {
+	parsed := make([]LanguageConfig, 0, len(languages))
+	seen := make(map[string]bool)
+	for _, cfg := range languages {
+		cfg.Domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(cfg.Domain)), "www.")
+		if cfg.Domain == "" {
+			return nil, fmt.Errorf("languages: domain is required")
+		}
+		if seen[cfg.Domain] {
+			return nil, fmt.Errorf("languages: %s is listed more than once", cfg.Domain)
+		}
+		seen[cfg.Domain] = true
+
+		cfg.AcceptLanguage = strings.TrimSpace(cfg.AcceptLanguage)
+		if !validAcceptLanguage(cfg.AcceptLanguage) {
+			return nil, fmt.Errorf("languages: %s: invalid accept_language %q", cfg.Domain, cfg.AcceptLanguage)
+		}
+		variants := make([]string, 0, len(cfg.Variants))
+		for _, v := range cfg.Variants {
+			v = strings.TrimSpace(v)
+			if !validAcceptLanguage(v) {
+				return nil, fmt.Errorf("languages: %s: invalid variant %q", cfg.Domain, v)
+			}
+			if v == cfg.AcceptLanguage || slices.Contains(variants, v) {
+				return nil, fmt.Errorf("languages: %s: variant %q is listed more than once", cfg.Domain, v)
+			}
+			variants = append(variants, v)
+		}
+		cfg.Variants = variants
+		parsed = append(parsed, cfg)
+	}
+	return parsed, nil
+}
+
+// negotiatedLanguage returns the language a page was served in and where
+// that came from: the Content-Language header, or the lang attribute of
+// the page's <html> element
+func negotiatedLanguage(e *colly.HTMLElement) (lang, source string) {
+	if header := e.Response.Headers.Get("Content-Language"); header != "" {
+		// A page in several languages lists them all; the first is the main one
+		first, _, _ := strings.Cut(header, ",")
+		if first = strings.TrimSpace(first); first != "" {
+			return first, "content-language"
+		}
+	}
+	if lang := strings.TrimSpace(e.Attr("lang")); lang != "" {
+		return lang, "html-lang"
+	}
+	return "", ""
+}
+
+// variesByLanguage reports whether a response depends on Accept-Language.
+// Sites that ignore the header rarely send either signal, so their pages
+// aren't fetched again per variant.
+func variesByLanguage(headers *http.Header) bool {
+	if headers.Get("Content-Language") != "" {
+		return true
+	}
+	for _, vary := range headers.Values("Vary") {
+		for _, field := range strings.Split(vary, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Language") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// languageTracker applies the per-domain languages of one crawl and
+// decides which pages are fetched again per variant
+type languageTracker struct {
+	mu       sync.Mutex
+	configs  []LanguageConfig
+	primary  map[string]string // content hash of each page fetched with its domain's accept_language, by URL
+	expanded map[string]bool   // URLs whose variants have been queued, to queue them once
+	stats    map[string]*DomainLanguageStats
+}
+
+func newLanguageTracker(configs []LanguageConfig) *languageTracker {
+	stats := make(map[string]*DomainLanguageStats, len(configs))
+	for _, cfg := range configs {
+		stats[cfg.Domain] = &DomainLanguageStats{
+			AcceptLanguage: cfg.AcceptLanguage,
+			Variants:       cfg.Variants,
+			Pages:          make(map[string]int),
+		}
+	}
+	return &languageTracker{
+		configs:  configs,
+		primary:  make(map[string]string),
+		expanded: make(map[string]bool),
+		stats:    stats,
+	}
+}
+
+// configFor returns the languages of host, the most specific ones when a
+// domain and its subdomain both have them
+func (t *languageTracker) configFor(host string) (LanguageConfig, bool) {
+	host = strings.ToLower(host)
+	var best LanguageConfig
+	found := false
+	for _, cfg := range t.configs {
+		if (host == cfg.Domain || strings.HasSuffix(host, "."+cfg.Domain)) &&
+			(!found || len(cfg.Domain) > len(best.Domain)) {
+			best, found = cfg, true
+		}
+	}
+	return best, found
+}
+
+// prepare sets the Accept-Language of a request to its domain's, unless the
+// request is a variant that already carries one
+func (t *languageTracker) prepare(r *colly.Request) {
+	if r.Headers.Get("Accept-Language") != "" {
+		return
+	}
+	if cfg, ok := t.configFor(r.URL.Hostname()); ok {
+		r.Headers.Set("Accept-Language", cfg.AcceptLanguage)
+	}
+}
+
+// identicalVariant reports whether r is a variant request whose page has
+// the same text, by hash, as the page fetched with the domain's
+// accept_language. The site ignored the variant, so it isn't stored.
+func (t *languageTracker) identicalVariant(r *colly.Request, hash string) bool {
+	cfg, ok := t.configFor(r.URL.Hostname())
+	requested := r.Headers.Get("Accept-Language")
+	if !ok || requested == cfg.AcceptLanguage {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.primary[r.URL.String()] != hash {
+		return false
+	}
+	t.stats[cfg.Domain].VariantsIdentical++
+	return true
+}
+
+// record counts a stored result by its negotiated language and remembers
+// the text of primary pages for identicalVariant
+func (t *languageTracker) record(r *colly.Request, language, hash string) {
+	cfg, ok := t.configFor(r.URL.Hostname())
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats[cfg.Domain].Pages[language]++
+	if r.Headers.Get("Accept-Language") == cfg.AcceptLanguage {
+		t.primary[r.URL.String()] = hash
+	}
+}
+
+// variantsFor returns the Accept-Language values to fetch a page again
+// with: none unless it is a stored primary page whose response varies by
+// language, and each page's variants only once
+func (t *languageTracker) variantsFor(r *colly.Request, headers *http.Header) []string {
+	cfg, ok := t.configFor(r.URL.Hostname())
+	if !ok || len(cfg.Variants) == 0 || r.Headers.Get("Accept-Language") != cfg.AcceptLanguage {
+		return nil
+	}
+	if !variesByLanguage(headers) {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := r.URL.String()
+	if _, stored := t.primary[u]; !stored || t.expanded[u] {
+		return nil
+	}
+	t.expanded[u] = true
+	t.stats[cfg.Domain].VariantsFetched += len(cfg.Variants)
+	return cfg.Variants
+}
+
+// snapshot returns each domain's language stats, keyed by domain
+func (t *languageTracker) snapshot() map[string]DomainLanguageStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := make(map[string]DomainLanguageStats, len(t.stats))
+	for domain, s := range t.stats {
+		c := *s
+		c.Pages = make(map[string]int, len(s.Pages))
+		for lang, n := range s.Pages {
+			c.Pages[lang] = n
+		}
+		stats[domain] = c
+	}
+	return stats
+}
+
+// SetLanguages sends each domain's Accept-Language and fetches its pages
+// once per variant
+func (ac *AdvancedCrawler) SetLanguages(languages []LanguageConfig) {
+	ac.job.languages = newLanguageTracker(languages)
+}
+
+// fetchLanguageVariants fetches a page again with each of its domain's
+// variants. It runs after the page is stored, so identicalVariant can
+// compare against it. colly's visited store refuses a second GET of the
+// same URL, so each variant is a retry of a copy of the request, with its
+// own headers.
+func (ac *AdvancedCrawler) fetchLanguageVariants(e *colly.HTMLElement) {
+	ac.mu.Lock()
+	done := ac.stopped || ac.draining || ac.pageCount >= ac.maxPages
+	ac.mu.Unlock()
+	if done {
+		return
+	}
+
+	for _, v := range ac.job.languages.variantsFor(e.Request, e.Response.Headers) {
+		hdr := e.Request.Headers.Clone()
+		hdr.Set("Accept-Language", v)
+		variant := *e.Request
+		variant.Headers = &hdr
+		fmt.Printf("Fetching %s again with Accept-Language: %s\n", e.Request.URL.String(), v)
+		if err := variant.Retry(); err != nil {
+			fmt.Printf("Failed to queue language variant of %s: %v\n", e.Request.URL.String(), err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocolly/colly"
+)
+
+// maxLinkSources caps how many linking pages are kept per target; a broken
+// link in the site footer would otherwise be listed once per page
+const maxLinkSources = 50
+
+// LinkCheckConfig turns the crawl into a link checker: every internal link
+// found on a crawled page is requested once and its status recorded
+type LinkCheckConfig struct {
+	Enabled        bool `json:"enabled"`
+	Concurrency    int  `json:"concurrency"`     // links checked at once, default 4
+	TimeoutSeconds int  `json:"timeout_seconds"` // per link, default 10
+	MaxLinks       int  `json:"max_links"`       // distinct targets checked, default 5000
+}
+
+// LinkStats summarizes a crawl's link checks
+type LinkStats struct {
+	Targets int            `json:"targets"` // distinct internal links found
+	Checked int            `json:"checked"`
+	Pending int            `json:"pending"`
+	Skipped int            `json:"skipped"` // found after max_links was reached
+	Broken  int            `json:"broken"`  // 4xx, 5xx or no response
+	ByClass map[string]int `json:"by_class"`
+}
+
+// BrokenLink is one row of the broken-links report
+type BrokenLink struct {
+	SourcePage string `json:"source_page"`
+	AnchorText string `json:"anchor_text"`
+	Target     string `json:"target"`
+	Status     int    `json:"status"` // 0 when there was no response
+	Error      string `json:"error,omitempty"`
+}
+
+// linkSource is a page linking to a target, with the link's text
+type linkSource struct {
+	page, anchor string
+}
+
+// linkTarget is what is known about one link target
+type linkTarget struct {
+	sources []linkSource
+	checked bool
+	status  int
+	err     string
+}
+
+// broken reports whether a checked link failed: no response, or a 4xx or 5xx
+func (t *linkTarget) broken() bool {
+	return t.checked && (t.status == 0 || t.status >= 400)
+}
+
+// statusClass buckets a status as 2xx, 3xx, 4xx, 5xx or error
+func (t *linkTarget) statusClass() string {
+	if t.status == 0 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", t.status/100)
+}
+
+// linkChecker checks link targets in the background while the crawl runs
+type linkChecker struct {
+	cfg       LinkCheckConfig
+	client    *http.Client
+	userAgent string
+	sem       chan struct{}
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	targets map[string]*linkTarget
+	skipped int
+}
+
+// SetLinkCheck enables link checking. Checks go through the crawl's base
+// transport, so they reuse its connections without showing up in its
+// connection stats, and redirects are recorded rather than followed.
+func (ac *AdvancedCrawler) SetLinkCheck(cfg LinkCheckConfig) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 4
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 10
+	}
+	if cfg.MaxLinks <= 0 {
+		cfg.MaxLinks = 5000
+	}
+
+	lc := &linkChecker{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: ac.transport,
+			Timeout:   time.Duration(cfg.TimeoutSeconds) * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		userAgent: ac.collector.UserAgent,
+		sem:       make(chan struct{}, cfg.Concurrency),
+		targets:   make(map[string]*linkTarget),
+	}
+	ac.job.mu.Lock()
+	ac.job.links = lc
+	ac.job.mu.Unlock()
+}
+
+// recordLink is an a[href] callback, registered next to the one that
+// follows links. It sees every internal link, including ones the crawl
+// won't follow: assets, pages already visited and pages past max_pages.
+func (ac *AdvancedCrawler) recordLink(e *colly.HTMLElement) {
+	link := e.Attr("href")
+	if link == "" || strings.HasPrefix(link, "#") || strings.HasPrefix(link, "javascript:") || strings.HasPrefix(link, "mailto:") || strings.HasPrefix(link, "tel:") {
+		return
+	}
+	target, err := url.Parse(resolveLink(e, link))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return
+	}
+	target.Fragment = ""
+	if !ac.isAllowedDomain(target.String()) {
+		return
+	}
+
+	anchor := strings.Join(strings.Fields(e.Text), " ")
+	if anchor == "" {
+		anchor = e.ChildAttr("img", "alt") // image links
+	}
+	if len(anchor) > 200 {
+		anchor = anchor[:200]
+	}
+	ac.job.links.add(e.Request.URL.String(), anchor, target.String())
+}
+
+// add records a link from page to target, checking target the first time it is seen
+func (lc *linkChecker) add(page, anchor, target string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	t, seen := lc.targets[target]
+	if !seen {
+		if len(lc.targets) >= lc.cfg.MaxLinks {
+			lc.skipped++
+			return
+		}
+		t = &linkTarget{}
+		lc.targets[target] = t
+		lc.wg.Add(1)
+		go lc.check(target)
+	}
+	if len(t.sources) >= maxLinkSources {
+		return
+	}
+	for _, src := range t.sources {
+		if src.page == page {
+			return // the same link twice on a page, e.g. in the header and footer
+		}
+	}
+	t.sources = append(t.sources, linkSource{page: page, anchor: anchor})
+}
+
+// check requests target with HEAD, falling back to GET for servers that
+// don't allow HEAD
+func (lc *linkChecker) check(target string) {
+	defer lc.wg.Done()
+	lc.sem <- struct{}{}
+	defer func() { <-lc.sem }()
+
+	status, err := lc.request(http.MethodHead, target)
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		status, err = lc.request(http.MethodGet, target)
+	}
+
+	lc.mu.Lock()
+	t := lc.targets[target]
+	t.checked = true
+	t.status = status
+	if err != nil {
+		t.err = err.Error()
+	}
+	broken := t.broken()
+	lc.mu.Unlock()
+	if broken {
+		fmt.Printf("Broken link: %s (status %d)\n", target, status)
+	}
+}
+
+func (lc *linkChecker) request(method, target string) (int, error) {
+	req, err := http.NewRequestWithContext(context.Background(), method, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", lc.userAgent)
+	resp, err := lc.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close() // only the status matters
+	return resp.StatusCode, nil
+}
+
+// wait blocks until every link found so far has been checked
+func (lc *linkChecker) wait() {
+	lc.wg.Wait()
+}
+
+// stats returns the current counts
+func (lc *linkChecker) stats() LinkStats {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	stats := LinkStats{Targets: len(lc.targets), Skipped: lc.skipped, ByClass: make(map[string]int)}
+	for _, t := range lc.targets {
+		if !t.checked {
+			stats.Pending++
+			continue
+		}
+		stats.Checked++
+		stats.ByClass[t.statusClass()]++
+		if t.broken() {
+			stats.Broken++
+		}
+	}
+	return stats
+}
+
+// brokenLinks lists every broken link once per linking page, by target
+func (lc *linkChecker) brokenLinks() []BrokenLink {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var rows []BrokenLink
+	for target, t := range lc.targets {
+		if !t.broken() {
+			continue
+		}
+		for _, src := range t.sources {
+			rows = append(rows, BrokenLink{SourcePage: src.page, AnchorText: src.anchor, Target: target, Status: t.status, Error: t.err})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Target != rows[j].Target {
+			return rows[i].Target < rows[j].Target
+		}
+		return rows[i].SourcePage < rows[j].SourcePage
+	})
+	return rows
+}
+
+// getBrokenLinks handles GET /api/v1/broken-links/{crawl_id}. The report
+// is available while the crawl runs; ?format=csv downloads it as a file.
+func getBrokenLinks(c *gin.Context) {
+	crawlID := c.Param("crawl_id")
+
+	job, exists := crawlJobs.Get(crawlID)
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Crawl job not found"})
+		return
+	}
+
+	job.mu.RLock()
+	links, status := job.links, job.Status
+	job.mu.RUnlock()
+
+	if links == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Link checking was not enabled for this crawl"})
+		return
+	}
+
+	rows := links.brokenLinks()
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{
+			"crawl_id":     crawlID,
+			"status":       status,
+			"generated_at": time.Now(),
+			"summary":      links.stats(),
+			"broken_links": rows,
+		})
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="broken-links-%s.csv"`, crawlID))
+		c.Status(http.StatusOK)
+		writeBrokenLinksCSV(c.Writer, rows)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+	}
+}
+
+func writeBrokenLinksCSV(w io.Writer, rows []BrokenLink) {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"source_page", "anchor_text", "target", "status", "error"})
+	for _, r := range rows {
+		_ = cw.Write([]string{r.SourcePage, r.AnchorText, r.Target, strconv.Itoa(r.Status), r.Error})
+	}
+	cw.Flush()
+}
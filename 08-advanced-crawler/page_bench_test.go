@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Benchmarks for the per-page work in the OnHTML callback. Run with:
+// go test -run '^$' -bench . -benchmem
+
+var (
+	benchTitle   = "Bank Indonesia Holds Rates Steady | The Jakarta Post"
+	benchContent = strings.Repeat("Governor Perry Warjiyo said on Tuesday that Bank Indonesia will keep its benchmark rate at 6 percent, citing inflation in Jakarta and pressure on the rupiah. ", 400) // ~60 KB
+)
+
+func BenchmarkMatchKeywords(b *testing.B) {
+	keywords := []string{"Inflation", "rupiah", "Bond Yields", "OJK"}
+	ac := &AdvancedCrawler{keywords: keywords, keywordsLower: lowerKeywords(keywords)}
+	b.ReportAllocs()
+	for b.Loop() {
+		ac.matchKeywords(benchTitle, benchContent)
+	}
+}
+
+func BenchmarkEntityGlossaryAddPage(b *testing.B) {
+	g := NewEntityGlossary()
+	b.ReportAllocs()
+	for b.Loop() {
+		g.AddPage(benchTitle, benchContent)
+	}
+}
+
+func BenchmarkContentHash(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		contentHash(benchContent)
+	}
+}
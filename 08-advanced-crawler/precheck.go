@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PrecheckConfig enables a HEAD request before each GET so resources that
+// would be thrown away anyway are never downloaded
+type PrecheckConfig struct {
+	Enabled          bool  `json:"enabled"`
+	MaxContentLength int64 `json:"max_content_length"` // bytes, default 5 MB; -1 disables the size check
+	AllowBinary      bool  `json:"allow_binary"`       // fetch non-text content types too
+	AllowUnchanged   bool  `json:"allow_unchanged"`    // fetch pages whose Last-Modified hasn't moved since an earlier crawl
+}
+
+// PrecheckStats reports what the HEAD pre-checks saved
+type PrecheckStats struct {
+	HeadRequests     int64 `json:"head_requests"`
+	HeadFailed       int64 `json:"head_failed"` // HEAD errored or was refused; the GET went ahead
+	SkippedTooLarge  int64 `json:"skipped_too_large"`
+	SkippedBinary    int64 `json:"skipped_binary"`
+	SkippedUnchanged int64 `json:"skipped_unchanged"`
+}
+
+// precheckStats holds the live counters behind PrecheckStats
+type precheckStats struct {
+	requests, failed, tooLarge, binary, unchanged atomic.Int64
+}
+
+// snapshot returns the current counters
+func (s *precheckStats) snapshot() PrecheckStats {
+	return PrecheckStats{
+		HeadRequests:     s.requests.Load(),
+		HeadFailed:       s.failed.Load(),
+		SkippedTooLarge:  s.tooLarge.Load(),
+		SkippedBinary:    s.binary.Load(),
+		SkippedUnchanged: s.unchanged.Load(),
+	}
+}
+
+// Last-Modified values seen by earlier crawls, keyed by URL. Shared across
+// jobs so a re-crawl can skip pages that haven't changed.
+var lastModifiedSeen = make(map[string]time.Time)
+var lastModifiedMutex sync.RWMutex
+
+// recordLastModified remembers a page's Last-Modified header
+func recordLastModified(url, header string) {
+	modified, err := http.ParseTime(header)
+	if err != nil {
+		return
+	}
+	lastModifiedMutex.Lock()
+	lastModifiedSeen[url] = modified
+	lastModifiedMutex.Unlock()
+}
+
+// precheck issues a HEAD request for url and returns a non-empty reason when
+// the GET should be skipped. Any HEAD failure lets the GET go ahead.
+func (ac *AdvancedCrawler) precheck(url string, header http.Header) string {
+	cfg := ac.precheckConfig
+	stats := ac.job.precheckStats
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		stats.failed.Add(1)
+		return ""
+	}
+	req.Header.Set("User-Agent", header.Get("User-Agent"))
+
+	stats.requests.Add(1)
+	resp, err := ac.headClient.Do(req)
+	if err != nil {
+		stats.failed.Add(1)
+		return ""
+	}
+	resp.Body.Close()
+
+	// Some servers don't implement HEAD; fall back to a normal fetch
+	if resp.StatusCode >= 400 {
+		stats.failed.Add(1)
+		return ""
+	}
+
+	maxLength := cfg.MaxContentLength
+	if maxLength == 0 {
+		maxLength = 5 << 20
+	}
+	if maxLength > 0 && resp.ContentLength > maxLength {
+		stats.tooLarge.Add(1)
+		return fmt.Sprintf("content length %d exceeds %d", resp.ContentLength, maxLength)
+	}
+
+	if !cfg.AllowBinary {
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" && !isTextContent(contentType) {
+			stats.binary.Add(1)
+			return "content type " + contentType
+		}
+	}
+
+	if !cfg.AllowUnchanged {
+		if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			lastModifiedMutex.RLock()
+			seen, ok := lastModifiedSeen[url]
+			lastModifiedMutex.RUnlock()
+			if ok && !modified.After(seen) {
+				stats.unchanged.Add(1)
+				return "not modified since " + seen.Format(time.RFC1123)
+			}
+		}
+	}
+
+	return ""
+}
+
+// isTextContent reports whether a Content-Type is something the HTML parser can use
+func isTextContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/xml" ||
+		mediaType == "application/json"
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/sleep"
+	"github.com/fajar/learn-go/crawlengine"
+)
+
+// dnsCacheTTL is how long a lookup is reused. Go's resolver doesn't cache,
+// so without this every new connection would look the host up again.
+const dnsCacheTTL = 5 * time.Minute
+
+// PrewarmConfig controls prewarming for crawls scheduled with start_at.
+// Shortly before the start, each seed domain is looked up and a connection
+// (TCP and TLS) is opened, so the crawl begins on warm connections.
+type PrewarmConfig struct {
+	Disabled       bool `json:"disabled"`
+	Concurrency    int  `json:"concurrency"`     // domains warmed at once, default 4
+	TimeoutSeconds int  `json:"timeout_seconds"` // per domain, default 10
+	LeadSeconds    int  `json:"lead_seconds"`    // how long before start_at to begin, default 30; keep it under the idle connection timeout
+}
+
+// PrewarmResult is what prewarming found for one seed domain
+type PrewarmResult struct {
+	Domain    string   `json:"domain"`
+	Addresses []string `json:"addresses,omitempty"`
+	DNSMs     int64    `json:"dns_ms"`
+	ConnectMs int64    `json:"connect_ms"` // TCP connect plus TLS handshake
+	Error     string   `json:"error,omitempty"`
+}
+
+// PrewarmReport is attached to a scheduled crawl before it starts fetching
+type PrewarmReport struct {
+	StartedAt   time.Time       `json:"started_at"`
+	DurationMs  int64           `json:"duration_ms"`
+	Warmed      int             `json:"warmed"`
+	Unreachable []string        `json:"unreachable"` // seeds that failed to resolve or connect; still crawled
+	Domains     []PrewarmResult `json:"domains"`
+}
+
+// dnsCache is shared by every crawl's fetcher, so lookups made while
+// prewarming are the ones the crawl uses
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+var sharedDNS = &dnsCache{entries: make(map[string]dnsEntry)}
+
+// lookup resolves host, reusing a cached answer until it expires
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(dnsCacheTTL)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// dialContext dials through the cache, trying each address in turn
+func (c *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, ip := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// SetSchedule holds the crawl until startAt. Its seed domains are
+// prewarmed shortly before, unless cfg disables it.
+func (ac *AdvancedCrawler) SetSchedule(startAt time.Time, cfg PrewarmConfig) {
+	ac.startAt = startAt
+	ac.prewarmConfig = cfg
+
+	ac.job.mu.Lock()
+	ac.job.Status = "scheduled"
+	ac.job.StartTime = startAt
+	ac.job.mu.Unlock()
+}
+
+// waitForStart blocks until a scheduled crawl's start time, prewarming on
+// the way, and reports whether the crawl should go ahead: false if it was
+// stopped or started draining while it waited. Crawls submitted without
+// start_at return true at once.
+func (ac *AdvancedCrawler) waitForStart(domains []string) bool {
+	if ac.startAt.IsZero() {
+		return true
+	}
+
+	if !ac.prewarmConfig.Disabled {
+		lead := time.Duration(ac.prewarmConfig.LeadSeconds) * time.Second
+		if lead == 0 {
+			lead = 30 * time.Second
+		}
+		if sleep.Until(ac.halted, time.Until(ac.startAt.Add(-lead))) != nil {
+			return false
+		}
+
+		report := ac.prewarm(domains)
+		ac.job.mu.Lock()
+		ac.job.prewarm = report
+		ac.job.mu.Unlock()
+		fmt.Printf("Prewarmed crawl %s: %d of %d domains ready in %dms, unreachable: %v\n",
+			ac.job.ID, report.Warmed, len(report.Domains), report.DurationMs, report.Unreachable)
+	}
+
+	if sleep.Until(ac.halted, time.Until(ac.startAt)) != nil {
+		return false
+	}
+
+	// Checked under ac.mu, which stop and drain are set under, so a stop
+	// racing the end of the wait isn't missed
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.stopped || ac.draining {
+		return false
+	}
+	ac.setStatus(crawlengine.JobRunning)
+	return true
+}
+
+// prewarm resolves and connects to every seed domain, a few at a time so
+// the burst doesn't look like an attack. Connections go through the crawl's
+// own transport, so they wait in its idle pool and their TLS sessions in
+// its session cache.
+func (ac *AdvancedCrawler) prewarm(domains []string) *PrewarmReport {
+	concurrency := ac.prewarmConfig.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	timeout := time.Duration(ac.prewarmConfig.TimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	report := &PrewarmReport{StartedAt: time.Now(), Domains: make([]PrewarmResult, len(domains))}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			report.Domains[i] = ac.prewarmDomain(domain, timeout)
+		}()
+	}
+	wg.Wait()
+
+	report.Unreachable = []string{}
+	for _, r := range report.Domains {
+		if r.Error != "" {
+			report.Unreachable = append(report.Unreachable, r.Domain)
+		} else {
+			report.Warmed++
+		}
+	}
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+	return report
+}
+
+// prewarmDomain looks the seed up and sends a HEAD request to it. The
+// response is thrown away; the pooled connection is what's kept.
+func (ac *AdvancedCrawler) prewarmDomain(domain string, timeout time.Duration) PrewarmResult {
+	seed := domain
+	if !strings.HasPrefix(seed, "http") {
+		seed = "https://" + seed
+	}
+	result := PrewarmResult{Domain: domain}
+	u, err := url.Parse(seed)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// Abandoned, like the wait around it, if the crawl stops meanwhile
+	ctx, cancel := context.WithTimeout(ac.halted, timeout)
+	defer cancel()
+
+	start := time.Now()
+	addrs, err := sharedDNS.lookup(ctx, u.Hostname())
+	result.DNSMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = "dns: " + err.Error()
+		return result
+	}
+	result.Addresses = addrs
+
+	var connectStart time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			if !connectStart.IsZero() {
+				result.ConnectMs = time.Since(connectStart).Milliseconds()
+			}
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, seed, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("User-Agent", ac.collector.UserAgent)
+
+	// The base transport, so prewarming doesn't show up in the crawl's stats
+	resp, err := ac.transport.RoundTrip(req)
+	if err != nil {
+		result.Error = "connect: " + err.Error()
+		return result
+	}
+	resp.Body.Close()
+	if result.ConnectMs == 0 && !connectStart.IsZero() {
+		result.ConnectMs = time.Since(connectStart).Milliseconds() // plain HTTP
+	}
+	return result
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/pool"
+)
+
+// RenderConfig enables JavaScript rendering through the headless browser
+// service. Each domain gets its own budget, so one SPA-heavy domain can't
+// hold the shared browser pool for the whole crawl.
+type RenderConfig struct {
+	Enabled             bool    `json:"enabled"`
+	MaxPagesPerDomain   int     `json:"max_pages_per_domain"`   // default 25
+	MaxSecondsPerDomain float64 `json:"max_seconds_per_domain"` // total render time, default 120
+	WaitSeconds         float64 `json:"wait_seconds"`           // time a page gets to run its scripts, default 0.5
+
+	// Custom scripts run against each rendered page, see renderscripts.go
+	Scripts              []RenderScript `json:"scripts"`
+	ScriptTimeoutSeconds float64        `json:"script_timeout_seconds"`  // all of a page's scripts together, default 2
+	MaxScriptResultBytes int            `json:"max_script_result_bytes"` // per script, default 4096
+}
+
+// DomainRenderStats reports how much of its rendering budget a domain used
+type DomainRenderStats struct {
+	Rendered        int64      `json:"rendered"`
+	RenderSeconds   float64    `json:"render_seconds"`
+	RenderErrors    int64      `json:"render_errors"`  // the renderer failed and the page was fetched statically
+	StaticFetches   int64      `json:"static_fetches"` // pages fetched statically after the downgrade
+	Downgraded      bool       `json:"downgraded"`
+	DowngradeReason string     `json:"downgrade_reason,omitempty"` // max_pages or max_seconds
+	DowngradedAt    *time.Time `json:"downgraded_at,omitempty"`
+}
+
+// fetchModeHeader tells the HTML callback whether a page was rendered
+const fetchModeHeader = "X-Crawler-Fetch-Mode"
+
+// renderServiceURL is a Splash-compatible render.html endpoint
+var renderServiceURL = envString("RENDER_SERVICE_URL", "http://localhost:8050/render.html")
+
+// renderPool caps concurrent renders across all crawls at the browser pool's size
+var renderPool = make(chan struct{}, envInt("RENDER_POOL_SIZE", 4))
+
+// renderClient talks to the render service; each render also has a deadline
+// from its domain's remaining budget
+var renderClient = &http.Client{Timeout: 90 * time.Second}
+
+func envString(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// domainRender is one domain's budget usage
+type domainRender struct {
+	stats    DomainRenderStats
+	elapsed  time.Duration
+	inFlight int
+}
+
+// renderBudget tracks every domain's rendering budget for one crawl
+type renderBudget struct {
+	cfg     RenderConfig
+	harness string // the scripts wrapped for the render service, empty without scripts
+	mu      sync.Mutex
+	domains map[string]*domainRender
+	scripts map[string]*RenderScriptStats
+}
+
+func newRenderBudget(cfg RenderConfig) *renderBudget {
+	if cfg.MaxPagesPerDomain == 0 {
+		cfg.MaxPagesPerDomain = 25
+	}
+	if cfg.MaxSecondsPerDomain == 0 {
+		cfg.MaxSecondsPerDomain = 120
+	}
+	if cfg.WaitSeconds == 0 {
+		cfg.WaitSeconds = 0.5
+	}
+	if cfg.ScriptTimeoutSeconds == 0 {
+		cfg.ScriptTimeoutSeconds = 2
+	}
+	if cfg.MaxScriptResultBytes == 0 {
+		cfg.MaxScriptResultBytes = 4096
+	}
+
+	b := &renderBudget{cfg: cfg, domains: make(map[string]*domainRender), scripts: make(map[string]*RenderScriptStats)}
+	if len(cfg.Scripts) > 0 {
+		b.harness = scriptHarness(cfg)
+		for _, script := range cfg.Scripts {
+			b.scripts[script.Name] = &RenderScriptStats{}
+		}
+	}
+	return b
+}
+
+func (b *renderBudget) domain(host string) *domainRender {
+	d, ok := b.domains[host]
+	if !ok {
+		d = &domainRender{}
+		b.domains[host] = d
+	}
+	return d
+}
+
+// downgrade switches a domain to static fetching for the rest of the crawl.
+// Called with b.mu held.
+func (b *renderBudget) downgrade(host string, d *domainRender, reason string) {
+	if d.stats.Downgraded {
+		return
+	}
+	now := time.Now()
+	d.stats.Downgraded = true
+	d.stats.DowngradeReason = reason
+	d.stats.DowngradedAt = &now
+	fmt.Printf("Rendering budget for %s exhausted (%s), falling back to static fetches\n", host, reason)
+}
+
+// reserve claims a render for host and returns how much render time the
+// domain has left. ok is false once the budget is spent.
+func (b *renderBudget) reserve(host string) (remaining time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := b.domain(host)
+	maxTime := time.Duration(b.cfg.MaxSecondsPerDomain * float64(time.Second))
+	switch {
+	case d.stats.Downgraded:
+	case int(d.stats.Rendered)+d.inFlight >= b.cfg.MaxPagesPerDomain:
+		b.downgrade(host, d, "max_pages")
+	case d.elapsed >= maxTime:
+		b.downgrade(host, d, "max_seconds")
+	default:
+		d.inFlight++
+		return maxTime - d.elapsed, true
+	}
+	d.stats.StaticFetches++
+	return 0, false
+}
+
+// finish records a render that was reserved for host
+func (b *renderBudget) finish(host string, elapsed time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := b.domain(host)
+	d.inFlight--
+	d.elapsed += elapsed
+	d.stats.RenderSeconds = d.elapsed.Seconds()
+	if err != nil {
+		d.stats.RenderErrors++
+	} else {
+		d.stats.Rendered++
+	}
+
+	if int(d.stats.Rendered) >= b.cfg.MaxPagesPerDomain {
+		b.downgrade(host, d, "max_pages")
+	} else if d.stats.RenderSeconds >= b.cfg.MaxSecondsPerDomain {
+		b.downgrade(host, d, "max_seconds")
+	}
+}
+
+// snapshot returns every domain's stats
+func (b *renderBudget) snapshot() map[string]DomainRenderStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make(map[string]DomainRenderStats, len(b.domains))
+	for host, d := range b.domains {
+		stats[host] = d.stats
+	}
+	return stats
+}
+
+// renderTransport fetches pages through the render service while their
+// domain has budget left, and through the static fetcher otherwise
+type renderTransport struct {
+	next   http.RoundTripper
+	budget *renderBudget
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *renderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.static(req)
+	}
+
+	host := req.URL.Hostname()
+	remaining, ok := t.budget.reserve(host)
+	if !ok {
+		return t.static(req)
+	}
+
+	// Waiting for a browser doesn't count against the domain's budget
+	select {
+	case renderPool <- struct{}{}:
+	case <-req.Context().Done():
+		t.budget.finish(host, 0, req.Context().Err())
+		return nil, req.Context().Err()
+	}
+	start := time.Now()
+	resp, err := t.render(req, remaining)
+	<-renderPool
+	t.budget.finish(host, time.Since(start), err)
+
+	if err != nil {
+		fmt.Printf("Rendering %s failed, fetching statically: %v\n", req.URL.String(), err)
+		return t.static(req)
+	}
+	return resp, nil
+}
+
+func (t *renderTransport) static(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		resp.Header.Set(fetchModeHeader, "static")
+	}
+	return resp, err
+}
+
+// render loads the page in the headless browser and returns the resulting
+// DOM as if the site had served it
+func (t *renderTransport) render(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	if t.budget.harness != "" {
+		html, scriptResults, err := t.renderWithScripts(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		resp := renderedResponse(req, io.NopCloser(strings.NewReader(html)), int64(len(html)))
+		if results, err := json.Marshal(scriptResults); err == nil {
+			resp.Header.Set(scriptResultsHeader, string(results))
+		}
+		return resp, nil
+	}
+
+	params := url.Values{
+		"url":  {req.URL.String()},
+		"wait": {strconv.FormatFloat(t.budget.cfg.WaitSeconds, 'f', -1, 64)},
+	}
+	renderReq, err := http.NewRequestWithContext(ctx, http.MethodGet, renderServiceURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := renderClient.Do(renderReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("render service returned %s", resp.Status)
+	}
+	// Read it all here so the render time covers the whole page. The buffer
+	// goes back to the pool when colly closes the body, having copied it.
+	body, err := pool.ReadAll(resp.Body, resp.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderedResponse(req, pool.Body(body), int64(body.Len())), nil
+}
+
+// renderedResponse wraps a rendered page as if the site had served it
+func renderedResponse(req *http.Request, body io.ReadCloser, length int64) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":  {"text/html; charset=utf-8"},
+			fetchModeHeader: {"rendered"},
+		},
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
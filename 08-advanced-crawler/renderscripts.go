@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// scriptResultsHeader carries a rendered page's script results from the
+// render transport to the HTML callback, as a JSON object of metadata keys
+// and values
+const scriptResultsHeader = "X-Crawler-Script-Results"
+
+const (
+	maxRenderScripts      = 10
+	maxRenderScriptSource = 8 << 10 // bytes per script
+	maxScriptError        = 200     // error messages are cut to this length
+)
+
+// renderScriptName is also the script's metadata key, after a js_ prefix
+var renderScriptName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// renderScriptURL is the render service's render.json endpoint, used
+// instead of render.html when a crawl has scripts, since it returns their
+// result along with the page
+var renderScriptURL = envString("RENDER_SCRIPT_URL", strings.TrimSuffix(renderServiceURL, "render.html")+"render.json")
+
+// RenderScript is a JavaScript snippet run against every rendered page,
+// after the page's own scripts have had wait_seconds to run
+type RenderScript struct {
+	Name   string `json:"name"`   // the result is stored as js_<name>
+	Source string `json:"source"` // a function body; what it returns is the result
+}
+
+// RenderScriptStats counts one script's outcomes across a crawl
+type RenderScriptStats struct {
+	Succeeded int64  `json:"succeeded"`
+	Failed    int64  `json:"failed"` // threw, ran out of time or returned too much
+	LastError string `json:"last_error,omitempty"`
+}
+
+// validateRenderScripts checks a crawl's scripts and their limits
+func validateRenderScripts(cfg RenderConfig) error {
+	if len(cfg.Scripts) == 0 {
+		return nil
+	}
+	if !cfg.Enabled {
+		return fmt.Errorf("render.scripts need render.enabled")
+	}
+	if len(cfg.Scripts) > maxRenderScripts {
+		return fmt.Errorf("render.scripts: at most %d scripts", maxRenderScripts)
+	}
+	if cfg.ScriptTimeoutSeconds < 0 || cfg.ScriptTimeoutSeconds > 30 {
+		return fmt.Errorf("render.script_timeout_seconds must be between 0 and 30")
+	}
+	if cfg.MaxScriptResultBytes < 0 || cfg.MaxScriptResultBytes > 64<<10 {
+		return fmt.Errorf("render.max_script_result_bytes must be between 0 and %d", 64<<10)
+	}
+	seen := make(map[string]bool)
+	for _, script := range cfg.Scripts {
+		if !renderScriptName.MatchString(script.Name) {
+			return fmt.Errorf("render.scripts: name %q must be lowercase letters, digits and underscores, starting with a letter", script.Name)
+		}
+		if seen[script.Name] {
+			return fmt.Errorf("render.scripts: duplicate name %q", script.Name)
+		}
+		seen[script.Name] = true
+		if strings.TrimSpace(script.Source) == "" || len(script.Source) > maxRenderScriptSource {
+			return fmt.Errorf("render.scripts: %s: source must be 1 to %d bytes", script.Name, maxRenderScriptSource)
+		}
+	}
+	return nil
+}
+
+// scriptHarness wraps a crawl's scripts in the JavaScript sent to the
+// render service. Each script runs in its own function, so it can't see
+// the others' variables, and an exception only fails that script. Scripts
+// can't be interrupted, so the time limit is checked between them: one that
+// overruns loses its result and the ones after it are skipped. Results are
+// serialized with JSON.stringify and dropped if over the size cap.
+func scriptHarness(cfg RenderConfig) string {
+	var scripts strings.Builder
+	for _, script := range cfg.Scripts {
+		fmt.Fprintf(&scripts, "{name: %q, run: function () {\n%s\n}},\n", script.Name, script.Source)
+	}
+	return fmt.Sprintf(`(function () {
+var scripts = [
+%s];
+var limit = %d, maxBytes = %d, start = Date.now(), out = {};
+for (var i = 0; i < scripts.length; i++) {
+  var s = scripts[i];
+  if (Date.now() - start > limit) { out[s.name] = {error: "skipped: time limit exceeded"}; continue; }
+  try {
+    var value = JSON.stringify(s.run());
+    if (Date.now() - start > limit) out[s.name] = {error: "time limit exceeded"};
+    else if (value === undefined) out[s.name] = {value: "null"};
+    else if (value.length > maxBytes) out[s.name] = {error: "result is over the " + maxBytes + " byte cap"};
+    else out[s.name] = {value: value};
+  } catch (e) {
+    out[s.name] = {error: String(e)};
+  }
+}
+return out;
+})()`, scripts.String(), int(cfg.ScriptTimeoutSeconds*1000), cfg.MaxScriptResultBytes)
+}
+
+// scriptOutcome is one script's entry in the harness's result
+type scriptOutcome struct {
+	Value *string `json:"value"` // the result as JSON text
+	Error string  `json:"error"`
+}
+
+// renderWithScripts renders a page through render.json, running the
+// crawl's scripts once the page has settled. It returns the page and the
+// script results as metadata.
+func (t *renderTransport) renderWithScripts(ctx context.Context, req *http.Request) (string, map[string]string, error) {
+	args, err := json.Marshal(map[string]any{
+		"url":       req.URL.String(),
+		"wait":      t.budget.cfg.WaitSeconds,
+		"html":      1,
+		"script":    1,
+		"js_source": t.budget.harness,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	renderReq, err := http.NewRequestWithContext(ctx, http.MethodPost, renderScriptURL, strings.NewReader(string(args)))
+	if err != nil {
+		return "", nil, err
+	}
+	renderReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := renderClient.Do(renderReq)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Splash explains a script that doesn't parse in the body
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", nil, fmt.Errorf("render service returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	var out struct {
+		HTML   string                   `json:"html"`
+		Script map[string]scriptOutcome `json:"script"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", nil, fmt.Errorf("decode render service response: %w", err)
+	}
+	return out.HTML, t.budget.scriptMetadata(out.Script), nil
+}
+
+// scriptMetadata turns the harness's result into js_<name> metadata, or
+// js_<name>_error for scripts that failed, and counts the outcomes
+func (b *renderBudget) scriptMetadata(outcomes map[string]scriptOutcome) map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	metadata := make(map[string]string, len(b.cfg.Scripts))
+	for _, script := range b.cfg.Scripts {
+		outcome, ok := outcomes[script.Name]
+		errMsg := outcome.Error
+		switch {
+		case !ok || (outcome.Value == nil && errMsg == ""):
+			errMsg = "no result"
+		case errMsg == "" && len(*outcome.Value) > b.cfg.MaxScriptResultBytes:
+			// the harness counts UTF-16 units, this counts bytes
+			errMsg = fmt.Sprintf("result is over the %d byte cap", b.cfg.MaxScriptResultBytes)
+		}
+
+		stats := b.scripts[script.Name]
+		if errMsg != "" {
+			if len(errMsg) > maxScriptError {
+				errMsg = strings.ToValidUTF8(errMsg[:maxScriptError], "")
+			}
+			metadata["js_"+script.Name+"_error"] = errMsg
+			stats.Failed++
+			stats.LastError = errMsg
+			continue
+		}
+		metadata["js_"+script.Name] = *outcome.Value
+		stats.Succeeded++
+	}
+	return metadata
+}
+
+// scriptSnapshot returns every script's stats
+func (b *renderBudget) scriptSnapshot() map[string]RenderScriptStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make(map[string]RenderScriptStats, len(b.scripts))
+	for name, s := range b.scripts {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// mergeScriptResults copies a rendered page's script results into its metadata
+func mergeScriptResults(header string, metadata map[string]string) {
+	var results map[string]string
+	if err := json.Unmarshal([]byte(header), &results); err != nil {
+		return
+	}
+	for key, value := range results {
+		metadata[key] = value
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Retention tiers a completed crawl moves through before it is deleted
+const (
+	tierFull    = "full"    // every CrawlResult, as crawled
+	tierSummary = "summary" // one ArchivedResult per page
+)
+
+// defaultTenant owns crawls submitted without a tenant, and its policy
+// applies to tenants that have none of their own
+const defaultTenant = "default"
+
+// compactionInterval is how often the background compactor runs
+const compactionInterval = time.Hour
+
+// RetentionPolicy controls how long a tenant's completed crawls are kept
+type RetentionPolicy struct {
+	FullDays      int `json:"full_days"`      // days full results are kept after the crawl ends
+	SummaryMonths int `json:"summary_months"` // months summary records are kept after that; then the crawl is deleted
+}
+
+// RetentionPolicyRequest is the body of PUT /api/v1/admin/retention/{tenant}.
+// Both fields are required so a typo can't silently mean "0 days".
+type RetentionPolicyRequest struct {
+	FullDays      *int `json:"full_days" binding:"required"`
+	SummaryMonths *int `json:"summary_months" binding:"required"`
+}
+
+// ArchivedResult is the summary record a CrawlResult is downsampled to
+type ArchivedResult struct {
+	URL   string  `json:"url"`
+	Title string  `json:"title"`
+	Hash  string  `json:"hash"`  // SHA-256 of the page text
+	Score float64 `json:"score"` // keyword relevance (0-1)
+}
+
+// ArchivedResultsResponse is returned by GET /api/v1/results/{crawl_id}
+// once a crawl has been downsampled
+type ArchivedResultsResponse struct {
+	CrawlID       string           `json:"crawl_id"`
+	GeneratedAt   time.Time        `json:"generated_at"`
+	Status        string           `json:"status"`
+	Tier          string           `json:"tier"`
+	DownsampledAt *time.Time       `json:"downsampled_at"`
+	TotalResults  int              `json:"total_results"`
+	Results       []ArchivedResult `json:"results"`
+}
+
+// Global retention policies, keyed by tenant
+var retentionPolicies = map[string]RetentionPolicy{
+	defaultTenant: {FullDays: 7, SummaryMonths: 6},
+}
+var retentionMutex sync.RWMutex
+
+// policyFor returns the tenant's policy, or the default one
+func policyFor(tenant string) RetentionPolicy {
+	retentionMutex.RLock()
+	defer retentionMutex.RUnlock()
+
+	if policy, ok := retentionPolicies[tenant]; ok {
+		return policy
+	}
+	return retentionPolicies[defaultTenant]
+}
+
+// CompactionStats is reported by GET /api/v1/admin/retention
+type CompactionStats struct {
+	Runs               int64      `json:"runs"`
+	JobsDownsampled    int64      `json:"jobs_downsampled"`
+	JobsDeleted        int64      `json:"jobs_deleted"`
+	ResultsDownsampled int64      `json:"results_downsampled"`
+	BytesReclaimed     int64      `json:"bytes_reclaimed"` // estimated size of the dropped result data
+	LastRunAt          *time.Time `json:"last_run_at,omitempty"`
+	LastRunMs          int64      `json:"last_run_ms"`
+}
+
+// compactionStats holds the live counters behind CompactionStats
+type compactionStats struct {
+	runs, downsampled, deleted, results, bytes atomic.Int64
+	mu                                         sync.Mutex
+	lastRun                                    time.Time
+	lastDuration                               time.Duration
+}
+
+var compaction = &compactionStats{}
+
+// snapshot returns the current counters
+func (s *compactionStats) snapshot() CompactionStats {
+	stats := CompactionStats{
+		Runs:               s.runs.Load(),
+		JobsDownsampled:    s.downsampled.Load(),
+		JobsDeleted:        s.deleted.Load(),
+		ResultsDownsampled: s.results.Load(),
+		BytesReclaimed:     s.bytes.Load(),
+	}
+	s.mu.Lock()
+	if !s.lastRun.IsZero() {
+		lastRun := s.lastRun
+		stats.LastRunAt = &lastRun
+		stats.LastRunMs = s.lastDuration.Milliseconds()
+	}
+	s.mu.Unlock()
+	return stats
+}
+
+// CompactionRun describes a single compaction pass
+type CompactionRun struct {
+	JobsDownsampled    int       `json:"jobs_downsampled"`
+	JobsDeleted        int       `json:"jobs_deleted"`
+	ResultsDownsampled int       `json:"results_downsampled"`
+	BytesReclaimed     int64     `json:"bytes_reclaimed"`
+	StartedAt          time.Time `json:"started_at"`
+	DurationMs         int64     `json:"duration_ms"`
+}
+
+// contentHash fingerprints page text for the summary tier. The text is
+// hashed a chunk at a time, since converting a whole page to []byte copies it.
+func contentHash(text string) string {
+	h := sha256.New()
+	var chunk [4096]byte
+	for len(text) > 0 {
+		n := copy(chunk[:], text)
+		h.Write(chunk[:n])
+		text = text[n:]
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// resultSize estimates the memory a result holds
+func resultSize(r CrawlResult) int64 {
+	size := len(r.URL) + len(r.Title) + len(r.Content) + len(r.Domain)
+	for _, keyword := range r.Keywords {
+		size += len(keyword)
+	}
+	for key, value := range r.Metadata {
+		size += len(key) + len(value)
+	}
+	return int64(size)
+}
+
+// archive converts a result to its summary record. The hash is taken at
+// crawl time over the full page text; older results fall back to the
+// stored excerpt.
+func archive(r CrawlResult) ArchivedResult {
+	hash := r.Metadata["content_hash"]
+	if hash == "" {
+		hash = contentHash(r.Content)
+	}
+	score, _ := strconv.ParseFloat(r.Metadata["relevance"], 64)
+	return ArchivedResult{URL: r.URL, Title: r.Title, Hash: hash, Score: score}
+}
+
+// compact downsamples and deletes completed crawls whose tier has expired
+// under their tenant's policy. Running crawls are never touched.
+func compact(now time.Time) CompactionRun {
+	run := CompactionRun{StartedAt: now}
+
+	var expired []string
+	for _, job := range crawlJobs.All() {
+		job.mu.Lock()
+		if job.EndTime == nil {
+			job.mu.Unlock()
+			continue
+		}
+
+		policy := policyFor(job.Tenant)
+		fullUntil := job.EndTime.AddDate(0, 0, policy.FullDays)
+		deleteAt := fullUntil.AddDate(0, policy.SummaryMonths, 0)
+
+		switch {
+		case !now.Before(deleteAt):
+			expired = append(expired, job.ID)
+		case job.Tier == tierFull && !now.Before(fullUntil):
+			archived := make([]ArchivedResult, len(job.Results))
+			for i, result := range job.Results {
+				archived[i] = archive(result)
+				run.BytesReclaimed += resultSize(result)
+			}
+			run.ResultsDownsampled += len(job.Results)
+			run.JobsDownsampled++
+
+			job.archive = archived
+			job.Results = nil
+			job.Tier = tierSummary
+			downsampledAt := now
+			job.DownsampledAt = &downsampledAt
+		}
+		job.mu.Unlock()
+	}
+
+	crawlJobs.Delete(expired...)
+	run.JobsDeleted = len(expired)
+
+	duration := time.Since(now)
+	run.DurationMs = duration.Milliseconds()
+
+	compaction.runs.Add(1)
+	compaction.downsampled.Add(int64(run.JobsDownsampled))
+	compaction.deleted.Add(int64(run.JobsDeleted))
+	compaction.results.Add(int64(run.ResultsDownsampled))
+	compaction.bytes.Add(run.BytesReclaimed)
+	compaction.mu.Lock()
+	compaction.lastRun = now
+	compaction.lastDuration = duration
+	compaction.mu.Unlock()
+
+	return run
+}
+
+// runRetention compacts on a fixed interval for the life of the process
+func runRetention(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		run := compact(time.Now())
+		if run.JobsDownsampled > 0 || run.JobsDeleted > 0 {
+			fmt.Printf("Retention: downsampled %d crawl(s) (%d results), deleted %d crawl(s)\n",
+				run.JobsDownsampled, run.ResultsDownsampled, run.JobsDeleted)
+		}
+	}
+}
+
+// archivedStats rebuilds the per-crawl stats from summary records
+func archivedStats(records []ArchivedResult) (int, map[string]int) {
+	pagesWithKeywords := 0
+	domains := make(map[string]int)
+	for _, record := range records {
+		if record.Score > 0 {
+			pagesWithKeywords++
+		}
+		if u, err := url.Parse(record.URL); err == nil {
+			domains[u.Host]++
+		}
+	}
+	return pagesWithKeywords, domains
+}
+
+// getRetention handles GET /api/v1/admin/retention
+func getRetention(c *gin.Context) {
+	retentionMutex.RLock()
+	policies := make(map[string]RetentionPolicy, len(retentionPolicies))
+	for tenant, policy := range retentionPolicies {
+		policies[tenant] = policy
+	}
+	retentionMutex.RUnlock()
+
+	tiers := map[string]int{tierFull: 0, tierSummary: 0}
+	for _, job := range crawlJobs.All() {
+		job.mu.RLock()
+		if job.EndTime != nil {
+			tiers[job.Tier]++
+		}
+		job.mu.RUnlock()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"policies":     policies,
+		"tiers":        tiers,
+		"compaction":   compaction.snapshot(),
+		"generated_at": time.Now(),
+	})
+}
+
+// putRetentionPolicy handles PUT /api/v1/admin/retention/{tenant}
+func putRetentionPolicy(c *gin.Context) {
+	var req RetentionPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if *req.FullDays < 0 || *req.SummaryMonths < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "full_days and summary_months must be >= 0"})
+		return
+	}
+
+	tenant := c.Param("tenant")
+	policy := RetentionPolicy{FullDays: *req.FullDays, SummaryMonths: *req.SummaryMonths}
+
+	retentionMutex.Lock()
+	retentionPolicies[tenant] = policy
+	retentionMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant, "policy": policy})
+}
+
+// deleteRetentionPolicy handles DELETE /api/v1/admin/retention/{tenant}
+func deleteRetentionPolicy(c *gin.Context) {
+	tenant := c.Param("tenant")
+	if tenant == defaultTenant {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The default policy can be changed but not removed"})
+		return
+	}
+
+	retentionMutex.Lock()
+	_, exists := retentionPolicies[tenant]
+	delete(retentionPolicies, tenant)
+	retentionMutex.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant, "policy": policyFor(tenant)})
+}
+
+// runCompaction handles POST /api/v1/admin/retention/compact
+func runCompaction(c *gin.Context) {
+	c.JSON(http.StatusOK, compact(time.Now()))
+}
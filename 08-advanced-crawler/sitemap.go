@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gocolly/colly"
+)
+
+// sitemapMaxURLs is the per-file limit from the sitemaps.org protocol
+const sitemapMaxURLs = 50000
+
+// sitemapURLSet is the <urlset> root of a sitemaps.org 0.9 sitemap
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// sitemapURL is a single <url> entry
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Meta tags and attributes that carry publish and modified dates, most specific first
+var (
+	publishedSelectors = []string{
+		`meta[property="article:published_time"]`,
+		`meta[name="pubdate"]`,
+		`meta[name="publishdate"]`,
+		`meta[name="date"]`,
+		`meta[itemprop="datePublished"]`,
+	}
+	modifiedSelectors = []string{
+		`meta[property="article:modified_time"]`,
+		`meta[property="og:updated_time"]`,
+		`meta[name="last-modified"]`,
+		`meta[itemprop="dateModified"]`,
+	}
+)
+
+// dateLayouts are the formats publishers commonly use in date meta tags
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC1123,
+	time.RFC1123Z,
+}
+
+// parseDate tries each known layout
+func parseDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// firstDate returns the first parseable content attribute among selectors
+func firstDate(e *colly.HTMLElement, selectors []string) (time.Time, bool) {
+	for _, selector := range selectors {
+		if t, ok := parseDate(e.ChildAttr(selector, "content")); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// pageMetadata adds canonical_url, published_at and modified_at to a
+// result's metadata when the page declares them. A <time datetime> element
+// stands in for the publish date, and the Last-Modified header for the
+// modified date.
+func pageMetadata(e *colly.HTMLElement, metadata map[string]string) {
+	if href := e.ChildAttr(`link[rel="canonical"]`, "href"); href != "" {
+		if canonical := resolveLink(e, href); canonical != "" {
+			metadata["canonical_url"] = canonical
+		}
+	}
+
+	published, ok := firstDate(e, publishedSelectors)
+	if !ok {
+		published, ok = parseDate(e.ChildAttr("time[datetime]", "datetime"))
+	}
+	if ok {
+		metadata["published_at"] = published.Format(time.RFC3339)
+	}
+
+	modified, ok := firstDate(e, modifiedSelectors)
+	if !ok && e.Response.Headers != nil {
+		modified, ok = parseDate(e.Response.Headers.Get("Last-Modified"))
+	}
+	if ok {
+		metadata["modified_at"] = modified.Format(time.RFC3339)
+	}
+}
+
+// buildSitemap renders the successfully crawled pages as sitemap.xml. Pages
+// are listed under their canonical URL (once each), with lastmod taken from
+// the modified date, falling back to the publish date.
+func buildSitemap(results []CrawlResult) ([]byte, int, error) {
+	urlSet := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	seen := make(map[string]bool)
+
+	for _, result := range results {
+		if result.StatusCode != http.StatusOK {
+			continue
+		}
+
+		loc := result.URL
+		if canonical := result.Metadata["canonical_url"]; canonical != "" {
+			if u, err := url.Parse(canonical); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+				loc = canonical
+			}
+		}
+		if seen[loc] {
+			continue
+		}
+		seen[loc] = true
+
+		lastMod := result.Metadata["modified_at"]
+		if lastMod == "" {
+			lastMod = result.Metadata["published_at"]
+		}
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{Loc: loc, LastMod: lastMod})
+
+		if len(urlSet.URLs) == sitemapMaxURLs {
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(urlSet); err != nil {
+		return nil, 0, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), len(urlSet.URLs), nil
+}
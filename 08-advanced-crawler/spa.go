@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gocolly/colly"
+)
+
+// Thresholds for flagging a statically fetched page as dynamic. They are
+// deliberately conservative: a page needs almost no text *and* script
+// evidence before it counts.
+const (
+	dynamicMaxTextChars   = 200       // visible text below this is "almost none"
+	dynamicMinScriptBytes = 50 * 1024 // inline script that looks like a bundle
+	dynamicMinScripts     = 3         // external <script src> tags
+	renderRecommendRatio  = 0.3       // share of dynamic pages at which render mode is recommended
+	renderRecommendPages  = 3         // dynamic pages needed before a domain is recommended
+	dynamicExamplePages   = 3         // sample URLs kept per domain
+)
+
+// spaMountSelectors match the containers front-end frameworks render into
+const spaMountSelectors = "#root, #app, #__next, #__nuxt, #___gatsby, app-root, [ng-version], [data-reactroot], [data-v-app]"
+
+// dynamicSignals is what the static HTML of a page says about how it is built
+type dynamicSignals struct {
+	visibleTextChars int
+	scriptBytes      int // inline scripts, excluding JSON-LD
+	externalScripts  int
+	emptyMountPoint  bool // a framework mount point with nothing in it
+	noscriptWarning  bool // <noscript> asks the visitor to enable JavaScript
+}
+
+// detectDynamic inspects a statically fetched page
+func detectDynamic(e *colly.HTMLElement) dynamicSignals {
+	body := e.DOM.Find("body").Clone()
+	body.Find("script, style, noscript, template, svg").Remove()
+	visible := strings.Join(strings.Fields(body.Text()), " ")
+
+	mounts := e.DOM.Find(spaMountSelectors)
+
+	return dynamicSignals{
+		visibleTextChars: len([]rune(visible)),
+		scriptBytes:      len(e.DOM.Find(`script:not([src]):not([type="application/ld+json"])`).Text()),
+		externalScripts:  e.DOM.Find("script[src]").Length(),
+		emptyMountPoint:  mounts.Length() > 0 && strings.TrimSpace(mounts.Text()) == "",
+		noscriptWarning:  strings.Contains(strings.ToLower(e.DOM.Find("noscript").Text()), "javascript"),
+	}
+}
+
+// likelyDynamic reports whether the page's content is probably built by
+// JavaScript, i.e. invisible to a static crawl
+func (s dynamicSignals) likelyDynamic() bool {
+	if s.visibleTextChars >= dynamicMaxTextChars {
+		return false
+	}
+	return s.scriptBytes >= dynamicMinScriptBytes ||
+		s.externalScripts >= dynamicMinScripts ||
+		s.emptyMountPoint ||
+		s.noscriptWarning
+}
+
+// DomainDynamicStats reports how much of a domain a static crawl couldn't see
+type DomainDynamicStats struct {
+	StaticPages   int      `json:"static_pages"`
+	LikelyDynamic int      `json:"likely_dynamic"`
+	DynamicRatio  float64  `json:"dynamic_ratio"`
+	ExamplePages  []string `json:"example_pages,omitempty"`
+}
+
+// DynamicContentReport is the dynamic_content section of the crawl stats
+type DynamicContentReport struct {
+	Domains         map[string]DomainDynamicStats `json:"domains"`
+	RecommendRender []string                      `json:"recommend_render"` // domains worth crawling with render enabled
+}
+
+// dynamicStats counts likely-dynamic pages per domain. Like the entity
+// glossary, it is kept on the job so it survives downsampling.
+type dynamicStats struct {
+	mu      sync.Mutex
+	domains map[string]*DomainDynamicStats
+}
+
+func newDynamicStats() *dynamicStats {
+	return &dynamicStats{domains: make(map[string]*DomainDynamicStats)}
+}
+
+// record counts a statically fetched page
+func (s *dynamicStats) record(domain, url string, dynamic bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.domains[domain]
+	if !ok {
+		d = &DomainDynamicStats{}
+		s.domains[domain] = d
+	}
+	d.StaticPages++
+	if dynamic {
+		d.LikelyDynamic++
+		if len(d.ExamplePages) < dynamicExamplePages {
+			d.ExamplePages = append(d.ExamplePages, url)
+		}
+	}
+	d.DynamicRatio = float64(d.LikelyDynamic) / float64(d.StaticPages)
+}
+
+// report returns the per-domain counts and the domains to render next time
+func (s *dynamicStats) report() DynamicContentReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := DynamicContentReport{
+		Domains:         make(map[string]DomainDynamicStats, len(s.domains)),
+		RecommendRender: []string{},
+	}
+	for domain, d := range s.domains {
+		stats := *d
+		stats.ExamplePages = append([]string(nil), d.ExamplePages...)
+		report.Domains[domain] = stats
+		if d.LikelyDynamic >= renderRecommendPages && d.DynamicRatio >= renderRecommendRatio {
+			report.RecommendRender = append(report.RecommendRender, domain)
+		}
+	}
+	sort.Strings(report.RecommendRender)
+	return report
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig tunes the fetcher's connection pooling. Zero values keep
+// the defaults below, which favor connection reuse for small-page crawls.
+type TransportConfig struct {
+	MaxIdleConnsPerHost int  `json:"max_idle_conns_per_host"` // default 16
+	MaxConnsPerHost     int  `json:"max_conns_per_host"`      // 0 = unlimited
+	DisableHTTP2        bool `json:"disable_http2"`
+	TLSSessionCacheSize int  `json:"tls_session_cache_size"` // default 64; -1 disables TLS session resumption
+	DisableKeepAlives   bool `json:"disable_keep_alives"`
+	KeepAliveSeconds    int  `json:"keep_alive_seconds"`     // TCP keep-alive probe interval, default 30
+	IdleConnTimeoutSecs int  `json:"idle_conn_timeout_secs"` // default 90
+}
+
+// ConnectionStats reports how well the fetcher reused connections
+type ConnectionStats struct {
+	Requests       int64   `json:"requests"`
+	ReusedConns    int64   `json:"reused_conns"`
+	NewConns       int64   `json:"new_conns"`
+	TLSHandshakes  int64   `json:"tls_handshakes"`
+	TLSResumed     int64   `json:"tls_resumed"`
+	HTTP2Responses int64   `json:"http2_responses"`
+	ReuseRatio     float64 `json:"reuse_ratio"`
+}
+
+// connStats holds the live counters behind ConnectionStats
+type connStats struct {
+	requests, reused, newConns, handshakes, resumed, http2 atomic.Int64
+}
+
+// snapshot returns the current counters
+func (s *connStats) snapshot() ConnectionStats {
+	stats := ConnectionStats{
+		Requests:       s.requests.Load(),
+		ReusedConns:    s.reused.Load(),
+		NewConns:       s.newConns.Load(),
+		TLSHandshakes:  s.handshakes.Load(),
+		TLSResumed:     s.resumed.Load(),
+		HTTP2Responses: s.http2.Load(),
+	}
+	if total := stats.ReusedConns + stats.NewConns; total > 0 {
+		stats.ReuseRatio = float64(stats.ReusedConns) / float64(total)
+	}
+	return stats
+}
+
+// newTransport builds the fetcher's http.Transport from the crawl config
+func newTransport(cfg TransportConfig) *http.Transport {
+	maxIdlePerHost := cfg.MaxIdleConnsPerHost
+	if maxIdlePerHost == 0 {
+		maxIdlePerHost = 16
+	}
+	keepAlive := time.Duration(cfg.KeepAliveSeconds) * time.Second
+	if keepAlive == 0 {
+		keepAlive = 30 * time.Second
+	}
+	idleTimeout := time.Duration(cfg.IdleConnTimeoutSecs) * time.Second
+	if idleTimeout == 0 {
+		idleTimeout = 90 * time.Second
+	}
+
+	tlsConfig := &tls.Config{}
+	switch {
+	case cfg.TLSSessionCacheSize > 0:
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(cfg.TLSSessionCacheSize)
+	case cfg.TLSSessionCacheSize == 0:
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		// Lookups are cached and shared with prewarming
+		DialContext: sharedDNS.dialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: keepAlive,
+		}),
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          maxIdlePerHost * 8,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       idleTimeout,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil, empty map is how net/http is told not to negotiate h2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// tracingTransport counts connection reuse and TLS resumption for every request
+type tracingTransport struct {
+	next  http.RoundTripper
+	stats *connStats
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.stats.requests.Add(1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.stats.reused.Add(1)
+			} else {
+				t.stats.newConns.Add(1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			t.stats.handshakes.Add(1)
+			if state.DidResume {
+				t.stats.resumed.Add(1)
+			}
+		},
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil && resp.ProtoMajor == 2 {
+		t.stats.http2.Add(1)
+	}
+	return resp, err
+}
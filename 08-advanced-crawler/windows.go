@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/sleep"
+	"github.com/fajar/learn-go/crawlengine"
+	"github.com/gocolly/colly"
+)
+
+// windowPoll bounds how long the crawl sleeps waiting for a window, so it
+// notices max_duration or a reached target while it waits
+const windowPoll = time.Minute
+
+// CrawlWindow restricts a domain, and its subdomains, to a time of day.
+// Some sites only allow crawling off-peak, e.g. 01:00-05:00 Asia/Jakarta.
+type CrawlWindow struct {
+	Domain   string `json:"domain"`
+	Start    string `json:"start"`    // "HH:MM"
+	End      string `json:"end"`      // "HH:MM", exclusive; before start when the window spans midnight
+	Timezone string `json:"timezone"` // IANA name, default UTC
+}
+
+// DomainWindowStats is the state of one domain's crawl window
+type DomainWindowStats struct {
+	Window   string     `json:"window"` // e.g. "01:00-05:00 Asia/Jakarta"
+	Open     bool       `json:"open"`
+	OpensAt  *time.Time `json:"opens_at,omitempty"`
+	ClosesAt *time.Time `json:"closes_at,omitempty"`
+	Held     int        `json:"held"`     // URLs waiting for the window to open
+	Released int        `json:"released"` // held URLs queued once it opened
+}
+
+// crawlWindow is a parsed CrawlWindow, with times in minutes after midnight
+type crawlWindow struct {
+	cfg        CrawlWindow
+	loc        *time.Location
+	start, end int
+}
+
+// parseWindows validates the windows of a crawl request
+func parseWindows(windows []CrawlWindow) ([]crawlWindow, error) {
+	parsed := make([]crawlWindow, 0, len(windows))
+	seen := make(map[string]bool)
+	for _, cfg := range windows {
+		cfg.Domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(cfg.Domain)), "www.")
+		if cfg.Domain == "" {
+			return nil, fmt.Errorf("windows: domain is required")
+		}
+		if seen[cfg.Domain] {
+			return nil, fmt.Errorf("windows: %s has more than one window", cfg.Domain)
+		}
+		seen[cfg.Domain] = true
+
+		if cfg.Timezone == "" {
+			cfg.Timezone = "UTC"
+		}
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("windows: %s: unknown timezone %q", cfg.Domain, cfg.Timezone)
+		}
+		start, errStart := parseClock(cfg.Start)
+		end, errEnd := parseClock(cfg.End)
+		if errStart != nil || errEnd != nil {
+			return nil, fmt.Errorf("windows: %s: start and end must be HH:MM", cfg.Domain)
+		}
+		if start == end {
+			return nil, fmt.Errorf("windows: %s: start and end must differ", cfg.Domain)
+		}
+		parsed = append(parsed, crawlWindow{cfg: cfg, loc: loc, start: start, end: end})
+	}
+	return parsed, nil
+}
+
+// parseClock turns "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// open reports whether the window is open at now
+func (w crawlWindow) open(now time.Time) bool {
+	local := now.In(w.loc)
+	m := local.Hour()*60 + local.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end // spans midnight
+}
+
+// next returns the first time after now that the clock reads minute, in
+// the window's timezone
+func (w crawlWindow) next(now time.Time, minute int) time.Time {
+	local := now.In(w.loc)
+	for day := 0; ; day++ {
+		t := time.Date(local.Year(), local.Month(), local.Day()+day, minute/60, minute%60, 0, 0, w.loc)
+		if t.After(now) {
+			return t
+		}
+	}
+}
+
+func (w crawlWindow) String() string {
+	return fmt.Sprintf("%s-%s %s", w.cfg.Start, w.cfg.End, w.cfg.Timezone)
+}
+
+// windowGate is the part of the frontier that enforces crawl windows. URLs
+// of a domain outside its window are held here instead of being queued, and
+// released once the window opens. Held URLs never reach colly, whose visited
+// store would otherwise refuse them later.
+type windowGate struct {
+	mu       sync.Mutex
+	windows  []crawlWindow
+	held     map[string][]string // by window domain
+	queued   map[string]bool     // held URLs, to hold each once
+	released map[string]int
+}
+
+func newWindowGate(windows []crawlWindow) *windowGate {
+	return &windowGate{
+		windows:  windows,
+		held:     make(map[string][]string),
+		queued:   make(map[string]bool),
+		released: make(map[string]int),
+	}
+}
+
+// windowFor returns the window of host, the most specific one when a domain
+// and its subdomain both have one
+func (g *windowGate) windowFor(host string) (crawlWindow, bool) {
+	host = strings.ToLower(host)
+	var best crawlWindow
+	found := false
+	for _, w := range g.windows {
+		if (host == w.cfg.Domain || strings.HasSuffix(host, "."+w.cfg.Domain)) &&
+			(!found || len(w.cfg.Domain) > len(best.cfg.Domain)) {
+			best, found = w, true
+		}
+	}
+	return best, found
+}
+
+// hold keeps rawURL back if its domain's window is closed at now, and
+// reports whether it did
+func (g *windowGate) hold(rawURL string, now time.Time) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	w, ok := g.windowFor(u.Hostname())
+	if !ok || w.open(now) {
+		return false
+	}
+	if !g.queued[rawURL] {
+		g.queued[rawURL] = true
+		g.held[w.cfg.Domain] = append(g.held[w.cfg.Domain], rawURL)
+	}
+	return true
+}
+
+// due takes the held URLs whose windows are open at now
+func (g *windowGate) due(now time.Time) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var urls []string
+	for _, w := range g.windows {
+		held := g.held[w.cfg.Domain]
+		if len(held) == 0 || !w.open(now) {
+			continue
+		}
+		for _, u := range held {
+			delete(g.queued, u)
+		}
+		urls = append(urls, held...)
+		g.released[w.cfg.Domain] += len(held)
+		delete(g.held, w.cfg.Domain)
+	}
+	return urls
+}
+
+// nextOpening returns when the first window with held URLs opens, and false
+// when nothing is held
+func (g *windowGate) nextOpening(now time.Time) (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var first time.Time
+	for _, w := range g.windows {
+		if len(g.held[w.cfg.Domain]) == 0 {
+			continue
+		}
+		if opens := w.next(now, w.start); first.IsZero() || opens.Before(first) {
+			first = opens
+		}
+	}
+	return first, !first.IsZero()
+}
+
+// heldCount returns how many URLs are waiting for their windows
+func (g *windowGate) heldCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.queued)
+}
+
+// snapshot returns each window's state at now, keyed by domain
+func (g *windowGate) snapshot(now time.Time) map[string]DomainWindowStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stats := make(map[string]DomainWindowStats, len(g.windows))
+	for _, w := range g.windows {
+		s := DomainWindowStats{
+			Window:   w.String(),
+			Open:     w.open(now),
+			Held:     len(g.held[w.cfg.Domain]),
+			Released: g.released[w.cfg.Domain],
+		}
+		if s.Open {
+			closes := w.next(now, w.end)
+			s.ClosesAt = &closes
+		} else {
+			opens := w.next(now, w.start)
+			s.OpensAt = &opens
+		}
+		stats[w.cfg.Domain] = s
+	}
+	return stats
+}
+
+// SetWindows restricts domains to their crawl windows
+func (ac *AdvancedCrawler) SetWindows(windows []crawlWindow) {
+	ac.job.windows = newWindowGate(windows)
+}
+
+// visit queues rawURL, from the page of r or as a seed when r is nil,
+// unless its domain's crawl window is closed
+func (ac *AdvancedCrawler) visit(r *colly.Request, rawURL string) {
+	if ac.job.windows != nil && ac.job.windows.hold(rawURL, time.Now()) {
+		fmt.Printf("Holding %s until its crawl window opens\n", rawURL)
+		return
+	}
+	if r == nil {
+		ac.collector.Visit(rawURL)
+		return
+	}
+	r.Visit(rawURL)
+}
+
+// releaseHeld waits for the windows of held URLs to open and crawls them,
+// until nothing is held or the crawl stops. URLs found on released pages
+// may be held in turn.
+func (ac *AdvancedCrawler) releaseHeld() {
+	gate := ac.job.windows
+	if gate == nil {
+		return
+	}
+	for {
+		ac.mu.Lock()
+		done := ac.stopped || ac.draining || ac.pageCount >= ac.maxPages
+		ac.mu.Unlock()
+		if done {
+			if n := gate.heldCount(); n > 0 {
+				fmt.Printf("Crawl %s stopped with %d URLs still waiting for their crawl windows\n", ac.job.ID, n)
+			}
+			return
+		}
+
+		if urls := gate.due(time.Now()); len(urls) > 0 {
+			ac.setStatus(crawlengine.JobRunning)
+			fmt.Printf("Crawl window open, releasing %d held URLs\n", len(urls))
+			for _, u := range urls {
+				ac.visit(nil, u)
+			}
+			ac.collector.Wait()
+			continue
+		}
+
+		opens, ok := gate.nextOpening(time.Now())
+		if !ok {
+			return
+		}
+		ac.setStatus(crawlengine.JobWaitingForWindow)
+		wait := time.Until(opens)
+		if wait > windowPoll {
+			wait = windowPoll
+		}
+		// Ends early when the crawl stops or drains, which the next pass sees
+		_ = sleep.Until(ac.halted, wait)
+	}
+}
+
+func (ac *AdvancedCrawler) setStatus(status string) {
+	ac.job.mu.Lock()
+	ac.job.Status = status
+	ac.job.mu.Unlock()
+}
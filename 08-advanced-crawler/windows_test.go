@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// mustWindow parses a single window or fails the test
+func mustWindow(t *testing.T, cfg CrawlWindow) crawlWindow {
+	t.Helper()
+	windows, err := parseWindows([]CrawlWindow{cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return windows[0]
+}
+
+func TestWindowOpen(t *testing.T) {
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC)
+	}
+	daytime := CrawlWindow{Domain: "example.com", Start: "09:00", End: "17:00"}
+	overnight := CrawlWindow{Domain: "example.com", Start: "22:00", End: "02:00"}
+	jakarta := CrawlWindow{Domain: "example.com", Start: "01:00", End: "05:00", Timezone: "Asia/Jakarta"}     // UTC+7
+	newYork := CrawlWindow{Domain: "example.com", Start: "01:00", End: "05:00", Timezone: "America/New_York"} // DST 2024-03-10 and 2024-11-03
+
+	tests := []struct {
+		name   string
+		window CrawlWindow
+		now    time.Time
+		want   bool
+	}{
+		{"before start", daytime, utc(1, 1, 8, 59), false},
+		{"at start", daytime, utc(1, 1, 9, 0), true},
+		{"before end", daytime, utc(1, 1, 16, 59), true},
+		{"at end", daytime, utc(1, 1, 17, 0), false},
+
+		{"spans midnight, before start", overnight, utc(1, 1, 21, 59), false},
+		{"spans midnight, evening", overnight, utc(1, 1, 23, 0), true},
+		{"spans midnight, at midnight", overnight, utc(1, 2, 0, 0), true},
+		{"spans midnight, before end", overnight, utc(1, 2, 1, 59), true},
+		{"spans midnight, at end", overnight, utc(1, 2, 2, 0), false},
+		{"spans midnight, afternoon", overnight, utc(1, 2, 14, 0), false},
+
+		{"timezone, 00:59 local", jakarta, utc(1, 1, 17, 59), false},
+		{"timezone, 01:00 local", jakarta, utc(1, 1, 18, 0), true},
+		{"timezone, 04:59 local", jakarta, utc(1, 1, 21, 59), true},
+		{"timezone, 05:00 local", jakarta, utc(1, 1, 22, 0), false},
+		{"timezone, 01:00 UTC is 08:00 local", jakarta, utc(1, 2, 1, 0), false},
+
+		{"spring forward, 01:30 EST", newYork, utc(3, 10, 6, 30), true},
+		{"spring forward, 03:30 EDT", newYork, utc(3, 10, 7, 30), true},
+		{"spring forward, 04:59 EDT", newYork, utc(3, 10, 8, 59), true},
+		{"spring forward, 05:00 EDT", newYork, utc(3, 10, 9, 0), false},
+		{"fall back, 00:59 EDT", newYork, utc(11, 3, 4, 59), false},
+		{"fall back, 01:30 EDT", newYork, utc(11, 3, 5, 30), true},
+		{"fall back, 01:30 EST", newYork, utc(11, 3, 6, 30), true},
+		{"fall back, 04:59 EST", newYork, utc(11, 3, 9, 59), true},
+		{"fall back, 05:00 EST", newYork, utc(11, 3, 10, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := mustWindow(t, tt.window)
+			if got := w.open(tt.now); got != tt.want {
+				t.Errorf("open(%s) = %t, want %t", tt.now.Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowNext(t *testing.T) {
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC)
+	}
+	overnight := CrawlWindow{Domain: "example.com", Start: "22:00", End: "02:00"}
+	jakarta := CrawlWindow{Domain: "example.com", Start: "01:00", End: "05:00", Timezone: "Asia/Jakarta"}
+	newYork := CrawlWindow{Domain: "example.com", Start: "01:00", End: "05:00", Timezone: "America/New_York"}
+
+	tests := []struct {
+		name   string
+		window CrawlWindow
+		now    time.Time
+		end    bool // next end instead of next start
+		want   time.Time
+	}{
+		{"start later today", overnight, utc(1, 1, 12, 0), false, utc(1, 1, 22, 0)},
+		{"start tomorrow", overnight, utc(1, 1, 23, 0), false, utc(1, 2, 22, 0)},
+		{"at start, the next one", overnight, utc(1, 1, 22, 0), false, utc(1, 2, 22, 0)},
+		{"end after midnight", overnight, utc(1, 1, 23, 0), true, utc(1, 2, 2, 0)},
+		{"end before midnight passes", overnight, utc(1, 2, 1, 0), true, utc(1, 2, 2, 0)},
+		{"timezone, local date ahead of UTC", jakarta, utc(1, 1, 19, 0), true, utc(1, 1, 22, 0)},
+		{"timezone, start after local midnight", jakarta, utc(1, 1, 12, 0), false, utc(1, 1, 18, 0)},
+		{"spring forward start", newYork, utc(3, 9, 17, 0), false, utc(3, 10, 6, 0)},
+		{"spring forward end", newYork, utc(3, 10, 6, 30), true, utc(3, 10, 9, 0)},
+		{"day after spring forward", newYork, utc(3, 10, 12, 0), false, utc(3, 11, 5, 0)},
+		{"fall back end", newYork, utc(11, 3, 6, 30), true, utc(11, 3, 10, 0)},
+		{"day after fall back", newYork, utc(11, 3, 12, 0), false, utc(11, 4, 6, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := mustWindow(t, tt.window)
+			minute := w.start
+			if tt.end {
+				minute = w.end
+			}
+			if got := w.next(tt.now, minute); !got.Equal(tt.want) {
+				t.Errorf("next(%s) = %s, want %s", tt.now.Format(time.RFC3339),
+					got.UTC().Format(time.RFC3339), tt.want.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestWindowFor(t *testing.T) {
+	windows, err := parseWindows([]CrawlWindow{
+		{Domain: "example.com", Start: "01:00", End: "05:00"},
+		{Domain: "news.example.com", Start: "02:00", End: "03:00"},
+		{Domain: "www.other.org", Start: "01:00", End: "05:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newWindowGate(windows)
+
+	tests := []struct {
+		host string
+		want string // window domain; "" = no window
+	}{
+		{"example.com", "example.com"},
+		{"shop.example.com", "example.com"},
+		{"news.example.com", "news.example.com"},
+		{"a.news.example.com", "news.example.com"},
+		{"NEWS.Example.COM", "news.example.com"},
+		{"www.example.com", "example.com"},
+		{"other.org", "other.org"},
+		{"notexample.com", ""},
+		{"example.com.evil.net", ""},
+		{"example.org", ""},
+	}
+	for _, tt := range tests {
+		w, ok := g.windowFor(tt.host)
+		got := ""
+		if ok {
+			got = w.cfg.Domain
+		}
+		if got != tt.want {
+			t.Errorf("windowFor(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package amqpconn keeps a RabbitMQ connection and channel usable across
+// broker restarts and network drops. A Manager dials with exponential
+// backoff, and runs a setup function (topology, QoS, confirm mode) on every
+// channel it opens, so callers get back a channel in the same state after
+// each reconnect.
+package amqpconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/sleep"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Config describes the connection a Manager maintains
+type Config struct {
+	URL string
+
+	// Setup runs on every new channel before it is handed out, e.g. to
+	// declare the topology, set QoS or enable publisher confirms
+	Setup func(ch *amqp.Channel) error
+
+	MinBackoff time.Duration // delay after the first failed attempt (0 = 500ms)
+	MaxBackoff time.Duration // cap on the delay between attempts (0 = 30s)
+}
+
+// ErrClosed is returned by Reconnect after Close
+var ErrClosed = errors.New("amqpconn: manager closed")
+
+// Manager owns one connection and one channel, and replaces both on Reconnect
+type Manager struct {
+	cfg        Config
+	reconnects atomic.Int64
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	ch     *amqp.Channel
+	closed bool
+}
+
+// Dial connects, retrying with exponential backoff until ctx is done
+func Dial(ctx context.Context, cfg Config) (*Manager, error) {
+	m := &Manager{cfg: cfg}
+	if err := m.connect(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Channel returns the current channel. It is replaced by Reconnect, so
+// don't hold on to it across a reconnect.
+func (m *Manager) Channel() *amqp.Channel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ch
+}
+
+// Connected reports whether the current connection and channel are open.
+// It turns false as soon as the broker goes away, before anyone notices and
+// calls Reconnect.
+func (m *Manager) Connected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn != nil && !m.conn.IsClosed() && m.ch != nil && !m.ch.IsClosed()
+}
+
+// Reconnects is how many times the connection has been re-established
+func (m *Manager) Reconnects() int64 {
+	return m.reconnects.Load()
+}
+
+// Reconnect drops the current connection, if it is still open, and dials
+// again with backoff until ctx is done. Setup has run on the returned channel.
+func (m *Manager) Reconnect(ctx context.Context) (*amqp.Channel, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	conn := m.conn
+	m.mu.Unlock()
+	if conn != nil && !conn.IsClosed() {
+		_ = conn.Close()
+	}
+
+	if err := m.connect(ctx); err != nil {
+		return nil, err
+	}
+	m.reconnects.Add(1)
+	log.Printf("amqp: reconnected")
+	return m.Channel(), nil
+}
+
+// Close closes the channel and the connection; Reconnect fails afterwards
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	if m.conn == nil || m.conn.IsClosed() {
+		return nil
+	}
+	if m.ch != nil {
+		_ = m.ch.Close()
+	}
+	return m.conn.Close()
+}
+
+// connect dials until it succeeds or ctx is done. The first attempt is
+// immediate; after that the delay doubles up to MaxBackoff, with jitter so a
+// fleet of workers doesn't reconnect in lockstep.
+func (m *Manager) connect(ctx context.Context) error {
+	backoff := m.cfg.MinBackoff
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+	maxBackoff := m.cfg.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := m.dial()
+		if err == nil || errors.Is(err, ErrClosed) {
+			return err
+		}
+
+		delay := backoff + rand.N(backoff/5+1)
+		log.Printf("amqp: connect attempt %d failed: %v; retrying in %s", attempt, err, delay.Round(time.Millisecond))
+		if waitErr := sleep.Until(ctx, delay); waitErr != nil {
+			return fmt.Errorf("amqp: giving up after %d attempt(s): %w (last error: %v)", attempt, waitErr, err)
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// dial makes a single attempt to open a connection and a ready channel
+func (m *Manager) dial() error {
+	conn, err := amqp.Dial(m.cfg.URL)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("open channel: %w", err)
+	}
+	if m.cfg.Setup != nil {
+		if err := m.cfg.Setup(ch); err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("set up channel: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		_ = conn.Close()
+		return ErrClosed
+	}
+	m.conn, m.ch = conn, ch
+	return nil
+}
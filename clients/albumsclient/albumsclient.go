@@ -0,0 +1,83 @@
+// Package albumsclient is a typed client for the albums service (go-tutor/web-service-gin)
+package albumsclient
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"net/url"
+
+	"github.com/fajar/learn-go/clients/httpclient"
+)
+
+// DefaultBaseURL is where the albums service listens when run locally
+const DefaultBaseURL = "http://localhost:8080"
+
+// Album is a stored album; prices are in integer cents
+type Album struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Artist     string `json:"artist"`
+	PriceCents int64  `json:"price_cents"`
+}
+
+// CreateAlbumRequest is the payload for adding an album; the server assigns the ID
+type CreateAlbumRequest struct {
+	Title      string `json:"title"`
+	Artist     string `json:"artist"`
+	PriceCents int64  `json:"price_cents"`
+}
+
+// Client talks to the albums service
+type Client struct {
+	HTTP *httpclient.Client
+}
+
+// New creates a client for the service at baseURL (see DefaultBaseURL)
+func New(baseURL string) *Client {
+	return &Client{HTTP: httpclient.New(baseURL)}
+}
+
+// Create adds an album and returns it with its assigned ID
+func (c *Client) Create(ctx context.Context, req CreateAlbumRequest) (*Album, error) {
+	var album Album
+	if err := c.HTTP.Do(ctx, http.MethodPost, "/albums", nil, req, &album); err != nil {
+		return nil, err
+	}
+	return &album, nil
+}
+
+// Get returns a single album; use httpclient.IsNotFound to detect a missing ID
+func (c *Client) Get(ctx context.Context, id string) (*Album, error) {
+	var album Album
+	if err := c.HTTP.Do(ctx, http.MethodGet, "/albums/"+url.PathEscape(id), nil, nil, &album); err != nil {
+		return nil, err
+	}
+	return &album, nil
+}
+
+// List returns every album
+func (c *Client) List(ctx context.Context) ([]Album, error) {
+	var albums []Album
+	if err := c.HTTP.Do(ctx, http.MethodGet, "/albums", nil, nil, &albums); err != nil {
+		return nil, err
+	}
+	return albums, nil
+}
+
+// All iterates over every album. The service returns the full list in one
+// response, so this is a single request.
+func (c *Client) All(ctx context.Context) iter.Seq2[Album, error] {
+	return func(yield func(Album, error) bool) {
+		albums, err := c.List(ctx)
+		if err != nil {
+			yield(Album{}, err)
+			return
+		}
+		for _, album := range albums {
+			if !yield(album, nil) {
+				return
+			}
+		}
+	}
+}
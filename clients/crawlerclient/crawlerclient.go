@@ -0,0 +1,166 @@
+// Package crawlerclient is a typed client for the Crawler REST API (07-crawl/api)
+package crawlerclient
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fajar/learn-go/clients/httpclient"
+	"github.com/fajar/learn-go/httpdelete"
+)
+
+// DefaultBaseURL is where the Crawler API listens when run locally
+const DefaultBaseURL = "http://localhost:8081/api/v1"
+
+// CrawlRequest describes a crawl to submit
+type CrawlRequest struct {
+	Keywords  []string `json:"keywords"`
+	Domains   []string `json:"domains"`
+	StartDate *string  `json:"start_date,omitempty"` // YYYY-MM-DD
+	EndDate   *string  `json:"end_date,omitempty"`   // YYYY-MM-DD
+	MaxDepth  int      `json:"max_depth,omitempty"`
+	MaxPages  int      `json:"max_pages,omitempty"`
+}
+
+// CrawlResponse is returned after submitting a crawl
+type CrawlResponse struct {
+	CrawlID   string `json:"crawl_id"`
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+}
+
+// CrawlStatus is the state of a crawl job
+type CrawlStatus struct {
+	CrawlID       string     `json:"crawl_id"`
+	Status        string     `json:"status"`
+	Progress      int        `json:"progress"`
+	TotalURLs     int        `json:"total_urls"`
+	ProcessedURLs int        `json:"processed_urls"`
+	StartTime     time.Time  `json:"start_time"`
+	EndTime       *time.Time `json:"end_time,omitempty"`
+}
+
+// CrawlResult is a single crawled page
+type CrawlResult struct {
+	URL        string            `json:"url"`
+	Title      string            `json:"title"`
+	Content    string            `json:"content"`
+	Domain     string            `json:"domain"`
+	Keywords   []string          `json:"keywords"`
+	Timestamp  time.Time         `json:"timestamp"`
+	StatusCode int               `json:"status_code"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// Pagination describes where a ResultsPage sits in the full result set
+type Pagination struct {
+	Page  int `json:"page"`
+	Limit int `json:"limit"`
+	Total int `json:"total"`
+	Pages int `json:"pages"`
+}
+
+// ResultsPage is one page of a crawl's results
+type ResultsPage struct {
+	CrawlID    string        `json:"crawl_id"`
+	Results    []CrawlResult `json:"results"`
+	Pagination Pagination    `json:"pagination"`
+}
+
+// Client talks to the Crawler API
+type Client struct {
+	HTTP *httpclient.Client
+}
+
+// New creates a client for the API at baseURL (see DefaultBaseURL). apiKey
+// selects the rate-limit tier and may be empty for anonymous access.
+func New(baseURL, apiKey string) *Client {
+	h := httpclient.New(baseURL)
+	if apiKey != "" {
+		h.Header.Set("X-API-Key", apiKey)
+	}
+	return &Client{HTTP: h}
+}
+
+// SubmitCrawl starts a new crawl job
+func (c *Client) SubmitCrawl(ctx context.Context, req CrawlRequest) (*CrawlResponse, error) {
+	var resp CrawlResponse
+	if err := c.HTTP.Do(ctx, http.MethodPost, "/crawl", nil, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetCrawl returns the status of a crawl job
+func (c *Client) GetCrawl(ctx context.Context, crawlID string) (*CrawlStatus, error) {
+	var status CrawlStatus
+	if err := c.HTTP.Do(ctx, http.MethodGet, "/crawl/"+url.PathEscape(crawlID), nil, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ListCrawls returns every known crawl job
+func (c *Client) ListCrawls(ctx context.Context) ([]CrawlStatus, error) {
+	var resp struct {
+		Crawls []CrawlStatus `json:"crawls"`
+	}
+	if err := c.HTTP.Do(ctx, http.MethodGet, "/crawl", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Crawls, nil
+}
+
+// CancelCrawl stops a running crawl job and reports whether it was still
+// running. Cancelling a crawl that is unknown or already cancelled is not an
+// error; cancelling one that already finished is a 409.
+func (c *Client) CancelCrawl(ctx context.Context, crawlID string) (bool, error) {
+	header, err := c.HTTP.DoHeader(ctx, http.MethodDelete, "/crawl/"+url.PathEscape(crawlID), nil, nil, nil)
+	if httpclient.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return header.Get(httpdelete.HeaderAlreadyAbsent) != "true", nil
+}
+
+// ResultsPage fetches one page of results; page numbers start at 1 and limit is capped at 1000 by the server
+func (c *Client) ResultsPage(ctx context.Context, crawlID string, page, limit int) (*ResultsPage, error) {
+	query := url.Values{}
+	query.Set("page", strconv.Itoa(page))
+	query.Set("limit", strconv.Itoa(limit))
+
+	var resp ResultsPage
+	if err := c.HTTP.Do(ctx, http.MethodGet, "/crawl/"+url.PathEscape(crawlID)+"/results", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Results iterates over every result of a crawl, fetching pageSize results
+// per request. Iteration stops at the first error, which is yielded once.
+func (c *Client) Results(ctx context.Context, crawlID string, pageSize int) iter.Seq2[CrawlResult, error] {
+	return func(yield func(CrawlResult, error) bool) {
+		for page := 1; ; page++ {
+			resp, err := c.ResultsPage(ctx, crawlID, page, pageSize)
+			if err != nil {
+				yield(CrawlResult{}, err)
+				return
+			}
+			for _, result := range resp.Results {
+				if !yield(result, nil) {
+					return
+				}
+			}
+			if len(resp.Results) == 0 || page >= resp.Pagination.Pages {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package crawlerclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fajar/learn-go/clients/httpclient"
+	"github.com/fajar/learn-go/httpdelete"
+)
+
+// cancelServer answers DELETE /crawl/:id with an httpdelete.Handler whose
+// absent status is absentStatus: "running" is cancelled, "done" already
+// finished and anything else is unknown
+func cancelServer(t *testing.T, absentStatus int) *Client {
+	t.Helper()
+	h := &httpdelete.Handler{Service: "crawler", AbsentStatus: absentStatus, Audit: nopAuditor{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/crawl/")
+		h.Delete(w, r, "crawl", id, func(context.Context) (bool, error) {
+			switch id {
+			case "running":
+				return true, nil
+			case "done":
+				return true, &httpdelete.Error{Status: http.StatusConflict, Message: "crawl already finished"}
+			}
+			return false, nil
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return New(srv.URL, "")
+}
+
+type nopAuditor struct{}
+
+func (nopAuditor) Record(context.Context, httpdelete.Event) {}
+
+func TestCancelCrawl(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		c := cancelServer(t, status)
+
+		if running, err := c.CancelCrawl(context.Background(), "running"); err != nil || !running {
+			t.Errorf("absent status %d: CancelCrawl(running) = %v, %v, want true, nil", status, running, err)
+		}
+		if running, err := c.CancelCrawl(context.Background(), "unknown"); err != nil || running {
+			t.Errorf("absent status %d: CancelCrawl(unknown) = %v, %v, want false, nil", status, running, err)
+		}
+		if _, err := c.CancelCrawl(context.Background(), "done"); !httpclient.IsConflict(err) {
+			t.Errorf("absent status %d: CancelCrawl(done) error = %v, want a conflict", status, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package httpclient is the JSON-over-HTTP transport shared by the service
+// client libraries (crawlerclient, usersclient, albumsclient). It handles
+// request encoding, error decoding, and retries with backoff.
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/sleep"
+)
+
+// Client sends JSON requests to a single service
+type Client struct {
+	BaseURL    string        // e.g. http://localhost:8081/api/v1
+	HTTPClient *http.Client  // defaults to a client with a 30s timeout
+	Header     http.Header   // sent with every request, e.g. X-API-Key
+	MaxRetries int           // retries after the first attempt (0 = no retries)
+	Backoff    time.Duration // base delay, doubled after each retry
+	MaxBackoff time.Duration // upper bound for a single delay, including Retry-After
+}
+
+// New creates a client with sensible retry defaults
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		Header:     make(http.Header),
+		MaxRetries: 3,
+		Backoff:    200 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+	}
+}
+
+// Error is returned for any non-2xx response
+type Error struct {
+	StatusCode int
+	Message    string // the service's "error" field, or the raw body
+	Details    string // the service's "details" field, if any
+	Code       string // the service's "code" field, e.g. "conflict", if any
+	Field      string // the service's "field" field: the input at fault, if any
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("http %d: %s: %s", e.StatusCode, e.Message, e.Details)
+	}
+	return fmt.Sprintf("http %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the service
+func IsNotFound(err error) bool {
+	var httpErr *Error
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 from the service, e.g. a unique
+// field that is already taken
+func IsConflict(err error) bool {
+	var httpErr *Error
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict
+}
+
+// Do sends a request and decodes the JSON response into out (which may be
+// nil). body, if non-nil, is encoded as JSON. Network errors, 429 and 5xx
+// responses are retried; non-idempotent methods are only retried on 429,
+// since the server did not process the request.
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	_, err := c.DoHeader(ctx, method, path, query, body, out)
+	return err
+}
+
+// DoHeader is Do for responses whose headers matter, such as a 204 that
+// carries its result in a header. The header is nil when no response was
+// received.
+func (c *Client) DoHeader(ctx context.Context, method, path string, query url.Values, body, out any) (http.Header, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("encode request: %w", err)
+		}
+	}
+
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, target, payload)
+
+		var retryAfter time.Duration
+		retryable := false
+		switch {
+		case err != nil:
+			retryable = idempotent(method) && ctx.Err() == nil
+		case resp.StatusCode == http.StatusTooManyRequests:
+			retryable = true
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		case resp.StatusCode >= 500:
+			retryable = idempotent(method)
+		}
+
+		if !retryable || attempt >= c.MaxRetries {
+			if err != nil {
+				return nil, err
+			}
+			return resp.Header, decode(resp, out)
+		}
+
+		if resp != nil {
+			// Drain so the connection can be reused
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := c.sleep(ctx, attempt, retryAfter); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// send performs a single attempt
+func (c *Client) send(ctx context.Context, method, target string, payload []byte) (*http.Response, error) {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	for key, values := range c.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+// sleep waits before the next attempt, honoring Retry-After when the server sent one
+func (c *Client) sleep(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	delay := retryAfter
+	if delay == 0 {
+		delay = c.Backoff << attempt
+	}
+	if c.MaxBackoff > 0 && delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+
+	return sleep.Until(ctx, delay)
+}
+
+// decode turns a response into out or an *Error
+func decode(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		httpErr := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		var body struct {
+			Error   string `json:"error"`
+			Details string `json:"details"`
+			Code    string `json:"code"`
+			Field   string `json:"field"`
+		}
+		if json.Unmarshal(data, &body) == nil && body.Error != "" {
+			httpErr.Message = body.Error
+			httpErr.Details = body.Details
+			httpErr.Code = body.Code
+			httpErr.Field = body.Field
+		}
+		return httpErr
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// idempotent reports whether a request can safely be sent twice
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,253 @@
+// Package usersclient is a typed client for the users CRUD service (06-mysql-demo)
+package usersclient
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fajar/learn-go/clients/httpclient"
+	"github.com/fajar/learn-go/httpdelete"
+)
+
+// DefaultBaseURL is where the users service listens when run locally
+const DefaultBaseURL = "http://localhost:8080"
+
+// User is a stored user
+type User struct {
+	ID        uint64    `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedBy string    `json:"created_by"` // principal that created the user
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedBy string    `json:"updated_by"` // principal of the last change
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UserInput is the payload for creating or updating a user
+type UserInput struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// UserPatch is the payload of Patch: only the fields set are changed
+type UserPatch struct {
+	Name  *string `json:"name,omitempty"`
+	Email *string `json:"email,omitempty"`
+}
+
+// Operations for Batch
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// BatchOperation is one item of a Batch: create takes Name and Email,
+// update takes ID, Name and Email, and delete takes ID
+type BatchOperation struct {
+	Op    string `json:"op"`
+	ID    uint64 `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// BatchItemResult is the outcome of one operation, with the status the
+// single-user endpoint would have answered
+type BatchItemResult struct {
+	Index         int    `json:"index"`
+	Op            string `json:"op"`
+	ID            uint64 `json:"id,omitempty"`
+	Status        int    `json:"status"`
+	User          *User  `json:"user,omitempty"`
+	Error         string `json:"error,omitempty"`
+	Code          string `json:"code,omitempty"`  // e.g. "conflict" or "invalid_value"
+	Field         string `json:"field,omitempty"` // the field at fault, e.g. of a 409
+	AlreadyAbsent bool   `json:"already_absent,omitempty"`
+}
+
+// OK reports whether the operation succeeded
+func (r BatchItemResult) OK() bool {
+	return r.Status < 400
+}
+
+// BatchResult is the response to Batch
+type BatchResult struct {
+	Atomic    bool              `json:"atomic"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// ListOptions selects a page of List. Zero values take the service's
+// defaults: 50 users, newest first, unfiltered.
+type ListOptions struct {
+	Limit  int // at most 1000
+	Offset int
+	Sort   string // "name" or "created_at"
+	Order  string // "asc" or "desc"
+	Name   string // only users whose name contains it
+	Email  string // only users whose email contains it
+}
+
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Offset > 0 {
+		query.Set("offset", strconv.Itoa(o.Offset))
+	}
+	for key, value := range map[string]string{"sort": o.Sort, "order": o.Order, "name": o.Name, "email": o.Email} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	return query
+}
+
+// Pagination describes where a UserPage sits among the users matching its
+// filters
+type Pagination struct {
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	Total  int    `json:"total"`
+	Sort   string `json:"sort"`
+	Order  string `json:"order"`
+}
+
+// UserPage is the response to List
+type UserPage struct {
+	Users      []User     `json:"users"`
+	Pagination Pagination `json:"pagination"`
+}
+
+// Client talks to the users service
+type Client struct {
+	HTTP *httpclient.Client
+}
+
+// New creates a client for the service at baseURL (see DefaultBaseURL).
+// token is one of the service's API_TOKENS, and names the principal its
+// changes are attributed to; it may be empty when API_TOKENS is unset.
+func New(baseURL, token string) *Client {
+	h := httpclient.New(baseURL)
+	if token != "" {
+		h.Header.Set("Authorization", "Bearer "+token)
+	}
+	return &Client{HTTP: h}
+}
+
+// Create adds a user and returns it with its assigned ID; use
+// httpclient.IsConflict to detect an email that is already taken
+func (c *Client) Create(ctx context.Context, in UserInput) (*User, error) {
+	var user User
+	if err := c.HTTP.Do(ctx, http.MethodPost, "/users", nil, in, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Get returns a single user; use httpclient.IsNotFound to detect a missing ID
+func (c *Client) Get(ctx context.Context, id uint64) (*User, error) {
+	var user User
+	if err := c.HTTP.Do(ctx, http.MethodGet, userPath(id), nil, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// List returns one page of users; see All to iterate over every page
+func (c *Client) List(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	var page UserPage
+	if err := c.HTTP.Do(ctx, http.MethodGet, "/users", opts.query(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Update replaces a user's name and email; like Create, a taken email is a 409
+func (c *Client) Update(ctx context.Context, id uint64, in UserInput) (*User, error) {
+	var user User
+	if err := c.HTTP.Do(ctx, http.MethodPut, userPath(id), nil, in, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Patch changes only the fields patch sets, leaving the others as they
+// are; a taken email is a 409, and an invalid field a 400 whose
+// *httpclient.Error names it in Field
+func (c *Client) Patch(ctx context.Context, id uint64, patch UserPatch) (*User, error) {
+	var user User
+	if err := c.HTTP.Do(ctx, http.MethodPatch, userPath(id), nil, patch, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Delete removes a user and reports whether it existed. Deleting a user
+// that doesn't exist is not an error, whichever status the service is
+// configured to answer it with.
+func (c *Client) Delete(ctx context.Context, id uint64) (bool, error) {
+	header, err := c.HTTP.DoHeader(ctx, http.MethodDelete, userPath(id), nil, nil, nil)
+	if httpclient.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return header.Get(httpdelete.HeaderAlreadyAbsent) != "true", nil
+}
+
+// Batch runs up to 100 operations in one request, in order. Without atomic
+// each operation stands alone and its outcome is in the result, so a partly
+// failed batch is not an error. With atomic the operations run in one
+// transaction: the first failure rolls back the rest and is returned as an
+// *httpclient.Error with that operation's status.
+func (c *Client) Batch(ctx context.Context, ops []BatchOperation, atomic bool) (*BatchResult, error) {
+	var query url.Values
+	if atomic {
+		query = url.Values{"atomic": {"true"}}
+	}
+	var result BatchResult
+	body := struct {
+		Operations []BatchOperation `json:"operations"`
+	}{ops}
+	if err := c.HTTP.Do(ctx, http.MethodPost, "/users/batch", query, body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// All iterates over every user matching opts, from opts.Offset, fetching
+// opts.Limit users per request. Users created or deleted while it runs can
+// shift the pages, so one may be skipped or seen twice. Iteration stops at
+// the first error, which is yielded once.
+func (c *Client) All(ctx context.Context, opts ListOptions) iter.Seq2[User, error] {
+	return func(yield func(User, error) bool) {
+		for {
+			page, err := c.List(ctx, opts)
+			if err != nil {
+				yield(User{}, err)
+				return
+			}
+			for _, user := range page.Users {
+				if !yield(user, nil) {
+					return
+				}
+			}
+			opts.Offset += len(page.Users)
+			if len(page.Users) == 0 || opts.Offset >= page.Pagination.Total {
+				return
+			}
+		}
+	}
+}
+
+func userPath(id uint64) string {
+	return "/users/" + strconv.FormatUint(id, 10)
+}
@@ -0,0 +1,50 @@
+package usersclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fajar/learn-go/httpdelete"
+)
+
+// deleteServer answers DELETE /users/:id with an httpdelete.Handler whose
+// absent status is absentStatus; only exists is there to delete
+func deleteServer(t *testing.T, absentStatus int, exists uint64) *Client {
+	t.Helper()
+	h := &httpdelete.Handler{Service: "users", AbsentStatus: absentStatus, Audit: nopAuditor{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/users/")
+		h.Delete(w, r, "user", id, func(context.Context) (bool, error) {
+			return id == strconv.FormatUint(exists, 10), nil
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return New(srv.URL, "")
+}
+
+type nopAuditor struct{}
+
+func (nopAuditor) Record(context.Context, httpdelete.Event) {}
+
+func TestDeleteExisted(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		c := deleteServer(t, status, 7)
+		tests := []struct {
+			id   uint64
+			want bool
+		}{
+			{7, true},
+			{8, false},
+		}
+		for _, tt := range tests {
+			existed, err := c.Delete(context.Background(), tt.id)
+			if err != nil || existed != tt.want {
+				t.Errorf("absent status %d: Delete(%d) = %v, %v, want %v, nil", status, tt.id, existed, err, tt.want)
+			}
+		}
+	}
+}
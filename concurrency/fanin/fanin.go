@@ -0,0 +1,102 @@
+// Package fanin merges the output of several producers into one channel,
+// the fan-in half of fan-out/fan-in, and with Ordered fans work out to a
+// pool of workers and back in without losing the input's order. Unlike the
+// tutorial's merge, every function stops when its context is done, so an
+// abandoned consumer doesn't leave goroutines blocked on sends forever.
+package fanin
+
+import (
+	"context"
+	"sync"
+)
+
+// Merge forwards every value received on chans to the returned channel,
+// which is closed once all of chans are closed or ctx is done. Values from
+// one channel keep their order; values from different channels interleave.
+//
+// After ctx is done Merge stops receiving, so producers should stop too,
+// usually by selecting on the same ctx when they send.
+func Merge[T any](ctx context.Context, chans ...<-chan T) <-chan T {
+	out := make(chan T)
+	var wg sync.WaitGroup
+	wg.Add(len(chans))
+	for _, c := range chans {
+		go func(c <-chan T) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case v, ok := <-c:
+					if !ok {
+						return
+					}
+					select {
+					case out <- v:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(c)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// Producer sends values on out until it is done or ctx is, and returns why
+// it stopped. It should select on ctx.Done() when sending, and must not
+// close out.
+type Producer[T any] func(ctx context.Context, out chan<- T) error
+
+// MergeResults runs each producer in its own goroutine and merges what they
+// send. The first error a producer returns cancels the context of all the
+// others and is sent on the error channel; later errors, including the
+// context.Canceled the others return, are dropped. Both channels are
+// closed once every producer has returned, so a caller ranges over the
+// values and then reads the error, which is nil when all succeeded:
+//
+//	values, errc := fanin.MergeResults(ctx, producers...)
+//	for v := range values {
+//		...
+//	}
+//	if err := <-errc; err != nil {
+//		...
+//	}
+//
+// The caller must receive until the values channel is closed, or cancel
+// ctx, for the producers to finish.
+func MergeResults[T any](ctx context.Context, producers ...Producer[T]) (<-chan T, <-chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+	out := make(chan T)
+	errc := make(chan error, 1)
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+	)
+	wg.Add(len(producers))
+	for _, produce := range producers {
+		go func(produce Producer[T]) {
+			defer wg.Done()
+			if err := produce(ctx, out); err != nil {
+				once.Do(func() {
+					errc <- err
+					cancel()
+				})
+			}
+		}(produce)
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(out)
+		close(errc)
+	}()
+	return out, errc
+}
@@ -0,0 +1,168 @@
+package fanin
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closedWithin fails the test unless c is closed, after draining anything
+// still on it, within a second
+func closedWithin[T any](t *testing.T, c <-chan T) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("channel not closed")
+		}
+	}
+}
+
+func TestMergeForwardsEverything(t *testing.T) {
+	ctx := context.Background()
+	var got []int
+	for v := range Merge(ctx, send(ctx, 100), send(ctx, 50), send(ctx, 0)) {
+		got = append(got, v)
+	}
+
+	var want []int
+	for i := range 100 {
+		want = append(want, i)
+	}
+	for i := range 50 {
+		want = append(want, i)
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %d values, want %d: %v", len(got), len(want), got)
+	}
+}
+
+func TestMergeKeepsEachChannelsOrder(t *testing.T) {
+	ctx := context.Background()
+	tagged := func(tag, n int) <-chan int {
+		c := make(chan int)
+		go func() {
+			defer close(c)
+			for i := range n {
+				c <- tag*1000 + i
+			}
+		}()
+		return c
+	}
+
+	last := map[int]int{1: -1, 2: -1}
+	for v := range Merge(ctx, tagged(1, 100), tagged(2, 100)) {
+		tag, i := v/1000, v%1000
+		if i != last[tag]+1 {
+			t.Fatalf("channel %d sent %d after %d", tag, i, last[tag])
+		}
+		last[tag] = i
+	}
+}
+
+func TestMergeNoChannels(t *testing.T) {
+	closedWithin(t, Merge[int](context.Background()))
+}
+
+func TestMergeCancelCloses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	never := make(chan int) // never sends or closes
+	out := Merge(ctx, send(ctx, 1000), never)
+
+	<-out
+	cancel()
+	closedWithin(t, out)
+}
+
+// count sends 0..n-1 and returns nil
+func count(n int) Producer[int] {
+	return func(ctx context.Context, out chan<- int) error {
+		for i := range n {
+			select {
+			case out <- i:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+}
+
+func TestMergeResultsAllSucceed(t *testing.T) {
+	values, errc := MergeResults(context.Background(), count(10), count(20), count(0))
+	n := 0
+	for range values {
+		n++
+	}
+	if n != 30 {
+		t.Errorf("got %d values, want 30", n)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("error = %v, want nil", err)
+	}
+}
+
+func TestMergeResultsFirstErrorWins(t *testing.T) {
+	first := errors.New("first")
+	var cancelled atomic.Int32
+
+	// blocked sends nothing until its context is cancelled
+	blocked := func(ctx context.Context, out chan<- int) error {
+		<-ctx.Done()
+		cancelled.Add(1)
+		return ctx.Err()
+	}
+	failing := func(ctx context.Context, out chan<- int) error {
+		select {
+		case out <- -1:
+		case <-ctx.Done():
+		}
+		return first
+	}
+	late := func(ctx context.Context, out chan<- int) error {
+		<-ctx.Done()
+		return errors.New("late")
+	}
+
+	values, errc := MergeResults(context.Background(), blocked, failing, blocked, late)
+	for range values {
+	}
+	if err := <-errc; err != first {
+		t.Errorf("error = %v, want %v", err, first)
+	}
+	if n := cancelled.Load(); n != 2 {
+		t.Errorf("%d producers saw their context cancelled, want 2", n)
+	}
+	closedWithin(t, errc)
+}
+
+func TestMergeResultsCancelCloses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	values, errc := MergeResults(ctx, count(1000), count(1000))
+
+	<-values
+	cancel()
+	closedWithin(t, values)
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	closedWithin(t, errc)
+}
+
+func TestMergeResultsNoProducers(t *testing.T) {
+	values, errc := MergeResults[int](context.Background())
+	closedWithin(t, values)
+	if err := <-errc; err != nil {
+		t.Errorf("error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,106 @@
+package fanin
+
+import (
+	"context"
+	"sync"
+)
+
+// sequenced pairs a value with its position in the input
+type sequenced[T any] struct {
+	seq   int
+	value T
+}
+
+// Ordered runs fn on every value received on input in a pool of workers,
+// and sends the results on the returned channel in the order the values
+// arrived, whatever order the workers finish in. The channel is closed once
+// input is closed and every result is sent, or soon after ctx is done.
+//
+// At most window values are being worked on or waiting for an earlier one
+// to be sent, so one slow value holds up at most window-1 results behind
+// it rather than buffering the rest of the input. window is raised to
+// workers if it is smaller, and workers to 1.
+//
+// After ctx is done Ordered stops receiving from input, so its producer
+// should stop too, usually by selecting on the same ctx when it sends.
+func Ordered[T, R any](ctx context.Context, input <-chan T, workers, window int, fn func(T) R) <-chan R {
+	workers = max(workers, 1)
+	window = max(window, workers)
+
+	jobs := make(chan sequenced[T])
+	done := make(chan sequenced[R])
+	out := make(chan R)
+	slots := make(chan struct{}, window) // held from dispatch until the result is sent
+
+	// Number each value and wait for a free slot before handing it out
+	go func() {
+		defer close(jobs)
+		for seq := 0; ; seq++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			var v T
+			var ok bool
+			select {
+			case v, ok = <-input:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- sequenced[T]{seq: seq, value: v}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for range workers {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				select {
+				case done <- sequenced[R]{seq: job.seq, value: fn(job.value)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Hold early results until everything before them has been sent. The
+	// slots keep pending to fewer than window entries.
+	go func() {
+		defer close(out)
+		pending := make(map[int]R, window)
+		next := 0
+		for r := range done {
+			pending[r.seq] = r.value
+			for {
+				v, ok := pending[next]
+				if !ok {
+					break
+				}
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return
+				}
+				delete(pending, next)
+				next++
+				<-slots
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,114 @@
+package fanin
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// send returns a channel that yields 0..n-1 and is then closed
+func send(ctx context.Context, n int) <-chan int {
+	c := make(chan int)
+	go func() {
+		defer close(c)
+		for i := range n {
+			select {
+			case c <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func TestOrderedKeepsInputOrder(t *testing.T) {
+	ctx := context.Background()
+	out := Ordered(ctx, send(ctx, 200), 8, 16, func(n int) int {
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		return n * n
+	})
+
+	want := 0
+	for got := range out {
+		if got != want*want {
+			t.Fatalf("result %d = %d, want %d", want, got, want*want)
+		}
+		want++
+	}
+	if want != 200 {
+		t.Fatalf("got %d results, want 200", want)
+	}
+}
+
+func TestOrderedWindowBoundsWork(t *testing.T) {
+	const workers, window = 2, 4
+	ctx := context.Background()
+
+	var (
+		mu      sync.Mutex
+		started int
+	)
+	release := make(chan struct{})
+	out := Ordered(ctx, send(ctx, 50), workers, window, func(n int) int {
+		mu.Lock()
+		started++
+		mu.Unlock()
+		if n == 0 {
+			<-release // the first value holds up every result behind it
+		}
+		return n
+	})
+
+	// Give the others time to run ahead as far as they can
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	ahead := started
+	mu.Unlock()
+	if ahead > window {
+		t.Fatalf("%d values started while the first was stuck, want at most the window of %d", ahead, window)
+	}
+	if ahead < window {
+		t.Fatalf("%d values started while the first was stuck, want the whole window of %d", ahead, window)
+	}
+
+	close(release)
+	n := 0
+	for got := range out {
+		if got != n {
+			t.Fatalf("result %d = %d", n, got)
+		}
+		n++
+	}
+	if n != 50 {
+		t.Fatalf("got %d results, want 50", n)
+	}
+}
+
+func TestOrderedStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := Ordered(ctx, send(ctx, 1_000_000), 4, 8, func(n int) int { return n })
+
+	<-out
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-out:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("output not closed after ctx was cancelled")
+		}
+	}
+}
+
+func TestOrderedEmptyInput(t *testing.T) {
+	ctx := context.Background()
+	for range Ordered(ctx, send(ctx, 0), 0, 0, func(n int) int { return n }) {
+		t.Fatal("got a result from empty input")
+	}
+}
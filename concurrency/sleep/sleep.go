@@ -0,0 +1,74 @@
+// Package sleep provides waits that end early when their context is done, so
+// a worker blocked in a retry delay or a poll interval doesn't hold up
+// shutdown or cancellation.
+package sleep
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Until waits for d, or until ctx is done, whichever comes first. It returns
+// nil after a full wait and ctx.Err() otherwise. A non-positive d returns
+// immediately, still reporting a done ctx.
+func Until(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Jitter returns base shifted by a random amount in [-jitter, +jitter],
+// never less than a millisecond
+func Jitter(base, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return base
+	}
+	d := base - jitter + rand.N(2*jitter+1)
+	return max(d, time.Millisecond)
+}
+
+// Ticker delivers ticks every base interval, each shifted by up to ±jitter so
+// workers started together drift apart. Unlike time.Ticker, C is closed once
+// the ticker stops, so a range over C ends on cancellation.
+type Ticker struct {
+	C <-chan time.Time
+
+	cancel context.CancelFunc
+}
+
+// NewTicker starts a ticker that runs until ctx is done or Stop is called.
+// It panics if base is not positive, like time.NewTicker. As with
+// time.Ticker, ticks are dropped for a slow receiver rather than queued.
+func NewTicker(ctx context.Context, base, jitter time.Duration) *Ticker {
+	if base <= 0 {
+		panic("sleep: non-positive interval for NewTicker")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := make(chan time.Time, 1)
+
+	go func() {
+		defer close(c)
+		for Until(ctx, Jitter(base, jitter)) == nil {
+			select {
+			case c <- time.Now():
+			default:
+			}
+		}
+	}()
+	return &Ticker{C: c, cancel: cancel}
+}
+
+// Stop ends the ticker; C is closed shortly after
+func (t *Ticker) Stop() {
+	t.cancel()
+}
@@ -0,0 +1,103 @@
+package sleep
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUntilWaits(t *testing.T) {
+	start := time.Now()
+	if err := Until(context.Background(), 20*time.Millisecond); err != nil {
+		t.Fatalf("Until = %v, want nil after a full wait", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Until returned after %s, want at least 20ms", waited)
+	}
+}
+
+func TestUntilEndsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := Until(ctx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Until = %v, want context.Canceled", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("Until returned after %s, want soon after the cancel", waited)
+	}
+}
+
+func TestUntilNonPositive(t *testing.T) {
+	if err := Until(context.Background(), 0); err != nil {
+		t.Errorf("Until(0) = %v, want nil", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Until(ctx, -time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("Until(-1s) on a done ctx = %v, want context.Canceled", err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if got := Jitter(time.Second, 0); got != time.Second {
+		t.Errorf("Jitter(1s, 0) = %s, want 1s", got)
+	}
+	for range 1000 {
+		if got := Jitter(time.Second, 100*time.Millisecond); got < 900*time.Millisecond || got > 1100*time.Millisecond {
+			t.Fatalf("Jitter(1s, 100ms) = %s, want within 900ms to 1.1s", got)
+		}
+	}
+	for range 1000 {
+		if got := Jitter(time.Millisecond, time.Second); got < time.Millisecond {
+			t.Fatalf("Jitter(1ms, 1s) = %s, want at least 1ms", got)
+		}
+	}
+}
+
+func TestTickerTicks(t *testing.T) {
+	ticker := NewTicker(context.Background(), 5*time.Millisecond, time.Millisecond)
+	defer ticker.Stop()
+
+	for i := range 3 {
+		select {
+		case _, ok := <-ticker.C:
+			if !ok {
+				t.Fatalf("C closed after %d ticks", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no tick %d within a second", i)
+		}
+	}
+}
+
+func TestTickerClosesWhenStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := NewTicker(ctx, time.Hour, 0)
+	stopped.Stop()
+	cancelled := NewTicker(ctx, time.Hour, 0)
+	cancel()
+
+	for name, ticker := range map[string]*Ticker{"Stop": stopped, "cancel": cancelled} {
+		select {
+		case _, ok := <-ticker.C:
+			if ok {
+				t.Errorf("%s: got a tick, want C closed", name)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: C not closed within a second", name)
+		}
+	}
+}
+
+func TestNewTickerPanicsOnNonPositive(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewTicker(0) didn't panic")
+		}
+	}()
+	NewTicker(context.Background(), 0, 0)
+}
@@ -0,0 +1,106 @@
+package crawlengine
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fajar/learn-go/concurrency/sleep"
+)
+
+// Fetcher retrieves one URL. Fetch never returns nil: a failure is a Result
+// with StatusError. Implementations must be safe for concurrent use.
+//
+// HTTPFetcher is the net/http one. 08-advanced-crawler has none: its pages
+// are fetched by colly, whose callbacks parse and follow them.
+type Fetcher interface {
+	Fetch(ctx context.Context, rawURL string) *Result
+}
+
+// DefaultUserAgent is what HTTPFetcher identifies as
+const DefaultUserAgent = "GoCrawler/1.0 (+https://example.com/bot)"
+
+// HTTPFetcher fetches with net/http, waiting at least its delay between two
+// requests to the same host. The client follows redirects, so a
+// StatusRedirect result is a 3xx it couldn't follow, such as one without a
+// Location.
+type HTTPFetcher struct {
+	client    *http.Client
+	userAgent string
+	delay     time.Duration
+	mu        sync.Mutex
+	last      map[string]time.Time // last request per host
+}
+
+// NewHTTPFetcher returns a fetcher that is polite to each host by delay
+func NewHTTPFetcher(delay time.Duration) *HTTPFetcher {
+	return &HTTPFetcher{
+		client:    &http.Client{Timeout: 30 * time.Second},
+		userAgent: DefaultUserAgent,
+		delay:     delay,
+		last:      make(map[string]time.Time),
+	}
+}
+
+// Fetch retrieves rawURL with politeness; a cancelled ctx ends both the
+// politeness wait and the request
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) *Result {
+	result := &Result{URL: rawURL, Status: StatusPending}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return result.fail(err)
+	}
+	if err := f.wait(ctx, parsed.Hostname()); err != nil {
+		return result.fail(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return result.fail(err)
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return result.fail(err)
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.Header = resp.Header
+	result.FetchedAt = time.Now()
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		result.Status = StatusRedirect
+		result.RedirectURL = resp.Header.Get("Location")
+		return result
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return result.fail(err)
+	}
+	result.Content = string(body)
+	result.Status = StatusFetched
+	return result
+}
+
+// wait holds the caller until host's delay has passed since its last
+// request, then records this one. Requests to other hosts wait behind it,
+// which keeps the politeness exact at the cost of some throughput.
+func (f *HTTPFetcher) wait(ctx context.Context, host string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if last, ok := f.last[host]; ok {
+		if since := time.Since(last); since < f.delay {
+			if err := sleep.Until(ctx, f.delay-since); err != nil {
+				return err
+			}
+		}
+	}
+	f.last[host] = time.Now()
+	return nil
+}
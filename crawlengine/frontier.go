@@ -0,0 +1,97 @@
+package crawlengine
+
+import (
+	"net/url"
+	"sync"
+)
+
+// DefaultFrontierSize is how many URLs a frontier queues before it drops
+// new ones
+const DefaultFrontierSize = 1000
+
+// Frontier is the queue of URLs still to crawl. Every URL is queued at
+// most once, and none deeper than its maximum depth.
+type Frontier struct {
+	urls     chan string
+	mu       sync.RWMutex
+	visited  map[string]bool
+	depth    map[string]int
+	maxDepth int // 0 = no limit
+}
+
+// NewFrontier returns a frontier holding up to size URLs, which refuses
+// URLs at maxDepth or deeper
+func NewFrontier(maxDepth, size int) *Frontier {
+	return &Frontier{
+		urls:     make(chan string, size),
+		visited:  make(map[string]bool),
+		depth:    make(map[string]int),
+		maxDepth: maxDepth,
+	}
+}
+
+// Add queues rawURL, found depth links from a seed, and reports whether it
+// was queued. A URL already seen, too deep, unparseable or arriving while
+// the queue is full is not.
+func (f *Frontier) Add(rawURL string, depth int) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	normalized := parsed.String()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.visited[normalized] || (f.maxDepth > 0 && depth >= f.maxDepth) {
+		return false
+	}
+	f.visited[normalized] = true
+	f.depth[normalized] = depth
+
+	select {
+	case f.urls <- normalized:
+		return true
+	default:
+		// The queue is full, skip this URL
+		return false
+	}
+}
+
+// MarkSeen records rawURL as seen without queueing it, for crawlers that
+// schedule their own requests and only need the frontier's deduplication
+func (f *Frontier) MarkSeen(rawURL string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.visited[rawURL] = true
+}
+
+// Seen reports whether rawURL was added or marked seen
+func (f *Frontier) Seen(rawURL string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.visited[rawURL]
+}
+
+// Next returns the next queued URL and its depth, or false when the queue
+// is empty right now
+func (f *Frontier) Next() (string, int, bool) {
+	select {
+	case u := <-f.urls:
+		f.mu.RLock()
+		depth := f.depth[u]
+		f.mu.RUnlock()
+		return u, depth, true
+	default:
+		return "", 0, false
+	}
+}
+
+// Len is the number of URLs waiting in the queue
+func (f *Frontier) Len() int {
+	return len(f.urls)
+}
+
+// Close closes the queue; Add must not be called after it
+func (f *Frontier) Close() {
+	close(f.urls)
+}
@@ -0,0 +1,95 @@
+package crawlengine
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestFrontierQueuesEachURLOnce(t *testing.T) {
+	f := NewFrontier(0, 10)
+	if !f.Add("https://example.com/a", 0) {
+		t.Fatal("first Add of a URL was refused")
+	}
+	if f.Add("https://example.com/a", 1) {
+		t.Error("second Add of the same URL was queued")
+	}
+	if f.Add("http://[::1", 0) {
+		t.Error("unparseable URL was queued")
+	}
+	if !f.Seen("https://example.com/a") || f.Seen("https://example.com/b") {
+		t.Error("Seen doesn't match what was added")
+	}
+
+	url, depth, ok := f.Next()
+	if !ok || url != "https://example.com/a" || depth != 0 {
+		t.Fatalf("Next() = %q, %d, %v; want the URL added at depth 0", url, depth, ok)
+	}
+	if _, _, ok := f.Next(); ok {
+		t.Error("Next() returned a URL from an empty queue")
+	}
+}
+
+func TestFrontierDepthLimit(t *testing.T) {
+	f := NewFrontier(2, 10)
+	if !f.Add("https://example.com/1", 1) {
+		t.Error("URL below the maximum depth was refused")
+	}
+	if f.Add("https://example.com/2", 2) {
+		t.Error("URL at the maximum depth was queued")
+	}
+
+	unlimited := NewFrontier(0, 10)
+	if !unlimited.Add("https://example.com/deep", 100) {
+		t.Error("maxDepth 0 refused a deep URL")
+	}
+}
+
+func TestFrontierFull(t *testing.T) {
+	f := NewFrontier(0, 1)
+	f.Add("https://example.com/1", 0)
+	if f.Add("https://example.com/2", 0) {
+		t.Error("URL queued past the frontier's size")
+	}
+	if f.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", f.Len())
+	}
+}
+
+func TestFrontierMarkSeen(t *testing.T) {
+	f := NewFrontier(0, 10)
+	f.MarkSeen("https://example.com/visited")
+	if !f.Seen("https://example.com/visited") {
+		t.Error("URL marked seen isn't Seen")
+	}
+	if f.Len() != 0 {
+		t.Error("MarkSeen queued the URL")
+	}
+	if f.Add("https://example.com/visited", 0) {
+		t.Error("URL marked seen was queued by Add")
+	}
+}
+
+func TestFrontierConcurrentAdd(t *testing.T) {
+	f := NewFrontier(0, 100)
+	var wg sync.WaitGroup
+	queued := make(chan bool, 50)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queued <- f.Add("https://example.com/same", 0)
+		}()
+	}
+	wg.Wait()
+	close(queued)
+
+	n := 0
+	for ok := range queued {
+		if ok {
+			n++
+		}
+	}
+	if n != 1 || f.Len() != 1 {
+		t.Errorf("URL queued %d times by concurrent Adds, want once", n)
+	}
+}
@@ -0,0 +1,68 @@
+package crawlengine
+
+import "sync"
+
+// Job statuses the crawl APIs report
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+
+	// JobWaitingForWindow is a crawl with nothing left to fetch until a
+	// domain's crawl window opens
+	JobWaitingForWindow = "waiting_for_window"
+)
+
+// Jobs is the store of crawl jobs a crawler's API serves, by ID. J is the
+// crawler's own job type, usually a pointer, which guards its own fields.
+type Jobs[J any] struct {
+	mu   sync.RWMutex
+	jobs map[string]J
+}
+
+// NewJobs returns an empty job store
+func NewJobs[J any]() *Jobs[J] {
+	return &Jobs[J]{jobs: make(map[string]J)}
+}
+
+// Add stores job under id, replacing any job with that ID
+func (s *Jobs[J]) Add(id string, job J) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id] = job
+}
+
+// Get returns the job stored under id
+func (s *Jobs[J]) Get(id string) (J, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// Delete removes the jobs with the given IDs
+func (s *Jobs[J]) Delete(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.jobs, id)
+	}
+}
+
+// All returns every job, in no particular order. The slice is a snapshot:
+// jobs added or deleted afterwards don't change it.
+func (s *Jobs[J]) All() []J {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jobs := make([]J, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// Len is the number of jobs stored
+func (s *Jobs[J]) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.jobs)
+}
@@ -0,0 +1,70 @@
+package crawlengine
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+type testJob struct{ id string }
+
+func TestJobs(t *testing.T) {
+	jobs := NewJobs[*testJob]()
+	if _, ok := jobs.Get("a"); ok {
+		t.Fatal("Get found a job in an empty store")
+	}
+
+	a, b := &testJob{"a"}, &testJob{"b"}
+	jobs.Add("a", a)
+	jobs.Add("b", b)
+	if got, ok := jobs.Get("a"); !ok || got != a {
+		t.Errorf("Get(a) = %v, %v; want the job added", got, ok)
+	}
+	if jobs.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", jobs.Len())
+	}
+
+	replacement := &testJob{"a"}
+	jobs.Add("a", replacement)
+	if got, _ := jobs.Get("a"); got != replacement || jobs.Len() != 2 {
+		t.Error("Add with an existing ID didn't replace the job")
+	}
+
+	all := jobs.All()
+	ids := make([]string, len(all))
+	for i, j := range all {
+		ids[i] = j.id
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"a", "b"}) {
+		t.Errorf("All() = %v, want a and b", ids)
+	}
+
+	jobs.Delete("a", "missing")
+	if _, ok := jobs.Get("a"); ok || jobs.Len() != 1 {
+		t.Error("Delete left the job behind")
+	}
+	if len(all) != 2 {
+		t.Error("All's snapshot changed after a Delete")
+	}
+}
+
+func TestJobsConcurrentUse(t *testing.T) {
+	jobs := NewJobs[int]()
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := string(rune('a' + i))
+			jobs.Add(id, i)
+			jobs.Get(id)
+			jobs.All()
+			jobs.Len()
+		}()
+	}
+	wg.Wait()
+	if jobs.Len() != 20 {
+		t.Errorf("Len() = %d after 20 concurrent Adds, want 20", jobs.Len())
+	}
+}
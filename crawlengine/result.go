@@ -0,0 +1,59 @@
+// Package crawlengine holds what the crawlers in 07-crawl and
+// 08-advanced-crawler have in common: the frontier of URLs still to fetch,
+// the Fetcher that retrieves one URL, the Result of a fetch and the Jobs
+// store their APIs, and 07-crawl/api, report on. Each crawler keeps only what is its own, such
+// as 07-crawl's bounded link parser or 08-advanced-crawler's colly
+// callbacks, so a feature of the shared pieces is written once.
+package crawlengine
+
+import (
+	"net/http"
+	"time"
+)
+
+// Status is how the fetch of a URL ended
+type Status int
+
+const (
+	StatusPending Status = iota
+	StatusFetched
+	StatusError
+	StatusRedirect
+)
+
+// String returns the status as the crawlers log it
+func (s Status) String() string {
+	switch s {
+	case StatusFetched:
+		return "fetched"
+	case StatusError:
+		return "error"
+	case StatusRedirect:
+		return "redirect"
+	default:
+		return "pending"
+	}
+}
+
+// Result is the outcome of fetching one URL. Links and LimitsHit are left
+// to the crawler that parses Content.
+type Result struct {
+	URL         string
+	Depth       int // links followed from a seed to reach URL
+	Status      Status
+	StatusCode  int
+	Header      http.Header
+	Content     string
+	Links       []string
+	Error       error
+	RedirectURL string
+	LimitsHit   []string // parse limits the page reached, its links are incomplete
+	FetchedAt   time.Time
+}
+
+// fail ends r with err
+func (r *Result) fail(err error) *Result {
+	r.Status = StatusError
+	r.Error = err
+	return r
+}
@@ -0,0 +1,124 @@
+// Package emailtopology is the RabbitMQ topology of the email queue: its
+// exchanges, queues, bindings and retry tiers. The producer, the consumer
+// and the 04-smtp AsyncSender all declare it, and RabbitMQ refuses to
+// redeclare a queue with different arguments, so they share this one
+// definition.
+package emailtopology
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	Exchange = "emails"     // jobs are published here with SendKey
+	DLX      = "emails.dlx" // retries, dead letters and quarantined jobs
+
+	PrimaryQueue    = "emails.primary"
+	DLQ             = "emails.dlq"
+	QuarantineQueue = "emails.quarantine"
+
+	// LegacyRetryQueue is the single 30s retry queue from before the retry
+	// tiers. It is still declared so messages already in it come back.
+	LegacyRetryQueue = "emails.retry"
+
+	SendKey        = "send"
+	DeadKey        = "dead"
+	QuarantineKey  = "quarantine"
+	legacyRetryKey = "retry"
+
+	// MaxPriority is PrimaryQueue's x-max-priority. Producers publish
+	// transactional mail at 9, normal mail at 5 and marketing mail at 1.
+	MaxPriority = 10
+)
+
+// RetryTier is one backoff step. Each tier has its own queue with a fixed
+// TTL: RabbitMQ only expires messages at the head of a queue, so mixing
+// delays in one queue would hold short ones behind long ones.
+type RetryTier struct {
+	Name  string
+	Delay time.Duration // the queue's message TTL
+}
+
+// Queue is the tier's queue; expired messages go back to PrimaryQueue
+func (t RetryTier) Queue() string { return "emails.retry." + t.Name }
+
+// RoutingKey routes a message on DLX to the tier's queue
+func (t RetryTier) RoutingKey() string { return "retry." + t.Name }
+
+// RetryTiers are used in order, one per failed attempt
+var RetryTiers = []RetryTier{
+	{"30s", 30 * time.Second},
+	{"2m", 2 * time.Minute},
+	{"10m", 10 * time.Minute},
+	{"1h", time.Hour},
+}
+
+// Declare declares the exchanges, queues and bindings, with a queue for
+// each of tiers (normally RetryTiers). It stops at the first error, since
+// the broker closes the channel after a failed declaration.
+func Declare(ch *amqp.Channel, tiers []RetryTier) error {
+	for _, exchange := range []string{Exchange, DLX} {
+		if err := ch.ExchangeDeclare(exchange, "direct", true, false, false, false, nil); err != nil {
+			return fmt.Errorf("declare exchange %s: %w", exchange, err)
+		}
+	}
+
+	if _, err := ch.QueueDeclare(PrimaryQueue, true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange": DLX,
+		"x-max-priority":         int32(MaxPriority),
+	}); err != nil {
+		return fmt.Errorf("declare %s (a queue created without x-max-priority must be drained and deleted first): %w", PrimaryQueue, err)
+	}
+	if err := declareQueue(ch, LegacyRetryQueue, retryArgs(30*time.Second)); err != nil {
+		return err
+	}
+	for _, tier := range tiers {
+		if err := declareQueue(ch, tier.Queue(), retryArgs(tier.Delay)); err != nil {
+			return err
+		}
+	}
+	for _, queue := range []string{DLQ, QuarantineQueue} {
+		if err := declareQueue(ch, queue, nil); err != nil {
+			return err
+		}
+	}
+
+	bindings := []binding{
+		{PrimaryQueue, SendKey, Exchange},
+		{LegacyRetryQueue, legacyRetryKey, DLX},
+		{DLQ, DeadKey, DLX},
+		{QuarantineQueue, QuarantineKey, DLX},
+	}
+	for _, tier := range tiers {
+		bindings = append(bindings, binding{tier.Queue(), tier.RoutingKey(), DLX})
+	}
+	for _, b := range bindings {
+		if err := ch.QueueBind(b.queue, b.key, b.exchange, false, nil); err != nil {
+			return fmt.Errorf("bind %s to %s: %w", b.queue, b.exchange, err)
+		}
+	}
+	return nil
+}
+
+// binding routes messages with key on exchange to queue
+type binding struct{ queue, key, exchange string }
+
+func declareQueue(ch *amqp.Channel, name string, args amqp.Table) error {
+	if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+		return fmt.Errorf("declare %s: %w", name, err)
+	}
+	return nil
+}
+
+// retryArgs are a retry queue's arguments: messages expire after ttl and
+// go back to PrimaryQueue
+func retryArgs(ttl time.Duration) amqp.Table {
+	return amqp.Table{
+		"x-dead-letter-exchange":    Exchange,
+		"x-dead-letter-routing-key": SendKey,
+		"x-message-ttl":             int32(ttl.Milliseconds()),
+	}
+}
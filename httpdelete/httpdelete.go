@@ -0,0 +1,196 @@
+// Package httpdelete gives the services one DELETE behavior. A delete that
+// removes something answers 204. Deleting something that is already gone
+// is not an error: it answers 204 with the X-Already-Absent header, or 404
+// when the service is configured to, so a repeated or retried delete is
+// safe. Every delete request is recorded as an audit event.
+package httpdelete
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// HeaderAlreadyAbsent is set to "true" on a 204 for a resource that did
+// not exist. A 204 has no body, so the flag travels as a header.
+const HeaderAlreadyAbsent = "X-Already-Absent"
+
+// Outcome is what a delete request did
+type Outcome string
+
+const (
+	Deleted       Outcome = "deleted"
+	AlreadyAbsent Outcome = "already_absent"
+	Rejected      Outcome = "rejected" // the resource exists but can't be deleted now
+	Failed        Outcome = "failed"
+)
+
+// Error rejects a delete with a status other than 500, e.g. a 409 for a
+// resource that is in a state where it can't be deleted
+type Error struct {
+	Status  int
+	Message string
+	Fields  map[string]any // added to the JSON body next to "error"
+}
+
+// Error implements the error interface
+func (e *Error) Error() string { return e.Message }
+
+// Event is the audit record of one delete request
+type Event struct {
+	Time       time.Time `json:"time"`
+	Service    string    `json:"service"`
+	Resource   string    `json:"resource"`
+	ID         string    `json:"id"`
+	Outcome    Outcome   `json:"outcome"`
+	Status     int       `json:"status"`
+	Actor      string    `json:"actor,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Auditor records delete events. Record must not block for long: it runs
+// before the response is written.
+type Auditor interface {
+	Record(ctx context.Context, e Event)
+}
+
+// SlogAuditor writes each event as an "audit" log record
+type SlogAuditor struct {
+	Logger *slog.Logger // slog.Default() when nil
+}
+
+// Record implements Auditor
+func (a SlogAuditor) Record(ctx context.Context, e Event) {
+	logger := a.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	attrs := []any{
+		"event", "delete", "service", e.Service, "resource", e.Resource, "id", e.ID,
+		"outcome", e.Outcome, "status", e.Status, "remote_addr", e.RemoteAddr,
+	}
+	if e.Actor != "" {
+		attrs = append(attrs, "actor", e.Actor)
+	}
+	if e.RequestID != "" {
+		attrs = append(attrs, "request_id", e.RequestID)
+	}
+	if e.Error != "" {
+		attrs = append(attrs, "error", e.Error)
+	}
+	logger.InfoContext(ctx, "audit", attrs...)
+}
+
+// Handler answers delete requests for one service
+type Handler struct {
+	Service string
+
+	// AbsentStatus is the status for a resource that doesn't exist:
+	// http.StatusNoContent (the default) or http.StatusNotFound
+	AbsentStatus int
+
+	Audit Auditor                      // SlogAuditor{} when nil
+	Actor func(r *http.Request) string // who is deleting, e.g. an API key ID; optional
+}
+
+// FromEnv returns a Handler for service, reading AbsentStatus from
+// DELETE_ABSENT_STATUS ("204" or "404", default "204")
+func FromEnv(service string) (*Handler, error) {
+	h := &Handler{Service: service, AbsentStatus: http.StatusNoContent}
+	switch v := os.Getenv("DELETE_ABSENT_STATUS"); v {
+	case "", "204":
+	case "404":
+		h.AbsentStatus = http.StatusNotFound
+	default:
+		return nil, fmt.Errorf("DELETE_ABSENT_STATUS: %q is neither 204 nor 404", v)
+	}
+	return h, nil
+}
+
+// Delete runs del for the resource with the given ID, writes the response
+// and records the audit event. del reports whether the resource existed;
+// it may return an *Error to reject the request with its own status.
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request, resource, id string, del func(ctx context.Context) (existed bool, err error)) {
+	existed, err := del(r.Context())
+	outcome, status := h.Record(r, resource, id, existed, err)
+
+	switch outcome {
+	case Deleted:
+		w.WriteHeader(http.StatusNoContent)
+	case AlreadyAbsent:
+		if status == http.StatusNoContent {
+			w.Header().Set(HeaderAlreadyAbsent, "true")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, status, map[string]any{"error": resource + " not found", "id": id, "already_absent": true})
+	case Rejected:
+		var rejected *Error
+		errors.As(err, &rejected)
+		body := map[string]any{"error": rejected.Message, "id": id}
+		for k, v := range rejected.Fields {
+			body[k] = v
+		}
+		writeJSON(w, status, body)
+	default:
+		writeJSON(w, status, map[string]any{"error": err.Error(), "id": id})
+	}
+}
+
+// Record classifies a delete and records its audit event without writing a
+// response, for deletes that are part of a larger request such as a bulk
+// endpoint. existed and err are what Delete's del callback would return.
+func (h *Handler) Record(r *http.Request, resource, id string, existed bool, err error) (Outcome, int) {
+	e := Event{
+		Time:       time.Now().UTC(),
+		Service:    h.Service,
+		Resource:   resource,
+		ID:         id,
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  r.Header.Get("X-Request-ID"),
+	}
+	if h.Actor != nil {
+		e.Actor = h.Actor(r)
+	}
+
+	var rejected *Error
+	switch {
+	case errors.As(err, &rejected):
+		e.Outcome, e.Status, e.Error = Rejected, rejected.Status, rejected.Message
+	case err != nil:
+		e.Outcome, e.Status, e.Error = Failed, http.StatusInternalServerError, err.Error()
+	case existed:
+		e.Outcome, e.Status = Deleted, http.StatusNoContent
+	default:
+		e.Outcome, e.Status = AlreadyAbsent, h.absentStatus()
+	}
+	h.audit().Record(r.Context(), e)
+	return e.Outcome, e.Status
+}
+
+func (h *Handler) absentStatus() int {
+	if h.AbsentStatus == 0 {
+		return http.StatusNoContent
+	}
+	return h.AbsentStatus
+}
+
+func (h *Handler) audit() Auditor {
+	if h.Audit == nil {
+		return SlogAuditor{}
+	}
+	return h.Audit
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,203 @@
+package httpdelete
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recorder is an Auditor that keeps every event
+type recorder struct{ events []Event }
+
+func (r *recorder) Record(_ context.Context, e Event) { r.events = append(r.events, e) }
+
+func TestDelete(t *testing.T) {
+	conflict := &Error{Status: http.StatusConflict, Message: "crawl already completed", Fields: map[string]any{"status": "completed"}}
+	tests := []struct {
+		name         string
+		absentStatus int
+		existed      bool
+		err          error
+		status       int
+		absentHeader string
+		body         map[string]any // nil for an empty body
+		outcome      Outcome
+		eventError   string
+	}{
+		{
+			name: "deleted", existed: true,
+			status: http.StatusNoContent, outcome: Deleted,
+		},
+		{
+			name:   "absent, default status",
+			status: http.StatusNoContent, absentHeader: "true", outcome: AlreadyAbsent,
+		},
+		{
+			name: "absent, 204", absentStatus: http.StatusNoContent,
+			status: http.StatusNoContent, absentHeader: "true", outcome: AlreadyAbsent,
+		},
+		{
+			name: "absent, 404", absentStatus: http.StatusNotFound,
+			status: http.StatusNotFound, outcome: AlreadyAbsent,
+			body: map[string]any{"error": "user not found", "id": "42", "already_absent": true},
+		},
+		{
+			name: "rejected", existed: true, err: conflict,
+			status: http.StatusConflict, outcome: Rejected, eventError: "crawl already completed",
+			body: map[string]any{"error": "crawl already completed", "id": "42", "status": "completed"},
+		},
+		{
+			name: "wrapped rejection", err: errors.Join(errors.New("cancel"), conflict),
+			status: http.StatusConflict, outcome: Rejected, eventError: "crawl already completed",
+			body: map[string]any{"error": "crawl already completed", "id": "42", "status": "completed"},
+		},
+		{
+			name: "failed", err: errors.New("database unavailable"),
+			status: http.StatusInternalServerError, outcome: Failed, eventError: "database unavailable",
+			body: map[string]any{"error": "database unavailable", "id": "42"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audit := &recorder{}
+			h := &Handler{
+				Service:      "users",
+				AbsentStatus: tt.absentStatus,
+				Audit:        audit,
+				Actor:        func(r *http.Request) string { return r.Header.Get("X-Actor") },
+			}
+			req := httptest.NewRequest(http.MethodDelete, "/users/42", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("X-Request-ID", "req-1")
+			req.Header.Set("X-Actor", "alice")
+			rec := httptest.NewRecorder()
+
+			var calls int
+			h.Delete(rec, req, "user", "42", func(ctx context.Context) (bool, error) {
+				calls++
+				return tt.existed, tt.err
+			})
+
+			if calls != 1 {
+				t.Errorf("del called %d times, want 1", calls)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get(HeaderAlreadyAbsent); got != tt.absentHeader {
+				t.Errorf("%s = %q, want %q", HeaderAlreadyAbsent, got, tt.absentHeader)
+			}
+			if tt.body == nil {
+				if rec.Body.Len() != 0 {
+					t.Errorf("body = %q, want none", rec.Body)
+				}
+			} else {
+				var body map[string]any
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatalf("body %q: %v", rec.Body, err)
+				}
+				if len(body) != len(tt.body) {
+					t.Errorf("body = %v, want %v", body, tt.body)
+				}
+				for k, v := range tt.body {
+					if body[k] != v {
+						t.Errorf("body[%q] = %v, want %v", k, body[k], v)
+					}
+				}
+			}
+
+			if len(audit.events) != 1 {
+				t.Fatalf("%d audit events, want 1", len(audit.events))
+			}
+			e := audit.events[0]
+			want := Event{
+				Time: e.Time, Service: "users", Resource: "user", ID: "42",
+				Outcome: tt.outcome, Status: tt.status, Actor: "alice",
+				RemoteAddr: "192.0.2.1:1234", RequestID: "req-1", Error: tt.eventError,
+			}
+			if e != want {
+				t.Errorf("event = %+v, want %+v", e, want)
+			}
+			if e.Time.IsZero() || e.Time.Location().String() != "UTC" {
+				t.Errorf("event time = %v, want a UTC time", e.Time)
+			}
+		})
+	}
+}
+
+func TestRecordWithoutActor(t *testing.T) {
+	audit := &recorder{}
+	h := &Handler{Service: "crawler", Audit: audit}
+	outcome, status := h.Record(httptest.NewRequest(http.MethodDelete, "/crawl/c1", nil), "crawl", "c1", false, nil)
+	if outcome != AlreadyAbsent || status != http.StatusNoContent {
+		t.Errorf("Record() = %s, %d, want %s, 204", outcome, status, AlreadyAbsent)
+	}
+	if len(audit.events) != 1 || audit.events[0].Actor != "" {
+		t.Errorf("events = %+v, want one without an actor", audit.events)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", http.StatusNoContent, false},
+		{"204", http.StatusNoContent, false},
+		{"404", http.StatusNotFound, false},
+		{"410", 0, true},
+		{"not found", 0, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("DELETE_ABSENT_STATUS", tt.value)
+		h, err := FromEnv("users")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("FromEnv with %q = %+v, want an error", tt.value, h)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FromEnv with %q: %v", tt.value, err)
+			continue
+		}
+		if h.Service != "users" || h.AbsentStatus != tt.want {
+			t.Errorf("FromEnv with %q = %+v, want AbsentStatus %d", tt.value, h, tt.want)
+		}
+	}
+}
+
+func TestSlogAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	a := SlogAuditor{Logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+	a.Record(context.Background(), Event{
+		Service: "users", Resource: "user", ID: "42", Outcome: Rejected, Status: http.StatusConflict,
+		RemoteAddr: "192.0.2.1:1234", Error: "in use",
+	})
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("log record %q: %v", buf.String(), err)
+	}
+	for k, v := range map[string]any{
+		"msg": "audit", "event": "delete", "service": "users", "resource": "user", "id": "42",
+		"outcome": "rejected", "status": float64(http.StatusConflict), "error": "in use",
+	} {
+		if rec[k] != v {
+			t.Errorf("%s = %v, want %v", k, rec[k], v)
+		}
+	}
+	// Empty optional fields are left out
+	for _, k := range []string{"actor", "request_id"} {
+		if _, ok := rec[k]; ok {
+			t.Errorf("record has %s, want it left out: %s", k, strings.TrimSpace(buf.String()))
+		}
+	}
+}
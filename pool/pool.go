@@ -0,0 +1,119 @@
+// Package pool recycles the byte buffers that hot paths fill and throw away
+// once per page or per email. Buffers are kept in size classes, so a caller
+// that knows roughly how much it will write gets one that won't need to
+// grow, and a single huge page can't leave every later caller holding a
+// huge buffer.
+package pool
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+const (
+	minClassSize = 4 << 10 // 4 KiB, the smallest buffer handed out
+	classShift   = 2       // each class is 4x the size of the one before
+	numClasses   = 6       // 4 KiB, 16 KiB, 64 KiB, 256 KiB, 1 MiB, 4 MiB
+
+	maxClassSize = minClassSize << (classShift * (numClasses - 1)) // larger buffers are left to the GC
+)
+
+// classes[i] holds buffers with a capacity of at least classSize(i)
+var classes [numClasses]sync.Pool
+
+// classSize is the capacity buffers in class i are created with
+func classSize(i int) int {
+	return minClassSize << (classShift * i)
+}
+
+// Get returns an empty buffer with room for at least sizeHint bytes. A hint
+// above the largest class gets a new buffer of that size, which Put then
+// drops. Hand the buffer back with Put once nothing refers to its bytes.
+func Get(sizeHint int) *bytes.Buffer {
+	i := getClass(sizeHint)
+	if i < 0 {
+		return bytes.NewBuffer(make([]byte, 0, sizeHint))
+	}
+	if b, ok := classes[i].Get().(*bytes.Buffer); ok {
+		return b
+	}
+	return bytes.NewBuffer(make([]byte, 0, classSize(i)))
+}
+
+// getClass is the smallest class whose buffers hold sizeHint bytes, or -1
+// when none does
+func getClass(sizeHint int) int {
+	for i := range classes {
+		if sizeHint <= classSize(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Put resets b and keeps it for reuse. It goes to the largest class its
+// capacity fills, so a buffer that grew is reused for bigger requests.
+// Buffers smaller than the smallest class or larger than the largest are
+// dropped. b must not be used after Put, nor any slice from b.Bytes().
+func Put(b *bytes.Buffer) {
+	if b == nil {
+		return
+	}
+	i := putClass(b.Cap())
+	if i < 0 {
+		return
+	}
+	b.Reset()
+	classes[i].Put(b)
+}
+
+// putClass is the largest class a buffer of the given capacity fills, or -1
+// when the buffer is to be dropped
+func putClass(capacity int) int {
+	if capacity < minClassSize || capacity > maxClassSize {
+		return -1
+	}
+	i := numClasses - 1
+	for capacity < classSize(i) {
+		i--
+	}
+	return i
+}
+
+// ReadAll reads r to the end into a buffer from Get. sizeHint is how much
+// is expected, such as a response's ContentLength; 0 or less picks the
+// smallest class. On error the buffer is returned to the pool.
+func ReadAll(r io.Reader, sizeHint int64) (*bytes.Buffer, error) {
+	b := Get(int(min(max(sizeHint, 0), maxClassSize)) + bytes.MinRead)
+	if _, err := b.ReadFrom(r); err != nil {
+		Put(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// Body wraps b as a response or request body that hands b back to the pool
+// when closed. Whoever reads it must be done with the bytes by then, as
+// readers that copy the body (io.ReadAll, json.Decoder) are.
+func Body(b *bytes.Buffer) io.ReadCloser {
+	return &body{buf: b}
+}
+
+type body struct {
+	buf  *bytes.Buffer
+	once sync.Once
+}
+
+// Read implements io.Reader
+func (b *body) Read(p []byte) (int, error) {
+	return b.buf.Read(p)
+}
+
+// Close implements io.Closer; closing twice doesn't put the buffer back twice
+func (b *body) Close() error {
+	b.once.Do(func() {
+		Put(b.buf)
+	})
+	return nil
+}
@@ -0,0 +1,163 @@
+package pool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestGetClass(t *testing.T) {
+	tests := []struct {
+		sizeHint int
+		want     int
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 0},
+		{4 << 10, 0},
+		{4<<10 + 1, 1},
+		{16 << 10, 1},
+		{100 << 10, 3},
+		{1 << 20, 4},
+		{4 << 20, numClasses - 1},
+		{4<<20 + 1, -1}, // above the largest class
+	}
+	for _, tt := range tests {
+		if got := getClass(tt.sizeHint); got != tt.want {
+			t.Errorf("getClass(%d) = %d, want %d", tt.sizeHint, got, tt.want)
+		}
+	}
+}
+
+func TestPutClass(t *testing.T) {
+	tests := []struct {
+		capacity int
+		want     int
+	}{
+		{0, -1},
+		{4<<10 - 1, -1}, // smaller than the smallest class
+		{4 << 10, 0},
+		{16<<10 - 1, 0}, // doesn't fill class 1, so it can't serve its requests
+		{16 << 10, 1},
+		{100 << 10, 2},
+		{4 << 20, numClasses - 1},
+		{4<<20 + 1, -1}, // larger than the largest class
+	}
+	for _, tt := range tests {
+		if got := putClass(tt.capacity); got != tt.want {
+			t.Errorf("putClass(%d) = %d, want %d", tt.capacity, got, tt.want)
+		}
+	}
+}
+
+// Whichever buffer sync.Pool hands back, Get's is empty and big enough
+func TestGetCapacity(t *testing.T) {
+	for _, hint := range []int{0, 1000, 4 << 10, 5 << 10, 100 << 10, 4 << 20} {
+		for range 10 {
+			b := Get(hint)
+			if b.Cap() < hint || b.Cap() < minClassSize {
+				t.Fatalf("Get(%d) has capacity %d", hint, b.Cap())
+			}
+			if b.Len() != 0 {
+				t.Fatalf("Get(%d) has %d bytes in it, want it empty", hint, b.Len())
+			}
+			b.WriteString("used")
+			Put(b)
+		}
+	}
+
+	huge := Get(maxClassSize + 1)
+	if huge.Cap() != maxClassSize+1 {
+		t.Errorf("Get(%d) has capacity %d, want exactly the hint", maxClassSize+1, huge.Cap())
+	}
+}
+
+func TestPutDropsOutsizedBuffers(t *testing.T) {
+	huge := bytes.NewBuffer(make([]byte, 0, maxClassSize+1))
+	tiny := bytes.NewBuffer(make([]byte, 0, minClassSize-1))
+	huge.WriteString("kept")
+	tiny.WriteString("kept")
+	Put(huge)
+	Put(tiny)
+	Put(nil)
+
+	// A dropped buffer isn't reset, and Get never hands it out
+	if huge.String() != "kept" || tiny.String() != "kept" {
+		t.Errorf("dropped buffers were reset")
+	}
+	for range 100 {
+		for i := range numClasses {
+			if b := Get(classSize(i)); b == huge || b == tiny {
+				t.Fatalf("Get(%d) returned a dropped buffer", classSize(i))
+			}
+		}
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	b, err := ReadAll(strings.NewReader(page), -1)
+	if err != nil || b.String() != page {
+		t.Fatalf("ReadAll = %d bytes, %v, want the page", b.Len(), err)
+	}
+	Put(b)
+
+	boom := errors.New("boom")
+	if _, err := ReadAll(io.MultiReader(strings.NewReader("part"), iotest.ErrReader(boom)), 0); err != boom {
+		t.Errorf("ReadAll error = %v, want %v", err, boom)
+	}
+}
+
+func TestBodyPutsBackOnce(t *testing.T) {
+	buf := Get(0)
+	buf.WriteString("hello")
+	body := Body(buf)
+	got, err := io.ReadAll(body)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v, want hello", got, err)
+	}
+
+	if err := body.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatal("first Close didn't put the buffer back")
+	}
+
+	// Put resets the buffer, so a second Put would empty it again
+	buf.WriteString("someone else's")
+	if err := body.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if buf.String() != "someone else's" {
+		t.Error("second Close put the buffer back again")
+	}
+	buf.Reset() // it is still in the pool
+}
+
+// Run with: go test -run '^$' -bench . -benchmem ./pool
+
+var page = strings.Repeat("<p>The quick brown fox jumps over the lazy dog.</p>\n", 2000) // ~100 KB
+
+func BenchmarkReadAllPooled(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		buf, err := ReadAll(strings.NewReader(page), int64(len(page)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		Put(buf)
+	}
+}
+
+func BenchmarkReadAllUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(strings.NewReader(page)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+type csvWriter struct {
+	w      *csv.Writer
+	sheets int
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+// WriteSheet writes the header and every row. csv.Writer flushes its buffer
+// as it fills, so rows reach the underlying writer while the sheet streams.
+func (c *csvWriter) WriteSheet(sheet Sheet) error {
+	if c.sheets > 0 {
+		return ErrTooManySheets
+	}
+	c.sheets++
+
+	record := make([]string, len(sheet.Columns))
+	for i, col := range sheet.Columns {
+		record[i] = col.Header
+	}
+	if err := c.w.Write(record); err != nil {
+		return err
+	}
+
+	n := 0
+	for row, err := range sheet.Rows {
+		if err != nil {
+			return err
+		}
+		n++
+		if err := checkRow(row, sheet.Columns, n); err != nil {
+			return err
+		}
+		for i, col := range sheet.Columns {
+			record[i] = ""
+			if i < len(row) {
+				record[i] = csvValue(row[i], col.Format)
+			}
+		}
+		if err := c.w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// csvValue renders a cell. Strings that a spreadsheet would run as a
+// formula are prefixed with a quote, so an export can't carry formula
+// injection into whoever opens it.
+func csvValue(v any, format Format) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		if len(v) > 0 {
+			switch v[0] {
+			case '=', '+', '-', '@', '\t', '\r':
+				return "'" + v
+			}
+		}
+		return v
+	case time.Time:
+		return csvTime(v, format)
+	case *time.Time:
+		if v == nil {
+			return ""
+		}
+		return csvTime(*v, format)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func csvTime(t time.Time, format Format) string {
+	switch {
+	case t.IsZero():
+		return ""
+	case format == Date:
+		return t.Format("2006-01-02")
+	case format == DateTime:
+		return t.Format("2006-01-02 15:04:05")
+	default:
+		return t.Format(time.RFC3339)
+	}
+}
@@ -0,0 +1,53 @@
+package report
+
+import (
+	"encoding/csv"
+	"strings"
+	"testing"
+)
+
+func TestCSVQuotesFormulas(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"=HYPERLINK(\"https://evil.example\")", "'=HYPERLINK(\"https://evil.example\")"},
+		{"+1+1", "'+1+1"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1:A2)", "'@SUM(A1:A2)"},
+		{"\t=1", "'\t=1"},
+		{"Ada", "Ada"},
+		{"a=b", "a=b"},
+		{"", ""},
+	}
+	rows := make([]Row, len(tests))
+	for i, tt := range tests {
+		rows[i] = Row{tt.value, -5}
+	}
+
+	var out strings.Builder
+	err := Write(&out, CSV, Sheet{
+		Columns: []Column{{Header: "Name"}, {Header: "Delta", Format: Integer}},
+		Rows:    FromSlice(rows, func(r Row) Row { return r }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(tests)+1 || records[0][0] != "Name" {
+		t.Fatalf("got %d records starting %v, want a header and %d rows", len(records), records[0], len(tests))
+	}
+	for i, tt := range tests {
+		if got := records[i+1][0]; got != tt.want {
+			t.Errorf("%q written as %q, want %q", tt.value, got, tt.want)
+		}
+		// Only strings are quoted; a negative number is still a number
+		if got := records[i+1][1]; got != "-5" {
+			t.Errorf("-5 written as %q", got)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package report streams tabular data to CSV and XLSX files, so services
+// that export lists share one implementation of headers, column widths and
+// number/date formats.
+//
+// Rows come from an iterator and are written as they arrive, so an export
+// never has to hold the whole table in memory.
+package report
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+)
+
+// FileType is the output format of a report
+type FileType string
+
+const (
+	CSV  FileType = "csv"
+	XLSX FileType = "xlsx"
+)
+
+// Errors returned by the writers
+var (
+	ErrUnknownFileType = errors.New("report: file type must be csv or xlsx")
+	ErrTooManySheets   = errors.New("report: a CSV file holds a single sheet")
+)
+
+// ParseFileType reads a ?format= style value; an empty string means CSV
+func ParseFileType(s string) (FileType, error) {
+	switch t := FileType(strings.ToLower(strings.TrimSpace(s))); t {
+	case "":
+		return CSV, nil
+	case CSV, XLSX:
+		return t, nil
+	default:
+		return "", ErrUnknownFileType
+	}
+}
+
+// ContentType is the MIME type to serve the file with
+func (t FileType) ContentType() string {
+	if t == XLSX {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// Filename appends the file type's extension to base
+func (t FileType) Filename(base string) string {
+	return base + "." + string(t)
+}
+
+// Format controls how a column's values are displayed. XLSX stores the
+// value as a number or date and applies the format; CSV writes numbers
+// as-is and uses the format only to lay out dates.
+type Format int
+
+const (
+	General  Format = iota // no formatting; times are written as RFC 3339 in CSV
+	Integer                // 1,234
+	Decimal                // 1,234.56
+	Percent                // 12.50% (from 0.125)
+	Date                   // 2006-01-02
+	DateTime               // 2006-01-02 15:04:05
+)
+
+// Column describes one column of a sheet
+type Column struct {
+	Header string
+	Width  float64 // XLSX width in characters (0 = sized from the header and format)
+	Format Format
+}
+
+// Row is one record; values are matched to the sheet's columns by position.
+// Supported values are strings, integers, floats, bools, time.Time and
+// *time.Time; nil and zero times become empty cells, and anything else is
+// written with fmt.Sprint.
+type Row []any
+
+// Sheet is a named table. CSV ignores the name.
+type Sheet struct {
+	Name    string
+	Columns []Column
+	Rows    iter.Seq2[Row, error]
+}
+
+// Writer writes sheets to a single file. Close must be called to finish the
+// file; for XLSX nothing reaches the underlying writer until then.
+type Writer interface {
+	WriteSheet(sheet Sheet) error
+	Close() error
+}
+
+// NewWriter returns a Writer for the given file type
+func NewWriter(t FileType, w io.Writer) (Writer, error) {
+	switch t {
+	case CSV:
+		return newCSVWriter(w), nil
+	case XLSX:
+		return newXLSXWriter(w)
+	default:
+		return nil, ErrUnknownFileType
+	}
+}
+
+// Write writes the sheets to w and closes the file
+func Write(w io.Writer, t FileType, sheets ...Sheet) error {
+	writer, err := NewWriter(t, w)
+	if err != nil {
+		return err
+	}
+	for _, sheet := range sheets {
+		if err := writer.WriteSheet(sheet); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// FromSlice adapts an in-memory slice to a row iterator
+func FromSlice[T any](items []T, toRow func(T) Row) iter.Seq2[Row, error] {
+	return func(yield func(Row, error) bool) {
+		for _, item := range items {
+			if !yield(toRow(item), nil) {
+				return
+			}
+		}
+	}
+}
+
+// checkRow rejects rows with more values than the sheet has columns
+func checkRow(row Row, columns []Column, n int) error {
+	if len(row) > len(columns) {
+		return fmt.Errorf("report: row %d has %d values for %d columns", n, len(row), len(columns))
+	}
+	return nil
+}
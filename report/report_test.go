@@ -0,0 +1,38 @@
+package report
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseFileType(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    FileType
+		wantErr bool
+	}{
+		{input: "", want: CSV},
+		{input: "csv", want: CSV},
+		{input: "xlsx", want: XLSX},
+		{input: " XLSX ", want: XLSX},
+		{input: "xls", wantErr: true},
+		{input: "pdf", wantErr: true},
+		{input: "csv,xlsx", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFileType(tt.input)
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnknownFileType) {
+				t.Errorf("ParseFileType(%q) = %q, %v, want ErrUnknownFileType", tt.input, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseFileType(%q) = %q, %v, want %q", tt.input, got, err, tt.want)
+		}
+	}
+
+	if _, err := NewWriter(FileType("pdf"), nil); !errors.Is(err, ErrUnknownFileType) {
+		t.Errorf("NewWriter(pdf) = %v, want ErrUnknownFileType", err)
+	}
+}
@@ -0,0 +1,177 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Built-in Excel number formats; dates use custom ones so they read the
+// same in every locale
+var builtinNumFmts = map[Format]int{
+	Integer: 3,  // #,##0
+	Decimal: 4,  // #,##0.00
+	Percent: 10, // 0.00%
+}
+
+var customNumFmts = map[Format]string{
+	Date:     "yyyy-mm-dd",
+	DateTime: "yyyy-mm-dd hh:mm:ss",
+}
+
+type xlsxWriter struct {
+	out         io.Writer
+	file        *excelize.File
+	sheets      int
+	headerStyle int
+	styles      map[Format]int
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	f := excelize.NewFile()
+	headerStyle, err := f.NewStyle(&excelize.Style{
+		Font:   &excelize.Font{Bold: true},
+		Fill:   excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"#D9E1F2"}},
+		Border: []excelize.Border{{Type: "bottom", Color: "#8EA9DB", Style: 1}},
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &xlsxWriter{out: w, file: f, headerStyle: headerStyle, styles: make(map[Format]int)}, nil
+}
+
+// style returns the cell style for a format, creating it on first use
+func (x *xlsxWriter) style(format Format) (int, error) {
+	if format == General {
+		return 0, nil
+	}
+	if id, ok := x.styles[format]; ok {
+		return id, nil
+	}
+
+	style := &excelize.Style{NumFmt: builtinNumFmts[format]}
+	if custom, ok := customNumFmts[format]; ok {
+		style.CustomNumFmt = &custom
+	}
+	id, err := x.file.NewStyle(style)
+	if err != nil {
+		return 0, err
+	}
+	x.styles[format] = id
+	return id, nil
+}
+
+// WriteSheet adds a worksheet with a frozen, styled header row. excelize's
+// stream writer spills rows to a temporary file past a threshold, so large
+// sheets don't stay in memory.
+func (x *xlsxWriter) WriteSheet(sheet Sheet) error {
+	name := sheet.Name
+	if name == "" {
+		name = fmt.Sprintf("Sheet%d", x.sheets+1)
+	}
+	if x.sheets == 0 {
+		// NewFile starts with "Sheet1"; rename it instead of leaving it empty
+		if err := x.file.SetSheetName("Sheet1", name); err != nil {
+			return err
+		}
+	} else if _, err := x.file.NewSheet(name); err != nil {
+		return err
+	}
+	x.sheets++
+
+	sw, err := x.file.NewStreamWriter(name)
+	if err != nil {
+		return err
+	}
+
+	styles := make([]int, len(sheet.Columns))
+	header := make([]any, len(sheet.Columns))
+	for i, col := range sheet.Columns {
+		if styles[i], err = x.style(col.Format); err != nil {
+			return err
+		}
+		if err := sw.SetColWidth(i+1, i+1, columnWidth(col)); err != nil {
+			return err
+		}
+		header[i] = excelize.Cell{StyleID: x.headerStyle, Value: col.Header}
+	}
+	if err := sw.SetPanes(&excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}); err != nil {
+		return err
+	}
+	if err := sw.SetRow("A1", header); err != nil {
+		return err
+	}
+
+	n := 0
+	for row, err := range sheet.Rows {
+		if err != nil {
+			return err
+		}
+		n++
+		if err := checkRow(row, sheet.Columns, n); err != nil {
+			return err
+		}
+
+		values := make([]any, len(row))
+		for i, v := range row {
+			values[i] = excelize.Cell{StyleID: styles[i], Value: xlsxValue(v)}
+		}
+		cell, err := excelize.CoordinatesToCellName(1, n+1)
+		if err != nil {
+			return err // past Excel's row limit
+		}
+		if err := sw.SetRow(cell, values); err != nil {
+			return err
+		}
+	}
+
+	return sw.Flush()
+}
+
+// Close writes the workbook to the underlying writer
+func (x *xlsxWriter) Close() error {
+	defer x.file.Close()
+	_, err := x.file.WriteTo(x.out)
+	return err
+}
+
+// xlsxValue converts values excelize would otherwise mis-store
+func xlsxValue(v any) any {
+	switch v := v.(type) {
+	case *time.Time:
+		if v == nil || v.IsZero() {
+			return nil
+		}
+		return *v
+	case time.Time:
+		if v.IsZero() {
+			return nil
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// columnWidth is the configured width, or one that fits the header and a
+// formatted value
+func columnWidth(col Column) float64 {
+	if col.Width > 0 {
+		return col.Width
+	}
+	width := float64(len(col.Header) + 2)
+	minimum := 10.0
+	switch col.Format {
+	case Date:
+		minimum = 12
+	case DateTime:
+		minimum = 20
+	}
+	if width < minimum {
+		width = minimum
+	}
+	return width
+}
@@ -0,0 +1,75 @@
+package report
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestXLSXHeaderRow(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	var out bytes.Buffer
+	err := Write(&out, XLSX, Sheet{
+		Name: "Users",
+		Columns: []Column{
+			{Header: "ID", Format: Integer},
+			{Header: "Email", Width: 36},
+			{Header: "Created At", Format: DateTime},
+		},
+		Rows: FromSlice([]Row{{1, "a@example.com", created}}, func(r Row) Row { return r }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := excelize.OpenReader(&out)
+	if err != nil {
+		t.Fatalf("output isn't a workbook: %v", err)
+	}
+	defer f.Close()
+
+	if sheets := f.GetSheetList(); len(sheets) != 1 || sheets[0] != "Users" {
+		t.Fatalf("sheets = %v, want [Users]", sheets)
+	}
+	rows, err := f.GetRows("Users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want the header and one row", len(rows))
+	}
+	want := []string{"ID", "Email", "Created At"}
+	if len(rows[0]) != len(want) {
+		t.Fatalf("header = %v, want %v", rows[0], want)
+	}
+	for i := range want {
+		if rows[0][i] != want[i] {
+			t.Errorf("header = %v, want %v", rows[0], want)
+			break
+		}
+	}
+	if rows[1][1] != "a@example.com" || rows[1][2] != "2024-03-01 09:30:00" {
+		t.Errorf("first row = %v", rows[1])
+	}
+
+	style, err := f.GetCellStyle("Users", "A1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := f.GetStyle(style)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Font == nil || !s.Font.Bold {
+		t.Error("header row isn't bold")
+	}
+	panes, err := f.GetPanes("Users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !panes.Freeze || panes.YSplit != 1 {
+		t.Errorf("panes = %+v, want the header row frozen", panes)
+	}
+}
@@ -0,0 +1,100 @@
+// Package tracing sets up OpenTelemetry tracing for the email queue and
+// carries trace context in message headers, so a single trace follows an
+// email from the producer through the queue to the SMTP server.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Setup installs the W3C trace context propagator and, when an OTLP
+// endpoint is configured, a tracer provider that exports spans to it over
+// OTLP/HTTP. Jaeger and Tempo both accept OTLP, usually on port 4318.
+//
+// The exporter reads the standard variables: OTEL_EXPORTER_OTLP_ENDPOINT
+// (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT), OTEL_EXPORTER_OTLP_HEADERS and
+// so on, and OTEL_TRACES_SAMPLER picks the sampler. OTEL_SERVICE_NAME
+// overrides service. Without an endpoint, or with OTEL_SDK_DISABLED=true,
+// no spans are recorded, but trace context that arrives in a header is
+// still passed along.
+//
+// The returned function flushes buffered spans; call it before exiting.
+func Setup(ctx context.Context, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	noop := func(context.Context) error { return nil }
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" ||
+		(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "") {
+		return noop, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return noop, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+	// Later options win, so OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override service
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", service)),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return noop, fmt.Errorf("build resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Headers adapts message headers, such as an amqp.Table or a consumer's
+// Message.Headers, to carry trace context. Values are written as strings;
+// brokers that hand headers back as bytes are read too.
+type Headers map[string]any
+
+// Get implements propagation.TextMapCarrier
+func (h Headers) Get(key string) string {
+	switch v := h[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// Set implements propagation.TextMapCarrier
+func (h Headers) Set(key, value string) {
+	h[key] = value
+}
+
+// Keys implements propagation.TextMapCarrier
+func (h Headers) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Inject writes the trace context of ctx into headers
+func Inject(ctx context.Context, headers map[string]any) {
+	otel.GetTextMapPropagator().Inject(ctx, Headers(headers))
+}
+
+// Extract returns ctx with the trace context found in headers, if any
+func Extract(ctx context.Context, headers map[string]any) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, Headers(headers))
+}